@@ -0,0 +1,89 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+// Command bench measures loopback throughput for a blocksize and windowsize.
+//
+// A server and client are run in the same process over the loopback
+// interface, exercising the real transfer path, so no external server
+// is needed.
+//
+//	go run _examples/bench/bench.go -blksize 1468 -windowsize 16 -size 64
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"time"
+
+	"pack.ag/tftp"
+)
+
+func main() {
+	blksize := flag.Int("blksize", 512, "blocksize to negotiate")
+	windowsize := flag.Int("windowsize", 1, "windowsize to negotiate")
+	size := flag.Int("size", 16, "size of each transfer in MiB")
+	count := flag.Int("n", 3, "number of transfers")
+	flag.Parse()
+
+	data := make([]byte, *size<<20)
+	rand.Read(data)
+
+	// Start a server on a random loopback port
+	server, err := tftp.NewServer("127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.ReadHandler(tftp.ReadHandlerFunc(func(w tftp.ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		if _, err := w.Write(data); err != nil {
+			log.Println(err)
+		}
+	}))
+	go server.ListenAndServe()
+	defer server.Close()
+	for !server.Connected() {
+		time.Sleep(time.Millisecond)
+	}
+	addr, err := server.Addr()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := tftp.NewClient(tftp.ClientBlocksize(*blksize), tftp.ClientWindowsize(*windowsize))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("blksize %d, windowsize %d, %d x %d MiB\n", *blksize, *windowsize, *count, *size)
+
+	var total time.Duration
+	for i := 0; i < *count; i++ {
+		start := time.Now()
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/bench", addr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, resp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		total += elapsed
+
+		stats := resp.Stats()
+		fmt.Printf("%d: %.2f MB/s, %d retransmits, rtt min/avg/max %s/%s/%s\n",
+			i+1, mbps(n, elapsed), stats.Retransmits, stats.MinRTT, stats.AvgRTT, stats.MaxRTT)
+	}
+
+	fmt.Printf("average: %.2f MB/s\n", mbps(int64(len(data)**count), total))
+}
+
+// mbps returns the throughput of n bytes over d in megabytes per second.
+func mbps(n int64, d time.Duration) float64 {
+	return float64(n) / 1e6 / d.Seconds()
+}
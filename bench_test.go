@@ -1,11 +1,16 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func BenchmarkGet_random(b *testing.B) {
@@ -110,3 +115,270 @@ func BenchmarkGet_random(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkServer_request(b *testing.B) {
+	for _, singlePort := range []bool{true, false} {
+		b.Run(fmt.Sprintf("single port mode: %t", singlePort), func(b *testing.B) {
+			ip, port, close := newTestServer(b, singlePort, func(w ReadRequest) {
+				w.WriteSize(8)
+				w.Write([]byte("the data"))
+			}, nil)
+			defer close()
+
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			client, err := NewClient()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file, err := client.Get(url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = ioutil.ReadAll(file); err != nil {
+					b.Fatal(err)
+				}
+				file.conn.netConn.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkCachingReadHandler(b *testing.B) {
+	var opens int
+	fs := FileServer("testdata")
+	counting := ReadHandlerFunc(func(w ReadRequest) {
+		opens++
+		fs.ServeTFTP(w)
+	})
+
+	cases := []struct {
+		name    string
+		handler ReadHandler
+	}{
+		{name: "FileServer", handler: counting},
+		{name: "CachingReadHandler", handler: CachingReadHandler(counting, 1<<20, time.Minute)},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			opens = 0
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := readRequestMock{name: "text"}
+				c.handler.ServeTFTP(&req)
+			}
+			b.ReportMetric(float64(opens)/float64(b.N), "opens/op")
+		})
+	}
+}
+
+// delayPacketConn delays datagrams written by latency, in order,
+// simulating a long link.
+type delayPacketConn struct {
+	net.PacketConn
+	latency time.Duration
+	queue   chan delayedDatagram
+}
+
+type delayedDatagram struct {
+	at   time.Time
+	p    []byte
+	addr net.Addr
+}
+
+func newDelayPacketConn(pc net.PacketConn, latency time.Duration) *delayPacketConn {
+	c := &delayPacketConn{PacketConn: pc, latency: latency, queue: make(chan delayedDatagram, 1024)}
+	go func() {
+		for d := range c.queue {
+			time.Sleep(time.Until(d.at))
+			c.PacketConn.WriteTo(d.p, d.addr)
+		}
+	}()
+	return c
+}
+
+func (c *delayPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.queue <- delayedDatagram{at: time.Now().Add(c.latency), p: append([]byte(nil), p...), addr: addr}
+	return len(p), nil
+}
+
+func (c *delayPacketConn) Close() error {
+	close(c.queue)
+	return c.PacketConn.Close()
+}
+
+func BenchmarkPut_pipelineDepth(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 256<<10)
+
+	for _, depth := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("depth %d", depth), func(b *testing.B) {
+			ip, port, close := newTestServer(b, false, nil, func(r WriteRequest) {
+				ioutil.ReadAll(r)
+			})
+			defer close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			delayed := newDelayPacketConn(pc, 10*time.Millisecond)
+			defer delayed.Close()
+
+			client, err := NewClient(
+				ClientPacketConn(delayed),
+				ClientBlocksize(1428),
+				ClientWindowsize(8),
+				ClientPipelineDepth(depth),
+			)
+			if err != nil {
+				b.Fatal(err)
+			}
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServeReaderAtAligned(b *testing.B) {
+	data := make([]byte, 1<<20)
+	const offset = 1000 // Unaligned offset, as from a resumed GetAt
+
+	for _, align := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("align=%d", align), func(b *testing.B) {
+			r := &pageReaderAt{data: data, pageSize: 4096}
+			b.SetBytes(int64(len(data) - offset))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.reads = r.reads[:0]
+				req := readRequestMock{offset: offset}
+				req.writer.Grow(len(data))
+				if err := ServeReaderAtAligned(&req, r, int64(len(data)), align); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(r.pages)/float64(b.N), "pages/op")
+		})
+	}
+}
+
+func BenchmarkNullHandlers(b *testing.B) {
+	const size = 1 << 20
+
+	for _, put := range []bool{false, true} {
+		for _, blksize := range []int{512, 1468, 8192} {
+			for _, windowsize := range []int{1, 8} {
+				op := "get"
+				if put {
+					op = "put"
+				}
+				b.Run(fmt.Sprintf("%s blksize=%d windowsize=%d", op, blksize, windowsize), func(b *testing.B) {
+					rh := &NullReadHandler{Size: size}
+					var wh NullWriteHandler
+					ip, port, close := newTestServer(b, false, rh.ServeTFTP, wh.ReceiveTFTP)
+					defer close()
+
+					client, err := NewClient(ClientBlocksize(blksize), ClientWindowsize(windowsize))
+					if err != nil {
+						b.Fatal(err)
+					}
+					url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+					data := make([]byte, size)
+
+					b.SetBytes(size)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						if put {
+							if err := client.Put(url, bytes.NewReader(data), size); err != nil {
+								b.Fatal(err)
+							}
+							continue
+						}
+						resp, err := client.Get(url)
+						if err != nil {
+							b.Fatal(err)
+						}
+						if _, err := ioutil.ReadAll(resp); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkClient_GetFile(b *testing.B) {
+	const size = 4 << 20
+
+	rh := &NullReadHandler{Size: size}
+	ip, port, close := newTestServer(b, false, rh.ServeTFTP, nil)
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	client, err := NewClient(ClientBlocksize(1468), ClientWindowsize(8))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		get  func() error
+	}{
+		{
+			name: "GetFile",
+			get: func() error {
+				_, err := client.GetFile(url, f)
+				return err
+			},
+		},
+		{
+			name: "io.Copy via bytes.Buffer",
+			get: func() error {
+				resp, err := client.Get(url)
+				if err != nil {
+					return err
+				}
+				var buf bytes.Buffer
+				if _, err := io.Copy(&buf, resp); err != nil {
+					return err
+				}
+				_, err = io.Copy(f, &buf)
+				return err
+			},
+		},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if err := c.get(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CachingReadHandler wraps inner, caching the content it serves in memory
+// keyed by file name.
+//
+// Up to maxBytes of content is retained, evicting the least recently used
+// files when full. Files larger than maxBytes are passed through without
+// being cached. Entries expire ttl after being cached; a ttl of zero
+// disables expiry. Responses in which inner sends an error are not cached.
+// Requests for an offset are passed to inner without using the cache.
+func CachingReadHandler(inner ReadHandler, maxBytes int, ttl time.Duration) ReadHandler {
+	return &cachingReadHandler{
+		inner:    inner,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// errResponseFailed is returned to handlers writing after an error was sent.
+var errResponseFailed = errors.New("response failed")
+
+type cachingReadHandler struct {
+	inner    ReadHandler
+	maxBytes int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	size    int                      // total bytes cached
+	entries map[string]*list.Element // values are *cacheEntry
+	lru     *list.List               // front is most recently used
+}
+
+type cacheEntry struct {
+	name    string
+	data    []byte
+	size    *int64 // tsize set by inner, if any
+	etag    string // ETag written by inner, if any
+	expires time.Time
+}
+
+// ServeTFTP serves the request from the cache if possible, otherwise inner
+// is called and the response is cached.
+func (h *cachingReadHandler) ServeTFTP(w ReadRequest) {
+	if _, ok := RequestedOptions(w)[optOffset]; ok {
+		// The response is only part of the file
+		h.inner.ServeTFTP(w)
+		return
+	}
+	if e := h.get(w.Name()); e != nil {
+		if e.etag != "" && WriteETag(w, e.etag) == ErrNotModified {
+			return
+		}
+		if e.size != nil {
+			w.WriteSize(*e.size)
+		}
+		w.Write(e.data)
+		return
+	}
+
+	cw := &cachingReadRequest{ReadRequest: w, limit: h.maxBytes}
+	h.inner.ServeTFTP(cw)
+	if cw.passthrough || cw.failed {
+		return
+	}
+
+	// Send the buffered response
+	if cw.size != nil {
+		w.WriteSize(*cw.size)
+	}
+	if _, err := w.Write(cw.buf.Bytes()); err != nil {
+		return
+	}
+
+	h.add(&cacheEntry{
+		name: w.Name(),
+		data: cw.buf.Bytes(),
+		size: cw.size,
+		etag: cw.etag,
+	})
+}
+
+// get returns the unexpired entry for name, or nil.
+func (h *cachingReadHandler) get(name string) *cacheEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	el, ok := h.entries[name]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if h.ttl > 0 && !h.now().Before(e.expires) {
+		h.remove(el)
+		return nil
+	}
+	h.lru.MoveToFront(el)
+	return e
+}
+
+// add caches e, evicting entries as needed.
+func (h *cachingReadHandler) add(e *cacheEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if el, ok := h.entries[e.name]; ok {
+		h.remove(el)
+	}
+	for h.size+len(e.data) > h.maxBytes && h.lru.Len() > 0 {
+		h.remove(h.lru.Back())
+	}
+
+	e.expires = h.now().Add(h.ttl)
+	h.entries[e.name] = h.lru.PushFront(e)
+	h.size += len(e.data)
+}
+
+// remove must be called with mu held.
+func (h *cachingReadHandler) remove(el *list.Element) {
+	e := h.lru.Remove(el).(*cacheEntry)
+	delete(h.entries, e.name)
+	h.size -= len(e.data)
+}
+
+// cachingReadRequest buffers a response up to limit bytes. If the
+// limit is exceeded the buffered data is sent and the remainder
+// passed through.
+type cachingReadRequest struct {
+	ReadRequest
+	limit int
+
+	buf         bytes.Buffer
+	size        *int64
+	etag        string
+	passthrough bool // limit exceeded, writing directly to ReadRequest
+	failed      bool // an error was sent or returned
+}
+
+func (w *cachingReadRequest) Write(p []byte) (int, error) {
+	if w.failed {
+		return 0, errResponseFailed
+	}
+	if !w.passthrough && w.buf.Len()+len(p) <= w.limit {
+		return w.buf.Write(p)
+	}
+
+	if !w.passthrough {
+		w.passthrough = true
+		if w.size != nil {
+			w.ReadRequest.WriteSize(*w.size)
+		}
+		if _, err := w.ReadRequest.Write(w.buf.Bytes()); err != nil {
+			w.failed = true
+			return 0, err
+		}
+		w.buf = bytes.Buffer{}
+	}
+
+	n, err := w.ReadRequest.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// Unwrap returns the request the response is sent to.
+func (w *cachingReadRequest) Unwrap() ReadRequest {
+	return w.ReadRequest
+}
+
+func (w *cachingReadRequest) WriteSize(i int64) {
+	w.size = &i
+}
+
+func (w *cachingReadRequest) WriteETag(etag string) error {
+	w.etag = etag
+	err := WriteETag(w.ReadRequest, etag)
+	if err != nil {
+		w.failed = true
+	}
+	return err
+}
+
+func (w *cachingReadRequest) WriteError(c ErrorCode, s string) {
+	w.failed = true
+	w.ReadRequest.WriteError(c, s)
+}
+
+func (w *cachingReadRequest) ExtendDeadline(d time.Duration) error {
+	// Size must be known before options are acknowledged
+	if w.size != nil {
+		w.ReadRequest.WriteSize(*w.size)
+	}
+	return ExtendDeadline(w.ReadRequest, d)
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachingReadHandler(t *testing.T) {
+	files := map[string][]byte{
+		"a":     []byte("aaaa"),
+		"b":     []byte("bbbb"),
+		"c":     []byte("cccc"),
+		"large": bytes.Repeat([]byte("l"), 20),
+	}
+
+	calls := map[string]int{}
+	inner := ReadHandlerFunc(func(w ReadRequest) {
+		calls[w.Name()]++
+		data, ok := files[w.Name()]
+		if !ok {
+			w.WriteError(ErrCodeFileNotFound, "not found")
+			return
+		}
+		w.WriteSize(int64(len(data)))
+		w.Write(data[:len(data)/2])
+		w.Write(data[len(data)/2:])
+	})
+
+	now := time.Now()
+	h := CachingReadHandler(inner, 10, time.Minute).(*cachingReadHandler)
+	h.now = func() time.Time { return now }
+
+	cases := []struct {
+		name    string
+		reqName string
+		advance time.Duration
+
+		expectedCalls int
+		expectedData  []byte
+		expectedCode  ErrorCode
+	}{
+		{name: "miss", reqName: "a", expectedCalls: 1, expectedData: files["a"]},
+		{name: "hit", reqName: "a", expectedCalls: 1, expectedData: files["a"]},
+		{name: "second file", reqName: "b", expectedCalls: 1, expectedData: files["b"]},
+		{name: "evicts least recently used", reqName: "c", expectedCalls: 1, expectedData: files["c"]},
+		{name: "evicted", reqName: "a", expectedCalls: 2, expectedData: files["a"]},
+		{name: "retained", reqName: "c", expectedCalls: 1, expectedData: files["c"]},
+		{name: "expired", reqName: "c", advance: time.Minute, expectedCalls: 2, expectedData: files["c"]},
+		{name: "larger than cache", reqName: "large", expectedCalls: 1, expectedData: files["large"]},
+		{name: "larger than cache, not cached", reqName: "large", expectedCalls: 2, expectedData: files["large"]},
+		{name: "error", reqName: "missing", expectedCalls: 1, expectedCode: ErrCodeFileNotFound},
+		{name: "error, not cached", reqName: "missing", expectedCalls: 2, expectedCode: ErrCodeFileNotFound},
+	}
+
+	for _, c := range cases {
+		now = now.Add(c.advance)
+
+		req := readRequestMock{name: c.reqName}
+		h.ServeTFTP(&req)
+
+		if calls[c.reqName] != c.expectedCalls {
+			t.Errorf("%s: expected %d calls to inner handler, but there were %d", c.name, c.expectedCalls, calls[c.reqName])
+		}
+		if !bytes.Equal(req.writer.Bytes(), c.expectedData) {
+			t.Errorf("%s: expected data %q, but it was %q", c.name, c.expectedData, req.writer.Bytes())
+		}
+		if c.expectedData != nil && (req.size == nil || *req.size != int64(len(c.expectedData))) {
+			t.Errorf("%s: expected size %d, but it was %v", c.name, len(c.expectedData), req.size)
+		}
+		if req.errCode != c.expectedCode {
+			t.Errorf("%s: expected error code %s, but it was %s", c.name, c.expectedCode, req.errCode)
+		}
+	}
+
+	if h.size > h.maxBytes {
+		t.Errorf("expected cache size to be at most %d, but it was %d", h.maxBytes, h.size)
+	}
+}
+
+func TestCachingReadHandler_offset(t *testing.T) {
+	data := getTestData(t, "text")[:3000]
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := CachingReadHandler(FileServer(dir), 1<<20, time.Minute)
+	ip, port, close := newTestServer(t, false, h.ServeTFTP, nil)
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offset requests before and after the file is cached
+	for i, offset := range []int64{1000, 0, 1000, 0} {
+		resp, err := client.GetAt(url, offset)
+		if err != nil {
+			t.Fatalf("request %d at offset %d: %v", i, offset, err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatalf("request %d at offset %d: %v", i, offset, err)
+		}
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("request %d at offset %d: expected %d bytes, got %d", i, offset, len(data)-int(offset), len(got))
+		}
+	}
+}
@@ -5,12 +5,20 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client makes requests to a server.
@@ -20,7 +28,33 @@ type Client struct {
 	mode TransferMode      // TFTP transfer mode
 	opts map[string]string // Map of TFTP options (RFC2347)
 
-	retransmit int // Per-packet retransmission limit
+	retransmit    int            // Per-packet retransmission limit
+	maxRetransmit int            // Per-transfer retransmission limit, 0 is unlimited
+	packetConn    net.PacketConn // Optional caller provided connection
+	broadcast     bool           // Send requests to an IPv4 broadcast address
+	verifyIP      bool           // Discard responses to requests from other IPs
+	concurrency   int            // Maximum simultaneous transfers for GetAll
+	verify        bool           // Read back and compare files after Put
+	initialBlock  uint16         // Number of the first DATA block
+	compress      bool           // Request gzip compression of octet transfers
+
+	lossThreshold float64 // Retransmit rate at which the send window is capped
+	pipelineDepth int     // Windows Put sends before waiting for an ACK
+	blksizes      []int   // Blocksizes to request in order when rejected
+
+	readTimeout   time.Duration // Wait for each response, 0 uses the negotiated timeout
+	retryInterval time.Duration // Pause before retransmitting after a timeout
+	natKeepAlive  time.Duration // Interval to resend the last ACK while waiting for DATA, 0 disables
+
+	retryCodes    []ErrorCode   // Server error codes which cause the request to be retried
+	retryAttempts int           // Retries of the request for retryCodes
+	retryBackoff  time.Duration // Delay before the first retry, doubled for each subsequent retry
+
+	followRedirect bool // Reissue requests redirected by the server
+
+	validateOACK func(NegotiatedOptions) error // Checks the options agreed for each transfer
+
+	closed int32 // Set by Close, accessed atomically
 }
 
 // NewClient returns a configured Client.
@@ -34,11 +68,14 @@ func NewClient(opts ...ClientOpt) (*Client, error) {
 	}
 
 	c := &Client{
-		log:        newLogger("client"),
-		net:        defaultUDPNet,
-		opts:       options,
-		mode:       defaultMode,
-		retransmit: defaultRetransmit,
+		log:          newLogger("client"),
+		net:          defaultUDPNet,
+		opts:         options,
+		mode:         defaultMode,
+		retransmit:   defaultRetransmit,
+		concurrency:  1,
+		initialBlock: defaultInitialBlock,
+		verifyIP:     true,
 	}
 
 	// Apply option functions to client
@@ -48,6 +85,10 @@ func NewClient(opts ...ClientOpt) (*Client, error) {
 		}
 	}
 
+	if c.compress && c.mode == ModeOctet {
+		c.opts[optCompress] = compressGzip
+	}
+
 	return c, nil
 }
 
@@ -55,39 +96,426 @@ func NewClient(opts ...ClientOpt) (*Client, error) {
 //
 // URL is in the format tftp://[server]:[port]/[file]
 func (c *Client) Get(url string) (*Response, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+
 	u, err := parseURL(url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create connection
-	conn, err := newConnFromHost(c.net, c.mode, u.host)
+	// Initiate the request
+	conn, err := c.request(u.host, func(conn *conn, opts map[string]string) error {
+		return conn.sendReadRequest(u.file, opts)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Set retransmit
-	conn.retransmit = c.retransmit
+	return &Response{conn: conn}, nil
+}
+
+// GetAt initiates a read request for url starting offset bytes into the
+// file, using the non-standard offset option. This allows an interrupted
+// transfer to be resumed without receiving the data again.
+//
+// If the server doesn't accept the offset, ErrOffsetNotAccepted is returned
+// and the transfer is aborted. Offsets aren't supported in netascii mode.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) GetAt(url string, offset int64) (*Response, error) {
+	if offset == 0 {
+		return c.Get(url)
+	}
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if offset < 0 || c.mode == ModeNetASCII {
+		return nil, ErrInvalidOffset
+	}
 
-	// Initiate the request
-	if err := conn.sendReadRequest(u.file, c.opts); err != nil {
+	u, err := parseURL(url)
+	if err != nil {
 		return nil, err
 	}
 
+	conn, err := c.request(u.host, func(conn *conn, opts map[string]string) error {
+		withOffset := make(map[string]string, len(opts)+1)
+		for k, v := range opts {
+			withOffset[k] = v
+		}
+		withOffset[optOffset] = strconv.FormatInt(offset, 10)
+		return conn.sendReadRequest(u.file, withOffset)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !conn.offsetAccepted || conn.offset != offset {
+		conn.sendError(ErrCodeOptionNegotiation, "Offset required")
+		errorDefer(conn.Close, c.log, "error closing network connection after declined offset")
+		return nil, ErrOffsetNotAccepted
+	}
+
 	return &Response{conn: conn}, nil
 }
 
+// Stream initiates a read request and calls fn with the data of each DATA
+// block as it's received, rather than returning a Reader. This suits
+// open-ended transfers, such as from a device sending continuously, which
+// may never reach the end of the file. fn must not retain the slice.
+//
+// Stream returns nil once the final block has been received or when fn
+// returns ErrStopStream, otherwise the error from the transfer or from fn.
+// If fn ends the transfer early the server is sent an ERROR.
+//
+// In netascii mode or with compression (see ClientCompress), fn is called
+// with the decoded data, which doesn't align with blocks.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) Stream(url string, fn func([]byte) error) error {
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	conn := resp.conn
+	defer errorDefer(conn.Close, c.log, "error closing network connection after stream")
+
+	// Negotiate options, the buffer holds a block at the agreed blocksize
+	if _, err := conn.readRaw(nil); err != nil {
+		return err
+	}
+	buf := make([]byte, conn.blksize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if fnErr := fn(buf[:n]); fnErr != nil {
+				if !conn.done {
+					conn.sendError(ErrCodeNotDefined, "Transfer stopped")
+				}
+				if fnErr == ErrStopStream {
+					return nil
+				}
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// NegotiatedOptions are the transfer options agreed with a server.
+type NegotiatedOptions struct {
+	Blocksize  int           // Size of DATA payloads
+	Timeout    time.Duration // Retransmission timeout
+	Windowsize int           // Number of DATA datagrams per ACK
+	Size       int64         // Size of the file from tsize, -1 if not received
+}
+
+// GetFile retrieves url and writes it to f, from its current offset,
+// returning the number of bytes written. Data is read from the transfer
+// in chunks of whole blocks at the negotiated blocksize, each written to f
+// with a single call, using one buffer for the transfer. f isn't truncated
+// or synced. If writing to f fails the server is sent an ERROR.
+//
+// Unlike FileClient.GetToFile, the transfer isn't retried and a partial
+// file is left in f if it fails.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) GetFile(url string, f *os.File) (int64, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	conn := resp.conn
+	defer errorDefer(conn.Close, c.log, "error closing network connection after GetFile")
+
+	// Negotiate options, the buffer holds blocks at the agreed blocksize
+	if _, err := conn.readRaw(nil); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, conn.chunkSize())
+	var written int64
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			wn, wErr := f.Write(buf[:n])
+			written += int64(wn)
+			if wErr != nil {
+				if !conn.done {
+					conn.sendError(ErrCodeNotDefined, "Error writing file")
+				}
+				return written, wrapError(wErr, "writing file")
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// negotiatedOptions returns the options agreed with the server, or the
+// defaults if it doesn't support options.
+func (c *conn) negotiatedOptions() NegotiatedOptions {
+	no := NegotiatedOptions{
+		Blocksize:  int(c.blksize),
+		Timeout:    c.timeout,
+		Windowsize: int(c.windowsize),
+		Size:       -1,
+	}
+	if c.tsize != nil {
+		no.Size = *c.tsize
+	}
+	return no
+}
+
+// Negotiate initiates a read request and returns the options agreed with
+// the server, aborting before any data is transferred. This can be used to
+// probe a server's capabilities.
+//
+// If the server doesn't support options the defaults are returned.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) Negotiate(url string) (NegotiatedOptions, error) {
+	if c.isClosed() {
+		return NegotiatedOptions{}, ErrClientClosed
+	}
+
+	u, err := parseURL(url)
+	if err != nil {
+		return NegotiatedOptions{}, err
+	}
+
+	conn, err := c.request(u.host, func(conn *conn, opts map[string]string) error {
+		return conn.negotiate(u.file, opts)
+	})
+	if err != nil {
+		return NegotiatedOptions{}, err
+	}
+	defer errorDefer(conn.Close, c.log, "error closing network connection after negotiation")
+
+	return conn.negotiatedOptions(), nil
+}
+
+// ProbeBlocksize returns the largest blocksize which can be received from
+// the server at url without loss, such as from datagrams exceeding the path
+// MTU being fragmented and dropped. It can be configured with
+// ClientBlocksize for subsequent transfers.
+//
+// A binary search is made over blocksizes from 512 to 65464, each probe
+// reads only the first block of the file in octet mode before aborting the
+// transfer. A probe is considered lost once it has been retransmitted
+// once, failed probes take the read timeout twice and a short
+// ClientReadTimeout speeds up the search.
+//
+// The result is limited by the largest blocksize the server accepts and by
+// the size of the file, blocksizes larger than the file can't be tested.
+// For a file smaller than the default of 512 bytes the default is returned.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) ProbeBlocksize(url string) (int, error) {
+	if c.isClosed() {
+		return 0, ErrClientClosed
+	}
+
+	u, err := parseURL(url)
+	if err != nil {
+		return 0, err
+	}
+
+	size, negotiated, err := c.probeBlocksize(u, defaultBlksize)
+	if err != nil {
+		return 0, wrapError(err, "probing default blocksize")
+	}
+	if negotiated < defaultBlksize {
+		return negotiated, nil
+	}
+	if size < defaultBlksize {
+		// The file is too small to test larger blocksizes
+		return defaultBlksize, nil
+	}
+
+	// lo is known to work, sizes above hi are known not to
+	lo, hi := size, 65464
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		size, _, err := c.probeBlocksize(u, mid)
+		switch {
+		case err != nil && IsRemoteError(err):
+			return 0, wrapError(err, fmt.Sprintf("probing blocksize %d", mid))
+		case err != nil:
+			c.log.debug("Blocksize %d probe to %s lost: %v", mid, u.host, err)
+			hi = mid - 1
+		case size < mid:
+			// Limited by the server or the size of the file
+			lo, hi = size, size
+		default:
+			lo = mid
+		}
+	}
+	return lo, nil
+}
+
+// probeRetransmit is the retransmission limit for ProbeBlocksize
+// requests, loss is expected once the blocksize exceeds the path MTU.
+const probeRetransmit = 1
+
+// probeBlocksize requests u with blksize and reads the first block,
+// returning the number of bytes received in it and the negotiated
+// blocksize. The size is less than blksize if the server negotiated a
+// smaller blocksize or the file is smaller.
+func (c *Client) probeBlocksize(u *parsedURL, blksize int) (int, int, error) {
+	opts := make(map[string]string, len(c.opts))
+	for k, v := range c.opts {
+		opts[k] = v
+	}
+	opts[optBlocksize] = strconv.Itoa(blksize)
+	delete(opts, optWindowSize)
+	delete(opts, optCompress)
+
+	probe := *c
+	probe.opts = opts
+	probe.mode = ModeOctet
+	probe.blksizes = nil
+	probe.retransmit = probeRetransmit
+	probe.retryAttempts = 0
+	probe.validateOACK = nil
+
+	conn, err := probe.request(u.host, func(conn *conn, opts map[string]string) error {
+		return conn.sendReadRequest(u.file, opts)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer errorDefer(conn.Close, c.log, "error closing network connection after blocksize probe")
+
+	// Acknowledge the OACK, setting up the buffers for the negotiated blocksize
+	if _, err := conn.readRaw(nil); err != nil {
+		return 0, 0, err
+	}
+	// Read the block without acknowledging it, the server would send the
+	// next which could be received by a later request on a shared conn
+	conn.windowsize++
+	n, err := io.ReadFull(readerFunc(conn.readRaw), make([]byte, conn.blksize))
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, 0, err
+	}
+	if !conn.done {
+		conn.sendError(ErrCodeNotDefined, "Blocksize probe complete")
+	}
+	return n, int(conn.blksize), nil
+}
+
 // Put takes an io.Reader request a server.
 //
 // URL is in the format tftp://[server]:[port]/[file]
-func (c *Client) Put(url string, r io.Reader, size int64) (err error) {
+func (c *Client) Put(url string, r io.Reader, size int64) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+
 	u, err := parseURL(url)
 	if err != nil {
 		return err
 	}
 
-	// Create connection
-	conn, err := newConnFromHost(c.net, c.mode, u.host)
+	if !c.verify {
+		return c.put(u, r, size)
+	}
+
+	h := sha256.New()
+	if err := c.put(u, io.TeeReader(r, h), size); err != nil {
+		return err
+	}
+	return c.verifyWrite(url, h.Sum(nil))
+}
+
+// PutFile writes the contents of f to url, from its current offset. When f
+// is a regular file it's read in chunks of whole blocks at the negotiated
+// blocksize, each sent without being buffered, and its size is sent as
+// tsize if the option is enabled (see ClientTransferSize).
+//
+// URL is in the format tftp://[server]:[port]/[file]
+func (c *Client) PutFile(url string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return wrapError(err, "getting file size")
+	}
+	if !fi.Mode().IsRegular() {
+		return c.Put(url, f, 0)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return wrapError(err, "getting file offset")
+	}
+	return c.Put(url, blockReader{f}, fi.Size()-offset)
+}
+
+// blockReader reads a regular file for PutFile.
+type blockReader struct {
+	f *os.File
+}
+
+func (r blockReader) Read(p []byte) (int, error) {
+	return r.f.Read(p)
+}
+
+// WriteTo is used by io.Copy in put, it fills a buffer of whole blocks
+// from the file for each write so conn doesn't buffer part of a block
+// between writes.
+func (r blockReader) WriteTo(w io.Writer) (int64, error) {
+	size := fileChunk
+	if c, ok := w.(*conn); ok {
+		size = c.chunkSize()
+	}
+	buf := make([]byte, size)
+	var written int64
+	for {
+		n, err := io.ReadFull(r.f, buf)
+		if n > 0 {
+			wn, wErr := w.Write(buf[:n])
+			written += int64(wn)
+			if wErr != nil {
+				return written, wErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// fileChunk is the approximate size of reads and writes of files by
+// GetFile and PutFile.
+const fileChunk = 64 << 10
+
+// chunkSize returns the size of file reads and writes, a whole number of
+// blocks of about fileChunk bytes.
+func (c *conn) chunkSize() int {
+	blksize := int(c.blksize)
+	if blksize >= fileChunk {
+		return blksize
+	}
+	return fileChunk / blksize * blksize
+}
+
+// put performs the write request for Put.
+func (c *Client) put(u *parsedURL, r io.Reader, size int64) (err error) {
+	// Initiate the request
+	conn, err := c.request(u.host, func(conn *conn, opts map[string]string) error {
+		return conn.sendWriteRequest(u.file, c.putOptions(opts, size))
+	})
 	if err != nil {
 		return err
 	}
@@ -98,29 +526,296 @@ func (c *Client) Put(url string, r io.Reader, size int64) (err error) {
 		}
 	}()
 
-	// Set retransmit
-	conn.retransmit = c.retransmit
+	// Write the data to the connections
+	_, err = io.Copy(conn, r)
+
+	return err
+}
+
+// putOptions returns the options for a write request of size bytes. They're
+// a copy of opts, which may be shared by concurrent requests.
+func (c *Client) putOptions(opts map[string]string, size int64) map[string]string {
+	put := make(map[string]string, len(opts)+1)
+	for k, v := range opts {
+		put[k] = v
+	}
 
 	// Check if tsize is enabled
-	if _, ok := c.opts[optTransferSize]; ok {
+	if _, ok := put[optTransferSize]; ok {
 		if size < 1 {
 			// If size is <1, remove the option
-			delete(c.opts, optTransferSize)
+			delete(put, optTransferSize)
 		} else {
 			// Otherwise add the size as a string
-			c.opts[optTransferSize] = fmt.Sprint(size)
+			put[optTransferSize] = fmt.Sprint(size)
 		}
 	}
 
-	// Initiate the request
-	if err := conn.sendWriteRequest(u.file, c.opts); err != nil {
-		return err
+	if c.lossThreshold > 0 {
+		// Ends shortened windows (see ClientLossWindowCap)
+		put[optFlush] = "1"
 	}
+	return put
+}
 
-	// Write the data to the connections
-	_, err = io.Copy(conn, r)
+// verifyWrite reads url back from the server and compares the
+// SHA-256 of the content with sum.
+func (c *Client) verifyWrite(url string, sum []byte) error {
+	resp, err := c.Get(url)
+	if err != nil {
+		return wrapError(err, "reading back file for verification")
+	}
 
-	return err
+	h := sha256.New()
+	if _, err := io.Copy(h, resp); err != nil {
+		return wrapError(err, "reading back file for verification")
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return ErrVerifyMismatch
+	}
+	return nil
+}
+
+// Close releases the client's resources. Requests made after Close
+// return ErrClientClosed, transfers already in progress are unaffected.
+//
+// A connection provided with ClientPacketConn is owned by the caller and
+// is not closed. Calls after the first have no effect.
+func (c *Client) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// request opens a connection to host and initiates a request with send.
+//
+// If blocksize preferences are configured and the server rejects the
+// request, it's retried on a new connection with the next blocksize.
+// Errors configured with ClientRetryOnServerError are retried on a new
+// connection with the same blocksize. Redirects are followed if enabled
+// with ClientFollowRedirect.
+func (c *Client) request(host string, send func(*conn, map[string]string) error) (*conn, error) {
+	opts := c.opts
+	for i, retries, redirects := 0, 0, 0; ; {
+		if i < len(c.blksizes) {
+			opts = make(map[string]string, len(c.opts))
+			for k, v := range c.opts {
+				opts[k] = v
+			}
+			opts[optBlocksize] = strconv.Itoa(c.blksizes[i])
+		}
+
+		udpNet := c.net
+		if c.broadcast {
+			udpNet = "udp4"
+		}
+
+		// Create connection
+		conn, err := newConnFromHost(udpNet, c.mode, host, c.packetConn)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.retransmit = c.retransmit
+		conn.maxRetransmit = c.maxRetransmit
+		conn.readTimeout = c.readTimeout
+		conn.retryInterval = c.retryInterval
+		conn.natKeepAlive = c.natKeepAlive
+		conn.lossThreshold = c.lossThreshold
+		conn.pipelineDepth = c.pipelineDepth
+		conn.verifyIP = c.verifyIP && !c.broadcast
+		conn.validateOACK = c.validateOACK
+		conn.setInitialBlock(c.initialBlock)
+
+		err = send(conn, opts)
+		if err == nil {
+			return conn, nil
+		}
+		errorDefer(conn.Close, c.log, "error closing network connection after request")
+
+		if target, ok := redirectTarget(err); ok && c.followRedirect {
+			if redirects == maxRedirects {
+				return nil, wrapError(ErrTooManyRedirects, "following redirect to "+target)
+			}
+			redirects++
+			c.log.debug("Request to %s redirected to %s", host, target)
+			host = target
+			continue
+		}
+		if isNotModified(err) {
+			return nil, wrapError(ErrNotModified, "ifnotmatch "+opts[optIfNotMatch])
+		}
+		if i+1 < len(c.blksizes) && isOptionRejection(err) {
+			c.log.debug("Blocksize %d rejected, retrying with %d: %v", c.blksizes[i], c.blksizes[i+1], err)
+			i++
+			continue
+		}
+		if retries < c.retryAttempts && c.isRetryCode(err) {
+			delay := c.retryBackoff << uint(retries)
+			retries++
+			c.log.debug("Retrying request in %s after server error (%d of %d): %v", delay, retries, c.retryAttempts, err)
+			time.Sleep(delay)
+			continue
+		}
+		return nil, err
+	}
+}
+
+// redirectPrefix begins the message of an ERROR redirecting a request
+// (see ClientFollowRedirect).
+const redirectPrefix = "redirect="
+
+// maxRedirects is the most redirects followed for a request.
+const maxRedirects = 5
+
+// redirectTarget returns the address a request was redirected to,
+// if err is a redirect.
+func redirectTarget(err error) (string, bool) {
+	rErr, ok := ErrorCause(err).(*errRemoteError)
+	if !ok || rErr.code != ErrCodeNotDefined || !strings.HasPrefix(rErr.msg, redirectPrefix) {
+		return "", false
+	}
+	target := strings.TrimPrefix(rErr.msg, redirectPrefix)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+// notModifiedMsg is the message of an ERROR telling a client the file
+// matches the ETag it sent (see ClientIfNotMatch).
+const notModifiedMsg = "not modified"
+
+// isNotModified reports whether err is a response to ClientIfNotMatch
+// indicating the client's version of the file is current.
+func isNotModified(err error) bool {
+	rErr, ok := ErrorCause(err).(*errRemoteError)
+	return ok && rErr.code == ErrCodeNotDefined && rErr.msg == notModifiedMsg
+}
+
+// isRetryCode reports whether err is an error response with
+// one of the codes configured with ClientRetryOnServerError.
+func (c *Client) isRetryCode(err error) bool {
+	rErr, ok := ErrorCause(err).(*errRemoteError)
+	if !ok {
+		return false
+	}
+	for _, code := range c.retryCodes {
+		if rErr.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isOptionRejection reports whether err is an error response
+// that may have been caused by the requested options.
+func isOptionRejection(err error) bool {
+	rErr, ok := ErrorCause(err).(*errRemoteError)
+	if !ok {
+		return false
+	}
+	switch rErr.code {
+	case ErrCodeOptionNegotiation, ErrCodeIllegalOperation, ErrCodeNotDefined:
+		return true
+	}
+	return false
+}
+
+// Result is the outcome of retrieving a single file with GetAll.
+type Result struct {
+	File string // File name requested from the server
+	Path string // Local path the file was written to
+	Size int64  // Number of bytes written, those received before the error if Err is set
+	Err  error  // Error retrieving or writing the file, if any
+}
+
+// GetAll retrieves each of files from server, writing them to destDir.
+//
+// Server is in the format [server]:[port]. Files are written relative to
+// destDir, preserving any directories in the file name. Up to the number
+// of transfers configured by ClientConcurrency are run at once.
+//
+// A result is returned for every file, in the same order as files. If any
+// transfer fails the returned error will be non-nil, successfully retrieved
+// files are kept.
+func (c *Client) GetAll(server string, files []string, destDir string) ([]Result, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+
+	results := make([]Result, len(files))
+
+	workers := c.concurrency
+	if c.packetConn != nil {
+		workers = 1 // Transfers can't share the conn concurrently
+	}
+
+	var wg sync.WaitGroup
+	idx := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				results[i] = c.getFile(server, files[i], destDir)
+			}
+		}()
+	}
+	for i := range files {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	var failed int
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return results, nil
+}
+
+// getFile retrieves a single file for GetAll.
+func (c *Client) getFile(server, file, destDir string) Result {
+	// Clean with a leading slash so that the path can't escape destDir
+	r := Result{
+		File: file,
+		Path: filepath.Join(destDir, filepath.FromSlash(path.Clean("/"+file))),
+	}
+
+	resp, err := c.Get(strings.TrimSuffix(server, "/") + "/" + file)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer errorDefer(resp.conn.Close, c.log, "error closing network connection in GetAll")
+
+	if err := os.MkdirAll(filepath.Dir(r.Path), 0755); err != nil {
+		r.Err = err
+		return r
+	}
+	f, err := os.Create(r.Path)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+
+	r.Size, r.Err = io.Copy(f, resp)
+	if err := f.Close(); r.Err == nil {
+		r.Err = err
+	}
+	if r.Err != nil {
+		os.Remove(r.Path)
+	}
+	return r
 }
 
 // parsedURL holds the result of parseURL
@@ -197,6 +892,11 @@ func (r *Response) Size() (int64, error) {
 	return *r.conn.tsize, nil
 }
 
+// Stats returns statistics collected during the transfer so far.
+func (r *Response) Stats() TransferStats {
+	return r.conn.stats
+}
+
 func (r *Response) Read(p []byte) (int, error) {
 	return r.conn.Read(p)
 }
@@ -217,6 +917,23 @@ func ClientMode(mode TransferMode) ClientOpt {
 	}
 }
 
+// ClientNetwork configures the network used to resolve the server's address
+// and send requests. Must be one of: udp, udp4, udp6.
+//
+// Use udp4 or udp6 to select the address family when a server's host name
+// resolves to both IPv4 and IPv6 addresses.
+//
+// Default: udp.
+func ClientNetwork(net string) ClientOpt {
+	return func(c *Client) error {
+		if net != "udp" && net != "udp4" && net != "udp6" {
+			return ErrInvalidNetwork
+		}
+		c.net = net
+		return nil
+	}
+}
+
 // ClientBlocksize configures the number of data bytes that will be send in each datagram.
 // Valid range is 8 to 65464.
 //
@@ -231,6 +948,32 @@ func ClientBlocksize(size int) ClientOpt {
 	}
 }
 
+// ClientBlocksizePreferences configures blocksizes to request in order of
+// preference. If the server responds to a request with an option negotiation,
+// illegal operation, or undefined error, the request is sent again with the
+// next blocksize. Each valid size is in the range 8 to 65464.
+//
+// Every rejection costs a round trip and a new connection before the transfer
+// starts. Servers that ignore options, or don't respond at all, aren't retried.
+// ClientBlocksizePreferences overrides ClientBlocksize.
+//
+// Default: none, only the ClientBlocksize is requested.
+func ClientBlocksizePreferences(sizes []int) ClientOpt {
+	return func(c *Client) error {
+		if len(sizes) == 0 {
+			return ErrInvalidBlocksize
+		}
+		for _, size := range sizes {
+			if size < 8 || size > 65464 {
+				return ErrInvalidBlocksize
+			}
+		}
+		c.blksizes = append([]int(nil), sizes...)
+		c.opts[optBlocksize] = strconv.Itoa(sizes[0])
+		return nil
+	}
+}
+
 // ClientTimeout configures the number of seconds to wait before resending an unacknowledged datagram.
 // Valid range is 1 to 255.
 //
@@ -245,6 +988,123 @@ func ClientTimeout(seconds int) ClientOpt {
 	}
 }
 
+// ClientUTimeout requests the non-standard utimeout option, configuring the
+// time to wait before resending an unacknowledged datagram with microsecond
+// granularity. It's intended for low latency links where the second
+// granularity of ClientTimeout is too coarse. If the server accepts it,
+// utimeout takes precedence over the timeout option. Servers that don't
+// support it ignore the option. Valid range is 1µs to 255s.
+//
+// Default: disabled.
+func ClientUTimeout(d time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if d < time.Microsecond || d > maxUTimeout*time.Microsecond {
+			return ErrInvalidUTimeout
+		}
+		c.opts[optUTimeout] = strconv.FormatInt(int64(d/time.Microsecond), 10)
+		return nil
+	}
+}
+
+// ClientReadTimeout configures how long to wait for each datagram from the
+// server before considering it lost, independent of the timeout option sent
+// to the server. Zero uses the negotiated timeout.
+//
+// Default: 0.
+func ClientReadTimeout(d time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		c.readTimeout = d
+		return nil
+	}
+}
+
+// ClientRetryInterval configures a pause between a read timing out and
+// the retransmission that follows. Retransmissions on timeout are made by
+// the receiving side, so this applies to Get. The number of retransmissions
+// is configured with ClientRetransmit.
+//
+// Default: 0, retransmit immediately.
+func ClientRetryInterval(d time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		c.retryInterval = d
+		return nil
+	}
+}
+
+// ClientNATKeepAlive configures Get to resend its last ACK every d while
+// waiting for DATA, keeping the mapping of a NAT or stateful firewall
+// between client and server from expiring when the server pauses for
+// longer than the mapping's idle timeout. Keep-alives are only sent during
+// the wait for a block; they don't count as retransmissions and don't
+// extend the time before the wait times out.
+//
+// A keep-alive is a duplicate ACK, the server resends blocks it has
+// already sent following it. d should be well beyond the server's usual
+// response time.
+//
+// Default: 0, disabled.
+func ClientNATKeepAlive(d time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		c.natKeepAlive = d
+		return nil
+	}
+}
+
+// ClientRetryOnServerError configures the client to retry a request when
+// the server responds with an ERROR with one of codes, such as a server
+// reporting it's temporarily busy. The request is retried up to attempts
+// times on a new connection, waiting backoff before the first retry and
+// doubling the wait for each retry after that.
+//
+// Only errors in response to the request are retried, errors once the
+// transfer has started are returned as usual.
+//
+// Default: no retries.
+func ClientRetryOnServerError(codes []ErrorCode, attempts int, backoff time.Duration) ClientOpt {
+	return func(c *Client) error {
+		if attempts < 0 {
+			return ErrInvalidRetransmit
+		}
+		if backoff < 0 {
+			return ErrInvalidDuration
+		}
+		c.retryCodes = append([]ErrorCode(nil), codes...)
+		c.retryAttempts = attempts
+		c.retryBackoff = backoff
+		return nil
+	}
+}
+
+// ClientFollowRedirect configures the client to reissue requests which a
+// server redirects to another address, such as to balance load across a
+// farm of servers. This is a non-standard extension. A redirect is an ERROR
+// in response to the request with code ErrCodeNotDefined and a message of
+// exactly "redirect=" followed by the target as host:port, for example
+// "redirect=192.0.2.10:69". IPv6 targets must be bracketed, as in
+// "redirect=[2001:db8::10]:69".
+//
+// The request is sent to the target with the same file name and options.
+// Up to 5 redirects are followed for a request, after which
+// ErrTooManyRedirects is returned. When disabled redirects are returned as
+// remote errors.
+//
+// Default: false.
+func ClientFollowRedirect(follow bool) ClientOpt {
+	return func(c *Client) error {
+		c.followRedirect = follow
+		return nil
+	}
+}
+
 // ClientWindowsize configures the number of datagrams that will be transmitted before needing an acknowledgement.
 //
 // Default: 1.
@@ -258,6 +1118,57 @@ func ClientWindowsize(window int) ClientOpt {
 	}
 }
 
+// ClientPipelineDepth configures Put to send up to depth windows before
+// waiting for an acknowledgement, keeping the link busy while ACKs are in
+// flight on links with a high bandwidth-delay product. Each ACK of an
+// earlier window allows another window to be sent. Depth must be between
+// 1 and 16, 1 disables pipelining.
+//
+// EXPERIMENTAL: Pipelining is not part of any TFTP standard and isn't
+// negotiated. It's only enabled when the server acknowledges a windowsize
+// greater than 1 (see ClientWindowsize), as RFC 7440 servers ACK each
+// window and accept blocks arriving before the ACK is sent. Servers which
+// discard such blocks will cause retransmissions, but not corruption.
+// At most 32767 blocks are in flight.
+//
+// Default: 1.
+func ClientPipelineDepth(depth int) ClientOpt {
+	return func(c *Client) error {
+		if depth < 1 || depth > maxPipeline {
+			return ErrInvalidPipelineDepth
+		}
+		c.pipelineDepth = depth
+		return nil
+	}
+}
+
+// ClientLossWindowCap configures Put to lower the windowsize when the
+// link is lossy. If more than threshold (a fraction between 0 and 1) of the
+// recently sent DATA datagrams were retransmissions, the window is halved
+// for the rest of the transfer. The window is never raised again.
+//
+// This is a simple alternative to congestion control for known-bad links
+// where large windows repeatedly fail. The server only ACKs after the
+// negotiated windowsize, so the last DATA of each shortened window is sent
+// one byte short of the blocksize, using the non-standard flush option
+// (see ClientFlush) to have it acknowledged without ending the transfer.
+// The option is requested with each Put; if the server declines it, as
+// RFC 7440 servers not implementing it do, the window isn't capped. This
+// is logged at debug level and recorded in TransferStats.LossCapUnavailable.
+// Pipelining (see ClientPipelineDepth) stops once
+// the window is capped.
+//
+// Default: disabled.
+func ClientLossWindowCap(threshold float64) ClientOpt {
+	return func(c *Client) error {
+		if threshold <= 0 || threshold >= 1 {
+			return ErrInvalidLossThreshold
+		}
+		c.lossThreshold = threshold
+		return nil
+	}
+}
+
 // ClientTransferSize requests for the server to send the file size before sending.
 //
 // Default: enabled.
@@ -273,6 +1184,7 @@ func ClientTransferSize(enable bool) ClientOpt {
 }
 
 // ClientRetransmit configures the per-packet retransmission limit for all requests.
+// Zero disables retransmission, a transfer fails at the first timeout.
 //
 // Default: 10.
 func ClientRetransmit(i int) ClientOpt {
@@ -284,3 +1196,198 @@ func ClientRetransmit(i int) ClientOpt {
 		return nil
 	}
 }
+
+// ClientMaxTotalRetransmits configures the total number of retransmissions
+// allowed over the course of a transfer. Unlike ClientRetransmit, which bounds
+// consecutive retransmissions of a single datagram, this bounds the total
+// effort spent on a transfer over a link with persistent intermittent loss.
+//
+// Default: 0, unlimited.
+func ClientMaxTotalRetransmits(i int) ClientOpt {
+	return func(c *Client) error {
+		if i < 0 {
+			return ErrInvalidRetransmit
+		}
+		c.maxRetransmit = i
+		return nil
+	}
+}
+
+// ClientBroadcast configures the client for sending requests to an IPv4
+// broadcast address, such as 255.255.255.255, to discover a server. The
+// transfer continues with the first server to respond, datagrams from
+// other servers are rejected with an Unknown Transfer ID error.
+//
+// The standard library enables broadcast on UDP sockets, a connection
+// provided with ClientPacketConn must permit it as well. Broadcasts are
+// not routed beyond the local network and the address must be an IPv4
+// address.
+//
+// Default: disabled.
+func ClientBroadcast(enable bool) ClientOpt {
+	return func(c *Client) error {
+		c.broadcast = enable
+		return nil
+	}
+}
+
+// ClientValidateOACK registers fn to check the options agreed with the
+// server before a transfer begins, such as to require a minimum blocksize.
+// If fn returns an error the options are rejected with an Option
+// Negotiation ERROR and the request fails with the error returned by fn.
+//
+// fn is called when the server's response to the request is received. If
+// the server doesn't support options it's called with the defaults. It
+// isn't called by Negotiate or ProbeBlocksize, which don't transfer data.
+func ClientValidateOACK(fn func(NegotiatedOptions) error) ClientOpt {
+	return func(c *Client) error {
+		c.validateOACK = fn
+		return nil
+	}
+}
+
+// ClientVerifyServerIP configures the client to discard responses to a
+// request which aren't from the IP the request was sent to, guarding
+// against replies spoofed by an off-path host. The port may differ, as the
+// server responds from the port chosen for the transfer. Datagrams later in
+// the transfer are checked against the server's full address regardless.
+//
+// If only discarded responses are received the request fails with
+// ErrUnexpectedServerIP. Disable for multihomed servers which may respond
+// from another interface. Has no effect with ClientBroadcast.
+//
+// Default: enabled.
+func ClientVerifyServerIP(enable bool) ClientOpt {
+	return func(c *Client) error {
+		c.verifyIP = enable
+		return nil
+	}
+}
+
+// ClientCompress requests the non-standard compress option, gzip
+// compressing the data of each transfer to reduce the bytes sent over
+// slow links. Data is compressed before being split into DATA blocks, and
+// decompressed by Read or the server as it's received.
+//
+// The option is only understood by servers from this package with
+// ServerCompress enabled, others ignore it and the transfer proceeds
+// uncompressed. It's only requested in octet mode (see ClientMode).
+// The tsize option, Response.Size and the server's WriteRequest.Size
+// remain the uncompressed size, the compressed size isn't known until
+// the transfer ends. TransferInfo.Bytes counts compressed bytes.
+//
+// Default: disabled.
+func ClientCompress(enable bool) ClientOpt {
+	return func(c *Client) error {
+		c.compress = enable
+		return nil
+	}
+}
+
+// ClientFlush requests the non-standard flush option, allowing servers to
+// deliver data before a full block is available, such as when tailing a log.
+//
+// In standard TFTP a DATA block shorter than the blocksize ends the transfer.
+// When flush is negotiated, short blocks are returned from Read as they arrive
+// and the transfer is ended by an empty block instead. Servers that don't
+// support the option ignore it and the transfer proceeds as normal.
+//
+// Default: disabled.
+func ClientFlush(enable bool) ClientOpt {
+	return func(c *Client) error {
+		if enable {
+			c.opts[optFlush] = "1"
+		} else {
+			delete(c.opts, optFlush)
+		}
+		return nil
+	}
+}
+
+// ClientIfNotMatch sends etag, identifying the version of a file the
+// client already has, with each request in the non-standard ifnotmatch
+// option. If the server's version matches it responds with an ERROR with
+// code ErrCodeNotDefined and the message "not modified" instead of the
+// file, and Get returns ErrNotModified. Servers compare the ETag with
+// WriteETag; those that don't support the option ignore it and send the
+// file.
+//
+// This suits fleets of devices polling for a provisioning file that
+// rarely changes. An empty etag disables the option, ErrInvalidETag is
+// returned if etag contains a NUL byte.
+//
+// Default: disabled.
+func ClientIfNotMatch(etag string) ClientOpt {
+	return func(c *Client) error {
+		if etag == "" {
+			delete(c.opts, optIfNotMatch)
+			return nil
+		}
+		if strings.IndexByte(etag, 0) >= 0 {
+			return ErrInvalidETag
+		}
+		c.opts[optIfNotMatch] = etag
+		return nil
+	}
+}
+
+// ClientVerifyWriteback configures Put to read the file back from the
+// server after the upload completes and compare it with the data sent,
+// returning ErrVerifyMismatch if it differs. This guards against servers
+// which accept an upload but store it incorrectly.
+//
+// Verification costs a full read transfer of the file, roughly doubling
+// the time taken by Put. The server must permit reading the file.
+//
+// Default: disabled.
+func ClientVerifyWriteback(enable bool) ClientOpt {
+	return func(c *Client) error {
+		c.verify = enable
+		return nil
+	}
+}
+
+// ClientInitialBlock configures the block number of the first DATA block
+// sent or expected by the client. RFC 1350 numbers the first block 1, but
+// some nonstandard peers, such as certain bootloaders, start at 0.
+//
+// Both peers must agree on the initial block, it isn't negotiated. The
+// request and OACK are still acknowledged with block 0.
+//
+// Default: 1.
+func ClientInitialBlock(block uint16) ClientOpt {
+	return func(c *Client) error {
+		c.initialBlock = block
+		return nil
+	}
+}
+
+// ClientPacketConn configures the client to send and receive all requests
+// via pc rather than listening on a new port for each request. This allows
+// the client to be used over a connection established by other means, such
+// as a tunnel or proxy.
+//
+// TID semantics still apply: the request is sent to the server's address and
+// the remainder of the transfer is conducted with the address the server
+// responds from. pc is not closed by the client. Requests sharing pc must not
+// be run concurrently.
+func ClientPacketConn(pc net.PacketConn) ClientOpt {
+	return func(c *Client) error {
+		c.packetConn = pc
+		return nil
+	}
+}
+
+// ClientConcurrency configures the maximum number of transfers GetAll
+// will run at the same time.
+//
+// Default: 1.
+func ClientConcurrency(n int) ClientOpt {
+	return func(c *Client) error {
+		if n < 1 {
+			return ErrInvalidConcurrency
+		}
+		c.concurrency = n
+		return nil
+	}
+}
@@ -5,10 +5,14 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -17,7 +21,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -167,6 +174,38 @@ func TestNewClient(t *testing.T) {
 
 			expectedError: ErrInvalidTimeout,
 		},
+		{
+			name: "retry on server error, negative attempts",
+			opts: []ClientOpt{
+				ClientRetryOnServerError([]ErrorCode{ErrCodeNotDefined}, -1, time.Second),
+			},
+
+			expectedError: ErrInvalidRetransmit,
+		},
+		{
+			name: "retry on server error, negative backoff",
+			opts: []ClientOpt{
+				ClientRetryOnServerError([]ErrorCode{ErrCodeNotDefined}, 1, -time.Second),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "utimeout too small",
+			opts: []ClientOpt{
+				ClientUTimeout(time.Nanosecond),
+			},
+
+			expectedError: ErrInvalidUTimeout,
+		},
+		{
+			name: "utimeout too large",
+			opts: []ClientOpt{
+				ClientUTimeout(256 * time.Second),
+			},
+
+			expectedError: ErrInvalidUTimeout,
+		},
 		{
 			name: "windowsize too small",
 			opts: []ClientOpt{
@@ -183,6 +222,22 @@ func TestNewClient(t *testing.T) {
 
 			expectedError: ErrInvalidWindowsize,
 		},
+		{
+			name: "pipeline depth too small",
+			opts: []ClientOpt{
+				ClientPipelineDepth(0),
+			},
+
+			expectedError: ErrInvalidPipelineDepth,
+		},
+		{
+			name: "pipeline depth too large",
+			opts: []ClientOpt{
+				ClientPipelineDepth(17),
+			},
+
+			expectedError: ErrInvalidPipelineDepth,
+		},
 		{
 			name: "retransmit negative",
 			opts: []ClientOpt{
@@ -191,6 +246,78 @@ func TestNewClient(t *testing.T) {
 
 			expectedError: ErrInvalidRetransmit,
 		},
+		{
+			name: "max total retransmits negative",
+			opts: []ClientOpt{
+				ClientMaxTotalRetransmits(-1),
+			},
+
+			expectedError: ErrInvalidRetransmit,
+		},
+		{
+			name: "network invalid",
+			opts: []ClientOpt{
+				ClientNetwork("tcp"),
+			},
+
+			expectedError: ErrInvalidNetwork,
+		},
+		{
+			name: "blocksize preferences empty",
+			opts: []ClientOpt{
+				ClientBlocksizePreferences(nil),
+			},
+
+			expectedError: ErrInvalidBlocksize,
+		},
+		{
+			name: "blocksize preferences invalid",
+			opts: []ClientOpt{
+				ClientBlocksizePreferences([]int{1468, 7}),
+			},
+
+			expectedError: ErrInvalidBlocksize,
+		},
+		{
+			name: "read timeout negative",
+			opts: []ClientOpt{
+				ClientReadTimeout(-time.Second),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "retry interval negative",
+			opts: []ClientOpt{
+				ClientRetryInterval(-time.Second),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "loss threshold too small",
+			opts: []ClientOpt{
+				ClientLossWindowCap(0),
+			},
+
+			expectedError: ErrInvalidLossThreshold,
+		},
+		{
+			name: "loss threshold too large",
+			opts: []ClientOpt{
+				ClientLossWindowCap(1),
+			},
+
+			expectedError: ErrInvalidLossThreshold,
+		},
+		{
+			name: "concurrency too small",
+			opts: []ClientOpt{
+				ClientConcurrency(0),
+			},
+
+			expectedError: ErrInvalidConcurrency,
+		},
 	}
 
 	for _, c := range cases {
@@ -931,34 +1058,136 @@ func TestClient_parseURL(t *testing.T) {
 	}
 }
 
-func newTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandlerFunc) (string, int, func()) {
-	s, err := NewServer("127.0.0.1:0", ServerSinglePort(singlePort))
+func newTestServer(t tester, singlePort bool, rh ReadHandlerFunc, wh WriteHandlerFunc, opts ...ServerOpt) (string, int, func()) {
+	s, addr := startTestServer(t, rh, wh, append([]ServerOpt{ServerSinglePort(singlePort)}, opts...)...)
 
-	if err != nil {
-		t.Fatalf("newTestServer: %v\n", err)
+	closer := func() {
+		s.Close()
 	}
-	s.ReadHandler(rh)
-	s.WriteHandler(wh)
 
-	go s.ListenAndServe()
+	// Check for IPv6
+	ip := addr.IP.String()
+	if addr.IP.To4() == nil {
+		ip = fmt.Sprintf("[%s]", addr.IP)
+	}
 
-	closer := func() {
-		s.Close()
+	return ip, addr.Port, closer
+}
+
+// startTestServer starts a server on the loopback interface with the
+// handlers which aren't nil, returning it and its address. The caller
+// closes the server.
+func startTestServer(t tester, rh ReadHandler, wh WriteHandler, opts ...ServerOpt) (*Server, *net.UDPAddr) {
+	s, err := NewServer("127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatalf("startTestServer: %v\n", err)
+	}
+	if rh != nil {
+		s.ReadHandler(rh)
+	}
+	if wh != nil {
+		s.WriteHandler(wh)
 	}
+	return s, serveTestServer(s)
+}
+
+// serveTestServer serves s in the background, returning its address once
+// it's listening.
+func serveTestServer(s *Server) *net.UDPAddr {
+	go s.ListenAndServe()
 
 	// Wait for server to start
 	for !s.Connected() {
 		runtime.Gosched() // Prevents gettting stuck here
 	}
 
-	// Check for IPv6
 	addr, _ := s.Addr()
-	ip := addr.IP.String()
-	if addr.IP.To4() == nil {
-		ip = fmt.Sprintf("[%s]", addr.IP)
+	return addr
+}
+
+// fakePeer is a loopback UDP peer standing in for a client or server, for
+// tests which need one to send or respond in ways Client and Server can't
+// be made to.
+type fakePeer struct {
+	*net.UDPConn
+	t tester
+}
+
+// newFakePeer starts a fakePeer on a loopback port, serving reply if it
+// isn't nil. Otherwise the test reads from the peer with read.
+func newFakePeer(t tester, reply func(dg *datagram, addr net.Addr) []datagram) *fakePeer {
+	p, err := listenFakePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, reply)
+	if err != nil {
+		t.Fatalf("newFakePeer: %v", err)
 	}
+	return p
+}
 
-	return ip, addr.Port, closer
+// listenFakePeer is newFakePeer listening on laddr.
+func listenFakePeer(t tester, laddr *net.UDPAddr, reply func(dg *datagram, addr net.Addr) []datagram) (*fakePeer, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &fakePeer{UDPConn: conn, t: t}
+	if reply != nil {
+		p.serve(reply)
+	}
+	return p, nil
+}
+
+// serve calls reply with each datagram received until the peer is closed,
+// sending the datagrams it returns back to addr.
+func (p *fakePeer) serve(reply func(dg *datagram, addr net.Addr) []datagram) {
+	go func() {
+		dg := datagram{buf: make([]byte, 65536)}
+		for {
+			n, addr, err := p.ReadFrom(dg.buf)
+			if err != nil {
+				return
+			}
+			dg.offset = n
+			for _, resp := range reply(&dg, addr) {
+				p.WriteTo(resp.bytes(), addr)
+			}
+		}
+	}()
+}
+
+// url returns the URL of "file" on the peer.
+func (p *fakePeer) url() string {
+	return fmt.Sprintf("tftp://%s/file", p.LocalAddr())
+}
+
+// send writes dg to addr, failing the test on error. It must be called
+// from the test's goroutine.
+func (p *fakePeer) send(dg datagram, addr net.Addr) {
+	if _, err := p.WriteTo(dg.bytes(), addr); err != nil {
+		p.t.Fatalf("fakePeer send: %v", err)
+	}
+}
+
+// read returns the next datagram received and its source, failing the test
+// if none arrives within timeout. It must be called from the test's
+// goroutine.
+func (p *fakePeer) read(timeout time.Duration) (*datagram, net.Addr) {
+	dg, addr, err := p.tryRead(timeout)
+	if err != nil {
+		p.t.Fatalf("fakePeer read: %v", err)
+	}
+	return dg, addr
+}
+
+// tryRead is read, returning the error rather than failing the test.
+func (p *fakePeer) tryRead(timeout time.Duration) (*datagram, net.Addr, error) {
+	dg := &datagram{buf: make([]byte, 65536)}
+	p.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := p.ReadFrom(dg.buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	dg.offset = n
+	return dg, addr, nil
 }
 
 type tester interface {
@@ -975,3 +1204,2066 @@ func getTestData(t tester, name string) []byte {
 
 	return data
 }
+
+func TestClient_PacketConn(t *testing.T) {
+	data := getTestData(t, "text")
+
+	var received bytes.Buffer
+	done := make(chan struct{})
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		w.Write(data)
+	}, func(r WriteRequest) {
+		received.ReadFrom(r)
+		close(done)
+	})
+	defer close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	client, err := NewClient(ClientPacketConn(pc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	// Multiple requests can be made over the same connection
+	for i := 0; i < 2; i++ {
+		file, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response, data) {
+			t.Errorf("get %d: response didn't match", i)
+		}
+	}
+
+	if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for write handler")
+	}
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("put: received data didn't match")
+	}
+
+	// Connection should still be open
+	if err := pc.SetDeadline(time.Now()); err != nil {
+		t.Errorf("expected connection to remain open: %v", err)
+	}
+}
+
+func TestClient_GetAll(t *testing.T) {
+	files := map[string][]byte{
+		"a":             []byte("file a"),
+		"dir/b":         getTestData(t, "text"),
+		"../../escaped": []byte("stays in dir"),
+	}
+
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		data, ok := files[w.Name()]
+		if !ok {
+			w.WriteError(ErrCodeFileNotFound, "not found")
+			return
+		}
+		w.WriteSize(int64(len(data)))
+		w.Write(data)
+	}, nil)
+	defer close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := NewClient(ClientConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"a", "missing", "dir/b", "../../escaped"}
+	results, err := client.GetAll(fmt.Sprintf("%s:%d", ip, port), names, dir)
+	if err == nil {
+		t.Error("expected error for missing file")
+	}
+	if len(results) != len(names) {
+		t.Fatalf("expected %d results, got %d", len(names), len(results))
+	}
+
+	for i, r := range results {
+		if r.File != names[i] {
+			t.Errorf("expected result %d to be for %q, but it was %q", i, names[i], r.File)
+		}
+		if !strings.HasPrefix(r.Path, dir) {
+			t.Errorf("expected %q to be within %q", r.Path, dir)
+		}
+
+		expected, ok := files[r.File]
+		if !ok {
+			if !IsRemoteError(r.Err) {
+				t.Errorf("expected remote error for %q, got %v", r.File, r.Err)
+			}
+			if _, err := os.Stat(r.Path); !os.IsNotExist(err) {
+				t.Errorf("expected %q not to be created", r.Path)
+			}
+			continue
+		}
+
+		if r.Err != nil {
+			t.Errorf("unexpected error for %q: %v", r.File, r.Err)
+			continue
+		}
+		if r.Size != int64(len(expected)) {
+			t.Errorf("expected size of %q to be %d, but it was %d", r.File, len(expected), r.Size)
+		}
+		data, _ := ioutil.ReadFile(r.Path)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("contents of %q didn't match", r.Path)
+		}
+	}
+}
+
+func TestClient_network(t *testing.T) {
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}, nil)
+	defer close()
+	if ip != "127.0.0.1" {
+		t.Fatalf("expected test server on 127.0.0.1, got %s", ip)
+	}
+
+	cases := []struct {
+		net string
+
+		expectIPv4 bool
+	}{
+		{net: "udp4", expectIPv4: true},
+		{net: "udp6", expectIPv4: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.net, func(t *testing.T) {
+			host := net.JoinHostPort("localhost", strconv.Itoa(port))
+			conn, err := newConnFromHost(c.net, ModeOctet, host, nil)
+			if err != nil {
+				if !c.expectIPv4 {
+					t.Skipf("IPv6 localhost unavailable: %v", err)
+				}
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ip := conn.remoteAddr.(*net.UDPAddr).IP
+			if isIPv4 := ip.To4() != nil; isIPv4 != c.expectIPv4 {
+				t.Errorf("expected localhost to resolve to IPv4 %t, but it resolved to %s", c.expectIPv4, ip)
+			}
+
+			if !c.expectIPv4 {
+				return
+			}
+
+			// Server is only listening on IPv4
+			client, err := NewClient(ClientNetwork(c.net))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get("tftp://" + host + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(resp)
+			if string(data) != "the data" {
+				t.Errorf("expected response %q, but it was %q", "the data", data)
+			}
+		})
+	}
+}
+
+// lossyPacketConn drops every dropEvery'th DATA datagram written, up to
+// maxDrops, and records the number of DATA datagrams sent between reads.
+type lossyPacketConn struct {
+	net.PacketConn
+	dropEvery int
+	maxDrops  int
+
+	sent  int
+	drops int
+	run   int
+	runs  []int
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) < 2 || opcode(p[1]) != opCodeDATA {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	c.sent++
+	c.run++
+	if c.drops < c.maxDrops && c.sent%c.dropEvery == 0 {
+		c.drops++
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *lossyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && c.run > 0 {
+		c.runs = append(c.runs, c.run)
+		c.run = 0
+	}
+	return n, addr, err
+}
+
+// dropReadPacketConn discards every dropEvery'th DATA datagram read.
+type dropReadPacketConn struct {
+	net.PacketConn
+	dropEvery int
+
+	received int
+}
+
+func (c *dropReadPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || n < 2 || opcode(p[1]) != opCodeDATA {
+			return n, addr, err
+		}
+		c.received++
+		if c.received%c.dropEvery != 0 {
+			return n, addr, err
+		}
+	}
+}
+
+// mtuPacketConn discards datagrams read which would exceed mtu with
+// IPv4 and UDP headers, simulating a path dropping fragmented datagrams.
+type mtuPacketConn struct {
+	net.PacketConn
+	mtu int
+}
+
+func (c *mtuPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || n+28 <= c.mtu {
+			return n, addr, err
+		}
+	}
+}
+
+func TestClient_ProbeBlocksize(t *testing.T) {
+	data := getTestData(t, "1MB-random")
+
+	cases := []struct {
+		name  string
+		mtu   int // 0 for unlimited
+		size  int // Size of the file, or all of data
+		empty bool
+		opts  []ServerOpt
+
+		expectedBlocksize int
+	}{
+		{name: "ethernet", mtu: 1500, expectedBlocksize: 1468},
+		{name: "jumbo", mtu: 9000, expectedBlocksize: 8968},
+		{name: "minimum", mtu: 544, expectedBlocksize: 512},
+		{name: "unlimited", expectedBlocksize: 65464},
+		{name: "small file", mtu: 1500, size: 1000, expectedBlocksize: 1000},
+		{name: "smaller than default", mtu: 1500, size: 5, expectedBlocksize: 512},
+		{name: "empty file", mtu: 1500, empty: true, expectedBlocksize: 512},
+		{name: "server limit", opts: []ServerOpt{ServerMaxBlocksize(300)}, expectedBlocksize: 300},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := data
+			if c.size > 0 || c.empty {
+				file = data[:c.size]
+			}
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				w.Write(file)
+			}, nil, c.opts...)
+			defer close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			if c.mtu > 0 {
+				pc = &mtuPacketConn{PacketConn: pc, mtu: c.mtu}
+			}
+
+			client, err := NewClient(
+				ClientPacketConn(pc),
+				ClientReadTimeout(100*time.Millisecond),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := client.ProbeBlocksize(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != c.expectedBlocksize {
+				t.Errorf("expected blocksize %d, got %d", c.expectedBlocksize, size)
+			}
+			if _, err := NewClient(ClientBlocksize(size)); err != nil {
+				t.Errorf("expected probed blocksize to be usable, got %v", err)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+			w.WriteError(ErrCodeFileNotFound, "not found")
+		}, nil)
+		defer close()
+
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.ProbeBlocksize(fmt.Sprintf("tftp://%s:%d/file", ip, port)); !IsRemoteError(err) {
+			t.Errorf("expected remote error, got %v", err)
+		}
+	})
+}
+
+func TestClient_MaxTotalRetransmits(t *testing.T) {
+	data := getTestData(t, "text")[:8*40] // 40 blocks, about 13 dropped with resends
+
+	cases := []struct {
+		name string
+		opts []ClientOpt
+
+		expectedError error
+	}{
+		{
+			name: "unlimited",
+		},
+		{
+			name: "under limit",
+			opts: []ClientOpt{ClientMaxTotalRetransmits(20)},
+		},
+		{
+			name:          "exceeded",
+			opts:          []ClientOpt{ClientMaxTotalRetransmits(3)},
+			expectedError: ErrMaxTotalRetransmits,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				w.WriteSize(int64(len(data)))
+				w.Write(data)
+			}, nil)
+			defer close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			opts := append([]ClientOpt{
+				ClientPacketConn(&dropReadPacketConn{PacketConn: pc, dropEvery: 4}),
+				ClientBlocksize(8),
+				ClientReadTimeout(20 * time.Millisecond),
+				// Consecutive limit is never reached with periodic loss
+				ClientRetransmit(2),
+			}, c.opts...)
+			client, err := NewClient(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(resp)
+			if cause := ErrorCause(err); cause != c.expectedError {
+				t.Fatalf("expected error %v, got %v", c.expectedError, err)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Error("received data didn't match")
+			}
+		})
+	}
+}
+
+func TestClient_LossWindowCap(t *testing.T) {
+	data := getTestData(t, "text")[:8*20] // 20 blocks
+
+	cases := []struct {
+		name string
+		opts []ClientOpt
+
+		expectedMaxRun int // Largest window sent after loss stops
+	}{
+		{
+			name:           "disabled",
+			expectedMaxRun: 8,
+		},
+		{
+			name:           "enabled",
+			opts:           []ClientOpt{ClientLossWindowCap(0.2)},
+			expectedMaxRun: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var received bytes.Buffer
+			done := make(chan struct{})
+			ip, port, close := newTestServer(t, false, nil, func(r WriteRequest) {
+				received.ReadFrom(r)
+				close(done)
+			})
+			defer close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			lossy := &lossyPacketConn{PacketConn: pc, dropEvery: 3, maxDrops: 6}
+
+			opts := append([]ClientOpt{
+				ClientPacketConn(lossy),
+				ClientBlocksize(8),
+				ClientWindowsize(8),
+			}, c.opts...)
+			client, err := NewClient(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			start := time.Now()
+			if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for write handler")
+			}
+			if !bytes.Equal(received.Bytes(), data) {
+				t.Errorf("received data didn't match")
+			}
+
+			// Shortened windows are acknowledged without waiting for
+			// the server to time out
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("expected transfer to take less than 2s, took %s", elapsed)
+			}
+
+			// Windows sent once the last drop has been resent, the
+			// resent blocks aren't shortened to the cap
+			var sent, maxRun int
+			for _, run := range lossy.runs {
+				sent += run
+				if sent-run < lossy.dropEvery*lossy.maxDrops+8 {
+					continue
+				}
+				if run > maxRun {
+					maxRun = run
+				}
+			}
+			if maxRun != c.expectedMaxRun {
+				t.Errorf("expected largest window after loss to be %d, but it was %d (runs: %v)", c.expectedMaxRun, maxRun, lossy.runs)
+			}
+		})
+	}
+}
+
+func TestClient_PipelineDepth(t *testing.T) {
+	data := getTestData(t, "text")[:8*40] // 40 blocks
+
+	cases := []struct {
+		name     string
+		opts     []ClientOpt
+		maxDrops int
+
+		expectedFirstRun int // DATA sent before the first ACK is read
+	}{
+		{
+			name:             "disabled",
+			opts:             []ClientOpt{ClientWindowsize(4)},
+			expectedFirstRun: 4,
+		},
+		{
+			name:             "depth 3",
+			opts:             []ClientOpt{ClientWindowsize(4), ClientPipelineDepth(3)},
+			expectedFirstRun: 12,
+		},
+		{
+			name:             "depth 3, loss",
+			opts:             []ClientOpt{ClientWindowsize(4), ClientPipelineDepth(3)},
+			maxDrops:         4,
+			expectedFirstRun: 12,
+		},
+		{
+			name:             "depth 3, windowsize not negotiated",
+			opts:             []ClientOpt{ClientPipelineDepth(3)},
+			expectedFirstRun: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var received bytes.Buffer
+			done := make(chan struct{})
+			ip, port, close := newTestServer(t, false, nil, func(r WriteRequest) {
+				received.ReadFrom(r)
+				close(done)
+			})
+			defer close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			lossy := &lossyPacketConn{PacketConn: pc, dropEvery: 5, maxDrops: c.maxDrops}
+
+			opts := append([]ClientOpt{
+				ClientPacketConn(lossy),
+				ClientBlocksize(8),
+				ClientTimeout(1),
+			}, c.opts...)
+			client, err := NewClient(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for write handler")
+			}
+			if !bytes.Equal(received.Bytes(), data) {
+				t.Errorf("received data didn't match")
+			}
+
+			if len(lossy.runs) == 0 || lossy.runs[0] != c.expectedFirstRun {
+				t.Errorf("expected %d DATA sent before the first ACK, runs were %v", c.expectedFirstRun, lossy.runs)
+			}
+		})
+	}
+}
+
+func TestClient_BlocksizePreferences(t *testing.T) {
+	cases := []struct {
+		name      string
+		prefs     []int
+		errorCode ErrorCode // Sent in response to blocksizes over 1024
+
+		expectedRequests []string
+		expectedError    string
+	}{
+		{
+			name:      "falls back",
+			prefs:     []int{9000, 1468, 512},
+			errorCode: ErrCodeOptionNegotiation,
+
+			expectedRequests: []string{"9000", "1468", "512"},
+		},
+		{
+			name:      "first accepted",
+			prefs:     []int{1024, 512},
+			errorCode: ErrCodeOptionNegotiation,
+
+			expectedRequests: []string{"1024"},
+		},
+		{
+			name:      "all rejected",
+			prefs:     []int{9000, 1468},
+			errorCode: ErrCodeIllegalOperation,
+
+			expectedRequests: []string{"9000", "1468"},
+			expectedError:    "remote error",
+		},
+		{
+			name:      "not a rejection",
+			prefs:     []int{9000, 512},
+			errorCode: ErrCodeFileNotFound,
+
+			expectedRequests: []string{"9000"},
+			expectedError:    "remote error",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Minimal server, rejecting large blocksizes and
+			// responding to others without options
+			requests := make(chan string, 10)
+			sConn := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+				if dg.opcode() != opCodeRRQ {
+					return nil
+				}
+				blksize := dg.options()[optBlocksize]
+				requests <- blksize
+
+				var resp datagram
+				if size, _ := strconv.Atoi(blksize); size > 1024 {
+					resp.writeError(c.errorCode, "blocksize too large")
+				} else {
+					resp.writeData(1, []byte("the data"))
+				}
+				return []datagram{resp}
+			})
+			defer sConn.Close()
+
+			client, err := NewClient(ClientBlocksizePreferences(c.prefs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(sConn.url())
+			if err != nil {
+				if c.expectedError == "" || !strings.Contains(err.Error(), c.expectedError) {
+					t.Errorf("expected error %q, got %v", c.expectedError, err)
+				}
+			} else {
+				data, _ := ioutil.ReadAll(resp)
+				if string(data) != "the data" {
+					t.Errorf("expected response %q, but it was %q", "the data", data)
+				}
+			}
+
+			var got []string
+			for len(requests) > 0 {
+				got = append(got, <-requests)
+			}
+			if !reflect.DeepEqual(got, c.expectedRequests) {
+				t.Errorf("expected requested blocksizes %v, but they were %v", c.expectedRequests, got)
+			}
+		})
+	}
+}
+
+func TestClient_Negotiate(t *testing.T) {
+	cases := []struct {
+		name string
+		oack map[string]string // nil responds with DATA
+
+		expected NegotiatedOptions
+	}{
+		{
+			name: "options acknowledged",
+			oack: map[string]string{optBlocksize: "1024", optWindowSize: "4", optTransferSize: "100"},
+
+			expected: NegotiatedOptions{Blocksize: 1024, Timeout: time.Second, Windowsize: 4, Size: 100},
+		},
+		{
+			name: "options ignored",
+
+			expected: NegotiatedOptions{Blocksize: 512, Timeout: time.Second, Windowsize: 1, Size: -1},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Minimal server, responding to the request then
+			// reporting the next datagram
+			next := make(chan opcode, 1)
+			sConn := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+				if dg.opcode() != opCodeRRQ {
+					select {
+					case next <- dg.opcode():
+					default:
+					}
+					return nil
+				}
+				var resp datagram
+				if c.oack != nil {
+					resp.writeOptionAck(c.oack)
+				} else {
+					resp.writeData(1, []byte("the data"))
+				}
+				return []datagram{resp}
+			})
+			defer sConn.Close()
+
+			client, err := NewClient(ClientBlocksize(1024), ClientWindowsize(4), ClientTimeout(3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.Negotiate(sConn.url())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.expected {
+				t.Errorf("expected options %+v, but they were %+v", c.expected, got)
+			}
+
+			select {
+			case op := <-next:
+				if op != opCodeERROR {
+					t.Errorf("expected transfer to be aborted with ERROR, got %s", op)
+				}
+			case <-time.After(time.Second):
+				t.Error("timeout waiting for ERROR")
+			}
+		})
+	}
+}
+
+func TestClient_Get_unexpectedEOF(t *testing.T) {
+	cases := []struct {
+		name string
+		oack map[string]string
+
+		expectedError error
+	}{
+		{
+			name: "tsize",
+			oack: map[string]string{optBlocksize: "8", optTransferSize: "8"},
+
+			expectedError: ErrUnexpectedEOF,
+		},
+		{
+			name: "no tsize",
+			oack: map[string]string{optBlocksize: "8"},
+
+			expectedError: ErrMaxRetries,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Minimal server, sending a single full block
+			// and omitting the terminating block
+			sConn := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+				var resp datagram
+				switch {
+				case dg.opcode() == opCodeRRQ:
+					resp.writeOptionAck(c.oack)
+				case dg.opcode() == opCodeACK && dg.block() == 0:
+					resp.writeData(1, []byte("8 bytes!"))
+				default:
+					return nil
+				}
+				return []datagram{resp}
+			})
+			defer sConn.Close()
+
+			client, err := NewClient(
+				ClientBlocksize(8),
+				ClientReadTimeout(20*time.Millisecond),
+				ClientRetransmit(2),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(sConn.url())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ioutil.ReadAll(resp)
+			if cause := ErrorCause(err); cause != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestClient_Retransmit(t *testing.T) {
+	cases := []struct {
+		name       string
+		retransmit int
+
+		expectedAcks int32 // Number of times the final block is acknowledged
+	}{
+		{name: "disabled", retransmit: 0, expectedAcks: 1},
+		{name: "once", retransmit: 1, expectedAcks: 2},
+		{name: "default", retransmit: 3, expectedAcks: 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Minimal server, sending a single full block and
+			// then going silent as if the next was lost
+			var acks int32
+			failed := make(chan struct{})
+			var failedOnce sync.Once
+			sConn := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+				var resp datagram
+				switch {
+				case dg.opcode() == opCodeRRQ:
+					resp.writeOptionAck(map[string]string{optBlocksize: "8"})
+				case dg.opcode() == opCodeACK && dg.block() == 0:
+					resp.writeData(1, []byte("8 bytes!"))
+				case dg.opcode() == opCodeACK && dg.block() == 1:
+					atomic.AddInt32(&acks, 1)
+					return nil
+				case dg.opcode() == opCodeERROR:
+					failedOnce.Do(func() { close(failed) })
+					return nil
+				default:
+					return nil
+				}
+				return []datagram{resp}
+			})
+			defer sConn.Close()
+
+			client, err := NewClient(
+				ClientBlocksize(8),
+				ClientReadTimeout(20*time.Millisecond),
+				ClientRetransmit(c.retransmit),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(sConn.url())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ioutil.ReadAll(resp)
+			if cause := ErrorCause(err); cause != ErrMaxRetries {
+				t.Errorf("expected error %v, got %v", ErrMaxRetries, err)
+			}
+
+			select {
+			case <-failed:
+			case <-time.After(time.Second):
+				t.Fatal("server didn't receive ERROR")
+			}
+			if n := atomic.LoadInt32(&acks); n != c.expectedAcks {
+				t.Errorf("expected block 1 to be acknowledged %d times, got %d", c.expectedAcks, n)
+			}
+		})
+	}
+
+	t.Run("reliable link", func(t *testing.T) {
+		text := getTestData(t, "text")
+		ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+			w.Write(text)
+		}, func(w WriteRequest) {
+			ioutil.ReadAll(w)
+		})
+		defer close()
+
+		client, err := NewClient(ClientRetransmit(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, text) {
+			t.Error("received data didn't match")
+		}
+		if err := client.Put(url, bytes.NewReader(text), int64(len(text))); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestClient_Broadcast(t *testing.T) {
+	s, err := NewServer("0.0.0.0:0") // Broadcasts aren't received by sockets bound to a unicast address
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}))
+	sAddr := serveTestServer(s)
+	defer s.Close()
+
+	client, err := NewClient(ClientBroadcast(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Loopback broadcast address
+	resp, err := client.Get(fmt.Sprintf("tftp://127.255.255.255:%d/file", sAddr.Port))
+	if err != nil {
+		t.Skipf("loopback broadcast not supported: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "the data" {
+		t.Errorf("expected response %q, but it was %q", "the data", data)
+	}
+}
+
+func TestClient_Get_unexpectedTID(t *testing.T) {
+	other := newFakePeer(t, nil)
+	defer other.Close()
+
+	// Minimal server, with a second server also
+	// sending DATA once the transfer starts
+	server := newFakePeer(t, func(dg *datagram, addr net.Addr) []datagram {
+		var resp datagram
+		switch {
+		case dg.opcode() == opCodeRRQ:
+			resp.writeOptionAck(options{optBlocksize: "8"})
+		case dg.opcode() == opCodeACK && dg.block() == 0:
+			resp.writeData(1, []byte("8 bytes!"))
+		case dg.opcode() == opCodeACK && dg.block() == 1:
+			var bad datagram
+			bad.writeData(2, []byte("bad"))
+			other.WriteTo(bad.bytes(), addr)
+			time.Sleep(10 * time.Millisecond)
+			resp.writeData(2, []byte("ok"))
+		default:
+			return nil
+		}
+		return []datagram{resp}
+	})
+	defer server.Close()
+
+	client, err := NewClient(ClientBlocksize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "8 bytes!ok" {
+		t.Errorf("expected response %q, but it was %q", "8 bytes!ok", data)
+	}
+
+	// Other server was sent an error
+	if dg, _ := other.read(time.Second); dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeUnknownTransferID {
+		t.Errorf("expected Unknown TID error, got %s", dg)
+	}
+}
+
+func TestClient_Stream(t *testing.T) {
+	errCallback := errors.New("callback failed")
+	block := bytes.Repeat([]byte("x"), 512)
+
+	cases := []struct {
+		name    string
+		endless bool              // Server writes until the transfer fails
+		fn      func(n int) error // Called with the number of each block from 1
+
+		expectedBlocks int
+		expectedError  error
+	}{
+		{
+			name: "to end",
+			fn:   func(int) error { return nil },
+
+			expectedBlocks: 4,
+		},
+		{
+			name:    "stopped",
+			endless: true,
+			fn: func(n int) error {
+				if n == 5 {
+					return ErrStopStream
+				}
+				return nil
+			},
+
+			expectedBlocks: 5,
+		},
+		{
+			name:    "callback error",
+			endless: true,
+			fn: func(n int) error {
+				if n == 2 {
+					return errCallback
+				}
+				return nil
+			},
+
+			expectedBlocks: 2,
+			expectedError:  errCallback,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			handlerErr := make(chan error, 1)
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				if !c.endless {
+					w.Write(bytes.Repeat(block, 3))
+					w.Write([]byte("end"))
+					handlerErr <- nil
+					return
+				}
+				for {
+					if _, err := w.Write(block); err != nil {
+						handlerErr <- err
+						return
+					}
+				}
+			}, nil)
+			defer close()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blocks int
+			err = client.Stream(fmt.Sprintf("tftp://%s:%d/file", ip, port), func(p []byte) error {
+				blocks++
+				if blocks <= 3 && !bytes.Equal(p, block) {
+					t.Errorf("expected block %d to be %d bytes of data, got %q", blocks, len(block), p)
+				}
+				return c.fn(blocks)
+			})
+
+			if ErrorCause(err) != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			}
+			if blocks != c.expectedBlocks {
+				t.Errorf("expected %d blocks, got %d", c.expectedBlocks, blocks)
+			}
+			select {
+			case err := <-handlerErr:
+				if c.endless && !IsRemoteError(err) {
+					t.Errorf("expected the handler to receive the client's error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler didn't return")
+			}
+		})
+	}
+}
+
+func TestClient_ValidateOACK(t *testing.T) {
+	errTooSmall := errors.New("blocksize too small")
+	validate := func(no NegotiatedOptions) error {
+		if no.Blocksize < 1024 {
+			return errTooSmall
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name string
+		put  bool
+		oack options // Sent in response to requests, nil to respond without options
+
+		expectedError error
+	}{
+		{name: "get, accepted", oack: options{optBlocksize: "1468"}},
+		{name: "put, accepted", put: true, oack: options{optBlocksize: "1468"}},
+		{name: "get, downgraded", oack: options{optBlocksize: "512"}, expectedError: errTooSmall},
+		{name: "put, downgraded", put: true, oack: options{optBlocksize: "512"}, expectedError: errTooSmall},
+		{name: "get, no options", expectedError: errTooSmall},
+		{name: "put, no options", put: true, expectedError: errTooSmall},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Stub server responding to the request, then reporting
+			// the client's next datagram
+			next := make(chan datagram, 1)
+			var requested bool
+			stub := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+				if requested {
+					select {
+					case next <- datagram{buf: append([]byte(nil), dg.bytes()...), offset: dg.offset}:
+					default:
+					}
+					return nil
+				}
+				requested = true
+				var resp datagram
+				switch {
+				case c.oack != nil:
+					resp.writeOptionAck(c.oack)
+				case dg.opcode() == opCodeRRQ:
+					resp.writeData(1, []byte("short"))
+				default:
+					resp.writeAck(0)
+				}
+				return []datagram{resp}
+			})
+			defer stub.Close()
+
+			// Accepted puts fail quickly once the stub stops responding
+			client, err := NewClient(ClientBlocksize(1468), ClientValidateOACK(validate), ClientRetransmit(0), ClientReadTimeout(50*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := stub.url()
+			if c.put {
+				err = client.Put(url, strings.NewReader("short"), 5)
+			} else {
+				_, err = client.Get(url)
+			}
+
+			if c.expectedError == nil {
+				if dg := <-next; dg.opcode() == opCodeERROR {
+					t.Errorf("expected options to be accepted, got %s", dg)
+				}
+				return
+			}
+			if ErrorCause(err) != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			}
+			if dg := <-next; dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeOptionNegotiation {
+				t.Errorf("expected Option Negotiation error, got %s", dg)
+			}
+		})
+	}
+}
+
+func TestClient_VerifyServerIP(t *testing.T) {
+	cases := []struct {
+		name    string
+		verify  bool
+		genuine bool // Whether the server responds after the spoofed response
+
+		expectedData  string
+		expectedError error
+	}{
+		{name: "spoof discarded", verify: true, genuine: true, expectedData: "genuine"},
+		{name: "only spoofed", verify: true, expectedError: ErrUnexpectedServerIP},
+		{name: "disabled", genuine: true, expectedData: "spoofed"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Another loopback IP, on the same port so only the IP differs
+			spoof, err := listenFakePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, nil)
+			if err != nil {
+				t.Skipf("unable to listen on a second loopback IP: %v", err)
+			}
+			defer spoof.Close()
+
+			// Minimal server without options, with the spoofed
+			// DATA arriving first
+			server, err := listenFakePeer(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: spoof.LocalAddr().(*net.UDPAddr).Port}, func(dg *datagram, addr net.Addr) []datagram {
+				if dg.opcode() != opCodeRRQ {
+					return nil
+				}
+				var resp datagram
+				resp.writeData(1, []byte("spoofed"))
+				spoof.WriteTo(resp.bytes(), addr)
+				if !c.genuine {
+					return nil
+				}
+				time.Sleep(10 * time.Millisecond)
+				resp.writeData(1, []byte("genuine"))
+				return []datagram{resp}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			client, err := NewClient(ClientVerifyServerIP(c.verify), ClientRetransmit(1), ClientReadTimeout(100*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var data []byte
+			resp, err := client.Get(server.url())
+			if err == nil {
+				data, err = ioutil.ReadAll(resp)
+			}
+			if ErrorCause(err) != c.expectedError {
+				t.Fatalf("expected error %v, got %v", c.expectedError, err)
+			}
+			if string(data) != c.expectedData {
+				t.Errorf("expected response %q, but it was %q", c.expectedData, data)
+			}
+		})
+	}
+}
+
+func TestClient_Flush(t *testing.T) {
+	lines := []string{"line 1\n", "line 2\n", strings.Repeat("x", 600) + "\n"}
+
+	cases := []struct {
+		name string
+		opts []ClientOpt
+
+		expectedFlushError error
+	}{
+		{
+			name: "negotiated",
+			opts: []ClientOpt{ClientFlush(true)},
+		},
+		{
+			name: "negotiated, windowsize 4",
+			opts: []ClientOpt{ClientFlush(true), ClientWindowsize(4)},
+		},
+		{
+			name: "not requested",
+
+			expectedFlushError: ErrFlushNotNegotiated,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			next := make(chan struct{})
+			flushErrs := make(chan error, len(lines))
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				for _, line := range lines {
+					w.Write([]byte(line))
+					flushErrs <- Flush(w)
+					if c.expectedFlushError == nil {
+						<-next // Wait for client to receive the line
+					}
+				}
+			}, nil)
+			defer close()
+
+			client, err := NewClient(c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.expectedFlushError != nil {
+				data, err := ioutil.ReadAll(resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != strings.Join(lines, "") {
+					t.Errorf("expected response %q, but it was %q", strings.Join(lines, ""), data)
+				}
+				if err := <-flushErrs; err != c.expectedFlushError {
+					t.Errorf("expected Flush error %v, got %v", c.expectedFlushError, err)
+				}
+				return
+			}
+
+			// Each line is received before the next is written
+			r := bufio.NewReader(resp)
+			for _, line := range lines {
+				got, err := r.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != line {
+					t.Errorf("expected line %q, but it was %q", line, got)
+				}
+				if err := <-flushErrs; err != nil {
+					t.Errorf("Flush: %v", err)
+				}
+				next <- struct{}{}
+			}
+			if _, err := r.ReadByte(); err != io.EOF {
+				t.Errorf("expected EOF after final line, got %v", err)
+			}
+		})
+	}
+}
+
+// failingPacketConn fails every write with err.
+type failingPacketConn struct {
+	net.PacketConn
+	err error
+}
+
+func (c *failingPacketConn) WriteTo([]byte, net.Addr) (int, error) {
+	return 0, c.err
+}
+
+func TestClient_NetworkError(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	writeErr := &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", syscall.ENOBUFS)}
+	client, err := NewClient(ClientPacketConn(&failingPacketConn{PacketConn: pc, err: writeErr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Get("tftp://127.0.0.1:69/file")
+	if !IsNetworkError(err) {
+		t.Fatalf("expected network error, got %v", err)
+	}
+	if IsRemoteError(err) {
+		t.Error("expected network error not to be a remote error")
+	}
+	nErr := ErrorCause(err).(*NetworkError)
+	if nErr.Op != "write" || nErr.Err != writeErr {
+		t.Errorf("expected write error %v, got %s error %v", writeErr, nErr.Op, nErr.Err)
+	}
+	if nErr.Timeout() {
+		t.Error("expected write error not to be a timeout")
+	}
+
+	// Remote errors are not network errors
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteError(ErrCodeFileNotFound, "not found")
+	}, nil)
+	defer close()
+
+	client, err = NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+	if IsNetworkError(err) || !IsRemoteError(err) {
+		t.Errorf("expected remote error, got %v", err)
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}, func(r WriteRequest) {
+		ioutil.ReadAll(r)
+	})
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := client.Close(); err != nil {
+			t.Errorf("close %d: expected no error, got %v", i+1, err)
+		}
+	}
+
+	// Transfer in progress is unaffected
+	if data, err := ioutil.ReadAll(resp); err != nil || string(data) != "the data" {
+		t.Errorf("expected in progress transfer to complete, got %q, %v", data, err)
+	}
+
+	if _, err := client.Get(url); err != ErrClientClosed {
+		t.Errorf("expected Get error %v, got %v", ErrClientClosed, err)
+	}
+	if err := client.Put(url, strings.NewReader("data"), 4); err != ErrClientClosed {
+		t.Errorf("expected Put error %v, got %v", ErrClientClosed, err)
+	}
+	if _, err := client.GetAll(fmt.Sprintf("%s:%d", ip, port), []string{"file"}, "unused"); err != ErrClientClosed {
+		t.Errorf("expected GetAll error %v, got %v", ErrClientClosed, err)
+	}
+}
+
+func TestClient_Put_transientTimeout(t *testing.T) {
+	// Server responds to the request and DATA after the client's
+	// read timeout has expired twice
+	const delay = 120 * time.Millisecond
+	received := make(chan []byte, 1)
+	sConn := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+		var ack datagram
+		switch dg.opcode() {
+		case opCodeWRQ:
+			ack.writeAck(0)
+		case opCodeDATA:
+			received <- append([]byte(nil), dg.data()...)
+			ack.writeAck(dg.block())
+		default:
+			return nil
+		}
+		time.Sleep(delay)
+		return []datagram{ack}
+	})
+	defer sConn.Close()
+
+	client, err := NewClient(ClientReadTimeout(50*time.Millisecond), ClientTransferSize(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(sConn.url(), strings.NewReader("the data"), 8); err != nil {
+		t.Fatalf("expected transfer to complete after timeouts, got %v", err)
+	}
+
+	if data := <-received; string(data) != "the data" {
+		t.Errorf("expected server to receive %q, but it was %q", "the data", data)
+	}
+}
+
+func TestClient_VerifyWriteback(t *testing.T) {
+	data := []byte(strings.Repeat("the data ", 100))
+
+	cases := []struct {
+		name    string
+		corrupt bool
+
+		expectedError error
+	}{
+		{
+			name: "match",
+		},
+		{
+			name:    "corrupted",
+			corrupt: true,
+
+			expectedError: ErrVerifyMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var stored []byte
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				mu.Lock()
+				defer mu.Unlock()
+				w.Write(stored)
+			}, func(r WriteRequest) {
+				b, _ := ioutil.ReadAll(r)
+				if c.corrupt {
+					b[len(b)/2] ^= 0xff
+				}
+				mu.Lock()
+				stored = b
+				mu.Unlock()
+			})
+			defer close()
+
+			client, err := NewClient(ClientVerifyWriteback(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			err = client.Put(url, bytes.NewReader(data), int64(len(data)))
+			if ErrorCause(err) != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestClient_Get_duplicateOACK(t *testing.T) {
+	// Minimal server which doesn't receive the first ACK 0 and resends the OACK
+	acks := make(chan uint16, 10)
+	var zeroAcks int
+	server := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+		var resp datagram
+		switch {
+		case dg.opcode() == opCodeRRQ:
+			resp.writeOptionAck(options{optTransferSize: "8"})
+		case dg.opcode() == opCodeACK && dg.block() == 0:
+			acks <- 0
+			if zeroAcks++; zeroAcks == 1 {
+				resp.writeOptionAck(options{optTransferSize: "8"})
+			} else {
+				resp.writeData(1, []byte("the data"))
+			}
+		case dg.opcode() == opCodeACK:
+			acks <- dg.block()
+			return nil
+		default:
+			return nil
+		}
+		return []datagram{resp}
+	})
+	defer server.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "the data" {
+		t.Errorf("expected response %q, but it was %q", "the data", data)
+	}
+
+	// ACK 0 was resent in response to the duplicate OACK
+	for _, expected := range []uint16{0, 0, 1} {
+		select {
+		case block := <-acks:
+			if block != expected {
+				t.Errorf("expected ACK %d, got ACK %d", expected, block)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for ACK %d", expected)
+		}
+	}
+}
+
+func TestClient_Put_duplicateOACK(t *testing.T) {
+	// Minimal server which doesn't receive the first DATA and resends the OACK
+	blocks := make(chan uint16, 10)
+	var dataCount int
+	server := newFakePeer(t, func(dg *datagram, _ net.Addr) []datagram {
+		var resp datagram
+		switch dg.opcode() {
+		case opCodeWRQ:
+			resp.writeOptionAck(options{optTransferSize: "8"})
+		case opCodeDATA:
+			blocks <- dg.block()
+			if dataCount++; dataCount == 1 {
+				resp.writeOptionAck(options{optTransferSize: "8"})
+			} else {
+				resp.writeAck(dg.block())
+			}
+		default:
+			return nil
+		}
+		return []datagram{resp}
+	})
+	defer server.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Put(server.url(), strings.NewReader("the data"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DATA 1 was resent in response to the duplicate OACK
+	for _, expected := range []uint16{1, 1} {
+		select {
+		case block := <-blocks:
+			if block != expected {
+				t.Errorf("expected DATA %d, got DATA %d", expected, block)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for DATA %d", expected)
+		}
+	}
+}
+
+func TestClient_RetryOnServerError(t *testing.T) {
+	cases := []struct {
+		name     string
+		codes    []ErrorCode
+		attempts int
+
+		expectedRequests int32
+		expectedError    bool
+	}{
+		{
+			name:     "busy twice, then success",
+			codes:    []ErrorCode{ErrCodeNotDefined},
+			attempts: 2,
+
+			expectedRequests: 3,
+		},
+		{
+			name:     "attempts exhausted",
+			codes:    []ErrorCode{ErrCodeNotDefined},
+			attempts: 1,
+
+			expectedRequests: 2,
+			expectedError:    true,
+		},
+		{
+			name:     "code not listed",
+			codes:    []ErrorCode{ErrCodeDiskFull},
+			attempts: 2,
+
+			expectedRequests: 1,
+			expectedError:    true,
+		},
+		{
+			name: "default, no retry",
+
+			expectedRequests: 1,
+			expectedError:    true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var requests int32
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				if atomic.AddInt32(&requests, 1) <= 2 {
+					w.WriteError(ErrCodeNotDefined, "server busy")
+					return
+				}
+				w.Write([]byte("the data"))
+			}, nil)
+			defer close()
+
+			var opts []ClientOpt
+			if c.codes != nil {
+				opts = append(opts, ClientRetryOnServerError(c.codes, c.attempts, 10*time.Millisecond))
+			}
+			client, err := NewClient(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if c.expectedError {
+				if !IsRemoteError(err) {
+					t.Errorf("expected remote error, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != "the data" {
+					t.Errorf("expected response %q, but it was %q", "the data", data)
+				}
+			}
+
+			if r := atomic.LoadInt32(&requests); r != c.expectedRequests {
+				t.Errorf("expected %d requests, but there were %d", c.expectedRequests, r)
+			}
+		})
+	}
+}
+
+func TestClient_InitialBlock(t *testing.T) {
+	data := getTestData(t, "text")
+
+	cases := []struct {
+		name  string
+		block uint16
+		opts  []ClientOpt
+	}{
+		{
+			name:  "0",
+			block: 0,
+		},
+		{
+			name:  "0, options",
+			block: 0,
+			opts:  []ClientOpt{ClientBlocksize(1000), ClientWindowsize(3)},
+		},
+		{
+			name:  "65535",
+			block: 65535,
+			opts:  []ClientOpt{ClientWindowsize(2)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var written bytes.Buffer
+			writeDone := make(chan struct{})
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(data)
+			}), WriteHandlerFunc(func(r WriteRequest) {
+				defer close(writeDone)
+				io.Copy(&written, r)
+			}), ServerInitialBlock(c.block))
+			defer s.Close()
+			url := fmt.Sprintf("tftp://%s/file", addr)
+
+			client, err := NewClient(append(c.opts, ClientInitialBlock(c.block))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Get
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("expected Get to receive %d bytes, received %d bytes that don't match", len(data), len(received))
+			}
+
+			// Put
+			if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+			<-writeDone
+			if !bytes.Equal(written.Bytes(), data) {
+				t.Errorf("expected Put to write %d bytes, wrote %d bytes that don't match", len(data), written.Len())
+			}
+
+			// First DATA block on the wire
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+			var req datagram
+			req.writeReadReq("file", ModeOctet, nil)
+			cConn.send(req, addr)
+			dg, tAddr := cConn.read(time.Second)
+			if dg.opcode() != opCodeDATA || dg.block() != c.block {
+				t.Errorf("expected DATA block %d, got %s", c.block, dg)
+			}
+			dg.writeError(ErrCodeNotDefined, "done")
+			cConn.send(*dg, tAddr)
+		})
+	}
+}
+
+func TestClient_Compress(t *testing.T) {
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name           string
+		serverCompress bool
+		mode           TransferMode
+
+		expectedCompressed bool
+	}{
+		{
+			name:           "compressed",
+			serverCompress: true,
+			mode:           ModeOctet,
+
+			expectedCompressed: true,
+		},
+		{
+			name: "server not enabled",
+			mode: ModeOctet,
+		},
+		{
+			name:           "netascii",
+			serverCompress: true,
+			mode:           ModeNetASCII,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 2)
+			var written bytes.Buffer
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.WriteSize(int64(len(text)))
+				w.Write(text)
+			}), WriteHandlerFunc(func(r WriteRequest) {
+				io.Copy(&written, r)
+			}),
+				ServerCompress(c.serverCompress),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+			)
+			defer s.Close()
+			url := fmt.Sprintf("tftp://%s/file", addr)
+
+			client, err := NewClient(ClientCompress(true), ClientMode(c.mode), ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBytes := func(op string, n int) {
+				var info TransferInfo
+				select {
+				case info = <-infos:
+				case <-time.After(3 * time.Second):
+					t.Fatal("timeout waiting for transfer hook")
+				}
+				if info.Err != nil {
+					t.Errorf("%s: transfer failed: %v", op, info.Err)
+				}
+				t.Logf("%s: %d bytes sent as %d", op, n, info.Bytes)
+				if compressed := info.Bytes < int64(n); compressed != c.expectedCompressed {
+					t.Errorf("%s: expected compressed %t, but %d bytes were sent as %d", op, c.expectedCompressed, n, info.Bytes)
+				}
+			}
+
+			// Get
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size, err := resp.Size(); err != nil || size != int64(len(text)) {
+				t.Errorf("expected size %d, got %d (%v)", len(text), size, err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBytes("Get", len(text))
+			if !bytes.Equal(received, text) {
+				t.Errorf("expected Get to receive %d bytes, received %d bytes that don't match", len(text), len(received))
+			}
+
+			// Put
+			if err := client.Put(url, bytes.NewReader(text), int64(len(text))); err != nil {
+				t.Fatal(err)
+			}
+			checkBytes("Put", len(text))
+			if !bytes.Equal(written.Bytes(), text) {
+				t.Errorf("expected Put to write %d bytes, wrote %d bytes that don't match", len(text), written.Len())
+			}
+		})
+	}
+}
+
+func TestClient_FollowRedirect(t *testing.T) {
+	data := getTestData(t, "text")
+
+	targetIP, targetPort, closeTarget := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(data)
+	}, func(w WriteRequest) {
+		ioutil.ReadAll(w)
+	})
+	defer closeTarget()
+	target := fmt.Sprintf("redirect=%s:%d", targetIP, targetPort)
+
+	cases := []struct {
+		name   string
+		follow bool
+		put    bool
+		msg    string // ERROR sent in response to requests, empty to redirect to itself
+
+		expectRemoteError bool
+		expectedError     error
+	}{
+		{name: "get", follow: true, msg: target},
+		{name: "put", follow: true, put: true, msg: target},
+		{name: "not followed", msg: target, expectRemoteError: true},
+		{name: "other error", follow: true, msg: "redirect to " + targetIP, expectRemoteError: true},
+		{name: "loop", follow: true, expectedError: ErrTooManyRedirects},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Stub server responding to every request with an ERROR
+			stub := newFakePeer(t, nil)
+			defer stub.Close()
+			msg := c.msg
+			if msg == "" {
+				msg = redirectPrefix + stub.LocalAddr().String()
+			}
+			stub.serve(func(*datagram, net.Addr) []datagram {
+				var resp datagram
+				resp.writeError(ErrCodeNotDefined, msg)
+				return []datagram{resp}
+			})
+
+			client, err := NewClient(ClientFollowRedirect(c.follow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := stub.url()
+			var got []byte
+			if c.put {
+				err = client.Put(url, bytes.NewReader(data), int64(len(data)))
+			} else {
+				var resp *Response
+				if resp, err = client.Get(url); err == nil {
+					got, err = ioutil.ReadAll(resp)
+				}
+			}
+
+			switch {
+			case c.expectRemoteError:
+				if !IsRemoteError(err) {
+					t.Errorf("expected remote error, got %v", err)
+				}
+			case ErrorCause(err) != c.expectedError:
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			case !c.put && err == nil && !bytes.Equal(got, data):
+				t.Error("received data didn't match")
+			}
+		})
+	}
+}
+
+func TestClient_IfNotMatch(t *testing.T) {
+	data := getTestData(t, "text")
+
+	etagErrs := make(chan error, 1)
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		err := WriteETag(w, "v2")
+		etagErrs <- err
+		if err != nil {
+			return
+		}
+		w.Write(data)
+	}, nil)
+	defer close()
+
+	cases := []struct {
+		name string
+		etag string
+
+		expectedError error
+	}{
+		{name: "match", etag: "v2", expectedError: ErrNotModified},
+		{name: "mismatch", etag: "v1"},
+		{name: "none"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewClient(ClientIfNotMatch(c.etag))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []byte
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if err == nil {
+				got, err = ioutil.ReadAll(resp)
+			}
+			if ErrorCause(err) != c.expectedError {
+				t.Fatalf("expected error %v, got %v", c.expectedError, err)
+			}
+			if etagErr := <-etagErrs; etagErr != c.expectedError {
+				t.Errorf("expected WriteETag to return %v, got %v", c.expectedError, etagErr)
+			}
+			if c.expectedError == nil && !bytes.Equal(got, data) {
+				t.Errorf("expected %d bytes, got %d bytes that don't match", len(data), len(got))
+			}
+		})
+	}
+
+	if _, err := NewClient(ClientIfNotMatch("v\x00")); err != ErrInvalidETag {
+		t.Errorf("expected %v for ETag with NUL, got %v", ErrInvalidETag, err)
+	}
+}
+
+func TestClient_GetFile_PutFile(t *testing.T) {
+	data := getTestData(t, "1MB-random")
+
+	received := make(chan []byte, 1)
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		w.Write(data)
+	}, func(w WriteRequest) {
+		if size, err := w.Size(); err != nil || size != int64(len(data)) {
+			t.Errorf("expected tsize %d, got %d (%v)", len(data), size, err)
+		}
+		got, _ := ioutil.ReadAll(w)
+		received <- got
+	})
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	client, err := NewClient(ClientBlocksize(1468), ClientWindowsize(4), ClientTransferSize(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := client.GetFile(url, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("expected GetFile to write %d bytes, wrote %d", len(data), n)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected file to contain %d bytes received, got %d bytes that don't match", len(data), len(got))
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PutFile(url, f); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("expected PutFile to send %d bytes, server received %d bytes that don't match", len(data), len(got))
+	}
+}
+
+func TestClient_PutFile_tsizeNotShared(t *testing.T) {
+	data := getTestData(t, "text")
+
+	sizes := make(chan int64, 2)
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		w.Write(data)
+	}, func(w WriteRequest) {
+		size, err := w.Size()
+		if err != nil {
+			size = -1
+		}
+		ioutil.ReadAll(w)
+		sizes <- size
+	})
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty, err := os.Create(filepath.Join(dir, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+
+	client, err := NewClient(ClientTransferSize(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a size, tsize is omitted from this request only
+	if err := client.PutFile(url, empty); err != nil {
+		t.Fatal(err)
+	}
+	if size := <-sizes; size != -1 {
+		t.Errorf("expected no tsize for empty file, got %d", size)
+	}
+
+	if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if size := <-sizes; size != int64(len(data)) {
+		t.Errorf("expected tsize %d after PutFile of an empty file, got %d", len(data), size)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := resp.Size(); err != nil || size != int64(len(data)) {
+		t.Errorf("expected Get to receive tsize %d, got %d (%v)", len(data), size, err)
+	}
+	if _, err := ioutil.ReadAll(resp); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import "time"
+
+// clock provides the time functions used by conn, allowing tests
+// to control timeouts and retransmissions.
+//
+// Deadlines set on the network connection are derived from Now, a
+// net.PacketConn used with a fake clock must compare against it.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	Sleep(d time.Duration)
+}
+
+// timer is the subset of *time.Timer used by conn.
+type timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// realClock implements clock with the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
@@ -0,0 +1,267 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock advanced manually by tests.
+//
+// It starts at the current time so that network deadlines derived from it
+// don't expire immediately, but reads from the network are still timed in
+// real time. It's intended for single port mode transfers, which use timers.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	slept  []time.Duration
+
+	armed chan struct{} // Receives when a timer is started or reset
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Now(),
+		armed: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	t.Reset(d)
+	return t
+}
+
+// Sleep records d and advances the clock without blocking.
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.slept = append(c.slept, d)
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+// Advance moves the clock forward by d, firing expired timers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.active = false
+			t.c <- c.now
+		}
+	}
+}
+
+// waitArmed blocks until a timer is started or reset.
+func (c *fakeClock) waitArmed(t *testing.T) {
+	select {
+	case <-c.armed:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for timer")
+	}
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	t.clock.mu.Unlock()
+	t.clock.armed <- struct{}{}
+	return wasActive
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func TestConn_readData_fakeClock(t *testing.T) {
+	cAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 54321}
+	cNetConn, err := net.ListenUDP("udp4", cAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cNetConn.Close()
+	sNetConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sNetConn.Close()
+
+	clk := newFakeClock()
+	start := clk.Now()
+	tConn := newSinglePortConn(cAddr, ModeOctet, sNetConn, make(chan []byte, 1))
+	tConn.clock = clk
+	tConn.retransmit = 3
+	tConn.retryInterval = 50 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for state := tConn.readData; state != nil; {
+			state = state()
+		}
+	}()
+
+	// Each timeout resends the ACK
+	dg := datagram{buf: make([]byte, 516)}
+	for i := 0; i < 3; i++ {
+		clk.waitArmed(t)
+		clk.Advance(time.Second)
+
+		cNetConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := cNetConn.ReadFrom(dg.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dg.offset = n
+		if dg.opcode() != opCodeACK || dg.block() != 0 {
+			t.Fatalf("expected ACK 0 after timeout %d, got %s", i+1, dg)
+		}
+	}
+	// The last retransmission is given a timeout to be answered
+	clk.waitArmed(t)
+	clk.Advance(time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for readData")
+	}
+	if ErrorCause(tConn.err) != ErrMaxRetries {
+		t.Errorf("expected error %v, got %v", ErrMaxRetries, tConn.err)
+	}
+	if tConn.stats.Retransmits != 3 {
+		t.Errorf("expected 3 retransmits, but it was %d", tConn.stats.Retransmits)
+	}
+	expectedSleeps := []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	if !reflect.DeepEqual(clk.slept, expectedSleeps) {
+		t.Errorf("expected retry interval sleeps %v, but they were %v", expectedSleeps, clk.slept)
+	}
+	if elapsed, expected := clk.Now().Sub(start), 4*time.Second+3*50*time.Millisecond; elapsed != expected {
+		t.Errorf("expected %s to elapse, but it was %s", expected, elapsed)
+	}
+}
+
+func TestServer_fakeClock(t *testing.T) {
+	clk := newFakeClock()
+	infos := make(chan TransferInfo, 1)
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}), nil,
+		ServerSinglePort(true),
+		ServerRetransmit(2),
+		ServerTransferHook(func(info TransferInfo) { infos <- info }),
+		serverClock(clk),
+	)
+	defer s.Close()
+
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	// Request without options and never ACK the DATA
+	var req datagram
+	req.writeReadReq("file", ModeOctet, nil)
+	cConn.send(req, sAddr)
+
+	// The first wait and one for each retransmission
+	for i := 0; i < 3; i++ {
+		clk.waitArmed(t)
+		select {
+		case info := <-infos:
+			t.Fatalf("expected transfer to wait for timeout %d, it ended with %v", i+1, info.Err)
+		default:
+		}
+		clk.Advance(time.Second)
+	}
+
+	select {
+	case info := <-infos:
+		if ErrorCause(info.Err) != ErrMaxRetries {
+			t.Errorf("expected error %v, got %v", ErrMaxRetries, info.Err)
+		}
+		if info.Duration != 3*time.Second {
+			t.Errorf("expected transfer duration %s, but it was %s", 3*time.Second, info.Duration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for transfer to end")
+	}
+}
+
+func TestServer_fakeClock_utimeout(t *testing.T) {
+	clk := newFakeClock()
+	infos := make(chan TransferInfo, 1)
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}), nil,
+		ServerSinglePort(true),
+		ServerRetransmit(3),
+		ServerTransferHook(func(info TransferInfo) { infos <- info }),
+		serverClock(clk),
+	)
+	defer s.Close()
+
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	// utimeout takes precedence over timeout, never ACK the OACK
+	var req datagram
+	req.writeReadReq("file", ModeOctet, map[string]string{optTimeout: "5", optUTimeout: "50000"})
+	cConn.send(req, sAddr)
+	dg, _ := cConn.read(time.Second)
+	if dg.opcode() != opCodeOACK {
+		t.Fatalf("expected OACK, got %s", dg)
+	}
+	expected := options{optTimeout: "5", optUTimeout: "50000"}
+	if opts := dg.options(); !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected OACK options %v, got %v", expected, opts)
+	}
+
+	// Each wait for the ACK times out after 50ms
+	for i := 0; i < 4; i++ {
+		clk.waitArmed(t)
+		clk.Advance(50 * time.Millisecond)
+	}
+
+	select {
+	case info := <-infos:
+		if ErrorCause(info.Err) != ErrMaxRetries {
+			t.Errorf("expected error %v, got %v", ErrMaxRetries, info.Err)
+		}
+		if expected := 200 * time.Millisecond; info.Duration != expected {
+			t.Errorf("expected transfer duration %s, but it was %s", expected, info.Duration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for transfer to end")
+	}
+}
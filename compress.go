@@ -0,0 +1,38 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+// ConditionalCompressReadHandler wraps inner, accepting the non-standard
+// compress option (see ClientCompress) for the files match reports true
+// for, such as large text files by extension. Those are gzip compressed on
+// the wire to clients which requested compression, inner writes them
+// uncompressed. Other files, and clients which didn't request compression,
+// are sent as is. Unlike ServerCompress, which accepts compression for
+// every transfer, this avoids compressing data which won't shrink.
+//
+// Middleware wrapping the ReadRequest before it reaches this handler must
+// implement Unwrap (see ReadRequest), otherwise files aren't compressed
+// and an error is logged. As with ServerCompress, only octet mode
+// transfers are compressed: text files requested in netascii mode are sent
+// netascii encoded and uncompressed.
+func ConditionalCompressReadHandler(inner ReadHandler, match func(name string) bool) ReadHandler {
+	l := newLogger("compress")
+	return ReadHandlerFunc(func(w ReadRequest) {
+		if match(w.Name()) && !unwrapRead(w, acceptCompress) {
+			l.err("Can't accept compress for %q, ReadRequest is wrapped without Unwrap", w.Name())
+		}
+		inner.ServeTFTP(w)
+	})
+}
+
+// acceptCompress accepts compression for the transfer if w is the
+// server's request, reporting whether it was.
+func acceptCompress(w ReadRequest) bool {
+	cw, ok := w.(interface{ acceptCompress() })
+	if ok {
+		cw.acceptCompress()
+	}
+	return ok
+}
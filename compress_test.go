@@ -0,0 +1,121 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"pack.ag/tftp/netascii"
+)
+
+func TestConditionalCompressReadHandler(t *testing.T) {
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name           string
+		file           string
+		clientCompress bool
+		mode           TransferMode
+		cached         bool // Wrapped by CachingReadHandler
+
+		expectedCompressed bool
+	}{
+		{name: "matched", file: "file.txt", clientCompress: true, expectedCompressed: true},
+		{name: "matched, wrapped", file: "file.txt", clientCompress: true, cached: true, expectedCompressed: true},
+		{name: "client without compress", file: "file.txt"},
+		{name: "not matched", file: "file.bin", clientCompress: true},
+		{name: "netascii", file: "file.txt", clientCompress: true, mode: ModeNetASCII},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			isText := func(name string) bool { return strings.HasSuffix(name, ".txt") }
+			var rh ReadHandler = ConditionalCompressReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(text)
+			}), isText)
+			if c.cached {
+				rh = CachingReadHandler(rh, 1<<20, time.Minute)
+			}
+			s, addr := startTestServer(t, rh, nil, ServerTransferHook(func(info TransferInfo) { infos <- info }))
+			defer s.Close()
+
+			mode := c.mode
+			if mode == "" {
+				mode = ModeOctet
+			}
+			client, err := NewClient(ClientCompress(c.clientCompress), ClientMode(mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/%s", addr, c.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, text) {
+				t.Errorf("expected %d bytes, received %d bytes that don't match", len(text), len(received))
+			}
+
+			select {
+			case info := <-infos:
+				if compressed := info.Bytes < int64(len(text)); compressed != c.expectedCompressed {
+					t.Errorf("expected compressed %t, but %d bytes were sent as %d", c.expectedCompressed, len(text), info.Bytes)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout waiting for transfer hook")
+			}
+		})
+	}
+}
+
+func TestConditionalCompressReadHandler_netascii(t *testing.T) {
+	text := getTestData(t, "text")
+	isText := func(name string) bool { return strings.HasSuffix(name, ".txt") }
+	s, sAddr := startTestServer(t, ConditionalCompressReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write(text)
+	}), isText), nil)
+	defer s.Close()
+
+	// Clients from this package only request compress in octet mode
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+	var req datagram
+	req.writeReadReq("file.txt", ModeNetASCII, map[string]string{optBlocksize: "512", optCompress: compressGzip})
+	cConn.send(req, sAddr)
+
+	oack, tAddr := cConn.read(3 * time.Second)
+	if oack.opcode() != opCodeOACK {
+		t.Fatalf("expected OACK, got %s", oack)
+	}
+	if _, ok := oack.options()[optCompress]; ok {
+		t.Errorf("expected compress to be declined in netascii mode, OACK was %s", oack)
+	}
+
+	// The first block is the netascii encoded text, uncompressed
+	var ack datagram
+	ack.writeAck(0)
+	cConn.send(ack, tAddr)
+	dg, _ := cConn.read(3 * time.Second)
+	var encoded bytes.Buffer
+	enc := netascii.NewWriter(&encoded)
+	enc.Write(text)
+	enc.Flush()
+	if dg.opcode() != opCodeDATA || !bytes.Equal(dg.data(), encoded.Bytes()[:512]) {
+		t.Errorf("expected DATA 1 with the first 512 netascii encoded bytes, got %s", dg)
+	}
+
+	var abort datagram
+	abort.writeError(ErrCodeNotDefined, "done")
+	cConn.send(abort, tAddr)
+}
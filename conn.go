@@ -6,10 +6,12 @@ package tftp // import "pack.ag/tftp"
 
 import (
 	"bytes"
-	"errors"
+	"compress/gzip"
+	"context"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"pack.ag/tftp/netascii"
@@ -23,6 +25,17 @@ const (
 	defaultBlksize    = 512
 	defaultWindowsize = 1
 	defaultRetransmit = 10
+
+	defaultInitialBlock = 1
+
+	defaultMaxRequestSize = 4096
+	defaultMaxOptions     = 16
+	defaultMTU            = 1500
+
+	maxUTimeout = 255000000 // Microseconds, the same as the timeout option's limit
+	maxOACKSize = 512       // RFC 2347 limits datagrams carrying options to 512 octets
+	maxInFlight = 1<<15 - 1 // Most blocks pipelined, keeping block numbers comparable as serial numbers
+	maxPipeline = 16        // Most windows pipelined
 )
 
 // All connections will use these options unless overridden.
@@ -32,14 +45,18 @@ var defaultOptions = map[string]string{
 
 // newConn starts listening on a system assigned port and returns an initialized conn
 //
+// The port is the transfer's TID. It's chosen by the OS from its ephemeral
+// range, which most randomize, the package doesn't pick ports itself.
+//
 // udpNet is one of "udp", "udp4", or "udp6"
 // addr is the address of the target client or server
 func newConn(udpNet string, mode TransferMode, addr *net.UDPAddr) (*conn, error) {
 	// Start listening, an empty UDPAddr will cause the system to assign a port
-	netConn, err := net.ListenUDP(udpNet, &net.UDPAddr{})
+	netConn, err := net.ListenUDP(peerNet(udpNet, addr), &net.UDPAddr{})
 	if err != nil {
 		return nil, wrapError(err, "network listen failed")
 	}
+	setRecvErr(netConn)
 
 	c := &conn{
 		log:        newLogger(addr.String()),
@@ -50,12 +67,26 @@ func newConn(udpNet string, mode TransferMode, addr *net.UDPAddr) (*conn, error)
 		windowsize: defaultWindowsize,
 		retransmit: defaultRetransmit,
 		mode:       mode,
+		clock:      realClock{},
 	}
-	c.rx.buf = make([]byte, 4+defaultBlksize) // +4 for headers
+	c.rx.buf = getBuf(4 + defaultBlksize) // +4 for headers
 
 	return c, nil
 }
 
+// peerNet narrows the dual stack "udp" network to the address family
+// of addr, avoiding address family mismatches when replying to peers.
+// Other networks are returned unchanged.
+func peerNet(udpNet string, addr *net.UDPAddr) string {
+	if udpNet != "udp" || addr == nil || addr.IP == nil {
+		return udpNet
+	}
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
 func newSinglePortConn(addr *net.UDPAddr, mode TransferMode, netConn *net.UDPConn, reqChan chan []byte) *conn {
 	return &conn{
 		log:        newLogger(addr.String()),
@@ -65,38 +96,74 @@ func newSinglePortConn(addr *net.UDPAddr, mode TransferMode, netConn *net.UDPCon
 		windowsize: defaultWindowsize,
 		retransmit: defaultRetransmit,
 		mode:       mode,
+		clock:      realClock{},
 		buf:        make([]byte, 4+defaultBlksize), // +4 for headers
 		reqChan:    reqChan,
 		netConn:    netConn,
 	}
 }
 
+// newSharedConn returns an initialized conn using an existing netConn.
+//
+// The netConn is owned by the caller and will not be closed by the conn.
+func newSharedConn(netConn net.PacketConn, mode TransferMode, addr *net.UDPAddr) *conn {
+	c := &conn{
+		log:        newLogger(addr.String()),
+		remoteAddr: addr,
+		netConn:    netConn,
+		sharedConn: true,
+		blksize:    defaultBlksize,
+		timeout:    defaultTimeout,
+		windowsize: defaultWindowsize,
+		retransmit: defaultRetransmit,
+		mode:       mode,
+		clock:      realClock{},
+	}
+	c.rx.buf = getBuf(4 + defaultBlksize) // +4 for headers
+
+	return c
+}
+
 // newConnFromHost wraps newConn and looks up the target's address from a string
 //
+// If netConn is non-nil it will be used rather than listening on a new port.
+//
 // This function is used by Client
-func newConnFromHost(udpNet string, mode TransferMode, host string) (*conn, error) {
+func newConnFromHost(udpNet string, mode TransferMode, host string, netConn net.PacketConn) (*conn, error) {
 	// Resolve server
 	addr, err := net.ResolveUDPAddr(udpNet, host)
 	if err != nil {
 		return nil, wrapError(err, "address resolve failed")
 	}
 
+	if netConn != nil {
+		return newSharedConn(netConn, mode, addr), nil
+	}
+
 	return newConn(udpNet, mode, addr)
 }
 
 // conn handles TFTP read and write requests
 type conn struct {
 	log        *logger
-	netConn    *net.UDPConn // Underlying network connection
-	remoteAddr net.Addr     // Address of the remote server or client
+	id         uint64         // Server assigned transfer ID, zero for clients
+	netConn    net.PacketConn // Underlying network connection
+	sharedConn bool           // netConn is owned elsewhere, don't close it
+	remoteAddr net.Addr       // Address of the remote server or client
+
+	clock clock // Source of time for timeouts, replaced in tests
 
 	// Single Port Mode
 	reqChan chan []byte
-	timer   *time.Timer
+	timer   timer
 
 	// Transfer type
 	isClient bool // Whether or not we're the client, gets set by sendRequest
 	isSender bool // Whether we're sending or receiving, gets set by writeSetup
+	probe    bool // Abort after negotiating options, gets set by negotiate
+	verifyIP bool // Discard responses to the request from other IPs
+
+	validateOACK func(NegotiatedOptions) error // Checks the agreed options before a client transfer begins
 
 	// Negotiable options
 	blksize    uint16        // Size of DATA payloads
@@ -104,21 +171,89 @@ type conn struct {
 	windowsize uint16        // Number of DATA packets between ACKs
 	mode       TransferMode  // octet or netascii
 	tsize      *int64        // Size of the file being sent/received
+	flush      bool          // Only an empty DATA block ends the transfer, allowing short blocks to be flushed
+	offset     int64         // Byte offset the transfer starts at, once accepted
+	compress   bool          // Data is gzip compressed
+
+	offsetAccepted bool // Handler accepted the requested offset, gets set by acceptOffset
 
 	// Other, non-negotiable options
-	retransmit int // Number of times an individual datagram will be retransmitted on error
+	retransmit    int                        // Number of times an individual datagram will be retransmitted on error
+	maxRetransmit int                        // Total retransmissions allowed for the transfer, 0 is unlimited
+	readTimeout   time.Duration              // How long to wait for a datagram, 0 uses timeout
+	retryInterval time.Duration              // Pause after a read times out before retransmitting
+	lossThreshold float64                    // Retransmit rate which lowers windowCap when sending, 0 disables
+	mtu           int                        // MTU to warn about fragmentation above, 0 disables
+	fragmentHook  func(FragmentationWarning) // Called when datagrams will exceed mtu
+	limiter       *rateLimiter               // Limits DATA sent, may be shared, nil is unlimited
+	errors        *errorCounter              // Counts ERRORs sent and received, may be shared, nil disables
+	suppressTSize bool                       // Decline tsize when sending
+	oackFallback  bool                       // Abandon options when the OACK isn't acknowledged
+	pipelineDepth int                        // Windows sent before waiting for an ACK, 0 or 1 disables
+	allowCompress bool                       // Accept compress requested by the client
+	maxWindowsize uint16                     // Largest windowsize acknowledged, 0 is unlimited
+	maxBlocksize  uint16                     // Largest blocksize acknowledged, 0 is unlimited
+	idleTimeout   time.Duration              // Wait for the first DATA as a server receiver, 0 disables
+	natKeepAlive  time.Duration              // Resend the last ACK while waiting for DATA, 0 disables
+
+	// Server transfers only, cancelled when the transfer ends
+	ctx         context.Context
+	cancel      context.CancelFunc
+	serverClose <-chan struct{} // Closed when the server is closed, aborting the transfer
+	abort       chan struct{}   // Closed by Server.AbortTransfer, aborting the transfer
+	abortOnce   sync.Once
+	doneHooks   []func(TransferInfo, string) // Called by the server with the result and sentError once complete
+	sentError   string                       // Last ERROR sent, empty if none
+
+	// Options of the request and those acknowledged, server transfers only
+	requested  options
+	negotiated options
 
 	// Track state of transfer
-	optionsParsed bool   // Whether TFTP options have been parsed yet
-	window        uint16 // Packets sent since last ACK
-	block         uint16 // Current block #
-	catchup       bool   // Ignore incoming blocks from a window we reset
-	p             []byte // bytes to be read/written (depending on send/receive)
-	n             int    // byte count read/written
-	tries         int    // retry counter
-	err           error  // error has occurreds
-	closing       bool   // connection is closing
-	done          bool   // the transfer is complete
+	idleDeadline  time.Time // First DATA must arrive by, zero once it has or if disabled
+	deadline      time.Time // Transfer must end by, zero if unlimited
+	timeline      *timeline // Events captured for postmortem, nil if disabled
+	keepAliveAt   time.Time // Next NAT keep-alive is due, zero when not waiting for DATA
+	readUntil     time.Time // End of the wait for the expected datagram, zero when not waiting
+	optionsParsed bool      // Whether TFTP options have been parsed yet
+	window        uint16    // Packets sent since last ACK
+	block         uint16    // Current block #
+	catchup       bool      // Ignore incoming blocks from a window we reset
+	p             []byte    // bytes to be read/written (depending on send/receive)
+	n             int       // byte count read/written
+	tries         int       // retry counter
+	err           error     // error has occurreds
+	closing       bool      // connection is closing
+	closed        bool      // Close has been called
+	done          bool      // the transfer is complete
+	flushing      bool      // Flush called, send buffered data in a short block
+	flushed       bool      // Received a flushed short block, return buffered data from Read
+	windowCap     uint16    // Lowered windowsize due to loss, 0 when not capped
+	loss          lossSample
+	lastAck       uint16 // Block of the last ACK received when sending
+	blockBase     uint16 // Block preceding the first DATA, 0 unless the initial block was changed
+
+	// Keep-alives while paused, nil when not paused
+	pauseStop chan struct{} // Closed by resume to stop keep-alives
+	pauseDone chan struct{} // Closed once keep-alives have stopped
+	kaBlock   uint16        // Block resent as keep-alives by the last pause
+	kaSent    int           // Keep-alives sent, duplicate ACKs of kaBlock are ignored
+
+	// Heartbeats before a read handler's first Write, nil when stopped
+	hbStop chan struct{} // Closed by stopHeartbeat
+	hbDone chan struct{} // Closed once heartbeats have stopped
+	hbMu   sync.Mutex    // Held by heartbeats while using the transfer
+	hbSent int           // OACKs resent as heartbeats, their ACK 0s are ignored
+
+	// Statistics
+	stats      TransferStats
+	bytes      int64     // data bytes transferred, excluding retransmits
+	sentAt     time.Time // time of last write to network
+	rttPending bool      // a response to the last write hasn't been received
+
+	// Published for Server.ActiveTransfers, nil if not tracked
+	diagMu sync.Mutex
+	diag   *TransferState
 
 	// Buffers
 	buf   []byte       // incoming data from, sized to blksize + headers
@@ -132,6 +267,29 @@ type conn struct {
 	// reader/writer are rxBuf/txBuf, possibly wrapped by netascii reader/writer
 	reader io.Reader
 	writer io.Writer
+
+	// Wrap Read and writer when compress is negotiated
+	zr *gzip.Reader
+	zw *gzip.Writer
+}
+
+// setRetransmit changes the per-packet retransmission limit of a transfer
+// in progress. The heartbeat may be running, so hbMu is held.
+func (c *conn) setRetransmit(n int) error {
+	if n < 0 {
+		return ErrInvalidRetransmit
+	}
+	c.hbMu.Lock()
+	defer c.hbMu.Unlock()
+	c.retransmit = n
+	return nil
+}
+
+// setInitialBlock numbers the first DATA block n rather than 1.
+func (c *conn) setInitialBlock(n uint16) {
+	c.blockBase = n - 1
+	c.block = c.blockBase
+	c.lastAck = c.blockBase
 }
 
 // sendWriteRequest sends WRQ to server and negotiates transfer options
@@ -140,9 +298,7 @@ func (c *conn) sendWriteRequest(filename string, opts map[string]string) error {
 	// Build WRQ
 	c.tx.writeWriteReq(filename, c.mode, opts)
 
-	for state := c.sendRequest; state != nil; {
-		state = state()
-	}
+	c.run(c.sendRequest)
 
 	return c.err
 }
@@ -155,13 +311,21 @@ func (c *conn) sendReadRequest(filename string, opts map[string]string) error {
 	// Build RRQ
 	c.tx.writeReadReq(filename, c.mode, opts)
 
-	for state := c.sendRequest; state != nil; {
-		state = state()
-	}
+	c.run(c.sendRequest)
 
 	return c.err
 }
 
+// negotiate sends RRQ to server and aborts the transfer with an ERROR
+// once the response has been received, without transferring data.
+//
+// The negotiated options are available in the conn fields. If the server
+// doesn't support options the defaults are unchanged.
+func (c *conn) negotiate(filename string, opts map[string]string) error {
+	c.probe = true
+	return c.sendReadRequest(filename, opts)
+}
+
 func (c *conn) sendRequest() stateType {
 	// Set that we're a client
 	c.isClient = true
@@ -176,16 +340,29 @@ func (c *conn) sendRequest() stateType {
 }
 
 func (c *conn) receiveResponse() stateType {
-	if c.tries >= c.retransmit {
+	if c.tries > c.retransmit {
 		c.err = wrapError(c.err, "receiving request response")
 		return nil
 	}
 	c.tries++
 
 	addr, err := c.readFromNet()
+	if err == ErrPeerUnreachable {
+		return c.unreachable("receiving request response")
+	}
 	if err != nil {
 		c.log.debug("error getting %s response from %v", c.tx.opcode(), c.remoteAddr)
-		c.err = err
+		// A discarded response explains the failure better than the timeout
+		if ErrorCause(c.err) != ErrUnexpectedServerIP {
+			c.err = err
+		}
+		return c.receiveResponse
+	}
+	c.err = nil // Clear timeout from previous attempt
+
+	if c.verifyIP && !sameIP(addr, c.remoteAddr) {
+		c.log.err("Received response from %v, expected IP of %v\n", addr, c.remoteAddr)
+		c.err = wrapError(ErrUnexpectedServerIP, addr.String())
 		return c.receiveResponse
 	}
 
@@ -228,6 +405,13 @@ func (c *conn) handleWRQResponse() stateType {
 
 func (c *conn) handleRRQResponse() stateType {
 	// Should have received OACK if server supports options, or DATA if not
+	switch c.rx.opcode() {
+	case opCodeOACK, opCodeDATA:
+		if c.probe {
+			return c.abortNegotiation
+		}
+	}
+
 	switch c.rx.opcode() {
 	case opCodeOACK:
 		// Got OACK, parse options
@@ -240,6 +424,7 @@ func (c *conn) handleRRQResponse() stateType {
 			c.err = wrapError(err, "writing RRQ response data")
 			return nil
 		}
+		c.bytes += int64(n)
 		c.block = c.rx.block()
 		if uint16(n) < c.blksize {
 			c.done = true
@@ -255,6 +440,19 @@ func (c *conn) handleRRQResponse() stateType {
 	}
 }
 
+// abortNegotiation parses options from an OACK and ends the transfer.
+func (c *conn) abortNegotiation() stateType {
+	defer c.sendError(ErrCodeNotDefined, "Transfer aborted after negotiation.")
+	if c.rx.opcode() == opCodeOACK {
+		if _, err := c.parseOptions(); err != nil {
+			c.err = wrapError(err, "parsing negotiated options")
+			return nil
+		}
+	}
+	c.done = true
+	return nil
+}
+
 // Write implements io.Writer and wraps write().
 //
 // If mode is ModeNetASCII, wrap write() with netascii.EncodeWriter.
@@ -263,17 +461,44 @@ func (c *conn) Write(p []byte) (int, error) {
 	if c.err != nil {
 		return 0, wrapError(c.err, "checking conn err before Write")
 	}
+	if !c.done && c.serverClosed() {
+		c.abortClosing("checking server before Write")
+		return 0, c.err
+	}
 
+	c.resume()
 	c.p = p
-	for state := c.startWrite; state != nil; {
-		state = state()
-	}
+	c.run(c.startWrite)
 
 	return c.n, wrapError(c.err, "writing")
 }
 
 type stateType func() stateType
 
+// run steps through states from state until one returns nil, publishing
+// progress after each. The network and time are only accessed through
+// netConn and clock, tests can drive the send and receive loops with
+// scripted implementations of both.
+func (c *conn) run(state stateType) {
+	for state != nil {
+		if !c.deadline.IsZero() && !c.clock.Now().Before(c.deadline) {
+			state = c.exceededDeadline
+		}
+		state = state()
+		c.publish()
+	}
+}
+
+// exceededDeadline ends a transfer which has run past its deadline
+// (see ServerTransferDeadline).
+func (c *conn) exceededDeadline() stateType {
+	c.log.debug("Transfer deadline exceeded after %d bytes, aborting", c.bytes)
+	c.deadline = time.Time{}
+	c.sendError(ErrCodeNotDefined, "transfer deadline exceeded")
+	c.err = wrapError(ErrTransferDeadline, "transferring")
+	return nil
+}
+
 func (c *conn) startWrite() stateType {
 	if !c.optionsParsed {
 		// Options won't be parsed before first write so that API consumer
@@ -283,6 +508,16 @@ func (c *conn) startWrite() stateType {
 	return c.write
 }
 
+// acknowledge negotiates options and sends the OACK ahead of the
+// first Write when the caller expects to take longer than the timeout.
+func (c *conn) acknowledge(d time.Duration) error {
+	if c.optionsParsed || d <= c.timeout {
+		return nil
+	}
+	_, err := c.Write(nil)
+	return err
+}
+
 // writeSetup parses options and sets up buffers before
 // first write.
 func (c *conn) writeSetup() stateType {
@@ -293,18 +528,22 @@ func (c *conn) writeSetup() stateType {
 	if err != nil {
 		return c.error(err, "parsing options")
 	}
-
-	// Set buf size
-	if len(c.buf) != int(c.blksize) {
-		c.buf = make([]byte, c.blksize)
+	if err := c.validateOptions(); err != nil {
+		c.err = wrapError(err, "write setup")
+		return nil
 	}
 
-	// Init ringBuffer
-	c.txBuf = newRingBuffer(int(c.windowsize), int(c.blksize))
+	c.initTxBuf()
 
-	c.writer = c.txBuf
-	if c.mode == ModeNetASCII {
-		c.writer = netascii.NewWriter(c.writer)
+	if c.lossThreshold > 0 && !c.flush {
+		c.log.debug("Peer didn't negotiate flush, the loss window cap won't be applied")
+		c.stats.LossCapUnavailable = true
+	}
+
+	// A server's receive buffer still holds the request, sliced to its
+	// length. Extend it so an ERROR from the client isn't truncated.
+	if len(c.rx.buf) < cap(c.rx.buf) {
+		c.rx.buf = c.rx.buf[:cap(c.rx.buf)]
 	}
 
 	// Client setup is done, ready to send data
@@ -321,11 +560,66 @@ func (c *conn) writeSetup() stateType {
 	return c.sendOACK(ackOpts)
 }
 
+// validateOptions calls validateOACK with the options agreed by a
+// client, rejecting them with an ERROR if it fails.
+func (c *conn) validateOptions() error {
+	if !c.isClient || c.validateOACK == nil {
+		return nil
+	}
+	if err := c.validateOACK(c.negotiatedOptions()); err != nil {
+		c.log.debug("Rejecting options agreed with %s: %v", c.remoteAddr, err)
+		c.sendError(ErrCodeOptionNegotiation, "Options rejected")
+		return wrapError(err, "validating options")
+	}
+	return nil
+}
+
+// initTxBuf sizes the send buffers for the negotiated options.
+func (c *conn) initTxBuf() {
+	// Set buf size
+	if len(c.buf) != int(c.blksize) {
+		c.buf = make([]byte, c.blksize)
+	}
+
+	// Init ringBuffer
+	c.txBuf = newRingBuffer(int(c.inFlightLimit()), int(c.blksize))
+
+	c.writer = c.txBuf
+	if c.mode == ModeNetASCII {
+		c.writer = netascii.NewWriter(c.writer)
+	}
+	if c.compress {
+		c.zw = gzip.NewWriter(c.writer)
+		c.writer = c.zw
+	}
+}
+
+// oackPending reports whether an OACK was the last datagram sent,
+// meaning it hasn't been acknowledged.
+func (c *conn) oackPending() bool {
+	return c.tx.offset >= 2 && c.tx.opcode() == opCodeOACK
+}
+
+// fallBack abandons the negotiated options after an OACK wasn't
+// acknowledged, continuing as if the request had none.
+func (c *conn) fallBack() {
+	c.log.debug("OACK not acknowledged by %s, falling back to default options", c.remoteAddr)
+	c.blksize = defaultBlksize
+	c.windowsize = defaultWindowsize
+	c.timeout = defaultTimeout
+	c.flush = false
+	c.compress = false
+	c.negotiated = nil
+	c.tries = 0
+	if c.isSender {
+		c.initTxBuf()
+	}
+}
+
 func (c *conn) sendOACK(o options) stateType {
 	return func() stateType {
 		c.log.trace("Sending OACK to %s\n", c.remoteAddr)
-		c.tx.writeOptionAck(o)
-		if err := c.writeToNet(); err != nil {
+		if err := c.writeOACK(o); err != nil {
 			return c.error(err, "writing OACK")
 		}
 
@@ -333,6 +627,18 @@ func (c *conn) sendOACK(o options) stateType {
 	}
 }
 
+// writeOACK sends an OACK with o. If the OACK would exceed maxOACKSize an
+// ERROR is sent instead and ErrOACKTooLarge is returned.
+func (c *conn) writeOACK(o options) error {
+	c.tx.writeOptionAck(o)
+	if c.tx.offset > maxOACKSize {
+		c.log.err("OACK of %d bytes exceeds %d byte limit", c.tx.offset, maxOACKSize)
+		c.sendError(ErrCodeOptionNegotiation, "Acknowledged options too large")
+		return ErrOACKTooLarge
+	}
+	return c.writeToNet()
+}
+
 func (c *conn) error(err error, desc string) stateType {
 	return func() stateType {
 		c.err = wrapError(err, desc)
@@ -359,14 +665,27 @@ func (c *conn) writeData() stateType {
 	if c.closing && c.done {
 		return nil
 	}
-	if c.txBuf.Len() < int(c.blksize) && !c.closing {
+	// Fatal errors end the state machine before a block is sent,
+	// any error here is a timeout that has since been resolved
+	c.err = nil
+	if c.txBuf.Len() < int(c.blksize) && !c.closing && (!c.flushing || c.txBuf.Len() == 0) {
 		return nil
 	}
 
 	c.block++
 
 	// Read data from txBuf
-	n, err := c.txBuf.Read(c.buf)
+	resend := c.txBuf.current != c.txBuf.head
+	if c.lossThreshold > 0 && c.flush {
+		c.observeLoss(resend)
+	}
+	p := c.buf
+	if !resend && c.windowCap > 0 && c.window+1 >= c.windowCap && c.txBuf.Len() >= int(c.blksize) {
+		// End the shortened window with a flushed block, otherwise
+		// the receiver waits for the rest of the negotiated window
+		p = c.buf[:c.blksize-1]
+	}
+	n, err := c.txBuf.Read(p)
 	if err != nil && err != io.EOF {
 		c.err = wrapError(err, "reading data from txBuf before writing to network")
 		return nil
@@ -380,18 +699,30 @@ func (c *conn) writeData() stateType {
 		c.err = wrapError(err, "writing data to network")
 		return nil
 	}
+	if resend {
+		c.retransmitted()
+	} else {
+		c.bytes += int64(n)
+	}
 
 	// Increment the window
 	c.window++
 
 	// If this is last block, move to get ack immediately
 	if uint16(n) < c.blksize {
+		if c.flush && n > 0 {
+			// Flushed block, the receiver ACKs it and resets its window
+			c.window = 0
+			return c.getAck
+		}
 		c.done = true
 		return c.getAck
 	}
 
-	// Continue on if we haven't reached the windowsize
-	if c.window < c.windowsize {
+	// Continue on if we haven't reached the windowsize. Resent blocks
+	// can't be shortened to end a capped window, they continue to the
+	// negotiated windowsize or the next block which can.
+	if c.window < c.inFlightLimit() || (resend && c.window < c.windowsize) {
 		return c.writeData
 	}
 
@@ -401,19 +732,75 @@ func (c *conn) writeData() stateType {
 	return c.getAck
 }
 
-// Read implements io.Reader and wraps read()
+// pipelined reports whether more than one window may be sent before
+// waiting for an ACK. It requires a negotiated windowsize, indicating the
+// receiver ACKs each window rather than each block, which no longer holds
+// once the window is capped.
+func (c *conn) pipelined() bool {
+	return c.pipelineDepth > 1 && c.windowsize > 1 && c.windowCap == 0
+}
+
+// inFlightLimit is the number of blocks sent before waiting for an ACK.
+func (c *conn) inFlightLimit() uint16 {
+	windowsize := c.windowsize
+	if c.windowCap > 0 && c.windowCap < windowsize {
+		windowsize = c.windowCap
+	}
+	if !c.pipelined() {
+		return windowsize
+	}
+	limit := int(windowsize) * c.pipelineDepth
+	if limit > maxInFlight {
+		limit = maxInFlight
+	}
+	if limit < int(windowsize) {
+		return windowsize
+	}
+	return uint16(limit)
+}
+
+// Read implements io.Reader, wrapping readRaw with a gzip reader if
+// compression was negotiated.
+func (c *conn) Read(p []byte) (int, error) {
+	if !c.optionsParsed && c.allowCompress {
+		// Negotiate to find out whether the data is compressed
+		if _, err := c.readRaw(nil); err != nil {
+			return 0, err
+		}
+	}
+	if !c.compress {
+		return c.readRaw(p)
+	}
+	if c.zr == nil {
+		zr, err := gzip.NewReader(readerFunc(c.readRaw))
+		if err != nil {
+			return 0, wrapError(err, "reading compressed data")
+		}
+		c.zr = zr
+	}
+	return c.zr.Read(p)
+}
+
+// readRaw reads data as sent over the network and wraps read()
 //
 // If mode is ModeNetASCII, read() is wrapped with netascii.ReadDecoder
-func (c *conn) Read(p []byte) (int, error) {
+func (c *conn) readRaw(p []byte) (int, error) {
 	c.n = 0
 	if c.err != nil {
 		// Can't read if an error has been sent/received
 		return 0, wrapError(c.err, "checking conn error before Read")
 	}
+	if c.serverClosed() {
+		c.abortClosing("checking server before Read")
+		return 0, c.err
+	}
 
 	c.p = p
-	for state := c.startRead; state != nil; {
-		state = state()
+	c.run(c.startRead)
+	if c.n == 0 && c.err != nil && c.err != io.EOF && c.reader != nil {
+		// Return data received before the transfer failed with
+		// the error, so callers can tell how far it got
+		c.n, _ = c.reader.Read(p)
 	}
 	return c.n, c.err
 }
@@ -438,6 +825,10 @@ func (c *conn) readSetup() stateType {
 		c.err = wrapError(err, "read setup")
 		return nil
 	}
+	if err := c.validateOptions(); err != nil {
+		c.err = wrapError(err, "read setup")
+		return nil
+	}
 
 	// Set buf size
 	if needed := int(c.blksize + 4); len(c.rx.buf) != needed {
@@ -446,16 +837,21 @@ func (c *conn) readSetup() stateType {
 
 	// If there we're not options negotiated, send ACK
 	// Client never sends OACK
+	// Send ACK/OACK
 	if len(ackOpts) == 0 || c.isClient {
+		// The request or OACK is acknowledged with block 0,
+		// regardless of the initial block
+		block := uint16(0)
+		if c.rx.opcode() == opCodeDATA {
+			block = c.block
+		}
 		c.log.trace("Sending ACK to %s\n", c.remoteAddr)
-		c.tx.writeAck(c.block)
+		c.tx.writeAck(block)
+		err = c.writeToNet()
 	} else {
 		c.log.trace("Sending OACK to %s\n", c.remoteAddr)
-		c.tx.writeOptionAck(ackOpts)
+		err = c.writeOACK(ackOpts)
 	}
-
-	// Send ACK/OACK
-	err = c.writeToNet()
 	if err != nil {
 		c.err = err
 		return nil
@@ -465,19 +861,25 @@ func (c *conn) readSetup() stateType {
 		return nil
 	}
 
+	if c.idleTimeout > 0 {
+		c.idleDeadline = c.clock.Now().Add(c.idleTimeout)
+	}
 	return c.read
 }
 
 // read reads data from netConn until p is full or the connection is
 // complete.
 func (c *conn) read() stateType {
-	if c.rxBuf.Len() >= len(c.p) || c.done {
+	if c.rxBuf.Len() >= len(c.p) || c.done || (c.flushed && c.rxBuf.Len() > 0) {
 		// Read buffered data into p
 		n, err := c.reader.Read(c.p)
 		c.n = n
 		if err != nil && err != io.EOF { // Ignore EOF from bytes.Buffer
 			c.err = wrapError(err, "reading from rxBuf after read")
 		}
+		if c.rxBuf.Len() == 0 {
+			c.flushed = false
+		}
 		// If done, signal that there's nothing more to read by io.EOF
 		if c.done && c.rxBuf.Len() == 0 {
 			c.err = io.EOF
@@ -491,22 +893,71 @@ func (c *conn) read() stateType {
 
 // readDatagram reads a single datagram into rx
 func (c *conn) readData() stateType {
-	if c.tries >= c.retransmit {
+	if c.tries > c.retransmit {
+		if c.tsize != nil && c.bytes >= *c.tsize && !c.compress {
+			// All data has been received but the sender didn't
+			// end the transfer with a short block
+			c.log.debug("Sender didn't send final block")
+			c.sendError(ErrCodeNotDefined, "unexpected end of transfer")
+			c.err = wrapError(ErrUnexpectedEOF, "reading data")
+			return nil
+		}
 		c.log.debug("Max retries exceeded")
 		c.sendError(ErrCodeNotDefined, "max retries reached")
 		c.err = wrapError(ErrMaxRetries, "reading data")
 		return nil
 	}
+	if c.exceededRetransmits() {
+		c.err = wrapError(ErrMaxTotalRetransmits, "reading data")
+		return nil
+	}
 	c.tries++
 
 	c.log.trace("Waiting for DATA from %s\n", c.remoteAddr)
-	_, err := c.readFromNet()
+	_, err := c.readExpected(c.readKeepingAlive)
+	if err == ErrServerClosing {
+		return c.abortClosing("reading data")
+	}
+	if err == ErrPeerUnreachable {
+		return c.unreachable("reading data")
+	}
 	if err != nil {
 		c.log.debug("error receiving block %d: %v", c.block+1, err)
-		c.log.trace("Resending ACK for %d\n", c.block)
-		if err := c.sendAck(c.block); err != nil {
-			c.log.debug("resending ACK %v", err)
+		if !c.idleDeadline.IsZero() && !c.clock.Now().Before(c.idleDeadline) {
+			c.log.debug("No DATA received within %s, abandoning transfer", c.idleTimeout)
+			c.sendError(ErrCodeNotDefined, "idle timeout")
+			c.err = wrapError(ErrWriteIdleTimeout, "reading data")
+			return nil
 		}
+		if c.tries > c.retransmit {
+			return c.readData // Fails without a final, unanswered retransmission
+		}
+		if c.retryInterval > 0 {
+			c.clock.Sleep(c.retryInterval)
+		}
+		switch {
+		case !c.oackPending():
+			c.log.trace("Resending ACK for %d\n", c.block)
+			if err = c.sendAck(c.block); err != nil {
+				c.log.debug("resending ACK %v", err)
+			}
+		case c.oackFallback:
+			c.fallBack()
+			if err = c.sendAck(0); err != nil {
+				c.log.debug("sending ACK after fallback %v", err)
+			}
+		default:
+			// Sender can't respond until it has the OACK,
+			// resend it in case it was lost
+			c.log.debug("Resending OACK to %s", c.remoteAddr)
+			if err = c.writeToNet(); err != nil {
+				c.log.debug("resending OACK: %v", err)
+			}
+		}
+		if ErrorCause(err) == ErrPeerUnreachable {
+			return c.unreachable("retransmitting")
+		}
+		c.retransmitted()
 		c.window = 0
 		return c.readData
 	}
@@ -524,6 +975,22 @@ func (c *conn) readData() stateType {
 		// Received an error
 		c.err = wrapError(c.remoteError(), "reading data")
 		return nil
+	case opCodeRRQ, opCodeWRQ:
+		return c.resendLast(c.readData)
+	case opCodeOACK:
+		if c.block == c.blockBase {
+			// OACK was resent, ACK 0 was lost or it's a heartbeat
+			// (see ServerHeartbeat), either way the server is alive
+			c.log.debug("Received duplicate OACK, resending ACK 0")
+			if err := c.sendAck(0); err != nil {
+				c.log.debug("resending ACK %v", err)
+			}
+			c.retransmitted()
+			c.tries = 0
+			return c.readData
+		}
+		c.err = wrapError(&errUnexpectedDatagram{dg: c.rx.String()}, "read data response")
+		return nil
 	default:
 		c.err = wrapError(&errUnexpectedDatagram{dg: c.rx.String()}, "read data response")
 		return nil
@@ -531,11 +998,17 @@ func (c *conn) readData() stateType {
 
 	c.log.trace("Received block %d\n", c.rx.block())
 	c.tries = 0
+	c.idleDeadline = time.Time{}
 
 	return c.ackData
 }
 
 // ackData handles block sequence, windowing, and acknowledgements
+//
+// Only the next block in sequence is buffered. Blocks received out of
+// order are discarded and the last block in sequence is acknowledged, the
+// sender resends from there. Data buffered for Read is therefore limited
+// by the size of the reads and the blocksize, whatever the windowsize.
 func (c *conn) ackData() stateType {
 	switch diff := c.rx.block() - c.block; {
 	case diff == 1:
@@ -565,6 +1038,7 @@ func (c *conn) ackData() stateType {
 			c.err = wrapError(err, "sending missed block(s) ACK")
 			return nil
 		}
+		c.retransmitted()
 		c.window = 0
 		c.catchup = true
 		return c.read
@@ -576,10 +1050,16 @@ func (c *conn) ackData() stateType {
 		c.err = wrapError(err, "writing to rxBuf after read")
 		return nil
 	}
+	c.bytes += int64(n)
 
 	if n < int(c.blksize) {
-		// Reveived last DATA, we're done
-		c.done = true
+		if c.flush && n > 0 {
+			// Sender flushed, make the data available to Read
+			c.flushed = true
+		} else {
+			// Reveived last DATA, we're done
+			c.done = true
+		}
 	}
 
 	if c.window < c.windowsize && n >= int(c.blksize) {
@@ -599,11 +1079,189 @@ func (c *conn) ackData() stateType {
 	return c.read
 }
 
+// acceptOffset accepts the offset requested by the client, returning it.
+// Zero is returned if no offset was requested or it can't be accepted
+// because options have already been negotiated.
+func (c *conn) acceptOffset() int64 {
+	if c.optionsParsed || c.mode == ModeNetASCII {
+		// Byte offsets are ambiguous in netascii
+		return c.offset
+	}
+	val, ok := c.rx.options()[optOffset]
+	if !ok {
+		return 0
+	}
+	offset, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || offset < 0 {
+		return 0 // Rejected when options are parsed
+	}
+	c.offset = offset
+	c.offsetAccepted = true
+	return offset
+}
+
+// Flush sends any buffered data in a short DATA block without ending
+// the transfer. The flush option must have been negotiated.
+func (c *conn) Flush() error {
+	if !c.optionsParsed {
+		// Negotiate options
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	if !c.flush {
+		return ErrFlushNotNegotiated
+	}
+	if c.err != nil {
+		return wrapError(c.err, "checking conn err before Flush")
+	}
+
+	// netasciiEnc needs to be flushed if it's in use
+	if flusher, ok := c.writer.(interface {
+		Flush() error
+	}); ok {
+		if err := flusher.Flush(); err != nil {
+			return wrapError(err, "flushing writer")
+		}
+	}
+
+	c.flushing = true
+	_, err := c.Write([]byte{})
+	c.flushing = false
+	return err
+}
+
+// pause resends the last DATA block every half timeout until resume is
+// called. The receiver ignores the duplicate, but it restarts the wait for
+// the next block so it doesn't time out while the sender has nothing to send.
+// RFC 1350 receivers acknowledge each duplicate, getAck ignores up to kaSent
+// of those ACKs rather than taking them as loss and resending, which would
+// otherwise duplicate every following block (the Sorcerer's Apprentice bug).
+func (c *conn) pause() error {
+	if c.err != nil {
+		return wrapError(c.err, "checking conn err before Pause")
+	}
+	if c.pauseStop != nil {
+		return nil // Already paused
+	}
+	if c.tx.offset < 4 || c.tx.opcode() != opCodeDATA {
+		return ErrNoDataSent
+	}
+
+	keepalive := append([]byte(nil), c.tx.bytes()...)
+	interval := c.timeout / 2
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.pauseStop, c.pauseDone = stop, done
+	if c.kaBlock != c.block {
+		c.kaBlock, c.kaSent = c.block, 0
+	}
+	c.log.debug("Pausing transfer to %s at block %d", c.remoteAddr, c.block)
+
+	t := c.clock.NewTimer(interval)
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C():
+			}
+			c.log.trace("Sending keep-alive for block %d to %s\n", c.block, c.remoteAddr)
+			err := c.netConn.SetWriteDeadline(c.writeDeadline())
+			if err == nil {
+				_, err = c.netConn.WriteTo(keepalive, c.remoteAddr)
+			}
+			if err != nil {
+				c.log.debug("sending keep-alive: %v", err)
+			} else {
+				c.kaSent++ // Not used by the transfer until resume waits for done
+			}
+			t.Reset(interval)
+		}
+	}()
+	return nil
+}
+
+// startHeartbeat negotiates options and sends the OACK on the handler's
+// behalf if it hasn't written within interval, then resends the OACK every
+// interval until stopHeartbeat. If the client didn't request any options
+// there is no OACK to send and heartbeats end after negotiating.
+//
+// Heartbeats use the transfer from their own goroutine, callers must stop
+// them before using it, other than with the hbMu held.
+func (c *conn) startHeartbeat(interval time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	c.hbStop, c.hbDone = stop, done
+
+	t := c.clock.NewTimer(interval)
+	go func() {
+		defer close(done)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C():
+			}
+
+			c.hbMu.Lock()
+			var err error
+			if c.optionsParsed {
+				c.log.trace("Sending heartbeat OACK to %s\n", c.remoteAddr)
+				err = c.writeToNet()
+				c.hbSent++
+			} else {
+				c.log.debug("No data from handler within %s, sending OACK to %s", interval, c.remoteAddr)
+				_, err = c.Write(nil)
+			}
+			idle := c.err != nil || c.tx.offset < 2 || c.tx.opcode() != opCodeOACK
+			c.hbMu.Unlock()
+			if err != nil {
+				c.log.debug("sending heartbeat: %v", err)
+			}
+			if idle {
+				return // Nothing to resend
+			}
+			t.Reset(interval)
+		}
+	}()
+}
+
+// stopHeartbeat stops heartbeats, waiting for them to finish with the transfer.
+func (c *conn) stopHeartbeat() {
+	if c.hbStop == nil {
+		return
+	}
+	close(c.hbStop)
+	<-c.hbDone
+	c.hbStop, c.hbDone = nil, nil
+}
+
+// resume stops the keep-alives started by pause, if any.
+func (c *conn) resume() {
+	if c.pauseStop == nil {
+		return
+	}
+	close(c.pauseStop)
+	<-c.pauseDone
+	c.pauseStop, c.pauseDone = nil, nil
+	c.log.debug("Resuming transfer to %s at block %d", c.remoteAddr, c.block)
+}
+
 // Close flushes any remaining data to be transferred and closes netConn
+//
+// Calls after the first have no effect and return nil.
 func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.resume()
+	c.stopHeartbeat()
 	c.log.debug("Closing connection to %s\n", c.remoteAddr)
 
-	if c.reqChan == nil {
+	if c.reqChan == nil && !c.sharedConn {
 		defer func() {
 			// Close network even if another error occurs
 			err := c.netConn.Close()
@@ -621,6 +1279,14 @@ func (c *conn) Close() error {
 		return wrapError(c.err, "checking conn err before Close")
 	}
 
+	// Compressed data ends with the gzip trailer
+	if c.zw != nil {
+		if err := c.zw.Close(); err != nil {
+			return wrapError(err, "closing compressor")
+		}
+		c.writer = c.txBuf
+	}
+
 	// netasciiEnc needs to be flushed if it's in use
 	if flusher, ok := c.writer.(interface {
 		Flush() error
@@ -646,8 +1312,13 @@ func (c *conn) Close() error {
 
 // parseOACK parses the options from a datagram and returns the successfully
 // negotiated options.
+//
+// An OACK may acknowledge a subset of the options requested (RFC 2347).
+// Options it omits were declined and keep their defaults, such as a
+// windowsize of 1 when only blksize is granted.
 func (c *conn) parseOptions() (options, error) {
 	ackOpts := make(map[string]string)
+	var utimeout time.Duration
 
 	// parse and set options
 	for opt, val := range c.rx.options() {
@@ -657,8 +1328,11 @@ func (c *conn) parseOptions() (options, error) {
 			if err != nil {
 				return nil, &errParsingOption{option: opt, value: val}
 			}
+			if !c.isClient && c.maxBlocksize > 0 && size > uint64(c.maxBlocksize) {
+				size = uint64(c.maxBlocksize)
+			}
 			c.blksize = uint16(size)
-			ackOpts[opt] = val
+			ackOpts[opt] = strconv.FormatUint(size, 10)
 		case optTimeout:
 			seconds, err := strconv.ParseUint(val, 10, 8)
 			if err != nil {
@@ -666,32 +1340,107 @@ func (c *conn) parseOptions() (options, error) {
 			}
 			c.timeout = time.Second * time.Duration(seconds)
 			ackOpts[opt] = val
+		case optUTimeout:
+			usec, err := strconv.ParseUint(val, 10, 32)
+			if err != nil || usec < 1 || usec > maxUTimeout {
+				return nil, &errParsingOption{option: opt, value: val}
+			}
+			utimeout = time.Microsecond * time.Duration(usec)
+			ackOpts[opt] = val
 		case optTransferSize:
 			tsize, err := strconv.ParseInt(val, 10, 64)
 			if err != nil {
 				return nil, &errParsingOption{option: opt, value: val}
 			}
+			if c.isSender && c.suppressTSize {
+				continue // Declined, the size isn't revealed
+			}
 			if c.isSender && c.tsize != nil {
 				// We're sender, send tsize
 				ackOpts[opt] = strconv.FormatInt(*c.tsize, 10)
 				continue
 			}
+			// Not acknowledged, a sender that doesn't know the size
+			// omits tsize rather than reporting 0
 			c.tsize = &tsize
 		case optWindowSize:
 			size, err := strconv.ParseUint(val, 10, 16)
 			if err != nil {
 				return nil, &errParsingOption{option: opt, value: val}
 			}
+			if !c.isClient && c.maxWindowsize > 0 && size > uint64(c.maxWindowsize) {
+				size = uint64(c.maxWindowsize)
+			}
 			c.windowsize = uint16(size)
+			ackOpts[opt] = strconv.FormatUint(size, 10)
+		case optFlush:
+			if val != "1" {
+				return nil, &errParsingOption{option: opt, value: val}
+			}
+			c.flush = true
 			ackOpts[opt] = val
+		case optOffset:
+			offset, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || offset < 0 {
+				return nil, &errParsingOption{option: opt, value: val}
+			}
+			if c.isClient {
+				// Server accepted the offset
+				c.offset = offset
+				c.offsetAccepted = true
+			} else if c.offsetAccepted {
+				ackOpts[opt] = val
+			}
+		case optCompress:
+			if c.isClient {
+				// Server agreed to compress
+				c.compress = val == compressGzip
+			} else if c.allowCompress && val == compressGzip && c.mode == ModeOctet {
+				c.compress = true
+				ackOpts[opt] = val
+			}
 		}
 	}
 
+	// Takes precedence over timeout, regardless of order
+	if utimeout > 0 {
+		c.timeout = utimeout
+	}
+
 	c.optionsParsed = true
+	c.negotiated = ackOpts
+
+	if c.mtu > 0 && !c.isClient {
+		c.checkFragmentation()
+	}
 
 	return ackOpts, nil
 }
 
+// checkFragmentation warns if DATA datagrams with the negotiated
+// blocksize will exceed the MTU.
+func (c *conn) checkFragmentation() {
+	size := int(c.blksize) + 4 + 8 + 20 // TFTP, UDP, and IPv4 headers
+	if addr, ok := c.remoteAddr.(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		size += 20 // IPv6 header is 40 bytes
+	}
+	if size <= c.mtu {
+		return
+	}
+
+	c.log.debug("Blocksize %d results in %d byte datagrams, exceeding MTU %d. Datagrams will be fragmented.", c.blksize, size, c.mtu)
+	if c.fragmentHook != nil {
+		addr, _ := c.remoteAddr.(*net.UDPAddr)
+		c.fragmentHook(FragmentationWarning{
+			ID:           c.id,
+			Addr:         addr,
+			Blocksize:    int(c.blksize),
+			DatagramSize: size,
+			MTU:          c.mtu,
+		})
+	}
+}
+
 // sendError sends ERROR datagram to remote host
 func (c *conn) sendError(code ErrorCode, msg string) {
 	c.log.debug("Sending error code %s to %s: %s\n", code, c.remoteAddr, msg)
@@ -704,9 +1453,18 @@ func (c *conn) sendError(code ErrorCode, msg string) {
 
 	// Send error
 	c.tx.writeError(code, msg)
+	c.sentError = c.tx.String()
 	if err := c.writeToNet(); err != nil {
 		c.log.debug("sending ERROR: %v", err)
 	}
+	c.observeError(code, msg, true)
+}
+
+// observeError counts an ERROR sent or received, if c.errors is set.
+func (c *conn) observeError(code ErrorCode, msg string, sent bool) {
+	if c.errors != nil {
+		c.errors.observe(code, msg, sent)
+	}
 }
 
 // sendAck sends ACK
@@ -722,40 +1480,50 @@ func (c *conn) sendAck(block uint16) error {
 // If the received ACK is for a previous block, indicating the receiver missed data,
 // it will rollback the transfer to the ACK'd block and reset the window.
 func (c *conn) getAck() stateType {
-	c.tries++
 	if c.tries > c.retransmit {
 		c.log.debug("Max retries exceeded")
 		c.sendError(ErrCodeNotDefined, "max retries reached")
 		c.err = wrapError(ErrMaxRetries, "reading ack")
 		return nil
 	}
+	if c.exceededRetransmits() {
+		c.err = wrapError(ErrMaxTotalRetransmits, "reading ack")
+		return nil
+	}
+	c.tries++
 
 	c.log.trace("Waiting for ACK from %s\n", c.remoteAddr)
-	sAddr, err := c.readFromNet()
+	_, err := c.readExpected(c.readFromNet)
+	if err == ErrServerClosing {
+		return c.abortClosing("waiting for ACK")
+	}
+	if err == ErrPeerUnreachable {
+		return c.unreachable("waiting for ACK")
+	}
 	if err != nil {
 		c.log.trace("Error waiting for ACK: %v", err)
 		c.err = wrapError(err, "waiting for ACK")
+		if c.oackPending() {
+			if c.oackFallback {
+				c.fallBack()
+				return c.write
+			}
+			if c.tries > c.retransmit {
+				return c.getAck // Fails without a final, unanswered retransmission
+			}
+			// The receiver can't resend ACK 0 until it has the OACK,
+			// resend it in case it was lost
+			c.log.debug("Resending OACK to %s", c.remoteAddr)
+			if err := c.writeToNet(); err == ErrPeerUnreachable {
+				return c.unreachable("resending OACK")
+			} else if err != nil {
+				c.log.debug("resending OACK: %v", err)
+			}
+			c.retransmitted()
+		}
 		return c.getAck
 	}
-
-	// Send error to requests not from requesting client. May consider
-	// ignoring entirely.
-	// RFC1350:
-	// "If a source TID does not match, the packet should be
-	// discarded as erroneously sent from somewhere else.  An error packet
-	// should be sent to the source of the incorrect packet, while not
-	// disturbing the transfer."
-	if c.reqChan == nil && sAddr.String() != c.remoteAddr.String() {
-		c.log.err("Received unexpected datagram from %v, expected %v\n", sAddr, c.remoteAddr)
-		go func() {
-			var err datagram
-			err.writeError(ErrCodeUnknownTransferID, "Unexpected TID")
-			// Don't care about an error here, just a courtesy
-			_, _ = c.netConn.WriteTo(err.bytes(), sAddr)
-		}()
-
-		return c.getAck // Read another datagram
-	}
+	c.err = nil // Clear timeout from previous attempt
 
 	// Validate received datagram
 	if err := c.rx.validate(); err != nil {
@@ -764,21 +1532,77 @@ func (c *conn) getAck() stateType {
 	}
 
 	// Check opcode
+	var rxBlock uint16
+	prevAck := c.lastAck
 	switch op := c.rx.opcode(); op {
 	case opCodeACK:
 		c.log.trace("Got ACK for block %d\n", c.rx.block())
-		// continue on
+		rxBlock = c.rx.block()
+		if rxBlock == 0 && c.oackPending() {
+			rxBlock = c.block // Acknowledges the OACK
+		}
+		c.lastAck = rxBlock
 	case opCodeERROR:
 		c.err = wrapError(c.remoteError(), "error receiving ACK")
 		return nil
+	case opCodeRRQ, opCodeWRQ:
+		return c.resendLast(c.getAck)
+	case opCodeOACK:
+		if !c.isClient || c.block-c.blockBase > c.inFlightLimit() {
+			c.err = wrapError(&errUnexpectedDatagram{c.rx.String()}, "error receiving ACK")
+			return nil
+		}
+		// Server resent the OACK, the first DATA was lost
+		c.log.debug("Received duplicate OACK, resending from the first block")
+		rxBlock = c.blockBase
 	default:
 		c.err = wrapError(&errUnexpectedDatagram{c.rx.String()}, "error receiving ACK")
 		return nil
 	}
 
+	if rxBlock == c.blockBase && c.hbSent > 0 && c.rx.opcode() == opCodeACK {
+		// Client acknowledged a heartbeat, not a lost block
+		c.hbSent--
+		c.tries--
+		c.lastAck = prevAck
+		return c.getAck
+	}
+
+	if c.kaSent > 0 && c.rx.opcode() == opCodeACK {
+		if rxBlock == c.kaBlock && rxBlock != c.block {
+			// Client acknowledged a keep-alive, not a lost block
+			c.kaSent--
+			c.tries--
+			c.lastAck = prevAck
+			return c.getAck
+		}
+		// Any outstanding were lost, they're sent before later blocks
+		c.kaSent = 0
+	}
+
+	if rxBlock != c.block && c.pipelined() && c.rx.opcode() == opCodeACK {
+		switch ahead := rxBlock - prevAck; {
+		case int16(ahead) < 0:
+			// Older than an ACK already received
+			c.log.debug("Received stale ACK for block %d, ignoring.", rxBlock)
+			c.lastAck = prevAck
+			return c.getAck
+		case ahead > 0 && ahead%c.windowsize == 0 && int16(rxBlock-c.block) < 0:
+			// An earlier window in the pipeline was acknowledged,
+			// send more while waiting for the rest
+			c.log.trace("Pipelined window acknowledged, %d blocks in flight", c.block-rxBlock)
+			c.window = c.block - rxBlock
+			c.tries = 0
+			if c.done {
+				return c.getAck
+			}
+			return c.writeData
+		}
+	}
+
 	// Check block #
-	if rxBlock := c.rx.block(); rxBlock != c.block {
-		if rxBlock > c.block {
+	if rxBlock != c.block {
+		if int16(rxBlock-c.block) > 0 { // Compared as serial numbers, allowing for wrap around
 			// Out of order ACKs can cause this scenario, ignore the ACK
 			c.log.debug("Received ACK > current block, ignoring.")
 			return c.getAck
@@ -800,9 +1624,61 @@ func (c *conn) getAck() stateType {
 	return c.writeData
 }
 
+// unexpectedTID reports whether addr is not the remote address of the
+// transfer, sending an error to addr if so. May consider ignoring entirely.
+//
+// RFC1350:
+// "If a source TID does not match, the packet should be
+// discarded as erroneously sent from somewhere else.  An error packet
+// should be sent to the source of the incorrect packet, while not
+// disturbing the transfer."
+func (c *conn) unexpectedTID(addr net.Addr) bool {
+	if c.reqChan != nil || addr.String() == c.remoteAddr.String() {
+		return false
+	}
+	c.log.err("Received unexpected datagram from %v, expected %v\n", addr, c.remoteAddr)
+	var err datagram
+	err.writeError(ErrCodeUnknownTransferID, "Unexpected TID")
+	// Don't care about an error here, just a courtesy
+	_, _ = c.netConn.WriteTo(err.bytes(), addr)
+	c.observeError(ErrCodeUnknownTransferID, "Unexpected TID", true)
+	return true
+}
+
+// localAddr returns the local address of netConn, nil if it isn't UDP.
+func (c *conn) localAddr() *net.UDPAddr {
+	addr, _ := c.netConn.LocalAddr().(*net.UDPAddr)
+	return addr
+}
+
+// sameIP reports whether a and b are UDP addresses with the same IP,
+// regardless of port.
+func sameIP(a, b net.Addr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	if !ok {
+		return a.String() == b.String()
+	}
+	ub, ok := b.(*net.UDPAddr)
+	return ok && ua.IP.Equal(ub.IP)
+}
+
+// resendLast handles a request retransmitted by the client in single port
+// mode, indicating the last datagram sent was lost. The datagram is sent
+// again and next is returned.
+func (c *conn) resendLast(next stateType) stateType {
+	c.log.debug("Received duplicate request, resending %s", c.tx)
+	if err := c.writeToNet(); err != nil {
+		return c.error(err, "resending after duplicate request")
+	}
+	c.retransmitted()
+	return next
+}
+
 // remoteError formats the error in rx, sets err and returns the error.
 func (c *conn) remoteError() error {
-	c.err = &errRemoteError{dg: c.rx.String()}
+	code, msg := c.rx.errorCode(), c.rx.errMsg()
+	c.observeError(code, msg, false)
+	c.err = &errRemoteError{dg: c.rx.String(), code: code, msg: msg}
 	return c.err
 }
 
@@ -811,36 +1687,359 @@ func (c *conn) readFromNet() (net.Addr, error) {
 	if c.reqChan != nil {
 		// Setup timer
 		if c.timer == nil {
-			c.timer = time.NewTimer(c.timeout)
+			c.timer = c.clock.NewTimer(c.readWait())
 		} else {
-			c.timer.Reset(c.timeout)
+			c.timer.Reset(c.readWait())
 		}
 
 		// Single port mode
 		select {
-		case c.rx.buf = <-c.reqChan:
+		case pkt := <-c.reqChan:
+			// Previous datagram is no longer referenced
+			putBuf(c.rx.buf)
+			c.rx.buf = pkt
 			c.rx.offset = len(c.rx.buf)
+			c.received()
+			c.mark("recv", &c.rx)
 			return nil, nil
-		case <-c.timer.C:
-			return nil, errors.New("timeout reading from channel")
+		case <-c.timer.C():
+			c.mark("timeout", nil)
+			return nil, errChannelTimeout
+		case <-c.serverClose:
+			return nil, ErrServerClosing
+		case <-c.abort:
+			return nil, ErrServerClosing
 		}
 	}
 
-	if err := c.netConn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
-		return nil, wrapError(err, "setting network read deadline")
+	if err := c.netConn.SetReadDeadline(c.clock.Now().Add(c.readWait())); err != nil {
+		return nil, wrapError(&NetworkError{Op: "read", Err: err}, "setting network read deadline")
+	}
+	// Checked after setting the deadline so that an interrupt from
+	// Server.Close can't be overwritten
+	if c.serverClosed() {
+		return nil, ErrServerClosing
 	}
 	n, addr, err := c.netConn.ReadFrom(c.rx.buf)
+	for isConnRefused(err) && !c.refusedByRemote() {
+		n, addr, err = c.netConn.ReadFrom(c.rx.buf)
+	}
+	if isConnRefused(err) {
+		// The error is reported ahead of datagrams already received. One
+		// sent by the peer before it went away, such as an ERROR, explains
+		// more than the port unreachable.
+		if c.netConn.SetReadDeadline(c.clock.Now().Add(time.Millisecond)) == nil {
+			if qn, qaddr, qerr := c.netConn.ReadFrom(c.rx.buf); qerr == nil {
+				n, addr, err = qn, qaddr, nil
+			}
+		}
+	}
 	c.rx.offset = n
-	return addr, err
+	if err != nil {
+		if c.serverClosed() {
+			return addr, ErrServerClosing
+		}
+		if isConnRefused(err) {
+			return addr, ErrPeerUnreachable
+		}
+		nErr := &NetworkError{Op: "read", Err: err}
+		if nErr.Timeout() {
+			c.mark("timeout", nil)
+		}
+		return addr, nErr
+	}
+	c.received()
+	c.mark("recv", &c.rx)
+	return addr, nil
+}
+
+// readKeepingAlive reads the next DATA like readFromNet, resending the
+// last ACK each time natKeepAlive passes without a datagram. The full
+// read wait applies, keep-alives are neither retries nor retransmissions.
+func (c *conn) readKeepingAlive() (net.Addr, error) {
+	if c.natKeepAlive <= 0 || c.oackPending() {
+		return c.readFromNet()
+	}
+	end := c.clock.Now().Add(c.readWait())
+	for {
+		c.keepAliveAt = c.clock.Now().Add(c.natKeepAlive)
+		addr, err := c.readFromNet()
+		c.keepAliveAt = time.Time{}
+		if !isTimeout(err) || !c.clock.Now().Before(end) {
+			return addr, err
+		}
+		c.log.trace("Sending keep-alive ACK for %d\n", c.block)
+		if err := c.sendAck(c.block); err != nil {
+			if ErrorCause(err) == ErrPeerUnreachable {
+				return nil, ErrPeerUnreachable
+			}
+			return nil, err
+		}
+	}
+}
+
+// readExpected reads a datagram from the remote with read, discarding any
+// from unexpected TIDs. They neither count as a try nor extend the wait,
+// which ends when it would have without them.
+func (c *conn) readExpected(read func() (net.Addr, error)) (net.Addr, error) {
+	c.readUntil = c.clock.Now().Add(c.readWait())
+	defer func() { c.readUntil = time.Time{} }()
+	for {
+		addr, err := read()
+		if err != nil || !c.unexpectedTID(addr) {
+			return addr, err
+		}
+	}
+}
+
+// refusedByRemote reports whether an ECONNREFUSED was caused by a datagram
+// sent to the remote, rather than an ERROR sent to an unexpected TID. If
+// the address isn't known it's assumed to be the remote.
+func (c *conn) refusedByRemote() bool {
+	addr, ok := refusedAddr(c.netConn)
+	if remote, isUDP := c.remoteAddr.(*net.UDPAddr); !ok || !isUDP || (addr.Port == remote.Port && addr.IP.Equal(remote.IP)) {
+		return true
+	}
+	c.log.debug("Ignoring port unreachable from %v", addr)
+	return false
+}
+
+// unreachable ends the transfer after the remote's host reported the port
+// unreachable, as the peer has gone away there's nothing to retransmit to.
+func (c *conn) unreachable(desc string) stateType {
+	c.log.debug("%s unreachable, abandoning transfer", c.remoteAddr)
+	c.err = wrapError(ErrPeerUnreachable, desc)
+	return nil
+}
+
+// serverClosed reports whether the server running the transfer has been
+// closed, or the transfer aborted with Server.AbortTransfer.
+func (c *conn) serverClosed() bool {
+	select {
+	case <-c.serverClose:
+		return true
+	case <-c.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// abortClosing ends the transfer because the server is closing or it was
+// aborted, notifying the remote on a best effort basis.
+func (c *conn) abortClosing(desc string) stateType {
+	select {
+	case <-c.abort:
+		c.log.debug("Transfer aborted")
+		c.sendError(ErrCodeNotDefined, "transfer aborted")
+		c.err = wrapError(ErrTransferAborted, desc)
+		return nil
+	default:
+	}
+	c.log.debug("Server closing, aborting transfer")
+	c.sendError(ErrCodeNotDefined, "server shutting down")
+	c.err = wrapError(ErrServerClosing, desc)
+	return nil
+}
+
+// abortTransfer ends the transfer early, the transfer's goroutine stops
+// with ErrTransferAborted once it next reads or writes. It's called from
+// Server.AbortTransfer.
+func (c *conn) abortTransfer() {
+	c.abortOnce.Do(func() {
+		close(c.abort)
+	})
+	c.cancel()
+	c.interrupt()
+}
+
+// interrupt unblocks a pending read after the server has been closed or
+// the transfer aborted. It's called from outside the transfer's goroutine.
+func (c *conn) interrupt() {
+	if c.reqChan != nil {
+		return // Single port transfers wait on serverClose and abort
+	}
+	if err := c.netConn.SetReadDeadline(time.Now()); err != nil {
+		c.log.debug("interrupting read: %v", err)
+	}
+}
+
+// readWait is how long to wait for an incoming datagram.
+func (c *conn) readWait() time.Duration {
+	wait := c.timeout
+	if c.readTimeout > 0 {
+		wait = c.readTimeout
+	}
+	if !c.idleDeadline.IsZero() {
+		if remaining := c.idleDeadline.Sub(c.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	if !c.deadline.IsZero() {
+		if remaining := c.deadline.Sub(c.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	if !c.readUntil.IsZero() {
+		if remaining := c.readUntil.Sub(c.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	if !c.keepAliveAt.IsZero() {
+		if remaining := c.keepAliveAt.Sub(c.clock.Now()); remaining < wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// writeDeadline returns the deadline for writing a datagram, long enough
+// for every retransmission of the previous one. At least one timeout is
+// allowed so writes don't fail immediately when retransmit is 0.
+func (c *conn) writeDeadline() time.Time {
+	return c.clock.Now().Add(c.timeout * time.Duration(c.retransmit+1))
 }
 
 // writeToNet writes tx to netConn.
 func (c *conn) writeToNet() error {
-	if err := c.netConn.SetWriteDeadline(time.Now().Add(c.timeout * time.Duration(c.retransmit))); err != nil {
-		return wrapError(err, "setting network write deadline")
+	if c.limiter != nil && c.tx.opcode() == opCodeDATA {
+		c.limiter.wait(c.tx.offset)
+	}
+	if err := c.netConn.SetWriteDeadline(c.writeDeadline()); err != nil {
+		return wrapError(&NetworkError{Op: "write", Err: err}, "setting network write deadline")
 	}
 	_, err := c.netConn.WriteTo(c.tx.bytes(), c.remoteAddr)
-	return err
+	c.sentAt = c.clock.Now()
+	c.rttPending = true
+	if isConnRefused(err) && c.refusedByRemote() {
+		return ErrPeerUnreachable
+	}
+	if err != nil {
+		return &NetworkError{Op: "write", Err: err}
+	}
+	c.mark("send", &c.tx)
+	return nil
+}
+
+// publish updates the state reported by Server.ActiveTransfers.
+// It's called by the transfer's goroutine after each state.
+func (c *conn) publish() {
+	if c.diag == nil {
+		return
+	}
+	c.diagMu.Lock()
+	defer c.diagMu.Unlock()
+	c.diag.Block = c.block
+	c.diag.Window = int(c.window)
+	c.diag.Retransmits = c.stats.Retransmits
+	c.diag.Bytes = c.bytes
+	if c.isSender {
+		c.diag.LastAck = c.lastAck
+		c.diag.Unacked = int(c.block - c.lastAck)
+	}
+}
+
+// snapshot returns a copy of the last published state.
+func (c *conn) snapshot() TransferState {
+	c.diagMu.Lock()
+	defer c.diagMu.Unlock()
+	return *c.diag
+}
+
+// received records the round trip time of the last write to network.
+func (c *conn) received() {
+	if c.rttPending {
+		c.stats.observeRTT(c.clock.Now().Sub(c.sentAt))
+		c.rttPending = false
+	}
+}
+
+// retransmitted records that the last write to network was a retransmission.
+func (c *conn) retransmitted() {
+	c.stats.Retransmits++
+	c.rttPending = false // Ambiguous which send a response belongs to
+	if c.timeline != nil {
+		c.timeline.resent()
+	}
+}
+
+// mark adds event to the timeline if it's captured, dg is nil for timeouts.
+func (c *conn) mark(event string, dg *datagram) {
+	if c.timeline == nil {
+		return
+	}
+	var summary string
+	if dg != nil {
+		summary = dg.summary()
+	}
+	c.timeline.add(c.clock.Now(), event, summary)
+}
+
+// exceededRetransmits reports whether the transfer has retransmitted more
+// than maxRetransmit datagrams, notifying the remote if so.
+func (c *conn) exceededRetransmits() bool {
+	if c.maxRetransmit == 0 || c.stats.Retransmits <= c.maxRetransmit {
+		return false
+	}
+	c.log.debug("Max total retransmits exceeded")
+	c.sendError(ErrCodeNotDefined, "max total retransmits reached")
+	return true
+}
+
+// observeLoss records whether a DATA datagram was a retransmission. If the
+// retransmit rate over the last lossSampleSize datagrams exceeds lossThreshold
+// the window is halved for the remainder of the transfer.
+//
+// The receiver is not aware of the cap, writeData ends each shortened window
+// with a flushed block so it's acknowledged, which requires the flush option.
+func (c *conn) observeLoss(resend bool) {
+	if c.loss.observe(resend) <= c.lossThreshold {
+		return
+	}
+	window := c.windowsize
+	if c.windowCap > 0 {
+		window = c.windowCap
+	}
+	if window <= 1 {
+		return
+	}
+	c.windowCap = window / 2
+	c.loss = lossSample{} // Measure the new window from scratch
+	c.log.debug("Retransmit rate exceeded %.2f, capping windowsize at %d", c.lossThreshold, c.windowCap)
+}
+
+// lossSampleSize is the number of DATA datagrams over which the
+// retransmit rate is measured.
+const lossSampleSize = 16
+
+// lossSample tracks retransmissions over a sliding window of datagrams.
+type lossSample struct {
+	resent [lossSampleSize]bool
+	i      int // next index in resent
+	n      int // number of samples, up to lossSampleSize
+	count  int // number of true values in resent
+}
+
+// observe adds a sample, returning the retransmit rate once
+// lossSampleSize samples have been observed and zero before.
+func (l *lossSample) observe(resend bool) float64 {
+	if l.n == lossSampleSize {
+		if l.resent[l.i] {
+			l.count--
+		}
+	} else {
+		l.n++
+	}
+	l.resent[l.i] = resend
+	if resend {
+		l.count++
+	}
+	l.i = (l.i + 1) % lossSampleSize
+
+	if l.n < lossSampleSize {
+		return 0
+	}
+	return float64(l.count) / lossSampleSize
 }
 
 // ringBuffer wraps a bytes.Buffer, adding the ability to unread data
@@ -903,6 +2102,45 @@ func (r *ringBuffer) UnreadSlots(n int) {
 	r.current -= n
 }
 
+// datagramBufSize is the size of pooled buffers, large enough
+// for any datagram using the default blocksize.
+const datagramBufSize = 4 + defaultBlksize
+
+// bufPool holds buffers for incoming requests and datagrams to
+// reduce allocations on busy servers.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new([datagramBufSize]byte)
+	},
+}
+
+// getBuf returns a buffer of length n, from bufPool if it fits.
+func getBuf(n int) []byte {
+	if n > datagramBufSize {
+		return make([]byte, n)
+	}
+	return bufPool.Get().(*[datagramBufSize]byte)[:n]
+}
+
+// putBuf returns b to bufPool. Buffers not sized for the pool are
+// left to the garbage collector.
+//
+// b must not be referenced after calling putBuf.
+func putBuf(b []byte) {
+	if cap(b) != datagramBufSize {
+		return
+	}
+	bufPool.Put((*[datagramBufSize]byte)(b[:datagramBufSize]))
+}
+
+// release returns the conn's datagram buffers to bufPool.
+// The conn must not be used after calling release.
+func (c *conn) release() {
+	putBuf(c.rx.buf)
+	putBuf(c.tx.buf)
+	c.rx.buf, c.tx.buf = nil, nil
+}
+
 // readerFunc is an adapter type to convert a function
 // to a io.Reader
 type readerFunc func([]byte) (int, error)
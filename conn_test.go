@@ -96,6 +96,65 @@ func TestNewConn(t *testing.T) {
 	}
 }
 
+func TestNewConn_peerNet(t *testing.T) {
+	cases := []struct {
+		name string
+		net  string
+		addr *net.UDPAddr
+
+		expectedNet string
+	}{
+		{
+			name:        "udp, ipv4",
+			net:         "udp",
+			addr:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 69},
+			expectedNet: "udp4",
+		},
+		{
+			name:        "udp, ipv4-mapped ipv6",
+			net:         "udp",
+			addr:        &net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 69},
+			expectedNet: "udp4",
+		},
+		{
+			name:        "udp, ipv6",
+			net:         "udp",
+			addr:        &net.UDPAddr{IP: net.ParseIP("::1"), Port: 69},
+			expectedNet: "udp6",
+		},
+		{
+			name:        "udp, no ip",
+			net:         "udp",
+			addr:        &net.UDPAddr{Port: 69},
+			expectedNet: "udp",
+		},
+		{
+			name:        "udp6 unchanged",
+			net:         "udp6",
+			addr:        &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 69},
+			expectedNet: "udp6",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if n := peerNet(c.net, c.addr); n != c.expectedNet {
+				t.Errorf("expected network %q, but it was %q", c.expectedNet, n)
+			}
+		})
+	}
+
+	// Reply socket for an IPv4 peer on a dual stack network is IPv4
+	conn, err := newConn("udp", ModeOctet, cases[0].addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.netConn.LocalAddr().(*net.UDPAddr).IP; ip.To4() == nil {
+		t.Errorf("expected IPv4 local address, but it was %s", ip)
+	}
+}
+
 func testWriteConn(t *testing.T, conn *net.UDPConn, addr *net.UDPAddr, dg datagram) error {
 	conn.SetWriteDeadline(time.Now().Add(testConnTimeout))
 	_, err := conn.WriteTo(dg.bytes(), addr)
@@ -871,6 +930,83 @@ func TestConn_readData(t *testing.T) {
 	}
 }
 
+func TestConn_readData_timing(t *testing.T) {
+	cases := []struct {
+		name          string
+		readTimeout   time.Duration
+		retryInterval time.Duration
+		retransmit    int
+
+		expectedAcks int
+		minDuration  time.Duration
+	}{
+		{
+			name:         "read timeout",
+			readTimeout:  20 * time.Millisecond,
+			retransmit:   3,
+			expectedAcks: 3,
+			minDuration:  60 * time.Millisecond,
+		},
+		{
+			name:          "retry interval",
+			readTimeout:   20 * time.Millisecond,
+			retryInterval: 30 * time.Millisecond,
+			retransmit:    3,
+			expectedAcks:  3,
+			minDuration:   150 * time.Millisecond,
+		},
+		{
+			name:         "retransmit",
+			readTimeout:  20 * time.Millisecond,
+			retransmit:   5,
+			expectedAcks: 5,
+			minDuration:  100 * time.Millisecond,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tConn, _, cNetConn, closer := testConns(t)
+			defer closer()
+			tConn.timeout = time.Second // Not used for reads when readTimeout is set
+			tConn.readTimeout = c.readTimeout
+			tConn.retryInterval = c.retryInterval
+			tConn.retransmit = c.retransmit
+
+			start := time.Now()
+			for state := tConn.readData; state != nil; {
+				state = state()
+			}
+			elapsed := time.Since(start)
+
+			if ErrorCause(tConn.err) != ErrMaxRetries {
+				t.Errorf("expected error %v, got %v", ErrMaxRetries, tConn.err)
+			}
+			if elapsed < c.minDuration || elapsed >= time.Second {
+				t.Errorf("expected duration between %s and 1s, but it was %s", c.minDuration, elapsed)
+			}
+
+			// Count ACKs sent before the final ERROR
+			var acks int
+			dg := datagram{buf: make([]byte, 516)}
+			for {
+				cNetConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, _, err := cNetConn.ReadFrom(dg.buf)
+				if err != nil {
+					break
+				}
+				dg.offset = n
+				if dg.opcode() == opCodeACK {
+					acks++
+				}
+			}
+			if acks != c.expectedAcks {
+				t.Errorf("expected %d ACKs, but there were %d", c.expectedAcks, acks)
+			}
+		})
+	}
+}
+
 func TestConn_ackData(t *testing.T) {
 	tDG := datagram{buf: make([]byte, 512)}
 
@@ -1124,6 +1260,18 @@ func TestConn_parseOptions(t *testing.T) {
 			expectedBlksize:     234,
 			expectedError:       "^$",
 		},
+		{
+			name: "blocksize, mixed case",
+			rx: func() datagram {
+				dg.writeOptionAck(options{"BlkSize": "234"})
+				return dg
+			},
+
+			expectOptionsParsed: true,
+			expectedOptions:     options{optBlocksize: "234"},
+			expectedBlksize:     234,
+			expectedError:       "^$",
+		},
 		{
 			name: "blocksize, invalid",
 			rx: func() datagram {
@@ -1158,6 +1306,41 @@ func TestConn_parseOptions(t *testing.T) {
 			expectedTimeout:     0,
 			expectedError:       `error parsing .* for option "timeout"`,
 		},
+		{
+			name: "utimeout, valid",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optUTimeout: "25000"})
+				return dg
+			},
+
+			expectedOptions:     options{optUTimeout: "25000"},
+			expectOptionsParsed: true,
+			expectedTimeout:     25 * time.Millisecond,
+			expectedError:       `^$`,
+		},
+		{
+			name: "utimeout, precedence over timeout",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optTimeout: "3", optUTimeout: "25000"})
+				return dg
+			},
+
+			expectedOptions:     options{optTimeout: "3", optUTimeout: "25000"},
+			expectOptionsParsed: true,
+			expectedTimeout:     25 * time.Millisecond,
+			expectedError:       `^$`,
+		},
+		{
+			name: "utimeout, out of range",
+			rx: func() datagram {
+				dg.writeOptionAck(options{optUTimeout: "0"})
+				return dg
+			},
+
+			expectOptionsParsed: false,
+			expectedTimeout:     0,
+			expectedError:       `error parsing .* for option "utimeout"`,
+		},
 		{
 			name: "tsize, valid, sending side",
 			rx: func() datagram {
@@ -1476,6 +1659,41 @@ func TestConn_write(t *testing.T) {
 	}
 }
 
+func TestConn_writeSetup_lossCap(t *testing.T) {
+	cases := []struct {
+		name      string
+		threshold float64
+		opts      options
+
+		expectedUnavailable bool
+	}{
+		{name: "flush negotiated", threshold: 0.2, opts: options{optFlush: "1"}},
+		{name: "flush declined", threshold: 0.2, opts: options{optWindowSize: "8"}, expectedUnavailable: true},
+		{name: "cap disabled", opts: options{optWindowSize: "8"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tConn, err := newConn("udp4", ModeOctet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 69})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tConn.netConn.Close()
+			tConn.isClient = true
+			tConn.lossThreshold = c.threshold
+			tConn.rx.writeOptionAck(c.opts)
+
+			tConn.writeSetup()
+			if tConn.err != nil {
+				t.Fatal(tConn.err)
+			}
+			if tConn.stats.LossCapUnavailable != c.expectedUnavailable {
+				t.Errorf("expected LossCapUnavailable %t, got %t", c.expectedUnavailable, tConn.stats.LossCapUnavailable)
+			}
+		})
+	}
+}
+
 func TestConn_Close(t *testing.T) {
 	dg := datagram{buf: make([]byte, 512)}
 
@@ -1593,6 +1811,19 @@ func TestConn_Close(t *testing.T) {
 	}
 }
 
+func TestConn_Close_twice(t *testing.T) {
+	tConn, err := newConn("udp", ModeOctet, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 69})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tConn.Close(); err != nil {
+			t.Errorf("close %d: expected no error, got %v", i+1, err)
+		}
+	}
+}
+
 func TestConn_read(t *testing.T) {
 	dg := datagram{buf: make([]byte, 512)}
 
@@ -1780,6 +2011,67 @@ func TestConn_sendError(t *testing.T) {
 	}
 }
 
+func TestConn_sendOACK(t *testing.T) {
+	large := options{}
+	for i := 0; len(large) < 40; i++ {
+		large[fmt.Sprintf("option-%02d", i)] = "value"
+	}
+
+	cases := []struct {
+		name string
+		opts options
+
+		expectedOpcode opcode
+		expectedError  error
+	}{
+		{
+			name: "fits",
+			opts: options{optBlocksize: "1024", optTransferSize: "12345"},
+
+			expectedOpcode: opCodeOACK,
+		},
+		{
+			name: "too large",
+			opts: large,
+
+			expectedOpcode: opCodeERROR,
+			expectedError:  ErrOACKTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tConn, _, cNetConn, closer := testConns(t)
+			defer closer()
+
+			next := tConn.sendOACK(c.opts)()
+			if c.expectedError != nil {
+				// Run the error state
+				for next != nil {
+					next = next()
+				}
+			}
+			if ErrorCause(tConn.err) != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, tConn.err)
+			}
+
+			dg := datagram{buf: make([]byte, 1024)}
+			cNetConn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := cNetConn.ReadFrom(dg.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dg.offset = n
+			if dg.opcode() != c.expectedOpcode {
+				t.Fatalf("expected %s, got %s", c.expectedOpcode, dg)
+			}
+			if c.expectedOpcode == opCodeERROR && dg.errorCode() != ErrCodeOptionNegotiation {
+				t.Errorf("expected error code %s, got %s", ErrCodeOptionNegotiation, dg.errorCode())
+			}
+		})
+	}
+}
+
 func ptrInt64(i int64) *int64 {
 	return &i
 }
@@ -57,6 +57,8 @@ const (
 	ErrCodeFileAlreadyExists ErrorCode = 0x6
 	// ErrCodeNoSuchUser - No such user.
 	ErrCodeNoSuchUser ErrorCode = 0x7
+	// ErrCodeOptionNegotiation - Terminate transfer due to option negotiation (RFC 2347).
+	ErrCodeOptionNegotiation ErrorCode = 0x8
 
 	// ModeNetASCII is the string for netascii transfer mode
 	ModeNetASCII TransferMode = "netascii"
@@ -66,8 +68,15 @@ const (
 
 	optBlocksize    = "blksize"
 	optTimeout      = "timeout"
+	optUTimeout     = "utimeout" // Non-standard, microseconds
 	optTransferSize = "tsize"
 	optWindowSize   = "windowsize"
+	optFlush        = "flush"      // Non-standard, see ClientFlush
+	optOffset       = "offset"     // Non-standard, see Client.GetAt
+	optCompress     = "compress"   // Non-standard, see ClientCompress
+	optIfNotMatch   = "ifnotmatch" // Non-standard, see ClientIfNotMatch
+
+	compressGzip = "gzip" // Value of optCompress
 )
 
 // TransferMode is a TFTP transer mode
@@ -83,6 +92,7 @@ var (
 		ErrCodeUnknownTransferID: "UNKNOWN_TRANSFER_ID",
 		ErrCodeFileAlreadyExists: "FILE_ALREADY_EXISTS",
 		ErrCodeNoSuchUser:        "NO_SUCH_USER",
+		ErrCodeOptionNegotiation: "OPTION_NEGOTIATION",
 	}
 	opcodeStrings = map[opcode]string{
 		opCodeRRQ:   "READ_REQUEST",
@@ -120,6 +130,27 @@ func (d datagram) String() string {
 	}
 }
 
+// summary formats d compactly, such as "DATA 3", "ACK 2" or "ERROR NOT_DEFINED".
+func (d *datagram) summary() string {
+	if d.offset < 2 {
+		return "INVALID_DATAGRAM"
+	}
+	switch op := d.opcode(); op {
+	case opCodeDATA, opCodeACK:
+		if d.offset < 4 {
+			return op.String()
+		}
+		return fmt.Sprintf("%s %d", op, d.block())
+	case opCodeERROR:
+		if d.offset < 4 {
+			return op.String()
+		}
+		return fmt.Sprintf("%s %s", op, d.errorCode())
+	default:
+		return op.String()
+	}
+}
+
 // Sets the buffer from raw bytes
 func (d *datagram) setBytes(b []byte) {
 	d.buf = b
@@ -235,14 +266,21 @@ func (d *datagram) errMsg() string {
 
 // Filename from RRQ and WRQ datagrams
 func (d *datagram) filename() string {
-	offset := bytes.IndexByte(d.buf[2:], 0x0) + 2
-	return string(d.buf[2:offset])
+	b := d.buf[2:d.offset]
+	if i := bytes.IndexByte(b, 0x0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
 }
 
 // Mode from RRQ and WRQ datagrams
 func (d *datagram) mode() TransferMode {
-	fields := bytes.Split(d.buf[2:], []byte{0x0})
-	return TransferMode(fields[1])
+	fields := bytes.Split(d.buf[2:d.offset], []byte{0x0})
+	if len(fields) < 2 {
+		return ""
+	}
+	// Modes are case insensitive
+	return TransferMode(strings.ToLower(string(fields[1])))
 }
 
 // Opcode from all datagrams
@@ -261,20 +299,54 @@ func (o options) String() string {
 	return "{" + strings.Join(opts, "; ") + "}"
 }
 
+// copy returns a copy of o that can be handed to API consumers.
+func (o options) copy() map[string]string {
+	c := make(map[string]string, len(o))
+	for k, v := range o {
+		c[k] = v
+	}
+	return c
+}
+
 func (d *datagram) options() options {
 	options := make(options)
 
+	op := d.opcode()
+	if op != opCodeRRQ && op != opCodeWRQ && op != opCodeOACK {
+		return options // Only these carry options
+	}
+
 	optSlice := bytes.Split(d.buf[2:d.offset-1], []byte{0x0}) // d.buf[2:d.offset-1] = file -> just before final NULL
-	if op := d.opcode(); op == opCodeRRQ || op == opCodeWRQ {
+	if op == opCodeRRQ || op == opCodeWRQ {
+		if len(optSlice) < 2 {
+			return options // No mode, so no options
+		}
 		optSlice = optSlice[2:] // Remove filename, mode
 	}
 
-	for i := 0; i < len(optSlice); i += 2 {
-		options[string(optSlice[i])] = string(optSlice[i+1])
+	for i := 0; i+1 < len(optSlice); i += 2 {
+		// RFC2347: option names are case insensitive
+		options[strings.ToLower(string(optSlice[i]))] = string(optSlice[i+1])
 	}
 	return options
 }
 
+// exceedsOptions reports whether a request has more than max options.
+// The options are counted without being parsed, stopping at the limit.
+func (d *datagram) exceedsOptions(max int) bool {
+	limit := 2 + 2*max // Filename and mode, then name and value for each option
+	var nulls int
+	for _, b := range d.buf[2:d.offset] {
+		if b == 0x0 {
+			nulls++
+			if nulls > limit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // BUFFER WRITING FUNCTIONS
 func (d *datagram) writeBytes(b []byte) {
 	copy(d.buf[d.offset:], b)
@@ -308,19 +380,24 @@ func (d *datagram) validate() error {
 	switch {
 	case d.offset < 2:
 		return errors.New("Datagram has no opcode")
-	case d.opcode() > 6:
+	case d.offset > len(d.buf):
+		return errors.New("Datagram offset exceeds buffer")
+	case d.opcode() < 1 || d.opcode() > 6:
 		return errors.New("Invalid opcode")
 	}
 
 	switch d.opcode() {
 	case opCodeRRQ, opCodeWRQ:
+		// Structure must be checked before accessing fields
 		switch {
-		case len(d.filename()) < 1:
-			return errors.New("No filename provided")
 		case d.buf[d.offset-1] != 0x0: // End with NULL
 			return fmt.Errorf("Corrupt %v datagram", d.opcode())
+		case bytes.Count(d.buf[2:d.offset], []byte{0x0}) == 1 && len(d.filename()) > 0: // Filename without a mode
+			return errInvalidMode
 		case bytes.Count(d.buf[2:d.offset], []byte{0x0})%2 != 0: // Number of NULL chars is not even
 			return fmt.Errorf("Corrupt %v datagram", d.opcode())
+		case len(d.filename()) < 1:
+			return errors.New("No filename provided")
 		default:
 			switch d.mode() {
 			case ModeNetASCII, ModeOctet:
@@ -328,7 +405,7 @@ func (d *datagram) validate() error {
 			case modeMail:
 				return errors.New("MAIL transfer mode is unsupported")
 			default:
-				return errors.New("Invalid transfer mode")
+				return errInvalidMode
 			}
 		}
 	case opCodeACK, opCodeDATA:
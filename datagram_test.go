@@ -6,6 +6,7 @@ package tftp // import "pack.ag/tftp"
 
 import (
 	"bytes"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -230,6 +231,20 @@ func TestDatagram(t *testing.T) {
 			offset: 20,
 			code:   opCodeDATA,
 		},
+		{
+			name: "data, zeroed payload",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeData(1, make([]byte, 3))
+				return dg
+			}(),
+
+			valid:  true,
+			len:    7,
+			offset: 7,
+			code:   opCodeDATA,
+			opts:   options{},
+		},
 		{
 			name: "RRQ",
 			dg: func() datagram {
@@ -286,6 +301,36 @@ func TestDatagram(t *testing.T) {
 			code:   opCodeOACK,
 			opts:   options{optBlocksize: "345"},
 		},
+		{
+			name: "RRQ, mixed case options",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeReadReq("the file", ModeOctet, options{"BLKSIZE": "1024", "TSize": "0", "windowSize": "4"})
+				return dg
+			}(),
+
+			valid:    true,
+			len:      51,
+			offset:   51,
+			code:     opCodeRRQ,
+			filename: ptrString("the file"),
+			mode:     ptrMode(ModeOctet),
+			opts:     options{optBlocksize: "1024", optTransferSize: "0", optWindowSize: "4"},
+		},
+		{
+			name: "OACK, mixed case options",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeOptionAck(options{"Blksize": "345", "TIMEOUT": "2"})
+				return dg
+			}(),
+
+			valid:  true,
+			len:    24,
+			offset: 24,
+			code:   opCodeOACK,
+			opts:   options{optBlocksize: "345", optTimeout: "2"},
+		},
 		{
 			name: "error",
 			dg: func() datagram {
@@ -373,6 +418,32 @@ func TestDatagram(t *testing.T) {
 
 			valid: false,
 		},
+		{
+			name: "empty mode",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeReadReq("file", "", options{})
+				return dg
+			}(),
+
+			valid: false,
+		},
+		{
+			name: "uppercase mode",
+			dg: func() datagram {
+				dg := datagram{}
+				dg.writeReadReq("file", "OCTET", options{})
+				return dg
+			}(),
+
+			valid:    true,
+			len:      13,
+			offset:   13,
+			code:     opCodeRRQ,
+			filename: ptrString("file"),
+			mode:     ptrMode(ModeOctet),
+			opts:     options{},
+		},
 		{
 			name: "corrupt block #",
 			dg: func() datagram {
@@ -504,3 +575,129 @@ func ptrMode(s TransferMode) *TransferMode {
 func ptrErrCode(e ErrorCode) *ErrorCode {
 	return &e
 }
+
+func TestDatagram_truncated(t *testing.T) {
+	var dgs []datagram
+	for _, f := range []func(*datagram){
+		func(dg *datagram) { dg.writeAck(3) },
+		func(dg *datagram) { dg.writeData(314, []byte("this is the data")) },
+		func(dg *datagram) { dg.writeError(ErrCodeDiskFull, "the message") },
+		func(dg *datagram) { dg.writeReadReq("the file", ModeNetASCII, options{optBlocksize: "1024"}) },
+		func(dg *datagram) { dg.writeWriteReq("a file", ModeOctet, options{optTransferSize: "0"}) },
+		func(dg *datagram) { dg.writeOptionAck(options{optWindowSize: "4", optTimeout: "2"}) },
+	} {
+		var dg datagram
+		f(&dg)
+		dgs = append(dgs, dg)
+	}
+
+	exercise := func(t *testing.T, b []byte, bufLen int) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("panic parsing % x: %v", b, r)
+			}
+		}()
+
+		// Reused receive buffers are larger than the datagram and may
+		// contain stale data beyond offset.
+		buf := bytes.Repeat([]byte{'x'}, bufLen)
+		copy(buf, b)
+		dg := datagram{buf: buf, offset: len(b)}
+
+		_ = dg.String()
+		if err := dg.validate(); err != nil {
+			return
+		}
+		switch dg.opcode() {
+		case opCodeRRQ, opCodeWRQ:
+			dg.filename()
+			dg.mode()
+			dg.options()
+		case opCodeOACK:
+			dg.options()
+		case opCodeDATA:
+			dg.block()
+			dg.data()
+		case opCodeACK:
+			dg.block()
+		case opCodeERROR:
+			dg.errorCode()
+			dg.errMsg()
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, dg := range dgs {
+		b := dg.bytes()
+		t.Run(dg.opcode().String(), func(t *testing.T) {
+			// Every truncation
+			for i := 0; i <= len(b); i++ {
+				exercise(t, b[:i], len(b))
+				exercise(t, b[:i], 516)
+			}
+
+			// Random corruption of truncations
+			for i := 0; i < 1000; i++ {
+				p := append([]byte(nil), b[:rnd.Intn(len(b)+1)]...)
+				for j := 0; j < len(p) && j < 3; j++ {
+					p[rnd.Intn(len(p))] = byte(rnd.Intn(256))
+				}
+				exercise(t, p, len(p)+rnd.Intn(8))
+			}
+		})
+	}
+}
+
+func FuzzDatagram(f *testing.F) {
+	// Seed corpus of well formed datagrams
+	var dg datagram
+	dg.writeReadReq("pxelinux.0", ModeOctet, options{optBlocksize: "1468", optTransferSize: "0"})
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeWriteReq("upload.log", ModeNetASCII, options{optWindowSize: "16", optTimeout: "3"})
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeReadReq("plain", ModeOctet, nil)
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeData(1, []byte("the data"))
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeData(65535, nil)
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeAck(0)
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeError(ErrCodeFileNotFound, "File not found")
+	f.Add(append([]byte(nil), dg.bytes()...))
+	dg.writeOptionAck(options{optBlocksize: "1468", optTransferSize: "1048576"})
+	f.Add(append([]byte(nil), dg.bytes()...))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var dg datagram
+		dg.setBytes(b)
+
+		str := dg.String()
+		if err := dg.validate(); err != nil {
+			return
+		}
+
+		switch dg.opcode() {
+		case opCodeRRQ, opCodeWRQ:
+			if dg.filename() == "" {
+				t.Errorf("valid %s has empty filename", str)
+			}
+			switch dg.mode() {
+			case ModeNetASCII, ModeOctet:
+			default:
+				t.Errorf("valid %s has unsupported mode", str)
+			}
+			dg.options()
+		case opCodeOACK:
+			dg.options()
+		case opCodeDATA:
+			dg.block()
+			dg.data()
+		case opCodeACK:
+			dg.block()
+		case opCodeERROR:
+			dg.errorCode()
+			dg.errMsg()
+		}
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// DecompressingReadHandler wraps inner, which serves gzip compressed
+// content, decompressing it as it's sent to the client. The content is
+// streamed, memory use doesn't depend on the size of the file.
+//
+// When inner serves files with ServeReaderAt, as FileServer does, the tsize
+// is read from the gzip trailer. This is only correct for files with a single
+// gzip member of less than 4 GiB uncompressed, as written by gzip and
+// compress/gzip. Otherwise inner may call WriteSize with the decompressed
+// size before its first Write, such as from a sidecar file, or no tsize is sent.
+//
+// Offsets requested by clients are declined. Flush, ExtendDeadline, and Pause
+// have no effect when called by inner. If the content isn't valid gzip an
+// error is sent to the client.
+func DecompressingReadHandler(inner ReadHandler) ReadHandler {
+	return &decompressingReadHandler{inner: inner, log: newLogger("decompress")}
+}
+
+type decompressingReadHandler struct {
+	inner ReadHandler
+	log   *logger
+}
+
+// ServeTFTP calls inner, decompressing the data it writes.
+func (h *decompressingReadHandler) ServeTFTP(w ReadRequest) {
+	pr, pw := io.Pipe()
+	dw := &decompressingReadRequest{ReadRequest: w, pw: pw, done: make(chan struct{})}
+	go dw.decompress(pr)
+
+	h.inner.ServeTFTP(dw)
+	dw.finish()
+	if dw.invalid != nil && !dw.failed {
+		h.log.err("Decompressing %q: %v", w.Name(), dw.invalid)
+		w.WriteError(ErrCodeNotDefined, "Invalid compressed file")
+	}
+}
+
+// decompressingReadRequest passes data written by inner through a gzip
+// reader. Decompressed data is written to ReadRequest from a separate
+// goroutine, methods which would use the transfer concurrently are
+// overridden to have no effect.
+type decompressingReadRequest struct {
+	ReadRequest
+	pw   *io.PipeWriter
+	done chan struct{} // Closed once decompression ends
+
+	size    *int64 // Decompressed size, if known
+	failed  bool   // WriteError was called
+	invalid error  // Error decompressing, rather than sending, the content
+}
+
+// decompress copies decompressed data from pr to ReadRequest until the
+// gzip stream ends or an error occurs.
+func (w *decompressingReadRequest) decompress(pr *io.PipeReader) {
+	defer close(w.done)
+
+	zr, err := gzip.NewReader(pr)
+	if err != nil {
+		w.invalid = err
+		pr.CloseWithError(err)
+		return
+	}
+	// Reading the gzip header waited for inner's first Write
+	if w.size != nil {
+		w.ReadRequest.WriteSize(*w.size)
+	}
+
+	var writeErr error
+	_, err = io.Copy(writerFunc(func(p []byte) (int, error) {
+		n, err := w.ReadRequest.Write(p)
+		writeErr = err
+		return n, err
+	}), zr)
+	if err != nil && writeErr == nil {
+		w.invalid = err
+	}
+	// Writes by inner fail once the stream has ended
+	pr.CloseWithError(err)
+}
+
+// finish ends the compressed stream and waits for decompression to complete.
+func (w *decompressingReadRequest) finish() {
+	w.pw.Close()
+	<-w.done
+}
+
+// serveCompressed sends the gzip compressed content of r for ServeReaderAt
+// within DecompressingReadHandler, taking the size from the gzip trailer.
+// w is the request passed to ServeReaderAt, which wraps the
+// decompressingReadRequest, possibly through other middleware.
+func serveCompressed(w ReadRequest, r io.ReaderAt, size int64) error {
+	const minGzipSize = 18 // 10 byte header and 8 byte trailer
+	if size >= minGzipSize {
+		var isize [4]byte
+		if _, err := r.ReadAt(isize[:], size-4); err == nil {
+			w.WriteSize(int64(binary.LittleEndian.Uint32(isize[:])))
+		}
+	}
+	_, err := io.Copy(w, io.NewSectionReader(r, 0, size))
+	return err
+}
+
+// Unwrap returns the request decompressed data is written to.
+func (w *decompressingReadRequest) Unwrap() ReadRequest {
+	return w.ReadRequest
+}
+
+func (w *decompressingReadRequest) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// WriteSize sets the decompressed size.
+func (w *decompressingReadRequest) WriteSize(i int64) {
+	w.size = &i
+}
+
+func (w *decompressingReadRequest) WriteError(c ErrorCode, s string) {
+	w.failed = true
+	w.pw.CloseWithError(errResponseFailed)
+	<-w.done
+	w.ReadRequest.WriteError(c, s)
+}
+
+func (w *decompressingReadRequest) Flush() error                       { return nil }
+func (w *decompressingReadRequest) ExtendDeadline(time.Duration) error { return nil }
+func (w *decompressingReadRequest) Offset() int64                      { return 0 }
+func (w *decompressingReadRequest) Pause() error                       { return nil }
+func (w *decompressingReadRequest) Resume()                            {}
@@ -0,0 +1,167 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressingReadHandler(t *testing.T) {
+	text := getTestData(t, "text")
+	compressed := gzipData(t, text)
+
+	cases := []struct {
+		name  string
+		inner ReadHandlerFunc
+
+		expectedData []byte
+		expectedSize *int64
+		expectedCode ErrorCode
+	}{
+		{
+			name: "chunked writes",
+			inner: func(w ReadRequest) {
+				for i := 0; i < len(compressed); i += 100 {
+					end := i + 100
+					if end > len(compressed) {
+						end = len(compressed)
+					}
+					w.Write(compressed[i:end])
+				}
+			},
+
+			expectedData: text,
+		},
+		{
+			name: "size from inner",
+			inner: func(w ReadRequest) {
+				w.WriteSize(int64(len(text)))
+				w.Write(compressed)
+			},
+
+			expectedData: text,
+			expectedSize: ptrInt64(int64(len(text))),
+		},
+		{
+			name: "size from trailer",
+			inner: func(w ReadRequest) {
+				ServeReaderAt(w, bytes.NewReader(compressed), int64(len(compressed)))
+			},
+
+			expectedData: text,
+			expectedSize: ptrInt64(int64(len(text))),
+		},
+		{
+			name: "not compressed",
+			inner: func(w ReadRequest) {
+				w.Write(text)
+			},
+
+			expectedCode: ErrCodeNotDefined,
+		},
+		{
+			name: "truncated",
+			inner: func(w ReadRequest) {
+				w.Write(compressed[:len(compressed)/2])
+			},
+
+			expectedCode: ErrCodeNotDefined,
+		},
+		{
+			name: "error from inner",
+			inner: func(w ReadRequest) {
+				w.WriteError(ErrCodeFileNotFound, "not found")
+			},
+
+			expectedCode: ErrCodeFileNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := readRequestMock{name: "file"}
+			DecompressingReadHandler(c.inner).ServeTFTP(&req)
+
+			if c.expectedData != nil && !bytes.Equal(req.writer.Bytes(), c.expectedData) {
+				t.Errorf("expected %d bytes of decompressed data, got %d bytes that don't match", len(c.expectedData), req.writer.Len())
+			}
+			if c.expectedSize == nil && req.size != nil {
+				t.Errorf("expected no size, got %d", *req.size)
+			} else if c.expectedSize != nil && (req.size == nil || *req.size != *c.expectedSize) {
+				t.Errorf("expected size %d, got %v", *c.expectedSize, req.size)
+			}
+			if req.errCode != c.expectedCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedCode, req.errCode, req.errMsg)
+			}
+		})
+	}
+}
+
+func TestDecompressingReadHandler_FileServer(t *testing.T) {
+	text := getTestData(t, "text")
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "text.gz"), gzipData(t, text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		inner ReadHandler
+	}{
+		{name: "file server", inner: FileServer(dir)},
+		// Size is still read from the trailer through the cache's request
+		{name: "cached", inner: CachingReadHandler(FileServer(dir), 1<<20, time.Minute)},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, port, close := newTestServer(t, false, DecompressingReadHandler(c.inner).ServeTFTP, nil)
+			defer close()
+
+			client, err := NewClient(ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/text.gz", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size, err := resp.Size(); err != nil || size != int64(len(text)) {
+				t.Errorf("expected size %d, got %d (%v)", len(text), size, err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, text) {
+				t.Errorf("expected %d bytes of decompressed data, received %d bytes that don't match", len(text), len(received))
+			}
+		})
+	}
+}
@@ -12,6 +12,12 @@ import (
 var (
 	// errBlockSequnce is a sentinel error used internally, never returned to API clients.
 	errBlockSequence = errors.New("block sequence error")
+	// errInvalidMode is returned when validating a request with an empty or
+	// unrecognized transfer mode, so the server can apply ServerStrictMode.
+	errInvalidMode = errors.New("Invalid transfer mode")
+	// errChannelTimeout is returned by reads in single port mode when no
+	// datagram arrives in time.
+	errChannelTimeout = errors.New("timeout reading from channel")
 	// ErrInvalidURL indicates that the URL passed to Get or Put is invalid.
 	ErrInvalidURL = errors.New("invalid URL")
 	// ErrInvalidHostIP indicates an empty or invalid host.
@@ -31,14 +37,101 @@ var (
 	ErrInvalidBlocksize = errors.New("invalid blocksize: must be between 8 and 65464")
 	// ErrInvalidTimeout indicates that a timeout outside the range 1 to 255 was configured.
 	ErrInvalidTimeout = errors.New("invalid timeout: must be between 1 and 255")
+	// ErrInvalidUTimeout indicates that a utimeout outside the range 1µs to 255s was configured.
+	ErrInvalidUTimeout = errors.New("invalid utimeout: must be between 1µs and 255s")
 	// ErrInvalidWindowsize indicates that a windowsize outside the range 1 to 65535 was configured.
 	ErrInvalidWindowsize = errors.New("invalid windowsize: must be between 1 and 65535")
+	// ErrInvalidPipelineDepth indicates that a pipeline depth outside the range 1 to 16 was configured.
+	ErrInvalidPipelineDepth = errors.New("invalid pipeline depth: must be between 1 and 16")
 	// ErrInvalidMode indicates that a mode other than ModeNetASCII or ModeOctet was configured.
 	ErrInvalidMode = errors.New("invalid transfer mode: must be ModeNetASCII or ModeOctet")
 	// ErrInvalidRetransmit indicates that the retransmit limit was configured with a negative value.
 	ErrInvalidRetransmit = errors.New("invalid retransmit: cannot be negative")
+	// ErrInvalidMaxRequestSize indicates that a max request size outside the range 512 to 65535 was configured.
+	ErrInvalidMaxRequestSize = errors.New("invalid max request size: must be between 512 and 65535")
+	// ErrInvalidMaxOptions indicates that a max options less than 1 was configured.
+	ErrInvalidMaxOptions = errors.New("invalid max options: must be at least 1")
+	// ErrInvalidConcurrency indicates that a concurrency less than 1 was configured.
+	ErrInvalidConcurrency = errors.New("invalid concurrency: must be at least 1")
+	// ErrInvalidLossThreshold indicates that a loss threshold outside the range 0 to 1 (exclusive) was configured.
+	ErrInvalidLossThreshold = errors.New("invalid loss threshold: must be between 0 and 1")
+	// ErrInvalidErrorMessage indicates that an error message containing a NUL byte was configured.
+	ErrInvalidErrorMessage = errors.New("invalid error message: cannot contain NUL bytes")
+	// ErrInvalidDuration indicates that a negative duration was configured.
+	ErrInvalidDuration = errors.New("invalid duration: cannot be negative")
+	// ErrInvalidRateLimit indicates that a negative rate limit was configured.
+	ErrInvalidRateLimit = errors.New("invalid rate limit: cannot be negative")
+	// ErrInvalidThroughput indicates that a negative throughput was configured.
+	ErrInvalidThroughput = errors.New("invalid throughput: cannot be negative")
+	// ErrInvalidMTU indicates that an MTU less than 68, other than 0, was configured.
+	ErrInvalidMTU = errors.New("invalid MTU: must be 0 or at least 68")
+	// ErrInvalidLogFormat indicates that a log format other than LogFormatText or LogFormatJSON was configured.
+	ErrInvalidLogFormat = errors.New("invalid log format: must be LogFormatText or LogFormatJSON")
+	// ErrInvalidETag indicates that an ETag containing a NUL byte was configured.
+	ErrInvalidETag = errors.New("invalid etag: cannot contain NUL bytes")
+	// ErrReuseNotSupported indicates ServerReuseAddr or ServerReusePort was
+	// enabled on a platform without support for the socket options.
+	ErrReuseNotSupported = errors.New("SO_REUSEADDR/SO_REUSEPORT not supported on this platform")
+	// ErrFlushNotNegotiated indicates Flush was called on a transfer where the
+	// client didn't request the flush option.
+	ErrFlushNotNegotiated = errors.New("flush option not negotiated")
+	// ErrUnsupportedRequest indicates a function such as Flush was called
+	// with a request which doesn't implement it, nor wraps one which does.
+	ErrUnsupportedRequest = errors.New("request doesn't support the operation")
+	// ErrNoDataSent indicates Pause was called before any DATA had been sent,
+	// leaving nothing to resend to the client.
+	ErrNoDataSent = errors.New("no data sent to resend while paused")
+	// ErrClientClosed indicates a request was made after the client was closed.
+	ErrClientClosed = errors.New("client closed")
+	// ErrServerClosing indicates a transfer was aborted because the server
+	// was closed, by Close or by Shutdown after its context was done.
+	ErrServerClosing = errors.New("server closing")
+	// ErrTransferAborted indicates a transfer was ended by Server.AbortTransfer.
+	ErrTransferAborted = errors.New("transfer aborted")
+	// ErrTransferNotFound indicates Server.AbortTransfer was called with the
+	// ID of a transfer which isn't active.
+	ErrTransferNotFound = errors.New("transfer not found")
+	// ErrInvalidOffset indicates a negative offset, or an offset in netascii mode
+	// or beyond the end of the file.
+	ErrInvalidOffset = errors.New("invalid offset")
+	// ErrOffsetNotAccepted indicates the server didn't accept the offset requested with GetAt.
+	ErrOffsetNotAccepted = errors.New("offset not accepted by server")
+	// ErrOACKTooLarge indicates that the options acknowledged for a transfer
+	// would result in an OACK exceeding the 512 byte limit of RFC 2347.
+	ErrOACKTooLarge = errors.New("OACK too large")
+	// ErrUnexpectedServerIP indicates responses to a request were received only
+	// from IPs other than the server's (see ClientVerifyServerIP).
+	ErrUnexpectedServerIP = errors.New("response from unexpected server IP")
+	// ErrTooManyRedirects indicates a request was redirected more times than
+	// the client will follow (see ClientFollowRedirect).
+	ErrTooManyRedirects = errors.New("too many redirects")
+	// ErrPeerUnreachable indicates the remote's host reported the transfer's
+	// port unreachable with ICMP, the peer is gone and the transfer was ended
+	// without further retransmissions. Only reported on platforms which
+	// surface ICMP errors on unconnected UDP sockets, such as Linux.
+	ErrPeerUnreachable = errors.New("peer unreachable")
+	// ErrStopStream can be returned by the function passed to Client.Stream
+	// to end the transfer early without Stream returning an error.
+	ErrStopStream = errors.New("stop stream")
+	// ErrNotModified indicates the server's version of a file matched the
+	// ETag sent with ClientIfNotMatch, so it wasn't transferred. It's also
+	// returned by WriteETag after the client has been told.
+	ErrNotModified = errors.New("not modified")
 	// ErrMaxRetries indicates that the maximum number of retries has been reached.
 	ErrMaxRetries = errors.New("max retries reached")
+	// ErrWriteIdleTimeout indicates a client didn't begin sending data within
+	// the limit configured with ServerWriteIdleTimeout.
+	ErrWriteIdleTimeout = errors.New("write idle timeout: no data received")
+	// ErrTransferDeadline indicates a transfer was aborted because it took
+	// longer than the limit configured with ServerTransferDeadline.
+	ErrTransferDeadline = errors.New("transfer deadline exceeded")
+	// ErrUnexpectedEOF indicates that all data was received according to tsize,
+	// but the sender never completed the transfer with a final, short DATA block.
+	ErrUnexpectedEOF = errors.New("unexpected end of transfer")
+	// ErrVerifyMismatch indicates that a file read back after Put didn't match the data written.
+	ErrVerifyMismatch = errors.New("verification failed: file read back does not match data written")
+	// ErrMaxTotalRetransmits indicates that the maximum number of retransmissions for a transfer has been reached.
+	ErrMaxTotalRetransmits = errors.New("max total retransmits reached")
 )
 
 type errUnexpectedDatagram struct {
@@ -58,7 +151,9 @@ func IsUnexpectedDatagram(err error) bool {
 }
 
 type errRemoteError struct {
-	dg string
+	dg   string
+	code ErrorCode
+	msg  string
 }
 
 func (e *errRemoteError) Error() string {
@@ -73,6 +168,43 @@ func IsRemoteError(err error) bool {
 	return ok
 }
 
+// NetworkError is returned when reading from or writing to the
+// underlying network connection fails, as opposed to a protocol error
+// or an error sent by the remote client/server.
+type NetworkError struct {
+	Op  string // "read" or "write"
+	Err error  // Error returned by the network connection
+}
+
+func (e *NetworkError) Error() string {
+	return e.Err.Error()
+}
+
+// Timeout reports whether the error was caused by a deadline expiring.
+func (e *NetworkError) Timeout() bool {
+	t, ok := e.Err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
+
+// IsNetworkError allows a consumer to check if an error
+// was caused by the underlying network connection.
+func IsNetworkError(err error) bool {
+	err = ErrorCause(err)
+	_, ok := err.(*NetworkError)
+	return ok
+}
+
+// isTimeout reports whether err is a read timing out.
+func isTimeout(err error) bool {
+	if ErrorCause(err) == errChannelTimeout {
+		return true
+	}
+	ne, ok := ErrorCause(err).(*NetworkError)
+	return ok && ne.Timeout()
+}
+
 type errParsingOption struct {
 	option string
 	value  string
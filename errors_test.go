@@ -108,6 +108,40 @@ func TestIsOptionParsingError(t *testing.T) {
 	}
 }
 
+func TestIsNetworkError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+
+		expected bool
+	}{
+		{
+			name:     "true",
+			err:      &NetworkError{Op: "write", Err: errBlockSequence},
+			expected: true,
+		},
+		{
+			name:     "true, wrapped",
+			err:      wrapError(&NetworkError{Op: "write", Err: errBlockSequence}, "testing"),
+			expected: true,
+		},
+		{
+			name:     "false, remote error",
+			err:      wrapError(&errRemoteError{}, "testing"),
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := IsNetworkError(c.err)
+			if result != c.expected {
+				t.Errorf("expected to IsNetworkError %t, but it wasn't", c.expected)
+			}
+		})
+	}
+}
+
 func TestErrorStrings(t *testing.T) {
 	dg := datagram{}
 	dg.writeAck(68)
@@ -127,6 +161,11 @@ func TestErrorStrings(t *testing.T) {
 			err:      &errRemoteError{dg: dg.String()},
 			expected: `remote error: ACK[Block: 68]`,
 		},
+		{
+			name:     "network error",
+			err:      &NetworkError{Op: "write", Err: errBlockSequence},
+			expected: errBlockSequence.Error(),
+		},
 		{
 			name:     "parse error",
 			err:      &errParsingOption{option: "timeout", value: "a"},
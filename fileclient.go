@@ -0,0 +1,170 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// FileClient retrieves files to disk, retrying failed transfers.
+//
+// Files are downloaded to a temporary file in the destination directory
+// and renamed into place once complete and verified, so a partially
+// transferred file is never left at the destination.
+type FileClient struct {
+	// Client performs the transfers.
+	Client *Client
+
+	// Attempts is the number of times a transfer is tried before
+	// giving up. Values less than 1 are treated as 1.
+	Attempts int
+
+	// RetryDelay is the pause between attempts.
+	RetryDelay time.Duration
+
+	// Verify, if set, is called with the content of each downloaded file
+	// before it's moved into place, such as to compare a checksum. If an
+	// error is returned the file is discarded and the transfer retried.
+	Verify func(url string, r io.Reader) error
+
+	// Progress, if set, is called as data is received with the number
+	// of bytes received so far and the transfer size, or -1 if the
+	// server didn't report it. It's called again from 0 on each attempt.
+	Progress func(url string, n, size int64)
+}
+
+// NewFileClient returns a FileClient using c, which makes up to 3 attempts
+// with a 1 second delay between them.
+func NewFileClient(c *Client) *FileClient {
+	return &FileClient{
+		Client:     c,
+		Attempts:   3,
+		RetryDelay: time.Second,
+	}
+}
+
+// GetToFile retrieves url and writes it to path, replacing any existing file.
+//
+// URL is in the format tftp://[server]:[port]/[file]
+//
+// Errors that can't be resolved by retrying, such as the file not existing
+// on the server, are returned immediately. Otherwise the error from the
+// last attempt is returned.
+func (fc *FileClient) GetToFile(url, path string) error {
+	var err error
+	for i := 0; i < fc.Attempts || i == 0; i++ {
+		if i > 0 {
+			fc.Client.log.debug("Retrying %s after attempt %d failed: %v", url, i, err)
+			time.Sleep(fc.RetryDelay)
+		}
+
+		err = fc.getToFile(url, path)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// getToFile makes a single attempt for GetToFile.
+func (fc *FileClient) getToFile(url, path string) error {
+	resp, err := fc.Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer errorDefer(resp.conn.Close, fc.Client.log, "error closing network connection in GetToFile")
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := createTemp(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly once renamed
+
+	var r io.Reader = resp
+	if fc.Progress != nil {
+		size, err := resp.Size()
+		if err != nil {
+			size = -1
+		}
+		r = &progressReader{r: resp, fn: func(n int64) { fc.Progress(url, n, size) }}
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil && fc.Verify != nil {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			err = wrapError(fc.Verify(url, f), "verifying "+url)
+		}
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// isRetryable reports whether a failed transfer may succeed if tried again.
+func isRetryable(err error) bool {
+	switch cause := ErrorCause(err); cause {
+	case ErrInvalidURL, ErrInvalidHostIP, ErrInvalidFile, ErrClientClosed:
+		return false
+	default:
+		if _, ok := cause.(*os.PathError); ok {
+			return false // Local file system errors
+		}
+		if rErr, ok := cause.(*errRemoteError); ok {
+			switch rErr.code {
+			case ErrCodeFileNotFound, ErrCodeAccessViolation:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// progressReader calls fn with the running total of bytes read.
+type progressReader struct {
+	r  io.Reader
+	n  int64
+	fn func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.fn(p.n)
+	}
+	return n, err
+}
+
+// createTemp creates a new file in dir with a name beginning with prefix.
+//
+// Unlike ioutil.TempFile, the file is created with mode 0666 before the
+// umask, so it has the usual permissions once renamed into place.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFileClient_GetToFile(t *testing.T) {
+	text := getTestData(t, "text")
+	sum := sha256.Sum256(text)
+	errMismatch := errors.New("checksum mismatch")
+	verify := func(url string, r io.Reader) error {
+		h := sha256.New()
+		io.Copy(h, r)
+		if !bytes.Equal(h.Sum(nil), sum[:]) {
+			return errMismatch
+		}
+		return nil
+	}
+
+	cases := []struct {
+		name     string
+		attempts int
+		verify   func(string, io.Reader) error
+		// Handler behavior for each attempt, subsequent attempts succeed
+		failures []func(ReadRequest)
+
+		expectedAttempts int32
+		expectedError    error
+		expectedFile     bool
+	}{
+		{
+			name: "success",
+
+			expectedAttempts: 1,
+			expectedFile:     true,
+		},
+		{
+			name: "retry after error",
+			failures: []func(ReadRequest){
+				func(w ReadRequest) { w.WriteError(ErrCodeNotDefined, "try again") },
+			},
+
+			expectedAttempts: 2,
+			expectedFile:     true,
+		},
+		{
+			name:   "retry after verification failure",
+			verify: verify,
+			failures: []func(ReadRequest){
+				func(w ReadRequest) { w.Write([]byte("corrupted")) },
+				func(w ReadRequest) { w.Write(text[1:]) },
+			},
+
+			expectedAttempts: 3,
+			expectedFile:     true,
+		},
+		{
+			name:     "attempts exhausted",
+			attempts: 2,
+			verify:   verify,
+			failures: []func(ReadRequest){
+				func(w ReadRequest) { w.Write([]byte("corrupted")) },
+				func(w ReadRequest) { w.Write([]byte("corrupted")) },
+			},
+
+			expectedAttempts: 2,
+			expectedError:    errMismatch,
+		},
+		{
+			name: "file not found, not retried",
+			failures: []func(ReadRequest){
+				func(w ReadRequest) { w.WriteError(ErrCodeFileNotFound, "missing") },
+			},
+
+			expectedAttempts: 1,
+			expectedError:    &errRemoteError{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var attempts int32
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				i := int(atomic.AddInt32(&attempts, 1)) - 1
+				if i < len(c.failures) {
+					c.failures[i](w)
+					return
+				}
+				w.WriteSize(int64(len(text)))
+				w.Write(text)
+			}, nil)
+			defer close()
+
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "sub", "text")
+
+			client, err := NewClient(ClientTransferSize(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc := NewFileClient(client)
+			fc.RetryDelay = 0
+			if c.attempts > 0 {
+				fc.Attempts = c.attempts
+			}
+			fc.Verify = c.verify
+			var progress, size int64
+			fc.Progress = func(url string, n, s int64) {
+				progress, size = n, s
+			}
+
+			err = fc.GetToFile(fmt.Sprintf("tftp://%s:%d/text", ip, port), path)
+
+			// Error
+			if e, ok := c.expectedError.(*errRemoteError); ok {
+				if !IsRemoteError(err) {
+					t.Errorf("expected error of type %T, got %v", e, err)
+				}
+			} else if ErrorCause(err) != c.expectedError {
+				t.Errorf("expected error %v, got %v", c.expectedError, err)
+			}
+
+			// Attempts
+			if a := atomic.LoadInt32(&attempts); a != c.expectedAttempts {
+				t.Errorf("expected %d attempts, but there were %d", c.expectedAttempts, a)
+			}
+
+			// File
+			data, err := ioutil.ReadFile(path)
+			if c.expectedFile {
+				if !bytes.Equal(data, text) {
+					t.Errorf("expected file to contain %d bytes, but it was %d (%v)", len(text), len(data), err)
+				}
+				if progress != int64(len(text)) || size != int64(len(text)) {
+					t.Errorf("expected progress %d of %d, but it was %d of %d", len(text), len(text), progress, size)
+				}
+				// Permissions match a file created normally
+				ref := filepath.Join(dir, "ref")
+				if f, err := os.OpenFile(ref, os.O_CREATE|os.O_EXCL, 0666); err == nil {
+					f.Close()
+					want, _ := os.Stat(ref)
+					got, _ := os.Stat(path)
+					if got.Mode() != want.Mode() {
+						t.Errorf("expected file mode %v, but it was %v", want.Mode(), got.Mode())
+					}
+					os.Remove(ref)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Errorf("expected no file to be written, got %v", err)
+			}
+
+			// Temporary files are removed
+			files, _ := ioutil.ReadDir(filepath.Dir(path))
+			if n := len(files); c.expectedFile && n != 1 || !c.expectedFile && n != 0 {
+				t.Errorf("expected only the destination file in directory, got %d files", n)
+			}
+		})
+	}
+}
@@ -5,12 +5,17 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // ReadHandler responds to a TFTP read request.
@@ -30,8 +35,13 @@ type ReadWriteHandler interface {
 }
 
 // WriteRequest is provided to a WriteHandler's ReceiveTFTP method.
+//
+// Middleware passing a wrapped WriteRequest to another handler should
+// implement Unwrap() WriteRequest, returning the request it wraps, so
+// handlers such as LoggingWriteHandler can reach the server's request.
 type WriteRequest interface {
-	// Addr is the network address of the client.
+	// Addr is the network address of the client, including the source
+	// port it chose as its transfer identifier (TID).
 	Addr() *net.UDPAddr
 
 	// Name is the file name provided by the client.
@@ -53,23 +63,41 @@ type WriteRequest interface {
 	TransferMode() TransferMode
 }
 
-// writeRequest implements WriteRequest.
+// Appender is implemented by WriteHandlers that can open a destination
+// for appending, such as FileServer.
+type Appender interface {
+	// OpenAppender opens name for appending, creating it if it
+	// doesn't exist.
+	OpenAppender(name string) (io.WriteCloser, error)
+}
+
+// writeRequest implements WriteRequest, and the methods used by functions
+// such as Append and Context.
 type writeRequest struct {
 	conn *conn
 
-	name string
+	name   string
+	append bool
 }
 
 func (w *writeRequest) Addr() *net.UDPAddr {
 	return w.conn.remoteAddr.(*net.UDPAddr)
 }
 
+func (w *writeRequest) LocalAddr() *net.UDPAddr {
+	return w.conn.localAddr()
+}
+
 func (w *writeRequest) Name() string {
 	return w.name
 }
 
 func (w *writeRequest) Read(p []byte) (int, error) {
-	return w.conn.Read(p)
+	n, err := w.conn.Read(p)
+	if err != nil && err != io.EOF {
+		w.conn.cancel()
+	}
+	return n, err
 }
 
 func (w *writeRequest) Size() (int64, error) {
@@ -87,9 +115,45 @@ func (w *writeRequest) TransferMode() TransferMode {
 	return w.conn.mode
 }
 
+func (w *writeRequest) SinglePort() bool {
+	return w.conn.reqChan != nil
+}
+
+func (w *writeRequest) Append() bool {
+	return w.append
+}
+
+func (w *writeRequest) RequestedOptions() map[string]string {
+	return w.conn.requested.copy()
+}
+
+func (w *writeRequest) NegotiatedOptions() map[string]string {
+	return w.conn.negotiated.copy()
+}
+
+func (w *writeRequest) SetRetransmit(n int) error {
+	return w.conn.setRetransmit(n)
+}
+
+func (w *writeRequest) Context() context.Context {
+	return w.conn.ctx
+}
+
+// onDone registers fn to be called once the transfer is complete
+// (see LoggingWriteHandler).
+func (w *writeRequest) onDone(fn func(TransferInfo, string)) {
+	w.conn.doneHooks = append(w.conn.doneHooks, fn)
+}
+
 // ReadRequest is provided to a ReadHandler's ServeTFTP method.
+//
+// Middleware passing a wrapped ReadRequest to another handler should
+// implement Unwrap() ReadRequest, returning the request it wraps, as this
+// package's wrappers do. Handlers such as ConditionalCompressReadHandler
+// and ServeReaderAt use it to find capabilities of the requests beneath.
 type ReadRequest interface {
-	// Addr is the network address of the client.
+	// Addr is the network address of the client, including the source
+	// port it chose as its transfer identifier (TID).
 	Addr() *net.UDPAddr
 
 	// Name is the file name requested by the client.
@@ -111,7 +175,8 @@ type ReadRequest interface {
 	TransferMode() TransferMode
 }
 
-// readRequest implements ReadRequest.
+// readRequest implements ReadRequest, and the methods used by functions
+// such as Flush and Context.
 type readRequest struct {
 	conn *conn
 
@@ -122,19 +187,32 @@ func (w *readRequest) Addr() *net.UDPAddr {
 	return w.conn.remoteAddr.(*net.UDPAddr)
 }
 
+func (w *readRequest) LocalAddr() *net.UDPAddr {
+	return w.conn.localAddr()
+}
+
 func (w *readRequest) Name() string {
 	return w.name
 }
 
 func (w *readRequest) Write(p []byte) (int, error) {
-	return w.conn.Write(p)
+	w.conn.stopHeartbeat()
+	n, err := w.conn.Write(p)
+	if err != nil {
+		w.conn.cancel()
+	}
+	return n, err
 }
 
 func (w *readRequest) WriteError(c ErrorCode, s string) {
+	w.conn.stopHeartbeat()
+	w.conn.resume()
 	w.conn.sendError(c, s)
 }
 
 func (w *readRequest) WriteSize(i int64) {
+	w.conn.hbMu.Lock()
+	defer w.conn.hbMu.Unlock()
 	w.conn.tsize = &i
 }
 
@@ -142,14 +220,412 @@ func (w *readRequest) TransferMode() TransferMode {
 	return w.conn.mode
 }
 
+func (w *readRequest) SinglePort() bool {
+	return w.conn.reqChan != nil
+}
+
+func (w *readRequest) Flush() error {
+	w.conn.stopHeartbeat()
+	return w.conn.Flush()
+}
+
+func (w *readRequest) ExtendDeadline(d time.Duration) error {
+	w.conn.stopHeartbeat()
+	return w.conn.acknowledge(d)
+}
+
+func (w *readRequest) Offset() int64 {
+	w.conn.stopHeartbeat()
+	return w.conn.acceptOffset()
+}
+
+func (w *readRequest) RequestedOptions() map[string]string {
+	return w.conn.requested.copy()
+}
+
+func (w *readRequest) NegotiatedOptions() map[string]string {
+	w.conn.hbMu.Lock()
+	defer w.conn.hbMu.Unlock()
+	return w.conn.negotiated.copy()
+}
+
+func (w *readRequest) Context() context.Context {
+	return w.conn.ctx
+}
+
+func (w *readRequest) Pause() error {
+	w.conn.stopHeartbeat()
+	return w.conn.pause()
+}
+
+func (w *readRequest) Resume() {
+	w.conn.stopHeartbeat()
+	w.conn.resume()
+}
+
+func (w *readRequest) SetRetransmit(n int) error {
+	return w.conn.setRetransmit(n)
+}
+
+// onDone registers fn to be called once the transfer is complete
+// (see LoggingReadHandler).
+func (w *readRequest) onDone(fn func(TransferInfo, string)) {
+	w.conn.doneHooks = append(w.conn.doneHooks, fn)
+}
+
+// acceptCompress allows the compress option to be negotiated for this
+// transfer (see ConditionalCompressReadHandler).
+func (w *readRequest) acceptCompress() {
+	w.conn.hbMu.Lock()
+	defer w.conn.hbMu.Unlock()
+	w.conn.allowCompress = true
+}
+
+func (w *readRequest) WriteETag(etag string) error {
+	if have, ok := w.conn.requested[optIfNotMatch]; !ok || etag == "" || have != etag {
+		return nil
+	}
+	w.WriteError(ErrCodeNotDefined, notModifiedMsg)
+	return ErrNotModified
+}
+
+// unwrapRead calls match with w and each request it wraps, found with
+// Unwrap (see ReadRequest), until match returns true. It reports whether
+// match returned true.
+func unwrapRead(w ReadRequest, match func(ReadRequest) bool) bool {
+	for w != nil {
+		if match(w) {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() ReadRequest })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+	return false
+}
+
+// unwrapWrite is unwrapRead for WriteRequests.
+func unwrapWrite(r WriteRequest, match func(WriteRequest) bool) bool {
+	for r != nil {
+		if match(r) {
+			return true
+		}
+		u, ok := r.(interface{ Unwrap() WriteRequest })
+		if !ok {
+			return false
+		}
+		r = u.Unwrap()
+	}
+	return false
+}
+
+// ServeReaderAt responds to w with size bytes of r, starting at the offset
+// requested by the client, if any. Only the requested range is read from r.
+// The tsize sent is the number of bytes remaining from the offset.
+//
+// If the offset is beyond size an error is sent to the client.
+//
+// Within DecompressingReadHandler, including through middleware which
+// implements Unwrap, r is gzip compressed. The whole of r is sent and the
+// tsize is read from its trailer.
+func ServeReaderAt(w ReadRequest, r io.ReaderAt, size int64) error {
+	return ServeReaderAtAligned(w, r, size, 0)
+}
+
+// ServeReaderAtAligned is ServeReaderAt for sources most efficiently read
+// in multiples of align bytes, such as memory-mapped files and block
+// devices. Each read from r starts at a multiple of align and is a multiple
+// of align long, except the last, which ends at size. If the client
+// requested an offset that isn't aligned, the data before it is read and
+// discarded. DATA is still sent in blocks of the negotiated blocksize.
+//
+// An align of 0 or 1 is the same as ServeReaderAt.
+func ServeReaderAtAligned(w ReadRequest, r io.ReaderAt, size int64, align int) error {
+	if unwrapRead(w, func(w ReadRequest) bool {
+		_, ok := w.(*decompressingReadRequest)
+		return ok
+	}) {
+		return serveCompressed(w, r, size)
+	}
+	offset := Offset(w)
+	if offset > size {
+		w.WriteError(ErrCodeOptionNegotiation, fmt.Sprintf("Offset %d beyond end of file", offset))
+		return ErrInvalidOffset
+	}
+	w.WriteSize(size - offset)
+
+	// Negotiate options even if there's no data to copy,
+	// otherwise nothing is sent to end the transfer
+	if _, err := w.Write(nil); err != nil {
+		return err
+	}
+	if align <= 1 {
+		_, err := io.Copy(w, io.NewSectionReader(r, offset, size-offset))
+		return err
+	}
+	return copyAligned(w, r, offset, size, int64(align))
+}
+
+// alignedReadSize is the approximate size of reads by copyAligned,
+// matching io.Copy.
+const alignedReadSize = 32 * 1024
+
+// copyAligned writes r from offset to size to w, reading in multiples of align.
+func copyAligned(w io.Writer, r io.ReaderAt, offset, size, align int64) error {
+	chunk := (alignedReadSize + align - 1) / align * align
+	buf := make([]byte, chunk)
+
+	pos := offset - offset%align
+	skip := offset - pos
+	for pos < size {
+		n := chunk
+		if size-pos < n {
+			n = size - pos
+		}
+		read, err := r.ReadAt(buf[:n], pos)
+		if int64(read) > skip {
+			if _, err := w.Write(buf[skip:read]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil // r is shorter than size, as with io.Copy
+		}
+		if err != nil {
+			return err
+		}
+		pos += n
+		skip = 0
+	}
+	return nil
+}
+
 // FileServer creates a handler for sending and reciving files on the filesystem.
-func FileServer(dir string) ReadWriteHandler {
-	return &fileServer{path: dir, log: newLogger("fileserver")}
+//
+// Requested names are resolved within dir, names such as "../file" can't
+// escape it.
+//
+// If the directory configured with FileServerTempDir can't be used the
+// error is logged and uploads are refused, use NewFileServer to have it
+// returned instead.
+func FileServer(dir string, opts ...FileServerOpt) ReadWriteHandler {
+	f := newFileServer(dir, opts)
+	if f.tempErr != nil {
+		f.log.err("Temporary directory %q unusable, refusing uploads: %v", f.tempDir, f.tempErr)
+	}
+	return f
+}
+
+// NewFileServer is FileServer, returning an error if the directory
+// configured with FileServerTempDir can't be used.
+func NewFileServer(dir string, opts ...FileServerOpt) (ReadWriteHandler, error) {
+	f := newFileServer(dir, opts)
+	if f.tempErr != nil {
+		return nil, wrapError(f.tempErr, "checking temporary directory")
+	}
+	return f, nil
+}
+
+func newFileServer(dir string, opts []FileServerOpt) *fileServer {
+	f := &fileServer{path: dir, log: newLogger("fileserver")}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.tempDir != "" {
+		// Checked once all options are applied, the check depends on them
+		f.tempErr = f.checkTempDir()
+	}
+	return f
+}
+
+// FileServerOpt is a function that configures a FileServer.
+type FileServerOpt func(*fileServer)
+
+// FileServerUploadDir confines write requests to subdir of the served
+// directory, which must exist. Names are still relative to the served
+// directory, so uploads must be named within subdir, such as
+// "subdir/file". Other uploads are refused with an Access Violation error.
+// Read requests may be for any file in the served directory.
+//
+// Default: uploads anywhere in the served directory.
+func FileServerUploadDir(subdir string) FileServerOpt {
+	return func(f *fileServer) {
+		f.uploadDir = path.Clean("/" + filepath.ToSlash(subdir))
+		if f.uploadDir == "/" {
+			f.uploadDir = ""
+		}
+	}
+}
+
+// OverwritePolicy determines how FileServer handles write requests for
+// files that already exist.
+type OverwritePolicy int
+
+const (
+	// OverwriteAllow replaces the existing file.
+	OverwriteAllow OverwritePolicy = iota
+	// OverwriteReject refuses the upload with ErrCodeFileAlreadyExists.
+	OverwriteReject
+	// OverwriteVersion keeps the existing file, writing the upload to the
+	// first of name.1, name.2, and so on, which doesn't exist.
+	OverwriteVersion
+)
+
+// maxVersions bounds the suffixes tried by OverwriteVersion.
+const maxVersions = 1000
+
+// FileServerOverwrite configures how uploads of existing files are handled.
+// Appends aren't affected.
+//
+// Default: OverwriteAllow.
+func FileServerOverwrite(policy OverwritePolicy) FileServerOpt {
+	return func(f *fileServer) {
+		f.overwrite = policy
+	}
+}
+
+// FileServerTempDir writes uploads to temporary files in dir, renaming
+// them into place once complete. Clients reading the file see either the
+// previous content or the whole upload, and failed uploads leave no partial
+// file. Where an existing file must not be replaced (see FileServerOverwrite)
+// the upload is hard linked into place instead, which fails if another file
+// took the name while it was in progress.
+//
+// dir must be writable and on the same filesystem as the directory uploads
+// are written to, which is checked by moving a file there. If the check
+// fails NewFileServer returns the error, FileServer logs it and uploads are
+// refused with an Access Violation error. Appends are written in place.
+//
+// Default: uploads are written directly to the destination.
+func FileServerTempDir(dir string) FileServerOpt {
+	return func(f *fileServer) {
+		f.tempDir = dir
+	}
 }
 
 type fileServer struct {
-	log  *logger
-	path string
+	log       *logger
+	path      string
+	uploadDir string // Cleaned, slash separated and rooted, empty for no restriction
+	overwrite OverwritePolicy
+	tempDir   string // Uploads are written here and renamed into place, empty to write in place
+	tempErr   error  // Reason tempDir can't be used
+}
+
+// tempSeq distinguishes temporary files created at the same time.
+var tempSeq uint64
+
+// createTemp creates a temporary file in tempDir for an upload to dest.
+func (f *fileServer) createTemp(dest string) (*atomicFile, error) {
+	if f.tempErr != nil {
+		return nil, f.tempErr
+	}
+	for {
+		name := filepath.Join(f.tempDir, fmt.Sprintf(".tftp-upload-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&tempSeq, 1)))
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &atomicFile{File: file, dest: dest, policy: f.overwrite, log: f.log}, nil
+	}
+}
+
+// checkTempDir checks that a file can be created in tempDir and moved
+// into the upload directory as atomicFile does.
+func (f *fileServer) checkTempDir() error {
+	probe, err := f.createTemp("")
+	if err != nil {
+		return err
+	}
+	probe.File.Close()
+	defer os.Remove(probe.Name())
+	dest := filepath.Join(f.path, filepath.FromSlash(f.uploadDir), filepath.Base(probe.Name()))
+	if f.overwrite == OverwriteAllow {
+		err = os.Rename(probe.Name(), dest)
+	} else {
+		err = os.Link(probe.Name(), dest)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(dest)
+}
+
+// atomicFile is an upload written to a temporary file, which is moved
+// to dest when closed.
+type atomicFile struct {
+	*os.File
+	dest    string
+	policy  OverwritePolicy
+	log     *logger
+	aborted bool
+}
+
+// Close closes the temporary file and moves it to dest.
+func (a *atomicFile) Close() error {
+	if a.aborted {
+		return nil
+	}
+	if err := a.File.Close(); err != nil {
+		a.abort()
+		return err
+	}
+	var err error
+	if a.policy == OverwriteAllow {
+		err = os.Rename(a.Name(), a.dest)
+	} else {
+		err = a.link()
+	}
+	if err != nil {
+		a.abort()
+		return err
+	}
+	return nil
+}
+
+// link links the temporary file to dest, or with OverwriteVersion the first
+// versioned name which doesn't exist, then removes it. Unlike a rename, an
+// existing file is never replaced.
+func (a *atomicFile) link() error {
+	dest := a.dest
+	err := os.Link(a.Name(), dest)
+	for i := 1; a.policy == OverwriteVersion && os.IsExist(err) && i <= maxVersions; i++ {
+		dest = fmt.Sprintf("%s.%d", a.dest, i)
+		err = os.Link(a.Name(), dest)
+	}
+	if err != nil {
+		return err
+	}
+	if dest != a.dest {
+		a.log.debug("%q exists, wrote upload to %q", a.dest, dest)
+	}
+	return os.Remove(a.Name())
+}
+
+// abort discards the upload, Close becomes a no-op.
+func (a *atomicFile) abort() {
+	a.aborted = true
+	a.File.Close()
+	os.Remove(a.Name())
+}
+
+// localPath maps a requested name to a path within the served directory.
+func (f *fileServer) localPath(name string) string {
+	return filepath.Join(f.path, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// uploadPath is localPath for write requests, enforcing uploadDir.
+func (f *fileServer) uploadPath(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if f.uploadDir != "" && clean != f.uploadDir && !strings.HasPrefix(clean, f.uploadDir+"/") {
+		return "", &os.PathError{Op: "create", Path: name, Err: os.ErrPermission}
+	}
+	return f.localPath(name), nil
 }
 
 // ServeTFTP serves files rooted at the configured directory.
@@ -157,9 +633,7 @@ type fileServer struct {
 // If the file does not exist or otherwise cannot be opened, a File Not Found
 // error will be sent.
 func (f *fileServer) ServeTFTP(w ReadRequest) {
-	path := filepath.Join(f.path, filepath.Clean(w.Name()))
-
-	file, err := os.Open(path)
+	file, err := os.Open(f.localPath(w.Name()))
 	if err != nil {
 		log.Println(err)
 		w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
@@ -168,31 +642,100 @@ func (f *fileServer) ServeTFTP(w ReadRequest) {
 	defer errorDefer(file.Close, f.log, "error closing file")
 
 	finfo, _ := file.Stat()
-	w.WriteSize(finfo.Size())
-	if _, err = io.Copy(w, file); err != nil {
+	if err := ServeReaderAt(w, file, finfo.Size()); err != nil {
 		log.Println(err)
 	}
 }
 
 // ReceiveTFTP writes received files to the configured directory.
 //
+// Existing files are replaced unless the request is to be appended.
 // If the file cannot be created an Access Violation error will be sent.
 func (f *fileServer) ReceiveTFTP(r WriteRequest) {
-	path := filepath.Join(f.path, filepath.Clean(r.Name()))
-
-	file, err := os.Create(path)
+	var (
+		file io.WriteCloser
+		err  error
+	)
+	if Append(r) {
+		file, err = f.OpenAppender(r.Name())
+	} else {
+		file, err = f.create(r.Name())
+	}
+	if os.IsExist(err) {
+		log.Println(err)
+		r.WriteError(ErrCodeFileAlreadyExists, fmt.Sprintf("File %q already exists", filepath.Clean(r.Name())))
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		r.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Cannot create file %q", filepath.Clean(r.Name())))
+		return
 	}
 	defer errorDefer(file.Close, f.log, "error closing file")
 
 	_, err = io.Copy(file, r)
 	if err != nil {
 		log.Println(err)
+		if a, ok := file.(*atomicFile); ok {
+			a.abort()
+		}
 	}
 }
 
+// create creates a file in the configured directory, handling an existing
+// file according to the overwrite policy.
+func (f *fileServer) create(name string) (io.WriteCloser, error) {
+	local, err := f.uploadPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.tempDir != "" {
+		if _, err := os.Lstat(local); err == nil && f.overwrite == OverwriteReject {
+			// Refused early, linking into place checks again once complete
+			return nil, &os.PathError{Op: "create", Path: local, Err: os.ErrExist}
+		}
+		a, err := f.createTemp(local)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	var file *os.File
+	switch f.overwrite {
+	case OverwriteReject:
+		file, err = os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	case OverwriteVersion:
+		file, err = os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		for i := 1; os.IsExist(err) && i <= maxVersions; i++ {
+			file, err = os.OpenFile(fmt.Sprintf("%s.%d", local, i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		}
+		if err == nil && file.Name() != local {
+			f.log.debug("%q exists, writing upload to %q", name, file.Name())
+		}
+	default:
+		file, err = os.Create(local)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// OpenAppender opens a file in the configured directory for appending.
+func (f *fileServer) OpenAppender(name string) (io.WriteCloser, error) {
+	local, err := f.uploadPath(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
 // ReadHandlerFunc is an adapter type to allow a function to serve as a ReadHandler.
 type ReadHandlerFunc func(ReadRequest)
 
@@ -208,3 +751,98 @@ type WriteHandlerFunc func(WriteRequest)
 func (h WriteHandlerFunc) ReceiveTFTP(w WriteRequest) {
 	h(w)
 }
+
+// GeneratorReadHandler adapts fn, which returns the content for a requested
+// file name, to a ReadHandler. The content is streamed from the returned
+// reader, which is closed when the transfer ends. A size which isn't
+// negative is sent as the tsize, it must match the length of the content.
+//
+// If fn returns an error a File Not Found error is sent when os.IsNotExist
+// reports true for it, Access Violation for os.IsPermission, and otherwise
+// the error's message. Offsets requested by clients are declined.
+func GeneratorReadHandler(fn func(name string) (io.ReadCloser, int64, error)) ReadHandler {
+	l := newLogger("generator")
+	return ReadHandlerFunc(func(w ReadRequest) {
+		rc, size, err := fn(w.Name())
+		switch {
+		case os.IsNotExist(err):
+			w.WriteError(ErrCodeFileNotFound, fmt.Sprintf("File %q does not exist", w.Name()))
+			return
+		case os.IsPermission(err):
+			w.WriteError(ErrCodeAccessViolation, fmt.Sprintf("Access to %q denied", w.Name()))
+			return
+		case err != nil:
+			w.WriteError(ErrCodeNotDefined, err.Error())
+			return
+		}
+		defer errorDefer(rc.Close, l, "error closing generated content")
+
+		if size >= 0 {
+			w.WriteSize(size)
+		}
+		var writeErr error
+		_, err = io.Copy(writerFunc(func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			writeErr = err
+			return n, err
+		}), rc)
+		if err != nil && writeErr == nil {
+			// Failed reading the content rather than sending it
+			l.err("Generating %q: %v", w.Name(), err)
+			w.WriteError(ErrCodeNotDefined, "Error generating file")
+		}
+	})
+}
+
+// LoggingReadHandler wraps h, logging the file name, client address, bytes
+// sent, duration, and any error of each read request. The line is logged
+// once the transfer is complete, after the final block is acknowledged,
+// with the result reported by ServerTransferHook.
+//
+// Middleware wrapping the ReadRequest before it reaches this handler must
+// implement Unwrap (see ReadRequest), otherwise the transfer isn't logged
+// and an error is logged instead.
+func LoggingReadHandler(h ReadHandler) ReadHandler {
+	return loggingReadHandler(newLogger("access"), h)
+}
+
+func loggingReadHandler(l *logger, h ReadHandler) ReadHandler {
+	return ReadHandlerFunc(func(w ReadRequest) {
+		if !unwrapRead(w, func(w ReadRequest) bool { return onDone(w, l.transfer) }) {
+			l.err("Can't log read of %q, ReadRequest is wrapped without Unwrap", w.Name())
+		}
+		h.ServeTFTP(w)
+	})
+}
+
+// LoggingWriteHandler wraps h, logging the file name, client address, bytes
+// received, duration, and any error of each write request. As with
+// LoggingReadHandler, the line is logged once the transfer is complete.
+//
+// Middleware wrapping the WriteRequest before it reaches this handler
+// must implement Unwrap (see WriteRequest).
+func LoggingWriteHandler(h WriteHandler) WriteHandler {
+	return loggingWriteHandler(newLogger("access"), h)
+}
+
+func loggingWriteHandler(l *logger, h WriteHandler) WriteHandler {
+	return WriteHandlerFunc(func(r WriteRequest) {
+		if !unwrapWrite(r, func(r WriteRequest) bool { return onDone(r, l.transfer) }) {
+			l.err("Can't log write of %q, WriteRequest is wrapped without Unwrap", r.Name())
+		}
+		h.ReceiveTFTP(r)
+	})
+}
+
+// onDone registers fn to be called with the result of the transfer, and
+// the last ERROR sent to the client if any, once it's complete if req is
+// the server's request, reporting whether it was.
+func onDone(req interface{}, fn func(TransferInfo, string)) bool {
+	d, ok := req.(interface {
+		onDone(func(TransferInfo, string))
+	})
+	if ok {
+		d.onDone(fn)
+	}
+	return ok
+}
@@ -6,11 +6,21 @@ package tftp // import "pack.ag/tftp"
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
+	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type readRequestMock struct {
@@ -21,6 +31,7 @@ type readRequestMock struct {
 	errMsg  string
 	size    *int64
 	tmode   TransferMode
+	offset  int64
 }
 
 func (r *readRequestMock) Addr() *net.UDPAddr          { return r.addr }
@@ -32,6 +43,7 @@ func (r *readRequestMock) WriteError(c ErrorCode, m string) {
 	r.errMsg = m
 }
 func (r *readRequestMock) TransferMode() TransferMode { return r.tmode }
+func (r *readRequestMock) Offset() int64              { return r.offset }
 
 func TestFileServer_ServeTFTP(t *testing.T) {
 	text := getTestData(t, "text")
@@ -104,11 +116,19 @@ type writeRequestMock struct {
 	errMsg  string
 	size    *int64
 	tmode   TransferMode
+	append  bool
+	readErr error // Returned by Read once reader is empty, rather than io.EOF
 }
 
-func (r *writeRequestMock) Addr() *net.UDPAddr         { return r.addr }
-func (r *writeRequestMock) Name() string               { return r.name }
-func (r *writeRequestMock) Read(p []byte) (int, error) { return r.reader.Read(p) }
+func (r *writeRequestMock) Addr() *net.UDPAddr { return r.addr }
+func (r *writeRequestMock) Name() string       { return r.name }
+func (r *writeRequestMock) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF && r.readErr != nil {
+		err = r.readErr
+	}
+	return n, err
+}
 func (r *writeRequestMock) Size() (int64, error) {
 	if r.size != nil {
 		return *r.size, nil
@@ -120,6 +140,7 @@ func (r *writeRequestMock) WriteError(c ErrorCode, m string) {
 	r.errMsg = m
 }
 func (r *writeRequestMock) TransferMode() TransferMode { return r.tmode }
+func (r *writeRequestMock) Append() bool               { return r.append }
 
 func TestFileServer_ReceiveTFTP(t *testing.T) {
 	text := getTestData(t, "text")
@@ -182,3 +203,1236 @@ func TestFileServer_ReceiveTFTP(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_GetAt(t *testing.T) {
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := FileServer(dir)
+
+	cases := []struct {
+		name   string
+		offset int64
+		rh     ReadHandlerFunc
+
+		expectedData  []byte
+		expectedError error
+	}{
+		{
+			name:   "middle of file",
+			offset: 100003,
+			rh:     fs.ServeTFTP,
+
+			expectedData: data[100003:],
+		},
+		{
+			name:   "end of file",
+			offset: int64(len(data)),
+			rh:     fs.ServeTFTP,
+
+			expectedData: []byte{},
+		},
+		{
+			name:   "beyond end of file",
+			offset: int64(len(data)) + 1,
+			rh:     fs.ServeTFTP,
+
+			expectedError: &errRemoteError{},
+		},
+		{
+			name:   "not accepted by handler",
+			offset: 100003,
+			rh: func(w ReadRequest) {
+				w.Write(data)
+			},
+
+			expectedError: ErrOffsetNotAccepted,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, port, close := newTestServer(t, false, c.rh, nil)
+			defer close()
+
+			client, err := NewClient(ClientBlocksize(1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.GetAt(fmt.Sprintf("tftp://%s:%d/large", ip, port), c.offset)
+			if c.expectedError != nil {
+				if _, remote := c.expectedError.(*errRemoteError); remote && !IsRemoteError(err) || !remote && ErrorCause(err) != c.expectedError {
+					t.Fatalf("expected error %v, got %v", c.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if size, _ := resp.Size(); size != int64(len(c.expectedData)) {
+				t.Errorf("expected size %d, but it was %d", len(c.expectedData), size)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, c.expectedData) {
+				t.Errorf("expected %d bytes from offset %d, received %d bytes that don't match", len(c.expectedData), c.offset, len(received))
+			}
+		})
+	}
+}
+
+func TestReadRequest_ExtendDeadline(t *testing.T) {
+	data := []byte("slow data")
+	const delay = 1200 * time.Millisecond
+
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		if err := ExtendDeadline(w, 2*time.Second); err != nil {
+			t.Errorf("ExtendDeadline: %v", err)
+			return
+		}
+		time.Sleep(delay)
+		w.Write(data)
+	}, nil)
+	defer close()
+
+	sAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	var req datagram
+	req.writeReadReq("file", ModeOctet, map[string]string{optTransferSize: "0"})
+	cConn.send(req, sAddr)
+
+	// OACK should arrive well before the handler finishes sleeping
+	start := time.Now()
+	dg, tAddr, err := cConn.tryRead(delay / 2)
+	if err != nil {
+		t.Fatalf("expected OACK before handler wrote data: %v", err)
+	}
+	if dg.opcode() != opCodeOACK {
+		t.Fatalf("expected OACK, got %s", dg)
+	}
+	if tsize := dg.options()[optTransferSize]; tsize != strconv.Itoa(len(data)) {
+		t.Errorf("expected tsize %d, got %q", len(data), tsize)
+	}
+
+	dg.writeAck(0)
+	cConn.send(*dg, tAddr)
+
+	dg, _ = cConn.read(2 * delay)
+	if dg.opcode() != opCodeDATA || !reflect.DeepEqual(dg.data(), data) {
+		t.Errorf("expected DATA %q, got %s", data, dg)
+	}
+	if elapsed := time.Since(start); elapsed < delay/2 {
+		t.Errorf("expected DATA after handler delay, got it after %s", elapsed)
+	}
+
+	dg.writeAck(1)
+	cConn.send(*dg, tAddr)
+}
+
+func TestReadRequest_Pause(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	const delay = 600 * time.Millisecond
+
+	cases := []struct {
+		name  string
+		pause bool
+
+		expectedError error
+	}{
+		{
+			name:  "paused",
+			pause: true,
+		},
+		{
+			name: "not paused",
+
+			expectedError: ErrMaxRetries,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+				if err := Pause(w); ErrorCause(err) != ErrNoDataSent {
+					t.Errorf("expected Pause before first block to return %v, got %v", ErrNoDataSent, err)
+				}
+				w.Write(data[:512])
+				if c.pause {
+					if err := Pause(w); err != nil {
+						t.Errorf("Pause: %v", err)
+					}
+				}
+				time.Sleep(delay)
+				Resume(w)
+				w.Write(data[512:])
+			}, nil)
+			defer close()
+
+			// Without keep-alives the client gives up after 200ms
+			client, err := NewClient(ClientUTimeout(100*time.Millisecond), ClientRetransmit(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/file", ip, port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, err := ioutil.ReadAll(resp)
+			if ErrorCause(err) != c.expectedError {
+				t.Fatalf("expected error %v, got %v", c.expectedError, err)
+			}
+			if err == nil && !bytes.Equal(received, data) {
+				t.Errorf("expected %d bytes, received %d bytes that don't match", len(data), len(received))
+			}
+		})
+	}
+}
+
+func TestReadRequest_Pause_duplicateACKs(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 8*512+100)
+	const paused = 2 // Block resent as keep-alives
+
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.Write(data[:paused*512])
+		if err := Pause(w); err != nil {
+			t.Errorf("Pause: %v", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		Resume(w)
+		w.Write(data[paused*512:])
+	}, nil)
+	defer close()
+
+	// An RFC 1350 client, acknowledging every DATA including duplicates
+	conn := newFakePeer(t, nil)
+	defer conn.Close()
+	var req datagram
+	req.writeReadReq("file", ModeOctet, map[string]string{optUTimeout: "100000"})
+	conn.send(req, &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+
+	sent := make(map[uint16]int)
+	var received []byte
+	for {
+		dg, addr, err := conn.tryRead(500 * time.Millisecond)
+		if err != nil {
+			break // Transfer complete, or failed and detected below
+		}
+		var ack datagram
+		switch dg.opcode() {
+		case opCodeOACK:
+			ack.writeAck(0)
+		case opCodeDATA:
+			if sent[dg.block()] == 0 {
+				received = append(received, dg.data()...)
+			}
+			sent[dg.block()]++
+			ack.writeAck(dg.block())
+		default:
+			t.Fatalf("unexpected datagram %s", dg)
+		}
+		conn.send(ack, addr)
+	}
+
+	if !bytes.Equal(received, data) {
+		t.Fatalf("expected %d bytes, received %d bytes that don't match", len(data), len(received))
+	}
+	if sent[paused] < 2 {
+		t.Errorf("expected keep-alives resending block %d, it was sent %d times", paused, sent[paused])
+	}
+	for block := uint16(paused + 1); int(block) <= len(data)/512+1; block++ {
+		if sent[block] != 1 {
+			t.Errorf("expected block %d to be sent once after resuming, it was sent %d times", block, sent[block])
+		}
+	}
+}
+
+func TestRequest_Context(t *testing.T) {
+	ctxErrs := make(chan error, 1)
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		ctx := Context(w)
+		if err := ctx.Err(); err != nil {
+			t.Errorf("expected context to be active at start, got %v", err)
+		}
+		block := bytes.Repeat([]byte("x"), 512)
+		for ctx.Err() == nil {
+			w.Write(block)
+		}
+		ctxErrs <- ctx.Err()
+	}, nil)
+	defer close()
+
+	sAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	var req datagram
+	req.writeReadReq("file", ModeOctet, nil)
+	cConn.send(req, sAddr)
+
+	// Client aborts after the first block
+	dg, tAddr := cConn.read(3 * time.Second)
+	if dg.opcode() != opCodeDATA {
+		t.Fatalf("expected DATA, got %s", dg)
+	}
+	dg.writeError(ErrCodeNotDefined, "abort")
+	cConn.send(*dg, tAddr)
+
+	select {
+	case err := <-ctxErrs:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for handler context to be cancelled")
+	}
+}
+
+func TestLoggingHandlers(t *testing.T) {
+	data := []byte("the data")
+
+	cases := []struct {
+		name   string
+		rh     ReadHandlerFunc
+		wh     WriteHandlerFunc
+		raw    bool // Request with a client which doesn't acknowledge the DATA
+		cached bool // Wrapped by CachingReadHandler
+
+		expectedLog string
+	}{
+		{
+			name: "read",
+			rh: func(w ReadRequest) {
+				w.Write(data)
+			},
+
+			expectedLog: `^\[INFO\] read "file" 127\.0\.0\.1:\d+: 8 bytes in \S+\n$`,
+		},
+		{
+			name: "read, wrapped",
+			rh: func(w ReadRequest) {
+				w.Write(data)
+			},
+			cached: true,
+
+			expectedLog: `^\[INFO\] read "file" 127\.0\.0\.1:\d+: 8 bytes in \S+\n$`,
+		},
+		{
+			name: "read error",
+			rh: func(w ReadRequest) {
+				w.WriteError(ErrCodeFileNotFound, "missing")
+			},
+
+			expectedLog: `^\[ERROR\] read "file" 127\.0\.0\.1:\d+: 0 bytes in \S+: .*FILE_NOT_FOUND.*\n$`,
+		},
+		{
+			name: "read, final block not acknowledged",
+			rh: func(w ReadRequest) {
+				w.Write(data)
+			},
+			raw: true,
+
+			// The handler returned before the transfer failed
+			expectedLog: `^\[ERROR\] read "file" 127\.0\.0\.1:\d+: 8 bytes in \S+: .*max retries reached\n$`,
+		},
+		{
+			name: "write",
+			wh: func(r WriteRequest) {
+				ioutil.ReadAll(r)
+			},
+
+			expectedLog: `^\[INFO\] write "file" 127\.0\.0\.1:\d+: 8 bytes in \S+\n$`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lines := make(chan string, 1)
+			l := &logger{log: log.New(writerFunc(func(p []byte) (int, error) {
+				lines <- string(p)
+				return len(p), nil
+			}), "", 0)}
+
+			var rh ReadHandlerFunc
+			var wh WriteHandlerFunc
+			if c.rh != nil {
+				h := loggingReadHandler(l, c.rh)
+				if c.cached {
+					h = CachingReadHandler(h, 1<<20, time.Minute)
+				}
+				rh = h.ServeTFTP
+			}
+			if c.wh != nil {
+				wh = loggingWriteHandler(l, c.wh).ReceiveTFTP
+			}
+			ip, port, close := newTestServer(t, false, rh, wh)
+			defer close()
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case c.raw:
+				conn := newFakePeer(t, nil)
+				defer conn.Close()
+				var req datagram
+				req.writeReadReq("file", ModeOctet, map[string]string{optUTimeout: "10000"})
+				conn.send(req, &net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+				// Acknowledge the OACK only
+				dg, addr := conn.read(time.Second)
+				if dg.opcode() != opCodeOACK {
+					t.Fatalf("expected OACK, got %s", dg)
+				}
+				dg.writeAck(0)
+				conn.send(*dg, addr)
+			case c.rh != nil:
+				if resp, err := client.Get(url); err == nil {
+					ioutil.ReadAll(resp)
+				}
+			default:
+				if err := client.Put(url, bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case line := <-lines:
+				if match, _ := regexp.MatchString(c.expectedLog, line); !match {
+					t.Errorf("expected log to match %q, but it was %q", c.expectedLog, line)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout waiting for transfer to be logged")
+			}
+		})
+	}
+}
+
+func TestRequest_TransferMode(t *testing.T) {
+	modes := make(chan TransferMode, 1)
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		modes <- w.TransferMode()
+		w.Write([]byte("data"))
+	}, func(r WriteRequest) {
+		modes <- r.TransferMode()
+		ioutil.ReadAll(r)
+	})
+	defer close()
+
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	for _, mode := range []TransferMode{ModeOctet, ModeNetASCII} {
+		client, err := NewClient(ClientMode(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read request
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp)
+		if m := <-modes; m != mode {
+			t.Errorf("expected read request mode %q, but it was %q", mode, m)
+		}
+
+		// Write request
+		if err := client.Put(url, strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+		if m := <-modes; m != mode {
+			t.Errorf("expected write request mode %q, but it was %q", mode, m)
+		}
+	}
+}
+
+func TestRequest_SinglePort(t *testing.T) {
+	for _, singlePort := range []bool{true, false} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			flags := make(chan bool, 1)
+			ip, port, close := newTestServer(t, singlePort, func(w ReadRequest) {
+				flags <- SinglePort(w)
+				w.Write([]byte("data"))
+			}, func(r WriteRequest) {
+				flags <- SinglePort(r)
+				ioutil.ReadAll(r)
+			})
+			defer close()
+
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp)
+			if f := <-flags; f != singlePort {
+				t.Errorf("expected read request SinglePort %t, but it was %t", singlePort, f)
+			}
+
+			if err := client.Put(url, strings.NewReader("data"), 4); err != nil {
+				t.Fatal(err)
+			}
+			if f := <-flags; f != singlePort {
+				t.Errorf("expected write request SinglePort %t, but it was %t", singlePort, f)
+			}
+		})
+	}
+}
+
+func TestRequest_SetRetransmit(t *testing.T) {
+	cases := []struct {
+		name       string
+		retransmit int // Set by the handler, 0 to keep the server's limit of 1
+
+		expectSuccess bool
+	}{
+		{name: "server limit"},
+		{name: "raised", retransmit: 5, expectSuccess: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			received := make(chan error, 1)
+			s, addr := startTestServer(t, nil, WriteHandlerFunc(func(r WriteRequest) {
+				if err := SetRetransmit(r, -1); err != ErrInvalidRetransmit {
+					t.Errorf("expected ErrInvalidRetransmit setting a negative limit, got %v", err)
+				}
+				if c.retransmit > 0 {
+					if err := SetRetransmit(r, c.retransmit); err != nil {
+						t.Error(err)
+					}
+				}
+				_, err := ioutil.ReadAll(r)
+				received <- err
+			}), ServerRetransmit(1), ServerReadTimeout(50*time.Millisecond))
+			defer s.Close()
+
+			// The first three DATA datagrams are lost, the server
+			// needs three retransmissions of ACK 0 to receive DATA 1
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			client, err := NewClient(ClientPacketConn(&lossyPacketConn{PacketConn: pc, dropEvery: 1, maxDrops: 3}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Put(fmt.Sprintf("tftp://%s/file", addr), strings.NewReader("data"), 4)
+
+			err = <-received
+			if c.expectSuccess && err != nil {
+				t.Errorf("expected transfer to succeed, got %v", err)
+			}
+			if !c.expectSuccess && ErrorCause(err) != ErrMaxRetries {
+				t.Errorf("expected ErrMaxRetries, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileServer_UploadDir(t *testing.T) {
+	text := getTestData(t, "text")
+
+	cases := []struct {
+		name    string
+		reqName string
+		append  bool
+
+		expectedPath      string // Relative to the served directory
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "inside",
+			reqName: "uploads/text",
+
+			expectedPath: "uploads/text",
+		},
+		{
+			name:    "inside, append",
+			reqName: "uploads/text",
+			append:  true,
+
+			expectedPath: "uploads/text",
+		},
+		{
+			name:    "inside, leading dot dot",
+			reqName: "../uploads/text",
+
+			expectedPath: "uploads/text",
+		},
+		{
+			name:    "outside",
+			reqName: "text",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "outside, append",
+			reqName: "text",
+			append:  true,
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "outside, via dot dot",
+			reqName: "uploads/../text",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "outside, sharing prefix",
+			reqName: "uploads2/text",
+
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, sub := range []string{"uploads", "uploads2"} {
+				if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "existing"), text, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fs := FileServer(dir, FileServerUploadDir("uploads"))
+
+			req := writeRequestMock{name: c.reqName, append: c.append}
+			req.reader.Write(text)
+			fs.ReceiveTFTP(&req)
+
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedErrorCode, req.errCode, req.errMsg)
+			}
+			if c.expectedPath != "" {
+				data, err := ioutil.ReadFile(filepath.Join(dir, c.expectedPath))
+				if err != nil || !bytes.Equal(data, text) {
+					t.Errorf("expected %s to contain the upload: %v", c.expectedPath, err)
+				}
+			}
+			for _, name := range []string{"text", "uploads2/text"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+					t.Errorf("expected %s not to be created", name)
+				}
+			}
+
+			// Reads aren't restricted
+			rreq := readRequestMock{name: "existing"}
+			fs.ServeTFTP(&rreq)
+			if !bytes.Equal(rreq.writer.Bytes(), text) {
+				t.Errorf("expected read outside upload dir to succeed, got error %s (%q)", rreq.errCode, rreq.errMsg)
+			}
+		})
+	}
+}
+
+func TestFileServer_Overwrite(t *testing.T) {
+	existing := []byte("existing")
+	upload := []byte("upload")
+
+	cases := []struct {
+		name     string
+		policy   OverwritePolicy
+		versions int // Existing numbered versions
+
+		expectedFiles     map[string][]byte
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:   "allow",
+			policy: OverwriteAllow,
+
+			expectedFiles: map[string][]byte{"file": upload},
+		},
+		{
+			name:   "reject",
+			policy: OverwriteReject,
+
+			expectedFiles:     map[string][]byte{"file": existing},
+			expectedErrorCode: ErrCodeFileAlreadyExists,
+		},
+		{
+			name:   "version",
+			policy: OverwriteVersion,
+
+			expectedFiles: map[string][]byte{"file": existing, "file.1": upload},
+		},
+		{
+			name:     "version, existing versions",
+			policy:   OverwriteVersion,
+			versions: 2,
+
+			expectedFiles: map[string][]byte{"file": existing, "file.1": existing, "file.2": existing, "file.3": upload},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "file"), existing, 0644); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= c.versions; i++ {
+				if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file.%d", i)), existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := FileServer(dir, FileServerOverwrite(c.policy))
+
+			req := writeRequestMock{name: "file"}
+			req.reader.Write(upload)
+			fs.ReceiveTFTP(&req)
+
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedErrorCode, req.errCode, req.errMsg)
+			}
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(c.expectedFiles) {
+				t.Errorf("expected %d files, got %d", len(c.expectedFiles), len(files))
+			}
+			for name, expected := range c.expectedFiles {
+				data, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil || !bytes.Equal(data, expected) {
+					t.Errorf("expected %s to contain %q, got %q (%v)", name, expected, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileServer_TempDir(t *testing.T) {
+	existing := []byte("existing")
+	upload := []byte("upload")
+
+	cases := []struct {
+		name    string
+		reqName string
+		policy  OverwritePolicy
+		fail    bool // Upload fails after the data is written
+		tempDir string
+		// Upload directory, created unless missingDir
+		uploadDir  string
+		missingDir bool
+		// Written to the destination while the upload is in progress
+		concurrent []byte
+
+		expectedFiles     map[string][]byte
+		expectedErrorCode ErrorCode
+	}{
+		{
+			name:    "replace",
+			reqName: "file",
+
+			expectedFiles: map[string][]byte{"file": upload},
+		},
+		{
+			name:    "replace, failed",
+			reqName: "file",
+			fail:    true,
+
+			expectedFiles: map[string][]byte{"file": existing},
+		},
+		{
+			name:    "reject, new file",
+			reqName: "new",
+			policy:  OverwriteReject,
+
+			expectedFiles: map[string][]byte{"file": existing, "new": upload},
+		},
+		{
+			name:    "reject, new file failed",
+			reqName: "new",
+			policy:  OverwriteReject,
+			fail:    true,
+
+			expectedFiles: map[string][]byte{"file": existing},
+		},
+		{
+			name:    "reject, existing",
+			reqName: "file",
+			policy:  OverwriteReject,
+
+			expectedFiles:     map[string][]byte{"file": existing},
+			expectedErrorCode: ErrCodeFileAlreadyExists,
+		},
+		{
+			name:       "reject, created during upload",
+			reqName:    "new",
+			policy:     OverwriteReject,
+			concurrent: []byte("concurrent"),
+
+			expectedFiles: map[string][]byte{"file": existing, "new": []byte("concurrent")},
+		},
+		{
+			name:    "version",
+			reqName: "file",
+			policy:  OverwriteVersion,
+
+			expectedFiles: map[string][]byte{"file": existing, "file.1": upload},
+		},
+		{
+			name:       "version, created during upload",
+			reqName:    "new",
+			policy:     OverwriteVersion,
+			concurrent: []byte("concurrent"),
+
+			expectedFiles: map[string][]byte{"file": existing, "new": []byte("concurrent"), "new.1": upload},
+		},
+		{
+			name:      "upload dir",
+			reqName:   "up/file",
+			policy:    OverwriteReject,
+			uploadDir: "up",
+
+			expectedFiles: map[string][]byte{"file": existing, "up/file": upload},
+		},
+		{
+			name:       "missing upload dir",
+			reqName:    "up/file",
+			uploadDir:  "up",
+			missingDir: true,
+
+			expectedFiles:     map[string][]byte{"file": existing},
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+		{
+			name:    "unusable temp dir",
+			reqName: "file",
+			tempDir: "missing",
+
+			expectedFiles:     map[string][]byte{"file": existing},
+			expectedErrorCode: ErrCodeAccessViolation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			dir, tempDir := filepath.Join(root, "served"), filepath.Join(root, "tmp")
+			for _, d := range []string{dir, tempDir} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "file"), existing, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if c.tempDir != "" {
+				tempDir = filepath.Join(root, c.tempDir)
+			}
+			if c.uploadDir != "" && !c.missingDir {
+				if err := os.Mkdir(filepath.Join(dir, c.uploadDir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := FileServer(dir, FileServerOverwrite(c.policy), FileServerTempDir(tempDir), FileServerUploadDir(c.uploadDir))
+
+			req := writeRequestMock{name: c.reqName}
+			req.reader.Write(upload)
+			if c.fail {
+				req.readErr = errors.New("transfer failed")
+			}
+			dest := filepath.Join(dir, filepath.FromSlash(c.reqName))
+			_, statErr := os.Lstat(dest)
+			existed := statErr == nil
+			fs.ReceiveTFTP(&hookedWriteRequest{writeRequestMock: &req, fn: func() {
+				if _, err := os.Lstat(dest); err == nil && !existed {
+					t.Errorf("expected nothing at %s during the upload", c.reqName)
+				}
+				if c.concurrent != nil {
+					if err := ioutil.WriteFile(dest, c.concurrent, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}})
+
+			if req.errCode != c.expectedErrorCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedErrorCode, req.errCode, req.errMsg)
+			}
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(c.expectedFiles) {
+				t.Errorf("expected %d files, got %d", len(c.expectedFiles), len(files))
+			}
+			for name, expected := range c.expectedFiles {
+				data, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil || !bytes.Equal(data, expected) {
+					t.Errorf("expected %s to contain %q, got %q (%v)", name, expected, data, err)
+				}
+			}
+			if temps, _ := ioutil.ReadDir(tempDir); len(temps) != 0 {
+				t.Errorf("expected temporary files to be removed, %d remain", len(temps))
+			}
+		})
+	}
+}
+
+func TestNewFileServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cases := []struct {
+		name    string
+		tempDir string
+
+		expectedError bool
+	}{
+		{name: "no temp dir"},
+		{name: "usable temp dir", tempDir: root},
+		{name: "missing temp dir", tempDir: filepath.Join(root, "missing"), expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var opts []FileServerOpt
+			if c.tempDir != "" {
+				opts = append(opts, FileServerTempDir(c.tempDir))
+			}
+			fs, err := NewFileServer(root, opts...)
+			if c.expectedError {
+				if cause := ErrorCause(err); !os.IsNotExist(cause) {
+					t.Errorf("expected a not exist error, got %v", err)
+				}
+				if fs != nil {
+					t.Error("expected no handler with an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if fs == nil {
+				t.Fatal("expected a handler")
+			}
+		})
+	}
+}
+
+// hookedWriteRequest calls fn before the first read of the upload.
+type hookedWriteRequest struct {
+	*writeRequestMock
+	fn func()
+}
+
+func (r *hookedWriteRequest) Read(p []byte) (int, error) {
+	if r.fn != nil {
+		r.fn()
+		r.fn = nil
+	}
+	return r.writeRequestMock.Read(p)
+}
+
+// pageReaderAt simulates a device read in whole pages, recording the
+// reads made and the number of pages they touched.
+type pageReaderAt struct {
+	data     []byte
+	pageSize int64
+
+	reads []int64 // Offsets of ReadAt calls
+	pages int64   // Pages read from the device
+	page  []byte
+}
+
+func (r *pageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads = append(r.reads, off)
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	if r.page == nil {
+		r.page = make([]byte, r.pageSize)
+	}
+	end := off + int64(len(p))
+	if end > int64(len(r.data)) {
+		end = int64(len(r.data))
+	}
+	for page := off / r.pageSize * r.pageSize; page < end; page += r.pageSize {
+		copy(r.page, r.data[page:]) // Device transfers the whole page
+		r.pages++
+	}
+	n := copy(p, r.data[off:end])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestServeReaderAtAligned(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	cases := []struct {
+		name   string
+		offset int64
+		size   int64
+		align  int
+	}{
+		{name: "no offset", align: 4096},
+		{name: "unaligned offset", offset: 10003, align: 4096},
+		{name: "aligned offset", offset: 8192, align: 4096},
+		{name: "offset at end", offset: int64(len(data)), align: 4096},
+		{name: "size beyond data", size: int64(len(data)) + 100, align: 4096},
+		{name: "unusual alignment", offset: 7, align: 3000},
+		{name: "unaligned", offset: 10003},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			size := c.size
+			if size == 0 {
+				size = int64(len(data))
+			}
+			r := &pageReaderAt{data: data, pageSize: 4096}
+			req := readRequestMock{name: "file", offset: c.offset}
+			if err := ServeReaderAtAligned(&req, r, size, c.align); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(req.writer.Bytes(), data[c.offset:]) {
+				t.Errorf("expected %d bytes from offset %d, got %d bytes that don't match", len(data)-int(c.offset), c.offset, req.writer.Len())
+			}
+			if req.size == nil || *req.size != size-c.offset {
+				t.Errorf("expected size %d, got %v", size-c.offset, req.size)
+			}
+			if c.align <= 1 {
+				return
+			}
+			for _, off := range r.reads {
+				if off%int64(c.align) != 0 {
+					t.Errorf("expected reads aligned to %d, got offset %d", c.align, off)
+				}
+			}
+		})
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestGeneratorReadHandler(t *testing.T) {
+	cases := []struct {
+		name string
+		gen  func(name string) (io.Reader, int64, error)
+
+		expectedData []byte
+		expectedSize *int64
+		expectedCode ErrorCode
+	}{
+		{
+			name: "sized",
+			gen: func(name string) (io.Reader, int64, error) {
+				content := "Hello, " + name
+				return strings.NewReader(content), int64(len(content)), nil
+			},
+
+			expectedData: []byte("Hello, file"),
+			expectedSize: ptrInt64(11),
+		},
+		{
+			name: "unknown size",
+			gen: func(name string) (io.Reader, int64, error) {
+				return strings.NewReader("streamed"), -1, nil
+			},
+
+			expectedData: []byte("streamed"),
+		},
+		{
+			name: "not exist",
+			gen: func(name string) (io.Reader, int64, error) {
+				return nil, 0, os.ErrNotExist
+			},
+
+			expectedCode: ErrCodeFileNotFound,
+		},
+		{
+			name: "permission",
+			gen: func(name string) (io.Reader, int64, error) {
+				return nil, 0, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+			},
+
+			expectedCode: ErrCodeAccessViolation,
+		},
+		{
+			name: "other error",
+			gen: func(name string) (io.Reader, int64, error) {
+				return nil, 0, fmt.Errorf("template failed")
+			},
+
+			expectedCode: ErrCodeNotDefined,
+		},
+		{
+			name: "read error",
+			gen: func(name string) (io.Reader, int64, error) {
+				return io.MultiReader(strings.NewReader("partial"), readerFunc(func([]byte) (int, error) {
+					return 0, fmt.Errorf("broken")
+				})), 100, nil
+			},
+
+			expectedSize: ptrInt64(100),
+			expectedCode: ErrCodeNotDefined,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var rc *closeRecorder
+			h := GeneratorReadHandler(func(name string) (io.ReadCloser, int64, error) {
+				r, size, err := c.gen(name)
+				if err != nil {
+					return nil, 0, err
+				}
+				rc = &closeRecorder{Reader: r}
+				return rc, size, nil
+			})
+
+			req := readRequestMock{name: "file"}
+			h.ServeTFTP(&req)
+
+			if c.expectedData != nil && !bytes.Equal(req.writer.Bytes(), c.expectedData) {
+				t.Errorf("expected data %q, got %q", c.expectedData, req.writer.Bytes())
+			}
+			if c.expectedSize == nil && req.size != nil {
+				t.Errorf("expected no size, got %d", *req.size)
+			} else if c.expectedSize != nil && (req.size == nil || *req.size != *c.expectedSize) {
+				t.Errorf("expected size %d, got %v", *c.expectedSize, req.size)
+			}
+			if req.errCode != c.expectedCode {
+				t.Errorf("expected error code %s, got %s (%q)", c.expectedCode, req.errCode, req.errMsg)
+			}
+			if rc != nil && !rc.closed {
+				t.Error("expected generated content to be closed")
+			}
+		})
+	}
+
+	t.Run("transfer", func(t *testing.T) {
+		text := getTestData(t, "text")
+		h := GeneratorReadHandler(func(name string) (io.ReadCloser, int64, error) {
+			return ioutil.NopCloser(bytes.NewReader(text)), int64(len(text)), nil
+		})
+		ip, port, close := newTestServer(t, false, h.ServeTFTP, nil)
+		defer close()
+
+		client, err := NewClient(ClientTransferSize(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(fmt.Sprintf("tftp://%s:%d/generated", ip, port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, err := resp.Size(); err != nil || size != int64(len(text)) {
+			t.Errorf("expected size %d, got %d (%v)", len(text), size, err)
+		}
+		received, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, text) {
+			t.Errorf("expected %d bytes of generated data, received %d bytes that don't match", len(text), len(received))
+		}
+	})
+}
+
+func TestRequest_LocalAddr(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		t.Run(fmt.Sprintf("single port %t", singlePort), func(t *testing.T) {
+			addrs := make(chan *net.UDPAddr, 2)
+			ip, port, close := newTestServer(t, singlePort, func(w ReadRequest) {
+				addrs <- LocalAddr(w)
+				w.Write([]byte("data"))
+			}, func(w WriteRequest) {
+				addrs <- LocalAddr(w)
+				ioutil.ReadAll(w)
+			})
+			defer close()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp)
+			if err := client.Put(url, strings.NewReader("data"), 4); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, op := range []string{"read", "write"} {
+				addr := <-addrs
+				if addr == nil {
+					t.Fatalf("%s: expected local address, got nil", op)
+				}
+				if singlePort && addr.Port != port {
+					t.Errorf("%s: expected listener's port %d, got %d", op, port, addr.Port)
+				}
+				if !singlePort && addr.Port == port {
+					t.Errorf("%s: expected ephemeral port, got listener's port %d", op, addr.Port)
+				}
+			}
+		})
+	}
+}
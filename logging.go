@@ -5,8 +5,11 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 var (
@@ -24,10 +27,40 @@ func init() {
 	}
 }
 
+// LogFormat is the format of log lines written by a Server.
+type LogFormat int
+
+const (
+	// LogFormatText writes freeform lines, prefixed with their source.
+	LogFormatText LogFormat = iota
+	// LogFormatJSON writes each line as a JSON object with the keys
+	// "level" and "msg", plus "transfer_id", "addr", "filename", and "err"
+	// when they apply.
+	LogFormatJSON
+)
+
 type logger struct {
 	log *log.Logger
 	d   bool
 	t   bool
+
+	json   bool      // Write JSON lines rather than text
+	fields logFields // Identify the source of JSON lines
+}
+
+// logFields are included in each JSON line written by a logger.
+type logFields struct {
+	ID   uint64 `json:"transfer_id,omitempty"`
+	Addr string `json:"addr,omitempty"`
+	Name string `json:"filename,omitempty"`
+}
+
+// logLine is the structure of a JSON line.
+type logLine struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	logFields
+	Err string `json:"err,omitempty"`
 }
 
 func newLogger(name string) *logger {
@@ -38,18 +71,68 @@ func newLogger(name string) *logger {
 	return &logger{log: log.New(os.Stderr, prefix, log.Lshortfile), d: debug, t: trace}
 }
 
+// newJSONLogger returns a logger writing JSON lines including fields.
+func newJSONLogger(fields logFields) *logger {
+	return &logger{log: log.New(os.Stderr, "", 0), d: debug, t: trace, json: true, fields: fields}
+}
+
 func (l *logger) debug(f string, args ...interface{}) {
 	if l.d {
-		l.log.Printf("[DEBUG] "+f, args...)
+		l.print("DEBUG", f, args)
 	}
 }
 
 func (l *logger) trace(f string, args ...interface{}) {
 	if l.t {
-		l.log.Printf("[TRACE] "+f, args...)
+		l.print("TRACE", f, args)
 	}
 }
 
 func (l *logger) err(f string, args ...interface{}) {
-	l.log.Printf("[ERROR] "+f, args...)
+	l.print("ERROR", f, args)
+}
+
+// transfer logs the result of a transfer, and the ERROR sent to the client
+// if any, for LoggingReadHandler and LoggingWriteHandler.
+func (l *logger) transfer(info TransferInfo, sent string) {
+	op := "read"
+	if info.Write {
+		op = "write"
+	}
+	if info.Err != nil {
+		l.err("%s %q %s: %d bytes in %s: %v", op, info.Name, info.Addr, info.Bytes, info.Duration, info.Err)
+		return
+	}
+	if sent != "" {
+		l.err("%s %q %s: %d bytes in %s: sent %s", op, info.Name, info.Addr, info.Bytes, info.Duration, sent)
+		return
+	}
+	l.print("INFO", "%s %q %s: %d bytes in %s", []interface{}{op, info.Name, info.Addr, info.Bytes, info.Duration})
+}
+
+// print writes a line at level. In JSON, the first error in args is
+// also reported separately as "err".
+func (l *logger) print(level, f string, args []interface{}) {
+	if !l.json {
+		l.log.Printf("["+level+"] "+f, args...)
+		return
+	}
+
+	line := logLine{
+		Level:     strings.ToLower(level),
+		Msg:       strings.TrimSuffix(fmt.Sprintf(f, args...), "\n"),
+		logFields: l.fields,
+	}
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			line.Err = err.Error()
+			break
+		}
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		l.log.Printf(`{"level":"error","msg":%q}`, "encoding log line: "+err.Error())
+		return
+	}
+	l.log.Print(string(b))
 }
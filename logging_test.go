@@ -0,0 +1,73 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLogger_JSON(t *testing.T) {
+	cases := []struct {
+		name   string
+		fields logFields
+		log    func(*logger)
+
+		expected map[string]interface{}
+	}{
+		{
+			name:   "transfer error",
+			fields: logFields{ID: 3, Addr: "127.0.0.1:5000", Name: "file"},
+			log: func(l *logger) {
+				l.err("sending %q: %v\n", "file", errors.New("boom"))
+			},
+
+			expected: map[string]interface{}{
+				"level":       "error",
+				"msg":         `sending "file": boom`,
+				"transfer_id": float64(3),
+				"addr":        "127.0.0.1:5000",
+				"filename":    "file",
+				"err":         "boom",
+			},
+		},
+		{
+			name: "server debug",
+			log: func(l *logger) {
+				l.d = true
+				l.debug("Dropping datagram from %v", "127.0.0.1:5000")
+			},
+
+			expected: map[string]interface{}{
+				"level": "debug",
+				"msg":   "Dropping datagram from 127.0.0.1:5000",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := newJSONLogger(c.fields)
+			l.log.SetOutput(&buf)
+			c.log(l)
+
+			lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+			if len(lines) != 1 {
+				t.Fatalf("expected 1 line, got %d: %q", len(lines), buf.String())
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(lines[0], &got); err != nil {
+				t.Fatalf("line %q isn't JSON: %v", lines[0], err)
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// NullReadHandler is a ReadHandler serving Size zero bytes for every
+// request, whatever the file name, so that benchmarks and load tests
+// measure the protocol rather than storage. The size is sent as the tsize
+// and offsets requested with Client.GetAt are honored.
+//
+// A NullReadHandler may serve concurrent requests and must not be copied
+// after first use.
+type NullReadHandler struct {
+	Size int64 // Bytes served for each request
+
+	sent int64 // Accessed atomically
+}
+
+// ServeTFTP serves h.Size zero bytes to w.
+func (h *NullReadHandler) ServeTFTP(w ReadRequest) {
+	ServeReaderAt(&nullReadRequest{ReadRequest: w, sent: &h.sent}, zeroReaderAt{}, h.Size)
+}
+
+// Sent returns the number of bytes sent to all clients.
+func (h *NullReadHandler) Sent() int64 {
+	return atomic.LoadInt64(&h.sent)
+}
+
+// nullReadRequest counts the bytes written to a ReadRequest.
+type nullReadRequest struct {
+	ReadRequest
+	sent *int64
+}
+
+// Unwrap returns the request the zeros are written to.
+func (w *nullReadRequest) Unwrap() ReadRequest {
+	return w.ReadRequest
+}
+
+func (w *nullReadRequest) Write(p []byte) (int, error) {
+	n, err := w.ReadRequest.Write(p)
+	atomic.AddInt64(w.sent, int64(n))
+	return n, err
+}
+
+// zeroReaderAt is an io.ReaderAt of unlimited zero bytes.
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, _ int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// NullWriteHandler is a WriteHandler discarding the data received for
+// every request, counting the bytes. It is the counterpart of
+// NullReadHandler for measuring uploads.
+//
+// The zero value is ready to use. A NullWriteHandler may receive
+// concurrent requests and must not be copied after first use.
+type NullWriteHandler struct {
+	received int64 // Accessed atomically
+}
+
+// ReceiveTFTP reads and discards the data from r.
+func (h *NullWriteHandler) ReceiveTFTP(r WriteRequest) {
+	io.Copy(writerFunc(func(p []byte) (int, error) {
+		atomic.AddInt64(&h.received, int64(len(p)))
+		return len(p), nil
+	}), r)
+}
+
+// Received returns the number of bytes received from all clients.
+func (h *NullWriteHandler) Received() int64 {
+	return atomic.LoadInt64(&h.received)
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNullReadHandler(t *testing.T) {
+	cases := []struct {
+		name   string
+		size   int64
+		offset int64
+
+		expectedSent int64
+		expectedCode ErrorCode
+	}{
+		{name: "empty", expectedSent: 0},
+		{name: "sized", size: 1000, expectedSent: 1000},
+		{name: "offset", size: 1000, offset: 600, expectedSent: 400},
+		{name: "offset beyond size", size: 1000, offset: 1001, expectedCode: ErrCodeOptionNegotiation},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &NullReadHandler{Size: c.size}
+			req := readRequestMock{name: "any", offset: c.offset}
+			h.ServeTFTP(&req)
+
+			if req.errCode != c.expectedCode {
+				t.Fatalf("expected error code %s, got %s (%q)", c.expectedCode, req.errCode, req.errMsg)
+			}
+			if c.expectedCode != 0 {
+				return
+			}
+			if !bytes.Equal(req.writer.Bytes(), make([]byte, c.expectedSent)) {
+				t.Errorf("expected %d zero bytes, got %d bytes", c.expectedSent, req.writer.Len())
+			}
+			if req.size == nil || *req.size != c.expectedSent {
+				t.Errorf("expected size %d, got %v", c.expectedSent, req.size)
+			}
+			if sent := h.Sent(); sent != c.expectedSent {
+				t.Errorf("expected %d bytes counted, got %d", c.expectedSent, sent)
+			}
+		})
+	}
+}
+
+func TestNullHandlers_transfer(t *testing.T) {
+	rh := &NullReadHandler{Size: 100*512 + 10}
+	var wh NullWriteHandler
+	ip, port, close := newTestServer(t, false, rh.ServeTFTP, wh.ReceiveTFTP)
+	defer close()
+
+	client, err := NewClient(ClientTransferSize(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	for i := 1; i <= 2; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, err := resp.Size(); err != nil || size != rh.Size {
+			t.Errorf("expected size %d, got %d (%v)", rh.Size, size, err)
+		}
+		if _, err := ioutil.ReadAll(resp); err != nil {
+			t.Fatal(err)
+		}
+		if sent := rh.Sent(); sent != int64(i)*rh.Size {
+			t.Errorf("expected %d bytes sent after %d requests, got %d", int64(i)*rh.Size, i, sent)
+		}
+	}
+
+	data := strings.Repeat("x", 3000)
+	if err := client.Put(url, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	// The final block is acknowledged before the handler reads it
+	deadline := time.Now().Add(time.Second)
+	for wh.Received() < int64(len(data)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if received := wh.Received(); received != int64(len(data)) {
+		t.Errorf("expected %d bytes received, got %d", len(data), received)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket which may be shared between conns.
+//
+// Senders reserve tokens before sending and sleep until the reservation is
+// covered, so concurrent senders are served in the order they reserved.
+type rateLimiter struct {
+	clock clock
+	rate  float64 // Tokens added per second
+	burst float64 // Most tokens accumulated while idle
+
+	mu     sync.Mutex
+	tokens float64 // May be negative when reserved ahead
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int, clk clock) *rateLimiter {
+	rate := float64(bytesPerSec)
+	return &rateLimiter{
+		clock:  clk,
+		rate:   rate,
+		burst:  rate / 10, // 100ms
+		tokens: rate / 10,
+		last:   clk.Now(),
+	}
+}
+
+// wait blocks until n bytes may be sent.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		l.clock.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
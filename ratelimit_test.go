@@ -0,0 +1,28 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_wait(t *testing.T) {
+	clk := newFakeClock()
+	l := newRateLimiter(1000, clk) // Burst of 100
+
+	l.wait(100) // Within burst
+	l.wait(50)  // Empty, sleeps until 50 tokens accumulate
+	l.wait(50)  // The previous sleep only repaid the deficit, sleeps again
+	clk.Advance(time.Second)
+	l.wait(150) // Idle, only the burst accumulated
+
+	// The fake clock advances while sleeping
+	expected := []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	if !reflect.DeepEqual(clk.slept, expected) {
+		t.Errorf("expected sleeps %v, but they were %v", expected, clk.slept)
+	}
+}
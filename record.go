@@ -0,0 +1,250 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordSend = "send"
+	recordRecv = "recv"
+)
+
+// RecordPacketConn wraps pc, writing each datagram sent or received to w.
+//
+// Each datagram is written as a line containing an RFC 3339 timestamp,
+// the direction ("send" or "recv"), the remote address, and the datagram
+// bytes in hex. Recordings can be replayed with ReplayPacketConn.
+//
+// The returned conn can be used with ClientPacketConn to record a client's
+// transfers.
+func RecordPacketConn(pc net.PacketConn, w io.Writer) net.PacketConn {
+	return &recordingPacketConn{PacketConn: pc, w: w, now: time.Now}
+}
+
+type recordingPacketConn struct {
+	net.PacketConn
+	now func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *recordingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.record(recordRecv, addr, p[:n])
+	}
+	return n, addr, err
+}
+
+func (c *recordingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		c.record(recordSend, addr, p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingPacketConn) record(dir string, addr net.Addr, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Recording is best effort, don't fail the transfer
+	fmt.Fprintf(c.w, "%s %s %s %x\n", c.now().Format(time.RFC3339Nano), dir, addr, p)
+}
+
+// record is a single datagram from a recording.
+type record struct {
+	time time.Time
+	dir  string
+	addr *net.UDPAddr
+	data []byte
+}
+
+// readRecords parses a recording written by RecordPacketConn.
+func readRecords(r io.Reader) ([]record, error) {
+	var records []record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 2*65536+256) // Largest datagram in hex, plus fields
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 4 fields, got %d", line, len(fields))
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, wrapError(err, fmt.Sprintf("line %d: parsing time", line))
+		}
+		if fields[1] != recordSend && fields[1] != recordRecv {
+			return nil, fmt.Errorf("line %d: invalid direction %q", line, fields[1])
+		}
+		addr, err := net.ResolveUDPAddr("udp", fields[2])
+		if err != nil {
+			return nil, wrapError(err, fmt.Sprintf("line %d: parsing address", line))
+		}
+		data, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return nil, wrapError(err, fmt.Sprintf("line %d: parsing datagram", line))
+		}
+
+		records = append(records, record{time: t, dir: fields[1], addr: addr, data: data})
+	}
+	return records, wrapError(scanner.Err(), "reading recording")
+}
+
+// ReplayPacketConn returns a net.PacketConn that replays the datagrams
+// received in a recording made by RecordPacketConn.
+//
+// Received datagrams are returned by ReadFrom at the same offset from the
+// first call to ReadFrom or WriteTo as they were from the start of the
+// recording. If a read deadline expires first a timeout error is returned,
+// reproducing timing dependent behavior such as retransmission. Datagrams
+// written to the conn are discarded.
+//
+// Replay is intended for reproducing a client's transfers via
+// ClientPacketConn. Servers open a new connection per transfer and can't
+// be replayed this way.
+func ReplayPacketConn(r io.Reader) (net.PacketConn, error) {
+	records, err := readRecords(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &replayPacketConn{done: make(chan struct{})}
+	for _, rec := range records {
+		if rec.dir == recordRecv {
+			c.recv = append(c.recv, rec)
+		}
+	}
+	if len(records) > 0 {
+		c.origin = records[0].time
+	}
+	return c, nil
+}
+
+// errReplayClosed is returned when a replayPacketConn is used after Close.
+var errReplayClosed = errors.New("replay connection closed")
+
+// errReplayTimeout is returned when a read deadline expires before the next
+// recorded datagram is due.
+type errReplayTimeout struct{}
+
+func (errReplayTimeout) Error() string   { return "replay: i/o timeout" }
+func (errReplayTimeout) Timeout() bool   { return true }
+func (errReplayTimeout) Temporary() bool { return true }
+
+type replayPacketConn struct {
+	origin time.Time // time of the first record
+	recv   []record  // datagrams to return from ReadFrom
+
+	mu       sync.Mutex
+	start    time.Time // time of first use
+	next     int       // index of next datagram in recv
+	deadline time.Time // read deadline
+	closed   bool
+	done     chan struct{}
+}
+
+// begin starts the replay clock on first use, must be called with mu held.
+func (c *replayPacketConn) begin() {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+}
+
+func (c *replayPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, nil, errReplayClosed
+	}
+	c.begin()
+	deadline := c.deadline
+	var rec *record
+	due := deadline
+	if c.next < len(c.recv) {
+		rec = &c.recv[c.next]
+		due = c.start.Add(rec.time.Sub(c.origin))
+	}
+	c.mu.Unlock()
+
+	if rec == nil && deadline.IsZero() {
+		return 0, nil, io.EOF // Recording exhausted and nothing to wait for
+	}
+
+	timedOut := rec == nil || (!deadline.IsZero() && deadline.Before(due))
+	if timedOut {
+		due = deadline
+	}
+
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.done:
+		return 0, nil, errReplayClosed
+	}
+	if timedOut {
+		return 0, nil, errReplayTimeout{}
+	}
+
+	c.mu.Lock()
+	c.next++
+	c.mu.Unlock()
+
+	return copy(p, rec.data), rec.addr, nil
+}
+
+func (c *replayPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errReplayClosed
+	}
+	c.begin()
+	return len(p), nil
+}
+
+func (c *replayPacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *replayPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *replayPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *replayPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *replayPacketConn) SetWriteDeadline(time.Time) error {
+	return nil // Writes never block
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	data := getTestData(t, "text")
+	ip, port, close := newTestServer(t, false, func(w ReadRequest) {
+		w.WriteSize(int64(len(data)))
+		w.Write(data)
+	}, nil)
+	defer close()
+	url := fmt.Sprintf("tftp://%s:%d/file", ip, port)
+
+	get := func(pc net.PacketConn) []byte {
+		client, err := NewClient(ClientPacketConn(pc), ClientWindowsize(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// Record
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var recording bytes.Buffer
+	if got := get(RecordPacketConn(pc, &recording)); !bytes.Equal(got, data) {
+		t.Fatal("recorded response didn't match")
+	}
+
+	records, err := readRecords(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sends int
+	for _, rec := range records {
+		if rec.dir == recordSend {
+			sends++
+		}
+	}
+
+	// Replay without the server
+	replay, err := ReplayPacketConn(&recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	counter := &countingPacketConn{PacketConn: replay}
+	if got := get(counter); !bytes.Equal(got, data) {
+		t.Error("replayed response didn't match")
+	}
+	if sent := atomic.LoadInt32(&counter.sent); int(sent) != sends {
+		t.Errorf("expected %d datagrams sent during replay, but there were %d", sends, sent)
+	}
+}
+
+// countingPacketConn counts the datagrams written to it.
+type countingPacketConn struct {
+	net.PacketConn
+	sent int32
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&c.sent, 1)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestReplayPacketConn_timing(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	recording := fmt.Sprintf("%s send 127.0.0.1:69 0001\n%s recv 127.0.0.1:5000 00040000\n",
+		start.Format(time.RFC3339Nano),
+		start.Add(100*time.Millisecond).Format(time.RFC3339Nano),
+	)
+
+	pc, err := ReplayPacketConn(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	buf := make([]byte, 16)
+
+	// Deadline before the datagram is due
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err = pc.ReadFrom(buf)
+	if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "127.0.0.1:5000" {
+		t.Errorf("expected datagram from 127.0.0.1:5000, got %s", addr)
+	}
+	if !bytes.Equal(buf[:n], []byte{0, 4, 0, 0}) {
+		t.Errorf("expected datagram 00040000, got %x", buf[:n])
+	}
+}
+
+func TestReplayPacketConn_invalid(t *testing.T) {
+	cases := []struct {
+		name      string
+		recording string
+
+		expectedError string
+	}{
+		{
+			name:          "fields",
+			recording:     "2017-01-01T00:00:00Z send 127.0.0.1:69\n",
+			expectedError: "line 1: expected 4 fields, got 3",
+		},
+		{
+			name:          "direction",
+			recording:     "2017-01-01T00:00:00Z sideways 127.0.0.1:69 0001\n",
+			expectedError: `line 1: invalid direction "sideways"`,
+		},
+		{
+			name:          "time",
+			recording:     "yesterday send 127.0.0.1:69 0001\n",
+			expectedError: "line 1: parsing time",
+		},
+		{
+			name:          "datagram",
+			recording:     "2017-01-01T00:00:00Z send 127.0.0.1:69 zz\n",
+			expectedError: "line 1: parsing datagram",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ReplayPacketConn(strings.NewReader(c.recording))
+			if err == nil || !strings.HasPrefix(err.Error(), c.expectedError) {
+				t.Errorf("expected error %q, got %v", c.expectedError, err)
+			}
+		})
+	}
+}
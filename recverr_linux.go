@@ -0,0 +1,55 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"net"
+	"syscall"
+)
+
+// setRecvErr enables IP_RECVERR and IPV6_RECVERR on conn. Linux only
+// reports ICMP errors on unconnected sockets with them set, the next read
+// then fails with ECONNREFUSED after a port unreachable. Errors are ignored,
+// only one applies to the socket's address family.
+func setRecvErr(conn *net.UDPConn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+	})
+}
+
+// refusedAddr returns the destination of the datagram which caused the
+// oldest ICMP error queued on pc by IP_RECVERR, removing it from the queue.
+// False is returned if it can't be determined.
+func refusedAddr(pc net.PacketConn) (*net.UDPAddr, bool) {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	var from syscall.Sockaddr
+	rc.Control(func(fd uintptr) {
+		var buf [4]byte
+		var oob [256]byte
+		_, _, _, from, err = syscall.Recvmsg(int(fd), buf[:], oob[:], syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+	})
+	if err != nil {
+		return nil, false
+	}
+	switch sa := from.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}, true
+	case *syscall.SockaddrInet6:
+		return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// closedAddr returns an address with no listener, for which the
+// kernel replies with ICMP port unreachable.
+func closedAddr(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	return addr
+}
+
+func TestConn_peerUnreachable(t *testing.T) {
+	t.Run("client request", func(t *testing.T) {
+		client, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = client.Get(fmt.Sprintf("tftp://%s/file", closedAddr(t)))
+		if ErrorCause(err) != ErrPeerUnreachable {
+			t.Errorf("expected ErrPeerUnreachable, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= defaultTimeout {
+			t.Errorf("expected failure before the first timeout, took %s", elapsed)
+		}
+	})
+
+	t.Run("server transfer", func(t *testing.T) {
+		gone := make(chan struct{})
+		infos := make(chan TransferInfo, 1)
+		s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+			<-gone
+			w.Write(make([]byte, 1000))
+		}), nil, ServerTransferHook(func(info TransferInfo) {
+			infos <- info
+		}))
+		defer s.Close()
+
+		// Client requesting a file then going away
+		client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req datagram
+		req.writeReadReq("file", ModeOctet, nil)
+		if _, err := client.WriteTo(req.bytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		client.Close()
+		start := time.Now()
+		close(gone)
+
+		select {
+		case info := <-infos:
+			if ErrorCause(info.Err) != ErrPeerUnreachable {
+				t.Errorf("expected ErrPeerUnreachable, got %v", info.Err)
+			}
+			if elapsed := time.Since(start); elapsed >= defaultTimeout {
+				t.Errorf("expected failure before the first timeout, took %s", elapsed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer didn't end")
+		}
+	})
+
+	t.Run("unexpected TID gone", func(t *testing.T) {
+		var conns [2]*net.UDPConn
+		for i := range conns {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conns[i] = conn
+		}
+		server, other := conns[0], conns[1]
+
+		// Minimal server, with another host sending DATA and going away
+		// before the client's Unknown TID error arrives
+		go func() {
+			dg := datagram{buf: make([]byte, 512)}
+			for {
+				n, addr, err := server.ReadFrom(dg.buf)
+				if err != nil {
+					return
+				}
+				dg.offset = n
+
+				var resp datagram
+				switch {
+				case dg.opcode() == opCodeRRQ:
+					resp.writeOptionAck(options{optBlocksize: "8"})
+				case dg.opcode() == opCodeACK && dg.block() == 0:
+					var bad datagram
+					bad.writeData(1, []byte("bad"))
+					other.WriteTo(bad.bytes(), addr)
+					other.Close()
+					time.Sleep(10 * time.Millisecond)
+					resp.writeData(1, []byte("ok"))
+				default:
+					continue
+				}
+				server.WriteTo(resp.bytes(), addr)
+			}
+		}()
+
+		client, err := NewClient(ClientBlocksize(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/file", server.LocalAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "ok" {
+			t.Errorf("expected response %q, but it was %q", "ok", data)
+		}
+	})
+}
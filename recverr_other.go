@@ -0,0 +1,18 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build !linux
+
+package tftp // import "pack.ag/tftp"
+
+import "net"
+
+// setRecvErr does nothing, other platforms report ICMP errors without an option
+// or not at all.
+func setRecvErr(conn *net.UDPConn) {}
+
+// refusedAddr reports false, the cause of an ICMP error isn't known.
+func refusedAddr(pc net.PacketConn) (*net.UDPAddr, bool) {
+	return nil, false
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Request is the part of ReadRequest and WriteRequest common to both,
+// accepted by the functions which apply to either.
+//
+// Functions such as Flush, Offset, and Context provide capabilities of the
+// server's requests beyond the ReadRequest and WriteRequest interfaces,
+// leaving those small enough for middleware and tests to implement. Each
+// uses the first request implementing the method of the same name,
+// starting with the one passed and continuing through those it wraps (see
+// Unwrap on ReadRequest). Wrappers can implement the methods to change the
+// behavior for the requests beneath. If none of them do, as with a test's
+// own request, the zero value or ErrUnsupportedRequest is returned.
+type Request interface {
+	Addr() *net.UDPAddr
+	Name() string
+	WriteError(ErrorCode, string)
+	TransferMode() TransferMode
+}
+
+// unwrapRequest is unwrapRead for either kind of request.
+func unwrapRequest(r Request, match func(Request) bool) bool {
+	for r != nil {
+		if match(r) {
+			return true
+		}
+		switch u := r.(type) {
+		case interface{ Unwrap() ReadRequest }:
+			r = u.Unwrap()
+		case interface{ Unwrap() WriteRequest }:
+			r = u.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// LocalAddr returns the server's address for the transfer. In multi-port
+// mode its port is the ephemeral port chosen for the transfer, the
+// server's TID, otherwise it's the port the server listens on. The IP
+// is unspecified if the server listens on all addresses.
+func LocalAddr(r Request) *net.UDPAddr {
+	var addr *net.UDPAddr
+	unwrapRequest(r, func(r Request) bool {
+		lr, ok := r.(interface{ LocalAddr() *net.UDPAddr })
+		if ok {
+			addr = lr.LocalAddr()
+		}
+		return ok
+	})
+	return addr
+}
+
+// SinglePort reports whether the server is in single port mode.
+func SinglePort(r Request) bool {
+	var single bool
+	unwrapRequest(r, func(r Request) bool {
+		sr, ok := r.(interface{ SinglePort() bool })
+		if ok {
+			single = sr.SinglePort()
+		}
+		return ok
+	})
+	return single
+}
+
+// RequestedOptions returns the options requested by the client,
+// including any the server declined, with the values as sent by the
+// client even where the server clamped them.
+func RequestedOptions(r Request) map[string]string {
+	var opts map[string]string
+	unwrapRequest(r, func(r Request) bool {
+		or, ok := r.(interface{ RequestedOptions() map[string]string })
+		if ok {
+			opts = or.RequestedOptions()
+		}
+		return ok
+	})
+	return opts
+}
+
+// AcknowledgedOptions returns the options acknowledged to the client,
+// with the values in effect for the transfer, which may differ from
+// those requested (see ServerMaxWindowsize and ServerMaxBlocksize).
+//
+// Write transfers negotiate options before the handler is called. Read
+// transfers negotiate them with the first call to Write, Flush, or
+// ExtendDeadline, before which the map is empty. It's also empty if the
+// client didn't acknowledge the OACK and the server fell back to the
+// defaults (see ServerOACKFallback).
+func AcknowledgedOptions(r Request) map[string]string {
+	var opts map[string]string
+	unwrapRequest(r, func(r Request) bool {
+		or, ok := r.(interface{ NegotiatedOptions() map[string]string })
+		if ok {
+			opts = or.NegotiatedOptions()
+		}
+		return ok
+	})
+	return opts
+}
+
+// Context returns the request's context. It's cancelled when the transfer
+// ends, including when Write or Read fails because the client aborted or
+// stopped responding, and when the server is closed. The client aborting
+// is only noticed during a call to Write or Read.
+//
+// context.Background is returned for requests without a context.
+func Context(r Request) context.Context {
+	ctx := context.Background()
+	unwrapRequest(r, func(r Request) bool {
+		cr, ok := r.(interface{ Context() context.Context })
+		if ok {
+			ctx = cr.Context()
+		}
+		return ok
+	})
+	return ctx
+}
+
+// SetRetransmit overrides the server's per-packet retransmission limit
+// (see ServerRetransmit) for the rest of the transfer, such as to
+// tolerate more loss to a known flaky client. For read transfers, call it
+// before Write for the limit to apply to the OACK. ErrInvalidRetransmit
+// is returned if n is negative.
+func SetRetransmit(r Request, n int) error {
+	err := ErrUnsupportedRequest
+	unwrapRequest(r, func(r Request) bool {
+		sr, ok := r.(interface{ SetRetransmit(int) error })
+		if ok {
+			err = sr.SetRetransmit(n)
+		}
+		return ok
+	})
+	return err
+}
+
+// Append reports whether the data should be appended to an existing
+// file rather than replacing it, as configured with ServerAppend.
+func Append(r WriteRequest) bool {
+	var append bool
+	unwrapWrite(r, func(r WriteRequest) bool {
+		ar, ok := r.(interface{ Append() bool })
+		if ok {
+			append = ar.Append()
+		}
+		return ok
+	})
+	return append
+}
+
+// Flush sends any data buffered by w to the client immediately, rather
+// than waiting for a full block. In TFTP a short block ends the transfer,
+// so this is only possible if the client requested the non-standard flush
+// option (see ClientFlush). Otherwise ErrFlushNotNegotiated is returned.
+// Like WriteSize, it negotiates options if Write hasn't been called.
+func Flush(w ReadRequest) error {
+	err := ErrUnsupportedRequest
+	unwrapRead(w, func(w ReadRequest) bool {
+		fw, ok := w.(interface{ Flush() error })
+		if ok {
+			err = fw.Flush()
+		}
+		return ok
+	})
+	return err
+}
+
+// ExtendDeadline informs the server that the handler expects to take d
+// before its first call to Write. If d exceeds the transfer timeout,
+// options are negotiated and the OACK is sent immediately so the client
+// stops waiting on its request.
+//
+// Clients wait up to timeout * retransmit for each response. Sending the
+// OACK early restarts that window for the first DATA block, it does not
+// lengthen it. WriteSize must be called before ExtendDeadline for tsize
+// to be sent. If the client didn't request any options there is nothing
+// to acknowledge and ExtendDeadline has no effect.
+func ExtendDeadline(w ReadRequest, d time.Duration) error {
+	err := ErrUnsupportedRequest
+	unwrapRead(w, func(w ReadRequest) bool {
+		ew, ok := w.(interface{ ExtendDeadline(time.Duration) error })
+		if ok {
+			err = ew.ExtendDeadline(d)
+		}
+		return ok
+	})
+	return err
+}
+
+// Offset accepts the byte offset requested by the client with the
+// non-standard offset option (see Client.GetAt) and returns it. The
+// handler must then write data starting at the offset. If Offset isn't
+// called before the first Write the option is declined and the whole
+// file should be sent. Zero is returned if no offset was requested,
+// or in netascii mode, where it isn't supported.
+func Offset(w ReadRequest) int64 {
+	var offset int64
+	unwrapRead(w, func(w ReadRequest) bool {
+		ow, ok := w.(interface{ Offset() int64 })
+		if ok {
+			offset = ow.Offset()
+		}
+		return ok
+	})
+	return offset
+}
+
+// Pause holds the transfer open while the handler has no data to write,
+// such as when reading from a slow source. Until Resume or Write is
+// called, the last DATA block is resent every half timeout. The client
+// discards the duplicates, but each one restarts its wait for the next
+// block. Clients which acknowledge the duplicates, as RFC 1350 specifies,
+// don't cause the following blocks to be resent.
+//
+// TFTP has no way to pause a transfer, so this relies on the client
+// waiting at most the negotiated timeout for each block. A client with a
+// shorter read timeout of its own may still give up. Only data already
+// written is resent, so ErrNoDataSent is returned if Write hasn't sent a
+// full block yet; use ExtendDeadline to delay the first block instead.
+func Pause(w ReadRequest) error {
+	err := ErrUnsupportedRequest
+	unwrapRead(w, func(w ReadRequest) bool {
+		pw, ok := w.(interface{ Pause() error })
+		if ok {
+			err = pw.Pause()
+		}
+		return ok
+	})
+	return err
+}
+
+// Resume stops the keep-alives started by Pause. Write, WriteError and
+// returning from the handler also resume the transfer.
+func Resume(w ReadRequest) {
+	unwrapRead(w, func(w ReadRequest) bool {
+		rw, ok := w.(interface{ Resume() })
+		if ok {
+			rw.Resume()
+		}
+		return ok
+	})
+}
+
+// WriteETag compares etag, identifying the current version of the file
+// such as a hash of its contents, with the one the client already has,
+// sent in the non-standard ifnotmatch option (see ClientIfNotMatch). If
+// they're equal the client is sent a "not modified" ERROR and
+// ErrNotModified is returned, the handler should return without writing.
+// Otherwise nil is returned and the file should be written as usual. It
+// must be called before any calls to Write.
+func WriteETag(w ReadRequest, etag string) error {
+	var err error
+	unwrapRead(w, func(w ReadRequest) bool {
+		ew, ok := w.(interface{ WriteETag(string) error })
+		if ok {
+			err = ew.WriteETag(etag)
+		}
+		return ok
+	})
+	return err
+}
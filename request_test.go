@@ -0,0 +1,109 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"context"
+	"testing"
+)
+
+// unwrappingReadRequest is middleware which implements Unwrap and nothing
+// else beyond ReadRequest.
+type unwrappingReadRequest struct {
+	ReadRequest
+}
+
+func (w *unwrappingReadRequest) Unwrap() ReadRequest { return w.ReadRequest }
+
+// unwrappingWriteRequest is unwrappingReadRequest for WriteRequests.
+type unwrappingWriteRequest struct {
+	WriteRequest
+}
+
+func (r *unwrappingWriteRequest) Unwrap() WriteRequest { return r.WriteRequest }
+
+// offsetOverrideReadRequest replaces the offset of the request it wraps.
+type offsetOverrideReadRequest struct {
+	ReadRequest
+	offset int64
+}
+
+func (w *offsetOverrideReadRequest) Unwrap() ReadRequest { return w.ReadRequest }
+func (w *offsetOverrideReadRequest) Offset() int64       { return w.offset }
+
+func TestRequestFunctions(t *testing.T) {
+	mock := &readRequestMock{offset: 10}
+
+	cases := []struct {
+		name string
+		req  ReadRequest
+
+		expectedOffset int64
+	}{
+		{
+			name:           "direct",
+			req:            mock,
+			expectedOffset: 10,
+		},
+		{
+			name:           "through unwrap",
+			req:            &unwrappingReadRequest{&unwrappingReadRequest{mock}},
+			expectedOffset: 10,
+		},
+		{
+			name:           "without unwrap",
+			req:            struct{ ReadRequest }{mock},
+			expectedOffset: 0,
+		},
+		{
+			name:           "wrapper overrides",
+			req:            &unwrappingReadRequest{&offsetOverrideReadRequest{mock, 20}},
+			expectedOffset: 20,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if offset := Offset(c.req); offset != c.expectedOffset {
+				t.Errorf("expected offset %d, but it was %d", c.expectedOffset, offset)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		w := &unwrappingReadRequest{mock}
+		if err := Flush(w); err != ErrUnsupportedRequest {
+			t.Errorf("expected Flush to return %v, but it was %v", ErrUnsupportedRequest, err)
+		}
+		if err := Pause(w); err != ErrUnsupportedRequest {
+			t.Errorf("expected Pause to return %v, but it was %v", ErrUnsupportedRequest, err)
+		}
+		if err := WriteETag(w, "etag"); err != nil {
+			t.Errorf("expected WriteETag to return nil, but it was %v", err)
+		}
+		if err := SetRetransmit(w, 1); err != ErrUnsupportedRequest {
+			t.Errorf("expected SetRetransmit to return %v, but it was %v", ErrUnsupportedRequest, err)
+		}
+		if ctx := Context(w); ctx != context.Background() {
+			t.Errorf("expected Context to return context.Background(), but it was %v", ctx)
+		}
+		if addr := LocalAddr(w); addr != nil {
+			t.Errorf("expected LocalAddr to return nil, but it was %v", addr)
+		}
+	})
+
+	t.Run("write request", func(t *testing.T) {
+		r := &unwrappingWriteRequest{&writeRequestMock{append: true}}
+		if !Append(r) {
+			t.Error("expected Append to be true through Unwrap")
+		}
+		if SinglePort(r) {
+			t.Error("expected SinglePort to be false")
+		}
+		if opts := RequestedOptions(r); opts != nil {
+			t.Errorf("expected no requested options, but they were %v", opts)
+		}
+	})
+}
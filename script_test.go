@@ -0,0 +1,611 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedConn is a net.PacketConn connecting a conn to a scripted peer,
+// allowing the send and receive loops to be driven deterministically.
+//
+// Each datagram written is recorded and, unless lose reports it lost,
+// passed to peer. Reads return the peer's replies in order. When none are
+// queued the read deadline is reached on the fake clock and the read times
+// out, as it would if the peer's reply had been lost. The peer is told of
+// the timeout so that it may retransmit for the next read.
+type scriptedConn struct {
+	clock *fakeClock
+	addr  *net.UDPAddr
+	peer  func(dg *datagram) []datagram // Replies to each datagram the peer receives, nil on timeout
+	lose  func(n int) bool              // Reports whether the nth datagram written, from 1, is lost
+
+	mu       sync.Mutex
+	wire     []string // Datagrams written, see scriptString
+	replies  [][]byte
+	deadline time.Time
+}
+
+func newScriptedConn(peer func(*datagram) []datagram, lose func(int) bool) *scriptedConn {
+	if lose == nil {
+		lose = func(int) bool { return false }
+	}
+	return &scriptedConn{
+		clock: newFakeClock(),
+		addr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 54321},
+		peer:  peer,
+		lose:  lose,
+	}
+}
+
+// client returns a conn for a client transfer over the scripted conn.
+func (c *scriptedConn) client() *conn {
+	tConn := newSharedConn(c, ModeOctet, c.addr)
+	tConn.clock = c.clock
+	return tConn
+}
+
+// scriptString formats dg compactly for comparing on-wire sequences,
+// such as "DATA 3" or "ACK 2".
+func scriptString(dg datagram) string {
+	return dg.summary()
+}
+
+// sent returns the datagrams written, lost datagrams are suffixed with " lost".
+func (c *scriptedConn) sent() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.wire...)
+}
+
+func (c *scriptedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.replies) == 0 {
+		if d := c.deadline.Sub(c.clock.Now()); d > 0 {
+			c.clock.Advance(d)
+		}
+		c.queue(c.peer(nil))
+		return 0, c.addr, errScriptTimeout{}
+	}
+	n := copy(p, c.replies[0])
+	c.replies = c.replies[1:]
+	return n, c.addr, nil
+}
+
+func (c *scriptedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var dg datagram
+	dg.setBytes(append([]byte(nil), p...))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := scriptString(dg)
+	if c.lose(len(c.wire) + 1) {
+		c.wire = append(c.wire, entry+" lost")
+		return len(p), nil
+	}
+	c.wire = append(c.wire, entry)
+	c.queue(c.peer(&dg))
+	return len(p), nil
+}
+
+// queue adds replies from the peer to be read, must be called with mu held.
+func (c *scriptedConn) queue(replies []datagram) {
+	for _, reply := range replies {
+		c.replies = append(c.replies, reply.bytes())
+	}
+}
+
+func (c *scriptedConn) Close() error                     { return nil }
+func (c *scriptedConn) LocalAddr() net.Addr              { return &net.UDPAddr{} }
+func (c *scriptedConn) SetDeadline(t time.Time) error    { return c.SetReadDeadline(t) }
+func (c *scriptedConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *scriptedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+type errScriptTimeout struct{}
+
+func (errScriptTimeout) Error() string   { return "script: i/o timeout" }
+func (errScriptTimeout) Timeout() bool   { return true }
+func (errScriptTimeout) Temporary() bool { return true }
+
+// scriptedServer returns a peer acting as a server for a client's
+// request. For a WRQ it acknowledges the options and receives data,
+// resending its last ACK on timeout. For an RRQ it sends data a window
+// at a time, following each ACK.
+//
+// Delivery of replies is scripted by deliver, called with the number of
+// each reply from 1 and returning the number of copies received. A nil
+// deliver receives each reply once.
+func scriptedServer(data []byte, blksize, windowsize int, deliver func(n int) int) func(*datagram) []datagram {
+	if deliver == nil {
+		deliver = func(int) int { return 1 }
+	}
+	blocks := len(data)/blksize + 1
+	block := func(b int) datagram {
+		var dg datagram
+		end := b * blksize
+		if end > len(data) {
+			end = len(data)
+		}
+		dg.writeData(uint16(b), data[(b-1)*blksize:end])
+		return dg
+	}
+	oack := map[string]string{
+		optBlocksize:  fmt.Sprint(blksize),
+		optWindowSize: fmt.Sprint(windowsize),
+	}
+
+	var next, inWindow, sent int // Next block expected from the client, blocks received in the window, replies sent
+	reply := func(dgs ...datagram) []datagram {
+		var out []datagram
+		for _, dg := range dgs {
+			sent++
+			for i := deliver(sent); i > 0; i-- {
+				out = append(out, dg)
+			}
+		}
+		return out
+	}
+	ack := func(b int) datagram {
+		var dg datagram
+		dg.writeAck(uint16(b))
+		return dg
+	}
+	window := func(from int) []datagram {
+		var dgs []datagram
+		for b := from; b < from+windowsize && b <= blocks; b++ {
+			dgs = append(dgs, block(b))
+		}
+		return reply(dgs...)
+	}
+
+	return func(dg *datagram) []datagram {
+		if dg == nil {
+			if next > 0 {
+				return reply(ack(next - 1))
+			}
+			return nil
+		}
+		switch dg.opcode() {
+		case opCodeWRQ:
+			next = 1
+			var resp datagram
+			resp.writeOptionAck(oack)
+			return reply(resp)
+		case opCodeRRQ:
+			var resp datagram
+			resp.writeOptionAck(oack)
+			return reply(resp)
+		case opCodeACK:
+			// Reading, send the window following the ACK
+			return window(int(dg.block()) + 1)
+		case opCodeDATA:
+			b := int(dg.block())
+			if b != next {
+				// Missing blocks, acknowledge the last in sequence
+				if b > next && inWindow >= 0 {
+					inWindow = -1 // Wait for the sender to catch up
+					return reply(ack(next - 1))
+				}
+				return nil
+			}
+			next++
+			if inWindow < 0 {
+				inWindow = 0
+			}
+			if inWindow++; inWindow == windowsize || len(dg.data()) < blksize {
+				inWindow = 0
+				return reply(ack(b))
+			}
+		}
+		return nil
+	}
+}
+
+// lost returns a deliver function for scriptedServer losing replies ns.
+func lost(ns ...int) func(int) int {
+	return func(n int) int {
+		for _, lost := range ns {
+			if n == lost {
+				return 0
+			}
+		}
+		return 1
+	}
+}
+
+// duplicated returns a deliver function for scriptedServer receiving
+// replies ns twice.
+func duplicated(ns ...int) func(int) int {
+	return func(n int) int {
+		for _, dup := range ns {
+			if n == dup {
+				return 2
+			}
+		}
+		return 1
+	}
+}
+
+func TestConn_scripted(t *testing.T) {
+	data := []byte(strings.Repeat("8 bytes!", 10)) // Ten blocks and an empty final block
+	opts := map[string]string{optBlocksize: "8", optWindowSize: "4"}
+
+	cases := []struct {
+		name    string
+		write   bool
+		lose    func(n int) bool // Datagrams sent by the client to lose, from 1
+		deliver func(n int) int  // Copies received of datagrams sent by the server, from 1
+
+		expectedWire        []string
+		expectedRetransmits int
+		expectedTimeouts    int
+	}{
+		{
+			name:  "send, DATA lost within window",
+			write: true,
+			lose:  func(n int) bool { return n == 4 }, // WRQ, DATA 1, DATA 2, DATA 3
+
+			expectedWire: []string{
+				"WRITE_REQUEST",
+				"DATA 1", "DATA 2", "DATA 3 lost", "DATA 4",
+				// ACK 2, resend from the missing block
+				"DATA 3", "DATA 4", "DATA 5", "DATA 6",
+				"DATA 7", "DATA 8", "DATA 9", "DATA 10",
+				"DATA 11",
+			},
+			expectedRetransmits: 2,
+		},
+		{
+			name:    "send, ACK lost",
+			write:   true,
+			deliver: lost(2), // OACK, ACK 4
+
+			expectedWire: []string{
+				"WRITE_REQUEST",
+				"DATA 1", "DATA 2", "DATA 3", "DATA 4",
+				// Timeout, the receiver resends its last ACK
+				"DATA 5", "DATA 6", "DATA 7", "DATA 8",
+				"DATA 9", "DATA 10", "DATA 11",
+			},
+			expectedTimeouts: 1,
+		},
+		{
+			name:    "send, duplicate ACK",
+			write:   true,
+			deliver: duplicated(2), // OACK, ACK 4
+
+			expectedWire: []string{
+				"WRITE_REQUEST",
+				"DATA 1", "DATA 2", "DATA 3", "DATA 4",
+				"DATA 5", "DATA 6", "DATA 7", "DATA 8",
+				// The duplicate ACK 4 rolls back the window, the
+				// receiver ignores the blocks it already has
+				"DATA 5", "DATA 6", "DATA 7", "DATA 8",
+				"DATA 9", "DATA 10", "DATA 11",
+			},
+			expectedRetransmits: 4,
+		},
+		{
+			name:    "receive, DATA lost within window",
+			deliver: lost(3), // OACK, DATA 1, DATA 2
+
+			expectedWire: []string{
+				"READ_REQUEST",
+				"ACK 0",
+				// DATA 3 received out of sequence
+				"ACK 1",
+				"ACK 5",
+				"ACK 9",
+				"ACK 11",
+			},
+			expectedRetransmits: 1,
+		},
+		{
+			name:    "receive, window lost",
+			deliver: lost(6, 7, 8, 9), // OACK, DATA 1-4, DATA 5-8
+
+			expectedWire: []string{
+				"READ_REQUEST",
+				"ACK 0",
+				"ACK 4",
+				// Timeout clears and the ACK is resent
+				"ACK 4",
+				"ACK 8",
+				"ACK 11",
+			},
+			expectedRetransmits: 1,
+			expectedTimeouts:    1,
+		},
+		{
+			name:    "receive, duplicate DATA",
+			deliver: duplicated(3), // OACK, DATA 1, DATA 2
+
+			expectedWire: []string{
+				"READ_REQUEST",
+				"ACK 0",
+				"ACK 4",
+				"ACK 8",
+				"ACK 11",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := newScriptedConn(scriptedServer(data, 8, 4, c.deliver), c.lose)
+			tConn := sc.client()
+			tConn.retransmit = 2
+			start := sc.clock.Now()
+
+			if c.write {
+				if err := tConn.sendWriteRequest("file", opts); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tConn.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := tConn.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err := tConn.sendReadRequest("file", opts); err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(tConn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("expected %q, got %q", data, got)
+				}
+			}
+
+			if wire := sc.sent(); !reflect.DeepEqual(wire, c.expectedWire) {
+				t.Errorf("expected on-wire sequence\n%s\ngot\n%s", strings.Join(c.expectedWire, ", "), strings.Join(wire, ", "))
+			}
+			if tConn.stats.Retransmits != c.expectedRetransmits {
+				t.Errorf("expected %d retransmits, got %d", c.expectedRetransmits, tConn.stats.Retransmits)
+			}
+			if elapsed, expected := sc.clock.Now().Sub(start), time.Duration(c.expectedTimeouts)*defaultTimeout; elapsed != expected {
+				t.Errorf("expected %s of timeouts to elapse, got %s", expected, elapsed)
+			}
+		})
+	}
+}
+
+func TestConn_scripted_noOptions(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, 1000) // A full block and a short block
+
+	// An RFC 1350 server, responding to the request without an OACK
+	rfc1350Server := func() func(*datagram) []datagram {
+		peer := scriptedServer(data, defaultBlksize, 1, nil)
+		return func(dg *datagram) []datagram {
+			if dg == nil {
+				return peer(nil)
+			}
+			var resp datagram
+			switch dg.opcode() {
+			case opCodeRRQ:
+				// The first block follows the request as if it were ACK 0
+				resp.writeAck(0)
+				return peer(&resp)
+			case opCodeWRQ:
+				peer(dg) // Discard the OACK
+				resp.writeAck(0)
+				return []datagram{resp}
+			}
+			return peer(dg)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		write bool
+
+		expectedWire []string
+	}{
+		{
+			name:         "read",
+			expectedWire: []string{"READ_REQUEST", "ACK 1", "ACK 2"},
+		},
+		{
+			name:         "write",
+			write:        true,
+			expectedWire: []string{"WRITE_REQUEST", "DATA 1", "DATA 2"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := newScriptedConn(rfc1350Server(), nil)
+			tConn := sc.client()
+			start := sc.clock.Now()
+
+			if c.write {
+				if err := tConn.sendWriteRequest("file", nil); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tConn.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := tConn.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err := tConn.sendReadRequest("file", nil); err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(tConn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("expected %d bytes, got %d bytes that don't match", len(data), len(got))
+				}
+			}
+
+			// One datagram per block, without waiting for an OACK
+			if wire := sc.sent(); !reflect.DeepEqual(wire, c.expectedWire) {
+				t.Errorf("expected on-wire sequence\n%s\ngot\n%s", strings.Join(c.expectedWire, ", "), strings.Join(wire, ", "))
+			}
+			if elapsed := sc.clock.Now().Sub(start); elapsed != 0 {
+				t.Errorf("expected no time to elapse, %s elapsed", elapsed)
+			}
+		})
+	}
+}
+
+func TestConn_scripted_natKeepAlive(t *testing.T) {
+	data := []byte(strings.Repeat("8 bytes!", 10)) // Ten blocks and an empty final block
+	opts := map[string]string{optBlocksize: "8", optWindowSize: "4"}
+
+	sc := newScriptedConn(nil, nil)
+	start := sc.clock.Now()
+	peer := scriptedServer(data, 8, 4, nil)
+	sc.peer = func(dg *datagram) []datagram {
+		// The server stalls after the first window, ignoring
+		// ACKs until it's ready to send more
+		if dg != nil && dg.opcode() == opCodeACK && dg.block() == 4 && sc.clock.Now().Sub(start) < 1500*time.Millisecond {
+			return nil
+		}
+		return peer(dg)
+	}
+	tConn := sc.client()
+	tConn.readTimeout = 3 * time.Second
+	tConn.natKeepAlive = time.Second
+
+	if err := tConn.sendReadRequest("file", opts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(tConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+
+	expectedWire := []string{
+		"READ_REQUEST",
+		"ACK 0",
+		"ACK 4",
+		// Keep-alives while the server is stalled, the second
+		// is answered once it resumes
+		"ACK 4",
+		"ACK 4",
+		"ACK 8",
+		"ACK 11",
+	}
+	if wire := sc.sent(); !reflect.DeepEqual(wire, expectedWire) {
+		t.Errorf("expected on-wire sequence\n%s\ngot\n%s", strings.Join(expectedWire, ", "), strings.Join(wire, ", "))
+	}
+	if tConn.stats.Retransmits != 0 {
+		t.Errorf("expected keep-alives not to count as retransmits, got %d", tConn.stats.Retransmits)
+	}
+	if elapsed := sc.clock.Now().Sub(start); elapsed != 2*time.Second {
+		t.Errorf("expected 2s to elapse, got %s", elapsed)
+	}
+}
+
+func TestConn_scripted_partialOACK(t *testing.T) {
+	data := []byte(strings.Repeat("8 bytes!", 4)) // Four blocks and an empty final block
+	opts := map[string]string{optBlocksize: "8", optWindowSize: "4"}
+
+	// A server granting blksize but not windowsize, which it omits
+	// from the OACK
+	partialServer := func() func(*datagram) []datagram {
+		peer := scriptedServer(data, 8, 1, nil)
+		return func(dg *datagram) []datagram {
+			if dg != nil && (dg.opcode() == opCodeRRQ || dg.opcode() == opCodeWRQ) {
+				peer(dg) // Sets up for the request, discard the OACK
+				var resp datagram
+				resp.writeOptionAck(map[string]string{optBlocksize: "8"})
+				return []datagram{resp}
+			}
+			return peer(dg)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		write bool
+
+		expectedWire []string
+	}{
+		{
+			name:  "send",
+			write: true,
+
+			expectedWire: []string{
+				"WRITE_REQUEST",
+				"DATA 1", "DATA 2", "DATA 3", "DATA 4", "DATA 5",
+			},
+		},
+		{
+			name: "receive",
+
+			expectedWire: []string{
+				"READ_REQUEST",
+				"ACK 0", "ACK 1", "ACK 2", "ACK 3", "ACK 4", "ACK 5",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := newScriptedConn(partialServer(), nil)
+			tConn := sc.client()
+			start := sc.clock.Now()
+
+			if c.write {
+				if err := tConn.sendWriteRequest("file", opts); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tConn.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := tConn.Close(); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err := tConn.sendReadRequest("file", opts); err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(tConn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("expected %q, got %q", data, got)
+				}
+			}
+
+			// Granted blksize is used, windowsize defaults to 1
+			if tConn.blksize != 8 || tConn.windowsize != 1 {
+				t.Errorf("expected blksize 8 and windowsize 1, got blksize %d and windowsize %d", tConn.blksize, tConn.windowsize)
+			}
+			if wire := sc.sent(); !reflect.DeepEqual(wire, c.expectedWire) {
+				t.Errorf("expected on-wire sequence\n%s\ngot\n%s", strings.Join(c.expectedWire, ", "), strings.Join(wire, ", "))
+			}
+			if elapsed := sc.clock.Now().Sub(start); elapsed != 0 {
+				t.Errorf("expected no time to elapse, %s elapsed", elapsed)
+			}
+		})
+	}
+}
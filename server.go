@@ -5,8 +5,16 @@
 package tftp // import "pack.ag/tftp"
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -14,30 +22,98 @@ import (
 //
 // A ReadHandler, WriteHandler, or both can be registered to the server. If one
 // of the handlers isn't registered, the server will return errors to clients
-// attempting to use them.
+// attempting to use them. Requests can also be routed to different handlers
+// with HandleRead, HandleWrite, and HandleFunc.
 type Server struct {
-	log     *logger
-	net     string
-	addrStr string
-	addr    *net.UDPAddr
-	connMu  sync.RWMutex
-	conn    *net.UDPConn
-	close   chan struct{}
+	log       *logger
+	net       string
+	addrStr   string
+	addr      *net.UDPAddr
+	connMu    sync.RWMutex
+	conn      *net.UDPConn
+	close     chan struct{}
+	closeOnce sync.Once
 
-	singlePort bool
+	singlePort    bool
+	appendWrites  bool // Flag write requests to append to existing files
+	suppressTSize bool // Decline tsize on read requests
+	oackFallback  bool // Abandon options when the OACK isn't acknowledged
+	compress      bool // Accept the compress option
+	strictMode    bool // Reject requests with an invalid transfer mode
+	reuseAddr     bool // Set SO_REUSEADDR on the listening socket
+	reusePort     bool // Set SO_REUSEPORT on the listening socket
+
+	logFormat LogFormat // Format of the server's and transfers' log lines
+
+	initialBlock  uint16 // Number of the first DATA block
+	maxWindowsize uint16 // Largest windowsize acknowledged, 0 is unlimited
+	maxBlocksize  uint16 // Largest blocksize acknowledged, 0 is unlimited
 
 	dispatchChan chan *request
-	reqDoneChan  chan string
 
-	retransmit int // Per-packet retransmission limit
+	lastID uint64 // ID of the most recent transfer, accessed atomically
+
+	shutdownMu   sync.Mutex
+	shuttingDown bool           // Shutdown has been called, reject new requests
+	active       sync.WaitGroup // Transfers in progress
+
+	transfersMu sync.Mutex
+	transfers   map[string]chan []byte // Single port mode transfers by client address
+
+	connsMu sync.Mutex
+	conns   map[uint64]*conn // Active transfers by ID, for ActiveTransfers
+
+	pingsMu sync.Mutex
+	pings   map[string]bool // Addresses of Pings awaiting a reply, not counted in ErrorStats
+
+	retransmit     int           // Per-packet retransmission limit
+	maxRetransmit  int           // Per-transfer retransmission limit, 0 is unlimited
+	readTimeout    time.Duration // Wait for each datagram, 0 uses the negotiated timeout
+	writeIdle      time.Duration // Wait for the first DATA of a write request, 0 disables
+	deadline       time.Duration // Most time a transfer may take, 0 is unlimited
+	timeline       bool          // Capture each transfer's timeline for TransferInfo
+	heartbeat      time.Duration // OACK interval before a read handler's first Write, 0 disables
+	retryInterval  time.Duration // Pause before retransmitting after a timeout
+	natKeepAlive   time.Duration // Interval to resend the last ACK while waiting for DATA, 0 disables
+	maxRequestSize int           // Largest RRQ/WRQ accepted
+	maxOptions     int           // Most options accepted in an RRQ/WRQ
+
+	transferHook func(TransferInfo)         // Called after each transfer completes
+	mtu          int                        // MTU for fragmentation warnings, 0 disables
+	fragmentHook func(FragmentationWarning) // Called when a transfer's datagrams exceed mtu
+	rateLimit    int                        // Bytes per second of DATA across all transfers, 0 is unlimited
+	limiter      *rateLimiter               // Shared by all transfers when rateLimit is set
+	errors       *errorCounter              // ERRORs sent and received, shared by all transfers
+	rewrite      func(string) string        // Maps requested file names before handlers see them
+
+	slowDuration  time.Duration      // Transfers taking longer are slow, 0 disables
+	minThroughput int                // Bytes per second below which transfers are slow, 0 disables
+	slowHook      func(TransferInfo) // Called after slow transfers complete
+
+	noReadMsg  string // ERROR message sent when there is no ReadHandler
+	noWriteMsg string // ERROR message sent when there is no WriteHandler
+
+	clock clock // Source of time for transfers, replaced in tests
+
+	ctx    context.Context    // Parent of request contexts
+	cancel context.CancelFunc // Cancels ctx when the server is closed
+
+	rh     ReadHandler
+	wh     WriteHandler
+	routes []route // Checked in order before rh and wh
+}
 
-	rh ReadHandler
-	wh WriteHandler
+// route is a handler registered with a Matcher.
+type route struct {
+	match Matcher
+	rh    ReadHandler
+	wh    WriteHandler
 }
 
 type request struct {
 	addr *net.UDPAddr
 	pkt  []byte
+	name string // File name, set once the request is validated
 }
 
 // NewServer returns a configured Server.
@@ -48,14 +124,24 @@ type request struct {
 // Any number of ServerOpts can be provided to configure optional values.
 func NewServer(addr string, opts ...ServerOpt) (*Server, error) {
 	s := &Server{
-		log:          newLogger("server"),
-		net:          defaultUDPNet,
-		addrStr:      addr,
-		retransmit:   defaultRetransmit,
-		dispatchChan: make(chan *request, 64),
-		reqDoneChan:  make(chan string, 64),
-		close:        make(chan struct{}),
+		log:            newLogger("server"),
+		net:            defaultUDPNet,
+		addrStr:        addr,
+		retransmit:     defaultRetransmit,
+		maxRequestSize: defaultMaxRequestSize,
+		maxOptions:     defaultMaxOptions,
+		mtu:            defaultMTU,
+		initialBlock:   defaultInitialBlock,
+		strictMode:     true,
+		noReadMsg:      "Server does not support read requests.",
+		noWriteMsg:     "Server does not support write requests.",
+		dispatchChan:   make(chan *request, 64),
+		transfers:      make(map[string]chan []byte),
+		conns:          make(map[uint64]*conn),
+		close:          make(chan struct{}),
+		clock:          realClock{},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
@@ -63,6 +149,11 @@ func NewServer(addr string, opts ...ServerOpt) (*Server, error) {
 		}
 	}
 
+	if s.rateLimit > 0 {
+		s.limiter = newRateLimiter(s.rateLimit, s.clock)
+	}
+	s.errors = newErrorCounter(s.clock)
+
 	return s, nil
 }
 
@@ -87,12 +178,147 @@ func (s *Server) WriteHandler(wh WriteHandler) {
 	s.wh = wh
 }
 
-// Serve starts the server using an existing UDPConn.
+// A Matcher reports whether a request should be routed to a handler,
+// based on the file name and the options requested by the client.
+type Matcher func(name string, opts map[string]string) bool
+
+// MatchName returns a Matcher for file names matching pattern, using the
+// syntax of path.Match.
+func MatchName(pattern string) Matcher {
+	return func(name string, _ map[string]string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+}
+
+// MatchOption returns a Matcher for requests including option with value.
+func MatchOption(option, value string) Matcher {
+	return func(_ string, opts map[string]string) bool {
+		v, ok := opts[option]
+		return ok && v == value
+	}
+}
+
+// HandleRead registers a ReadHandler for read requests matching m.
+//
+// Handlers are checked in the order they were registered, the first match
+// serves the request. If none match the handler registered with ReadHandler
+// is used as a fallback.
+func (s *Server) HandleRead(m Matcher, rh ReadHandler) {
+	s.routes = append(s.routes, route{match: m, rh: rh})
+}
+
+// HandleWrite registers a WriteHandler for write requests matching m.
+//
+// Handlers are checked in the order they were registered, the first match
+// serves the request. If none match the handler registered with WriteHandler
+// is used as a fallback.
+func (s *Server) HandleWrite(m Matcher, wh WriteHandler) {
+	s.routes = append(s.routes, route{match: m, wh: wh})
+}
+
+// HandleFunc registers functions to serve read and write requests matching m.
+// Either may be nil, in which case requests of that type are not matched.
+func (s *Server) HandleFunc(m Matcher, rh ReadHandlerFunc, wh WriteHandlerFunc) {
+	r := route{match: m}
+	if rh != nil {
+		r.rh = rh
+	}
+	if wh != nil {
+		r.wh = wh
+	}
+	s.routes = append(s.routes, r)
+}
+
+// readHandler returns the handler for a read request.
+func (s *Server) readHandler(name string, opts options) ReadHandler {
+	for _, r := range s.routes {
+		if r.rh != nil && r.match(name, opts) {
+			return r.rh
+		}
+	}
+	return s.rh
+}
+
+// writeHandler returns the handler for a write request.
+func (s *Server) writeHandler(name string, opts options) WriteHandler {
+	for _, r := range s.routes {
+		if r.wh != nil && r.match(name, opts) {
+			return r.wh
+		}
+	}
+	return s.wh
+}
+
+// hasHandler reports whether any handler is registered for the request type.
+func (s *Server) hasHandler(write bool) bool {
+	if (write && s.wh != nil) || (!write && s.rh != nil) {
+		return true
+	}
+	for _, r := range s.routes {
+		if (write && r.wh != nil) || (!write && r.rh != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve starts the server using an existing UDPConn, such as one
+// obtained from an inherited file descriptor (see ServeFile).
 func (s *Server) Serve(conn *net.UDPConn) error {
-	if s.rh == nil && s.wh == nil {
+	return s.ServeContext(context.Background(), conn)
+}
+
+// ServeFile starts the server on a UDP socket which is already bound,
+// passed to the process as an open file. This supports socket activation,
+// where systemd passes the sockets from LISTEN_FDS starting at descriptor
+// 3, and restarts which hand the socket to a new process without missing
+// requests. For example:
+//
+//	s.ServeFile(os.NewFile(3, "tftp"))
+//
+// The descriptor is duplicated, closing f doesn't affect the server and
+// is left to the caller. ErrInvalidNetwork is returned if f
+// isn't a UDP socket. The network configured with ServerNet isn't used.
+func (s *Server) ServeFile(f *os.File) error {
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return wrapError(err, "opening inherited socket")
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return ErrInvalidNetwork
+	}
+	return wrapError(s.Serve(conn), "serving tftp")
+}
+
+// ServeContext starts the server using an existing UDPConn, as Serve,
+// and stops accepting requests when ctx is done, returning ctx.Err().
+//
+// As with Shutdown, transfers in progress are allowed to complete and
+// new requests are rejected. Call Shutdown or Close to wait for them
+// and release the server's resources. In single port mode transfers
+// share conn and cannot continue once ServeContext has returned.
+func (s *Server) ServeContext(ctx context.Context, conn *net.UDPConn) error {
+	if !s.hasHandler(false) && !s.hasHandler(true) {
 		return ErrNoRegisteredHandlers
 	}
 
+	// Unblock the read below when ctx is done
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.shutdownMu.Lock()
+			s.shuttingDown = true
+			s.shutdownMu.Unlock()
+			conn.SetReadDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+
 	s.connMu.Lock()
 	s.conn = conn
 	s.connMu.Unlock()
@@ -101,13 +327,25 @@ func (s *Server) Serve(conn *net.UDPConn) error {
 
 	s.connMu.RLock()
 	defer s.connMu.RUnlock()
-	buf := make([]byte, 65536) // Largest possible TFTP datagram
+
+	// Only requests are received on the listening conn unless in single port
+	// mode. One byte larger than the limit so oversized requests can be
+	// detected rather than silently truncated.
+	bufSize := s.maxRequestSize + 1
+	if s.singlePort {
+		bufSize = 65536 // Largest possible TFTP datagram
+	}
+	buf := make([]byte, bufSize)
 	for {
+		// Checked after setting the deadline so a cancellation between
+		// the two isn't overwritten
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
 		select {
 		case <-s.close:
 			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
-			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
 			n, addr, err := conn.ReadFromUDP(buf)
 			if err != nil {
 				if err, ok := err.(*net.OpError); ok && err.Timeout() {
@@ -120,10 +358,27 @@ func (s *Server) Serve(conn *net.UDPConn) error {
 				continue // Must be at least 2 bytes to read opcode
 			}
 
-			// Make a copy of the received data
+			if op := opcode(buf[1]); buf[0] == 0 && (op == opCodeRRQ || op == opCodeWRQ) {
+				var errMsg string
+				switch {
+				case n > s.maxRequestSize:
+					s.log.debug("Request from %v exceeds %d bytes", addr, s.maxRequestSize)
+					errMsg = "Request too large"
+				case (&datagram{buf: buf, offset: n}).exceedsOptions(s.maxOptions):
+					s.log.debug("Request from %v exceeds %d options", addr, s.maxOptions)
+					errMsg = "Too many options"
+				}
+				if errMsg != "" {
+					s.writeError(addr, ErrCodeIllegalOperation, errMsg)
+					continue
+				}
+			}
+
+			// Make a copy of the received data, the conn handling
+			// the request releases it
 			req := &request{
 				addr: addr,
-				pkt:  make([]byte, n),
+				pkt:  getBuf(n),
 			}
 			copy(req.pkt, buf)
 			s.dispatchChan <- req
@@ -132,50 +387,176 @@ func (s *Server) Serve(conn *net.UDPConn) error {
 }
 
 func (s *Server) connManager() {
-	reqMap := make(map[string]chan []byte)
-	var reqChan chan []byte
-
 	for {
 		select {
 		case req := <-s.dispatchChan:
-			switch req.pkt[1] {
-			case 1: //RRQ
-				if s.singlePort {
-					reqChan = make(chan []byte, 64)
-					reqMap[req.addr.String()] = reqChan
-				}
-				go s.dispatchReadRequest(req, reqChan)
-			case 2: //WRQ
-				if s.singlePort {
-					reqChan = make(chan []byte, 64)
-					reqMap[req.addr.String()] = reqChan
-				}
-				go s.dispatchWriteRequest(req, reqChan)
-			default:
-				if s.singlePort {
-					if reqChan, ok := reqMap[req.addr.String()]; ok {
-						reqChan <- req.pkt
-						break
-					}
-				}
+			s.route(req)
+		case <-s.close:
+			return
+		}
+	}
+}
 
-				// RFC1350:
-				// "If a source TID does not match, the packet should be
-				// discarded as erroneously sent from somewhere else.  An error packet
-				// should be sent to the source of the incorrect packet, while not
-				// disturbing the transfer."
-				dg := datagram{}
-				dg.writeError(ErrCodeUnknownTransferID, "Unexpected TID")
-				// Don't care about an error here, just a courtesy
-				_, _ = s.conn.WriteTo(dg.bytes(), req.addr)
-				s.log.debug("Unexpected datagram: %s", dg)
+// route starts a transfer for requests and, in single port mode, delivers
+// other datagrams to the transfer with the sender's address.
+func (s *Server) route(req *request) {
+	var reqChan chan []byte
+	if s.singlePort {
+		// A request from a peer with a transfer in progress is a
+		// retransmission, the client didn't receive our response.
+		// Route it to the transfer rather than starting another.
+		var ok bool
+		if reqChan, ok = s.transfer(req); ok {
+			select {
+			case reqChan <- req.pkt:
+			default:
+				// The transfer isn't keeping up, drop the datagram
+				// like the network would.
+				s.log.debug("Dropping datagram from %v, transfer queue full", req.addr)
+				putBuf(req.pkt)
 			}
-		case addr := <-s.reqDoneChan:
-			delete(reqMap, addr)
-		case <-s.close:
 			return
 		}
 	}
+
+	switch req.pkt[1] {
+	case 1, 2: //RRQ, WRQ
+		if !s.beginTransfer() {
+			s.endTransfer(req.addr, reqChan)
+			s.log.debug("Rejecting request from %v, server shutting down", req.addr)
+			s.writeError(req.addr, ErrCodeNotDefined, "server shutting down")
+			putBuf(req.pkt)
+			return
+		}
+		if req.pkt[1] == 1 {
+			go s.dispatchReadRequest(req, reqChan)
+		} else {
+			go s.dispatchWriteRequest(req, reqChan)
+		}
+	default:
+		// RFC1350:
+		// "If a source TID does not match, the packet should be
+		// discarded as erroneously sent from somewhere else.  An error packet
+		// should be sent to the source of the incorrect packet, while not
+		// disturbing the transfer."
+		s.log.debug("Unexpected datagram from %v", req.addr)
+		// Just a courtesy, the transfer isn't affected
+		if s.isPing(req.addr) {
+			s.sendError(req.addr, ErrCodeUnknownTransferID, "Unexpected TID")
+		} else {
+			s.writeError(req.addr, ErrCodeUnknownTransferID, "Unexpected TID")
+		}
+		putBuf(req.pkt)
+	}
+}
+
+// transfer returns the channel for the single port mode transfer with
+// req's address and true if one is in progress. Otherwise, if req is
+// a request a channel is registered for the new transfer.
+func (s *Server) transfer(req *request) (chan []byte, bool) {
+	key := req.addr.String()
+
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	if reqChan, ok := s.transfers[key]; ok {
+		return reqChan, true
+	}
+	if op := req.pkt[1]; op != 1 && op != 2 {
+		return nil, false
+	}
+	reqChan := make(chan []byte, 64)
+	s.transfers[key] = reqChan
+	return reqChan, false
+}
+
+// beginTransfer registers an active transfer, returning false
+// if the server is shutting down.
+func (s *Server) beginTransfer() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.active.Add(1)
+	return true
+}
+
+// endTransfer unregisters a single port mode transfer.
+func (s *Server) endTransfer(addr *net.UDPAddr, reqChan chan []byte) {
+	if reqChan == nil {
+		return
+	}
+
+	s.transfersMu.Lock()
+	defer s.transfersMu.Unlock()
+
+	key := addr.String()
+	if s.transfers[key] == reqChan {
+		delete(s.transfers, key)
+	}
+}
+
+// ActiveTransfers returns the state of each transfer in progress, ordered
+// by ID. The state is updated as handlers read and write, a transfer
+// waiting on the client reports where it's waiting.
+func (s *Server) ActiveTransfers() []TransferState {
+	s.connsMu.Lock()
+	states := make([]TransferState, 0, len(s.conns))
+	for _, c := range s.conns {
+		states = append(states, c.snapshot())
+	}
+	s.connsMu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// AbortTransfer ends the active transfer with id (see ActiveTransfers),
+// such as one from a misbehaving client, without affecting the server or
+// other transfers. The client is sent an ERROR, the transfer's context is
+// cancelled and it ends with ErrTransferAborted, returned from the
+// handler's Read or Write, once it next waits on the client or does either.
+// ErrTransferNotFound is returned if no transfer with id is active.
+func (s *Server) AbortTransfer(id uint64) error {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	c, ok := s.conns[id]
+	if !ok {
+		return ErrTransferNotFound
+	}
+	c.abortTransfer()
+	return nil
+}
+
+// ErrorStats returns counts of the ERROR datagrams sent and received by the
+// server's transfers, by error code. ERRORs sent in response to requests
+// that don't start a transfer, such as when there is no handler, are
+// included. Codes which haven't been seen are omitted.
+func (s *Server) ErrorStats() map[ErrorCode]ErrorStats {
+	return s.errors.snapshot()
+}
+
+// writeError sends an ERROR datagram to addr from the listening conn, for
+// requests which haven't started a transfer.
+func (s *Server) writeError(addr *net.UDPAddr, code ErrorCode, msg string) {
+	s.sendError(addr, code, msg)
+	s.errors.observe(code, msg, true)
+}
+
+// sendError is writeError without counting the ERROR in ErrorStats, for
+// replies to Ping.
+func (s *Server) sendError(addr *net.UDPAddr, code ErrorCode, msg string) {
+	var dg datagram
+	dg.writeError(code, msg)
+	_, _ = s.conn.WriteTo(dg.bytes(), addr) // Ignore error
+}
+
+// isPing reports whether addr is a Ping awaiting a reply.
+func (s *Server) isPing(addr *net.UDPAddr) bool {
+	s.pingsMu.Lock()
+	defer s.pingsMu.Unlock()
+	return s.pings[addr.String()]
 }
 
 // Connected is true if the server has started serving.
@@ -185,23 +566,145 @@ func (s *Server) Connected() bool {
 	return s.conn != nil
 }
 
-// Close stops the server and closes the network connection.
-func (s *Server) Close() error {
+// Ready is true if the server is listening and has not been closed.
+func (s *Server) Ready() bool {
 	s.connMu.RLock()
 	defer s.connMu.RUnlock()
-	close(s.close)
-	return s.conn.Close()
+	if s.conn == nil {
+		return false
+	}
+	select {
+	case <-s.close:
+		return false
+	default:
+		return true
+	}
+}
+
+// Ping checks that the server is responding to datagrams by sending
+// an unsolicited ACK to its listening address and waiting up to timeout
+// for the "Unexpected TID" error in reply. Handlers are not invoked and
+// the reply isn't counted in ErrorStats.
+//
+// If the server is listening on all interfaces the ping is sent
+// to the loopback address.
+func (s *Server) Ping(timeout time.Duration) error {
+	if !s.Ready() {
+		return ErrAddressNotAvailable
+	}
+	addr, err := s.Addr()
+	if err != nil {
+		return err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		ip := net.IPv4(127, 0, 0, 1)
+		if s.net == "udp6" {
+			ip = net.IPv6loopback
+		}
+		addr = &net.UDPAddr{IP: ip, Port: addr.Port}
+	}
+
+	conn, err := net.DialUDP(s.net, nil, addr)
+	if err != nil {
+		return wrapError(err, "opening ping connection")
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().String()
+	s.pingsMu.Lock()
+	if s.pings == nil {
+		s.pings = make(map[string]bool)
+	}
+	s.pings[local] = true
+	s.pingsMu.Unlock()
+	defer func() {
+		s.pingsMu.Lock()
+		delete(s.pings, local)
+		s.pingsMu.Unlock()
+	}()
+
+	var dg datagram
+	dg.writeAck(0)
+	if _, err := conn.Write(dg.bytes()); err != nil {
+		return wrapError(err, "sending ping")
+	}
+
+	dg.buf = make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(dg.buf)
+	if err != nil {
+		return wrapError(err, "reading ping response")
+	}
+	dg.offset = n
+	return wrapError(dg.validate(), "validating ping response")
+}
+
+// Shutdown gracefully stops the server. New requests are rejected with
+// an error while transfers in progress are allowed to complete. Once they
+// have, or ctx is done, the server is closed.
+//
+// If ctx is done before transfers complete its error is returned, transfers
+// still in progress are aborted as with Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownMu.Lock()
+	s.shuttingDown = true
+	s.shutdownMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if cErr := s.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// Close stops the server and closes the network connection. Transfers in
+// progress are aborted, handlers and ServerTransferHook receive an error
+// with the cause ErrServerClosing.
+//
+// Calls after the first have no effect and return nil.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.connMu.RLock()
+		defer s.connMu.RUnlock()
+		close(s.close)
+		s.cancel()
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+		// Active transfers end with ErrServerClosing
+		s.connsMu.Lock()
+		for _, c := range s.conns {
+			c.interrupt()
+		}
+		s.connsMu.Unlock()
+	})
+	return err
 }
 
 // dispatchReadRequest dispatches the read handler, if it is registered.
 // If a handler is not registered the server sends an error to the client.
 func (s *Server) dispatchReadRequest(req *request, reqChan chan []byte) {
+	defer s.active.Done()
+	defer s.endTransfer(req.addr, reqChan)
+
 	// Check for handler
-	if s.rh == nil {
+	if !s.hasHandler(false) {
 		s.log.debug("No read handler registered.")
-		var err datagram
-		err.writeError(ErrCodeIllegalOperation, "Server does not support read requests.")
-		_, _ = s.conn.WriteTo(err.bytes(), req.addr) // Ignore error
+		s.writeError(req.addr, ErrCodeIllegalOperation, s.noReadMsg)
+		putBuf(req.pkt)
 		return
 	}
 
@@ -211,24 +714,36 @@ func (s *Server) dispatchReadRequest(req *request, reqChan chan []byte) {
 	}
 	defer errorDefer(closer, s.log, "error closing network connection in dispath")
 
-	s.log.debug("New request from %v: %s", req.addr, c.rx)
+	s.log.debug("New request %d from %v: %s", c.id, req.addr, c.rx)
+
+	rh := s.readHandler(req.name, c.rx.options())
+	if rh == nil {
+		s.log.debug("No read handler matched %q.", req.name)
+		c.sendError(ErrCodeIllegalOperation, s.noReadMsg)
+		return
+	}
 
 	// Create request
-	w := &readRequest{conn: c, name: c.rx.filename()}
+	w := &readRequest{conn: c, name: req.name}
+	if s.heartbeat > 0 {
+		c.startHeartbeat(s.heartbeat)
+	}
 
 	// execute handler
-	s.rh.ServeTFTP(w)
+	rh.ServeTFTP(w)
 }
 
 // dispatchWriteRequest dispatches the read handler, if it is registered.
 // If a handler is not registered the server sends an error to the client.
 func (s *Server) dispatchWriteRequest(req *request, reqChan chan []byte) {
+	defer s.active.Done()
+	defer s.endTransfer(req.addr, reqChan)
+
 	// Check for handler
-	if s.wh == nil {
+	if !s.hasHandler(true) {
 		s.log.debug("No write handler registered.")
-		var err datagram
-		err.writeError(ErrCodeIllegalOperation, "Server does not support write requests.")
-		_, _ = s.conn.WriteTo(err.bytes(), req.addr) // Ignore error
+		s.writeError(req.addr, ErrCodeIllegalOperation, s.noWriteMsg)
+		putBuf(req.pkt)
 		return
 	}
 
@@ -238,16 +753,24 @@ func (s *Server) dispatchWriteRequest(req *request, reqChan chan []byte) {
 	}
 	defer errorDefer(closer, s.log, "error closing network connection in dispath")
 
-	s.log.debug("New request from %v: %s", req.addr, c.rx)
+	s.log.debug("New request %d from %v: %s", c.id, req.addr, c.rx)
+
+	wh := s.writeHandler(req.name, c.rx.options())
+	if wh == nil {
+		s.log.debug("No write handler matched %q.", req.name)
+		c.sendError(ErrCodeIllegalOperation, s.noWriteMsg)
+		return
+	}
 
 	// Create request
-	w := &writeRequest{conn: c, name: c.rx.filename()}
+	w := &writeRequest{conn: c, name: req.name, append: s.appendWrites}
 
 	// parse options to get size
 	c.log.trace("performing write setup")
+	c.idleTimeout = s.writeIdle
 	c.readSetup()
 
-	s.wh.ReceiveTFTP(w)
+	wh.ReceiveTFTP(w)
 }
 
 func (s *Server) newConn(req *request, reqChan chan []byte) (*conn, func() error, error) {
@@ -258,29 +781,111 @@ func (s *Server) newConn(req *request, reqChan chan []byte) (*conn, func() error
 	dg.setBytes(req.pkt)
 
 	// Validate request datagram
-	if err := dg.validate(); err != nil {
+	mode := dg.mode()
+	if err := dg.validate(); err == errInvalidMode && !s.strictMode {
+		s.log.debug("Request from %v has transfer mode %q, using octet", req.addr, mode)
+		mode = ModeOctet
+	} else if err != nil {
 		s.log.debug("Error decoding new request: %v", err)
+		if err == errInvalidMode || mode == modeMail {
+			s.writeError(req.addr, ErrCodeIllegalOperation, err.Error())
+		}
+		putBuf(req.pkt)
 		return nil, nil, err
 	}
 
+	req.name = dg.filename()
+	if s.rewrite != nil {
+		req.name = s.rewrite(req.name)
+	}
+
 	if s.singlePort {
-		c = newSinglePortConn(req.addr, dg.mode(), s.conn, reqChan)
+		c = newSinglePortConn(req.addr, mode, s.conn, reqChan)
 	} else {
-		c, err = newConn(s.net, dg.mode(), req.addr) // Use empty mode until request has been parsed.
+		c, err = newConn(s.net, mode, req.addr)
 		if err != nil {
 			s.log.err("Received error opening connection for new request: %v", err)
 			return nil, nil, err
 		}
 	}
 
+	// Identify the transfer in logs
+	c.id = atomic.AddUint64(&s.lastID, 1)
+	if s.logFormat == LogFormatJSON {
+		c.log = newJSONLogger(logFields{ID: c.id, Addr: req.addr.String(), Name: req.name})
+	} else {
+		c.log = newLogger(fmt.Sprintf("%s|%d", req.addr, c.id))
+	}
+
+	putBuf(c.rx.buf) // Replaced by the request buffer
 	c.rx = dg
+	c.clock = s.clock
+
 	// Set retransmit
 	c.retransmit = s.retransmit
+	c.maxRetransmit = s.maxRetransmit
+	c.readTimeout = s.readTimeout
+	c.retryInterval = s.retryInterval
+	c.natKeepAlive = s.natKeepAlive
+	if s.deadline > 0 {
+		c.deadline = s.clock.Now().Add(s.deadline)
+	}
+	c.mtu = s.mtu
+	c.fragmentHook = s.fragmentHook
+	c.limiter = s.limiter
+	c.errors = s.errors
+	c.suppressTSize = s.suppressTSize
+	c.oackFallback = s.oackFallback
+	c.allowCompress = s.compress
+	c.maxWindowsize = s.maxWindowsize
+	c.maxBlocksize = s.maxBlocksize
+	c.requested = dg.options()
+	c.setInitialBlock(s.initialBlock)
+	c.ctx, c.cancel = context.WithCancel(s.ctx)
+	c.serverClose = s.close
+	c.abort = make(chan struct{})
+
+	// dg shares the buffer with c.rx, capture fields before it's reused
+	name, write, start := req.name, dg.opcode() == opCodeWRQ, s.clock.Now()
+	c.diag = &TransferState{ID: c.id, Name: name, Addr: req.addr, Write: write, Started: start}
+	if s.timeline {
+		c.timeline = newTimeline(start)
+	}
+	s.connsMu.Lock()
+	s.conns[c.id] = c
+	s.connsMu.Unlock()
 
 	closer := func() error {
 		err := c.Close()
-		if s.singlePort {
-			s.reqDoneChan <- req.addr.String()
+		c.cancel()
+		s.connsMu.Lock()
+		delete(s.conns, c.id)
+		s.connsMu.Unlock()
+		defer c.release()
+		info := TransferInfo{
+			ID:       c.id,
+			Name:     name,
+			Addr:     req.addr,
+			Write:    write,
+			Bytes:    c.bytes,
+			Duration: s.clock.Now().Sub(start),
+			Err:      err,
+			Stats:    c.stats,
+		}
+		if err != nil && c.timeline != nil {
+			info.Timeline = c.timeline.snapshot()
+		}
+		if s.transferHook != nil {
+			s.transferHook(info)
+		}
+		for _, fn := range c.doneHooks {
+			fn(info, c.sentError)
+		}
+		if s.isSlow(info) {
+			c.log.debug("Slow transfer of %d bytes in %s", info.Bytes, info.Duration)
+			if s.slowHook != nil {
+				s.slowHook(info)
+			}
 		}
 		return err
 	}
@@ -288,6 +893,21 @@ func (s *Server) newConn(req *request, reqChan chan []byte) (*conn, func() error
 	return c, closer, nil
 }
 
+// isSlow reports whether a successful transfer breached the thresholds
+// configured with ServerSlowTransferThreshold.
+func (s *Server) isSlow(info TransferInfo) bool {
+	if info.Err != nil {
+		return false
+	}
+	if s.slowDuration > 0 && info.Duration > s.slowDuration {
+		return true
+	}
+	if s.minThroughput > 0 && info.Duration >= time.Second {
+		return float64(info.Bytes)/info.Duration.Seconds() < float64(s.minThroughput)
+	}
+	return false
+}
+
 // ListenAndServe starts a configured server.
 func (s *Server) ListenAndServe() error {
 	addr, err := net.ResolveUDPAddr(s.net, s.addrStr)
@@ -296,7 +916,7 @@ func (s *Server) ListenAndServe() error {
 	}
 	s.addr = addr
 
-	conn, err := net.ListenUDP(s.net, s.addr)
+	conn, err := s.listen()
 	if err != nil {
 		return wrapError(err, "opening network connection")
 	}
@@ -304,6 +924,32 @@ func (s *Server) ListenAndServe() error {
 	return wrapError(s.Serve(conn), "serving tftp")
 }
 
+// listen opens the server's UDPConn, setting the socket options
+// configured with ServerReuseAddr and ServerReusePort before binding.
+func (s *Server) listen() (*net.UDPConn, error) {
+	if !s.reuseAddr && !s.reusePort {
+		return net.ListenUDP(s.net, s.addr)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setReuse(fd, s.reuseAddr, s.reusePort)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), s.net, s.addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
 // ServerOpt is a function that configures a Server.
 type ServerOpt func(*Server) error
 
@@ -322,6 +968,7 @@ func ServerNet(net string) ServerOpt {
 }
 
 // ServerRetransmit configures the per-packet retransmission limit for all requests.
+// Zero disables retransmission, a transfer fails at the first timeout.
 //
 // Default: 10.
 func ServerRetransmit(i int) ServerOpt {
@@ -334,10 +981,168 @@ func ServerRetransmit(i int) ServerOpt {
 	}
 }
 
+// ServerMaxTotalRetransmits configures the total number of retransmissions
+// allowed over the course of a transfer. Unlike ServerRetransmit, which bounds
+// consecutive retransmissions of a single datagram, this bounds the total
+// effort spent on a transfer over a link with persistent intermittent loss.
+//
+// Default: 0, unlimited.
+func ServerMaxTotalRetransmits(i int) ServerOpt {
+	return func(s *Server) error {
+		if i < 0 {
+			return ErrInvalidRetransmit
+		}
+		s.maxRetransmit = i
+		return nil
+	}
+}
+
+// ServerReadTimeout configures how long to wait for each datagram from a
+// client before considering it lost, independent of the timeout option
+// negotiated with the client. Zero uses the negotiated timeout.
+//
+// Default: 0.
+func ServerReadTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		s.readTimeout = d
+		return nil
+	}
+}
+
+// ServerWriteIdleTimeout configures how long to wait for the first DATA
+// block of a write request after acknowledging it. Clients which never
+// start sending are abandoned once d has passed, rather than after
+// retransmitting the acknowledgement the full number of times, and the
+// handler's Read returns ErrWriteIdleTimeout. Zero disables the limit.
+//
+// The wait is only ever shortened, a d longer than the timeout multiplied
+// by the retransmit limit has no effect.
+//
+// Default: 0.
+func ServerWriteIdleTimeout(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		s.writeIdle = d
+		return nil
+	}
+}
+
+// ServerTransferDeadline limits how long a transfer may take from the
+// request, so a stalled or trickling client can't hold a transfer open
+// indefinitely. Once d has passed the client is sent an ERROR and the
+// transfer ends with ErrTransferDeadline. The bytes transferred until
+// then are reported by TransferInfo, as for any failed transfer, showing
+// how far it got. Zero disables the limit.
+//
+// Default: 0.
+func ServerTransferDeadline(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		s.deadline = d
+		return nil
+	}
+}
+
+// ServerCaptureTimeline configures the server to record a timeline of each
+// transfer's datagrams: the time each is sent, resent, or received, and
+// each read timing out. When a transfer fails the timeline is included in
+// the TransferInfo passed to the ServerTransferHook, for diagnosing
+// failures on poor connections. Only the last 128 events are kept.
+//
+// Default: false.
+func ServerCaptureTimeline(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.timeline = enable
+		return nil
+	}
+}
+
+// ServerHeartbeat configures the server to keep clients waiting while a
+// read handler prepares its data, such as when generating content. If the
+// handler hasn't called Write within interval, the server negotiates
+// options and sends the OACK on its behalf, then resends the OACK every
+// interval until the handler's first Write. This is a non-standard use of
+// the OACK.
+//
+// Clients from this package treat each resent OACK as a sign the server
+// is alive and keep waiting. Other clients reply with ACK 0
+// as if their acknowledgement was lost. They restart their timeout but may
+// count the OACK as a retry, or reject it, ending the transfer. The
+// interval should be shorter than the client's timeout. Heartbeats require
+// the client to request options, otherwise there is no OACK to send.
+// Calling WriteSize before the first heartbeat ensures tsize is included.
+//
+// Default: 0, disabled.
+func ServerHeartbeat(interval time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if interval < 0 {
+			return ErrInvalidDuration
+		}
+		s.heartbeat = interval
+		return nil
+	}
+}
+
+// ServerRetryInterval configures a pause between a read timing out and
+// the retransmission that follows. Retransmissions on timeout are made by
+// the receiving side, so this applies to write requests. The number of
+// retransmissions is configured with ServerRetransmit.
+//
+// Default: 0, retransmit immediately.
+func ServerRetryInterval(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		s.retryInterval = d
+		return nil
+	}
+}
+
+// ServerNATKeepAlive configures write requests to resend the last ACK
+// every d while waiting for DATA, so a client behind a NAT doesn't lose
+// its mapping when it pauses longer than the NAT's idle timeout, such as
+// while it waits on a slow source. Keep-alives don't count as
+// retransmissions and don't extend ServerReadTimeout or
+// ServerWriteIdleTimeout.
+//
+// A keep-alive is a duplicate ACK, which the client may answer by
+// resending blocks. d should be well beyond the client's usual response
+// time.
+//
+// Default: 0, disabled.
+func ServerNATKeepAlive(d time.Duration) ServerOpt {
+	return func(s *Server) error {
+		if d < 0 {
+			return ErrInvalidDuration
+		}
+		s.natKeepAlive = d
+		return nil
+	}
+}
+
+// serverClock configures the clock used by transfers. It's unexported,
+// only tests need to control time.
+func serverClock(clk clock) ServerOpt {
+	return func(s *Server) error {
+		s.clock = clk
+		return nil
+	}
+}
+
 // ServerSinglePort enables the server to service all requests via a single port rather
 // than the standard TFTP behavior of each client communicating on a separate port.
 //
-// This is an experimental feature.
+// Datagrams are routed to transfers by the client's address. A request
+// from a client with a transfer in progress is treated as a retransmission
+// of the original request.
 //
 // Default is disabled.
 func ServerSinglePort(enable bool) ServerOpt {
@@ -346,3 +1151,346 @@ func ServerSinglePort(enable bool) ServerOpt {
 		return nil
 	}
 }
+
+// ServerReuseAddr sets SO_REUSEADDR on the socket opened by ListenAndServe,
+// allowing a restarted server to bind its address immediately.
+//
+// Only supported on Unix-like systems, ListenAndServe returns an error elsewhere.
+// Has no effect on Serve, which uses an existing UDPConn.
+//
+// Default is disabled.
+func ServerReuseAddr(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.reuseAddr = enable
+		return nil
+	}
+}
+
+// ServerReusePort sets SO_REUSEPORT on the socket opened by ListenAndServe,
+// allowing several servers, usually in separate processes, to listen on the
+// same address. Each server must enable it. Combined with ServerSinglePort
+// the operating system distributes clients across the servers.
+//
+// Only supported on Unix-like systems, ListenAndServe returns an error elsewhere.
+// Has no effect on Serve, which uses an existing UDPConn.
+//
+// Default is disabled.
+func ServerReusePort(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.reusePort = enable
+		return nil
+	}
+}
+
+// ServerAppend configures write requests to append to existing files rather
+// than replace them, for clients that repeatedly upload a growing file such
+// as a log. WriteHandlers check Append; FileServer opens files with
+// OpenAppender.
+//
+// Default is disabled.
+func ServerAppend(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.appendWrites = enable
+		return nil
+	}
+}
+
+// ServerNoReadHandlerMessage configures the message sent to clients making
+// read requests when no ReadHandler is registered. The message cannot
+// contain NUL bytes.
+//
+// Default: "Server does not support read requests."
+func ServerNoReadHandlerMessage(msg string) ServerOpt {
+	return func(s *Server) error {
+		if strings.IndexByte(msg, 0) != -1 {
+			return ErrInvalidErrorMessage
+		}
+		s.noReadMsg = msg
+		return nil
+	}
+}
+
+// ServerNoWriteHandlerMessage configures the message sent to clients making
+// write requests when no WriteHandler is registered. The message cannot
+// contain NUL bytes.
+//
+// Default: "Server does not support write requests."
+func ServerNoWriteHandlerMessage(msg string) ServerOpt {
+	return func(s *Server) error {
+		if strings.IndexByte(msg, 0) != -1 {
+			return ErrInvalidErrorMessage
+		}
+		s.noWriteMsg = msg
+		return nil
+	}
+}
+
+// ServerFilenameRewrite registers a function mapping the file name requested
+// by the client to the name handlers see.
+//
+// fn is called after the request is validated. Its result is returned by
+// the request's Name method and reported in TransferInfo.
+//
+// For example, to serve versioned boot images:
+//
+//	tftp.ServerFilenameRewrite(func(name string) string {
+//		return path.Join("images/v2", name)
+//	})
+func ServerFilenameRewrite(fn func(string) string) ServerOpt {
+	return func(s *Server) error {
+		s.rewrite = fn
+		return nil
+	}
+}
+
+// ServerTransferHook registers a function to be called with the details
+// of each transfer after it completes, successfully or not.
+//
+// The function is called from the transfer's goroutine and should not block.
+func ServerTransferHook(fn func(TransferInfo)) ServerOpt {
+	return func(s *Server) error {
+		s.transferHook = fn
+		return nil
+	}
+}
+
+// ServerSlowTransferThreshold configures the server to report transfers
+// taking longer than maxDuration, or averaging fewer than minBytesPerSec,
+// to the function registered with ServerSlowTransferHook. Slow transfers
+// are also logged in debug mode. Zero disables either threshold.
+//
+// Only successful transfers are checked, failures are reported by
+// ServerTransferHook. Transfers completing in under a second aren't
+// checked against minBytesPerSec, their throughput is dominated by
+// round trip latency rather than the connection's bandwidth.
+//
+// Default: 0, 0.
+func ServerSlowTransferThreshold(maxDuration time.Duration, minBytesPerSec int) ServerOpt {
+	return func(s *Server) error {
+		if maxDuration < 0 {
+			return ErrInvalidDuration
+		}
+		if minBytesPerSec < 0 {
+			return ErrInvalidThroughput
+		}
+		s.slowDuration = maxDuration
+		s.minThroughput = minBytesPerSec
+		return nil
+	}
+}
+
+// ServerSlowTransferHook registers a function to be called with the details
+// of transfers breaching the thresholds configured with
+// ServerSlowTransferThreshold, after ServerTransferHook.
+//
+// The function is called from the transfer's goroutine and should not block.
+func ServerSlowTransferHook(fn func(TransferInfo)) ServerOpt {
+	return func(s *Server) error {
+		s.slowHook = fn
+		return nil
+	}
+}
+
+// ServerMTU configures the MTU used to detect a negotiated blocksize which
+// results in fragmented DATA datagrams. Transfers exceeding it are logged in
+// debug mode and reported to the function registered with
+// ServerFragmentationHook. The transfer is unaffected. Zero disables the check.
+//
+// Default: 1500.
+func ServerMTU(mtu int) ServerOpt {
+	return func(s *Server) error {
+		if mtu != 0 && mtu < 68 {
+			return ErrInvalidMTU
+		}
+		s.mtu = mtu
+		return nil
+	}
+}
+
+// ServerOACKFallback configures the server to abandon negotiated options
+// when the client doesn't acknowledge the OACK within the timeout. The
+// transfer continues as if no options were requested, using 512 byte
+// blocks. This supports clients which send options but silently ignore
+// the OACK.
+//
+// When disabled the OACK is resent on each timeout. Enabling fallback
+// can corrupt transfers with clients whose acknowledgment of the OACK
+// is delayed rather than never sent, only enable it if such clients
+// need to be supported.
+//
+// Default: false.
+func ServerOACKFallback(fallback bool) ServerOpt {
+	return func(s *Server) error {
+		s.oackFallback = fallback
+		return nil
+	}
+}
+
+// ServerCompress configures the server to accept the non-standard compress
+// option requested by clients from this package (see ClientCompress). The
+// data of octet mode transfers is then gzip compressed on the wire, handlers
+// read and write it uncompressed.
+//
+// Default: false.
+func ServerCompress(enable bool) ServerOpt {
+	return func(s *Server) error {
+		s.compress = enable
+		return nil
+	}
+}
+
+// ServerInitialBlock configures the number of the first DATA block of
+// each transfer, for clients which don't start at 1 as RFC 1350 requires.
+// It isn't negotiated, so every client of the server must use the same
+// initial block (see ClientInitialBlock).
+//
+// Default: 1.
+func ServerInitialBlock(block uint16) ServerOpt {
+	return func(s *Server) error {
+		s.initialBlock = block
+		return nil
+	}
+}
+
+// ServerMaxWindowsize configures the largest windowsize acknowledged
+// for a transfer. Clients requesting a larger window are offered size
+// instead, as permitted by RFC 7440.
+//
+// Default: no limit.
+func ServerMaxWindowsize(size int) ServerOpt {
+	return func(s *Server) error {
+		if size < 1 || size > 65535 {
+			return ErrInvalidWindowsize
+		}
+		s.maxWindowsize = uint16(size)
+		return nil
+	}
+}
+
+// ServerMaxBlocksize configures the largest blocksize acknowledged for a
+// transfer. Clients requesting larger blocks are offered size instead, as
+// permitted by RFC 2348. The blocksize the client asked for remains
+// available from RequestedOptions.
+//
+// Default: no limit.
+func ServerMaxBlocksize(size int) ServerOpt {
+	return func(s *Server) error {
+		if size < 8 || size > 65464 {
+			return ErrInvalidBlocksize
+		}
+		s.maxBlocksize = uint16(size)
+		return nil
+	}
+}
+
+// ServerLogFormat configures the format of log lines written by the server
+// and its transfers. With LogFormatJSON lines from a transfer include its
+// ID, client address, and file name. Handlers such as FileServer log
+// separately and aren't affected.
+//
+// Default: LogFormatText.
+func ServerLogFormat(format LogFormat) ServerOpt {
+	return func(s *Server) error {
+		switch format {
+		case LogFormatText:
+			s.log = newLogger("server")
+		case LogFormatJSON:
+			s.log = newJSONLogger(logFields{})
+		default:
+			return ErrInvalidLogFormat
+		}
+		s.logFormat = format
+		return nil
+	}
+}
+
+// ServerStrictMode configures whether requests with an empty or
+// unrecognized transfer mode are rejected with ErrCodeIllegalOperation.
+// When disabled such requests are served in octet mode, for clients that
+// don't comply with RFC 1350. The mail mode is rejected regardless.
+//
+// Default: true.
+func ServerStrictMode(strict bool) ServerOpt {
+	return func(s *Server) error {
+		s.strictMode = strict
+		return nil
+	}
+}
+
+// ServerSuppressTSize configures the server to decline the tsize option on
+// read requests, even when the handler provides the size with WriteSize.
+// Clients are unable to learn the size of files without transferring them,
+// such as with Client.Negotiate. The size sent by clients on write requests
+// is still available to handlers.
+//
+// Default: false.
+func ServerSuppressTSize(suppress bool) ServerOpt {
+	return func(s *Server) error {
+		s.suppressTSize = suppress
+		return nil
+	}
+}
+
+// ServerGlobalRateLimit limits the rate DATA is sent to bytesPerSec,
+// shared across all transfers. Transfers draw from a single token bucket
+// in the order they're ready to send, no attempt is made to divide the
+// rate evenly between them. Zero disables the limit.
+//
+// The limit includes TFTP headers and retransmissions, but not IP and
+// UDP headers. Bursts of up to a tenth of bytesPerSec are permitted after
+// the server has been idle.
+//
+// Default: 0.
+func ServerGlobalRateLimit(bytesPerSec int) ServerOpt {
+	return func(s *Server) error {
+		if bytesPerSec < 0 {
+			return ErrInvalidRateLimit
+		}
+		s.rateLimit = bytesPerSec
+		return nil
+	}
+}
+
+// ServerFragmentationHook registers a function to be called when a transfer
+// negotiates a blocksize resulting in datagrams larger than the MTU
+// configured with ServerMTU.
+//
+// The function is called from the transfer's goroutine and should not block.
+func ServerFragmentationHook(fn func(FragmentationWarning)) ServerOpt {
+	return func(s *Server) error {
+		s.fragmentHook = fn
+		return nil
+	}
+}
+
+// ServerMaxOptions configures the most options the server will accept in a
+// read or write request. Requests with more are rejected with an error
+// before the options are parsed, limiting the work done for malicious
+// requests.
+//
+// Default: 16.
+func ServerMaxOptions(n int) ServerOpt {
+	return func(s *Server) error {
+		if n < 1 {
+			return ErrInvalidMaxOptions
+		}
+		s.maxOptions = n
+		return nil
+	}
+}
+
+// ServerMaxRequestSize configures the largest read or write request, in bytes,
+// the server will accept. Larger requests are rejected with an error rather
+// than being truncated.
+// Valid range is 512 to 65535.
+//
+// Default: 4096.
+func ServerMaxRequestSize(size int) ServerOpt {
+	return func(s *Server) error {
+		if size < 512 || size > 65535 {
+			return ErrInvalidMaxRequestSize
+		}
+		s.maxRequestSize = size
+		return nil
+	}
+}
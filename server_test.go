@@ -4,7 +4,24 @@
 
 package tftp // import "pack.ag/tftp"
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestNewServer(t *testing.T) {
 	t.Parallel()
@@ -64,6 +81,141 @@ func TestNewServer(t *testing.T) {
 
 			expectedError: ErrInvalidRetransmit,
 		},
+		{
+			name: "max options, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxOptions(0),
+			},
+
+			expectedError: ErrInvalidMaxOptions,
+		},
+		{
+			name: "global rate limit, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerGlobalRateLimit(-1),
+			},
+
+			expectedError: ErrInvalidRateLimit,
+		},
+		{
+			name: "slow transfer duration, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerSlowTransferThreshold(-1, 0),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "slow transfer throughput, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerSlowTransferThreshold(0, -1),
+			},
+
+			expectedError: ErrInvalidThroughput,
+		},
+		{
+			name: "max windowsize, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxWindowsize(0),
+			},
+
+			expectedError: ErrInvalidWindowsize,
+		},
+		{
+			name: "max blocksize, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxBlocksize(65465),
+			},
+
+			expectedError: ErrInvalidBlocksize,
+		},
+		{
+			name: "write idle timeout, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerWriteIdleTimeout(-1),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "log format, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerLogFormat(LogFormat(5)),
+			},
+
+			expectedError: ErrInvalidLogFormat,
+		},
+		{
+			name: "heartbeat, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerHeartbeat(-1),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "mtu, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMTU(10),
+			},
+
+			expectedError: ErrInvalidMTU,
+		},
+		{
+			name: "max total retransmits, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxTotalRetransmits(-1),
+			},
+
+			expectedError: ErrInvalidRetransmit,
+		},
+		{
+			name: "read timeout, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerReadTimeout(-time.Second),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "retry interval, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerRetryInterval(-time.Second),
+			},
+
+			expectedError: ErrInvalidDuration,
+		},
+		{
+			name: "no read handler message, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerNoReadHandlerMessage("no\x00reads"),
+			},
+
+			expectedError: ErrInvalidErrorMessage,
+		},
+		{
+			name: "max request size, invalid",
+			addr: "",
+			opts: []ServerOpt{
+				ServerMaxRequestSize(100),
+			},
+
+			expectedError: ErrInvalidMaxRequestSize,
+		},
 	}
 
 	for _, c := range cases {
@@ -96,3 +248,2213 @@ func TestNewServer(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_TransferHook(t *testing.T) {
+	data := []byte("the data")
+
+	infoChan := make(chan TransferInfo, 1)
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write(data)
+	}), nil, ServerTransferHook(func(i TransferInfo) {
+		infoChan <- i
+	}))
+	defer s.Close()
+
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	// Request without options, server responds with DATA 1
+	var dg datagram
+	dg.writeReadReq("file", ModeOctet, nil)
+	cConn.send(dg, sAddr)
+	_, tAddr := cConn.read(3 * time.Second)
+
+	// ACK 0 causes the server to retransmit DATA 1
+	dg.writeAck(0)
+	cConn.send(dg, tAddr)
+	if rx, _ := cConn.read(3 * time.Second); rx.opcode() != opCodeDATA || rx.block() != 1 {
+		t.Fatalf("expected DATA 1 to be retransmitted, got %s", rx)
+	}
+
+	dg.writeAck(1)
+	cConn.send(dg, tAddr)
+
+	var info TransferInfo
+	select {
+	case info = <-infoChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for transfer hook")
+	}
+
+	if info.Name != "file" {
+		t.Errorf("expected name %q, but it was %q", "file", info.Name)
+	}
+	if info.Addr.String() != cConn.LocalAddr().String() {
+		t.Errorf("expected addr %s, but it was %s", cConn.LocalAddr(), info.Addr)
+	}
+	if info.Write {
+		t.Errorf("expected read transfer")
+	}
+	if info.Bytes != int64(len(data)) {
+		t.Errorf("expected %d bytes, but it was %d", len(data), info.Bytes)
+	}
+	if info.Err != nil {
+		t.Errorf("expected no error, got %v", info.Err)
+	}
+	if info.Stats.Retransmits != 1 {
+		t.Errorf("expected 1 retransmit, but it was %d", info.Stats.Retransmits)
+	}
+	if info.Stats.RTTSamples < 1 || info.Stats.MaxRTT < info.Stats.MinRTT {
+		t.Errorf("expected RTT to be measured, got %+v", info.Stats)
+	}
+}
+
+func TestServer_maxRequestSize(t *testing.T) {
+	// RRQ with options totalling over 1024 bytes
+	opts := map[string]string{optTransferSize: "0"}
+	for i := 0; i < 10; i++ {
+		opts[fmt.Sprintf("x-option-%02d", i)] = strings.Repeat("v", 128)
+	}
+	var req datagram
+	req.writeReadReq("file", ModeOctet, opts)
+	if req.offset <= 1024 {
+		t.Fatalf("expected request over 1024 bytes, but it was %d", req.offset)
+	}
+
+	cases := []struct {
+		name string
+		opts []ServerOpt
+
+		expectedOpcode opcode
+	}{
+		{
+			name: "default",
+
+			expectedOpcode: opCodeOACK,
+		},
+		{
+			name: "1024",
+			opts: []ServerOpt{ServerMaxRequestSize(1024)},
+
+			expectedOpcode: opCodeERROR,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.WriteSize(8)
+				w.Write([]byte("the data"))
+			}), nil, c.opts...)
+			defer s.Close()
+
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+
+			cConn.send(req, sAddr)
+			dg, _ := cConn.read(3 * time.Second)
+
+			if dg.opcode() != c.expectedOpcode {
+				t.Errorf("expected %s response, got %s", c.expectedOpcode, dg)
+			}
+		})
+	}
+}
+
+func TestServer_maxOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []ServerOpt
+		options int
+
+		expectedOpcode opcode
+		expectedMsg    string
+	}{
+		{
+			name:    "default, at limit",
+			options: 16,
+
+			expectedOpcode: opCodeOACK,
+		},
+		{
+			name:    "default, hundreds",
+			options: 300,
+
+			expectedOpcode: opCodeERROR,
+			expectedMsg:    "Too many options",
+		},
+		{
+			name:    "4, exceeded",
+			opts:    []ServerOpt{ServerMaxOptions(4)},
+			options: 5,
+
+			expectedOpcode: opCodeERROR,
+			expectedMsg:    "Too many options",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.WriteSize(8)
+				w.Write([]byte("the data"))
+			}), nil, c.opts...)
+			defer s.Close()
+
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+
+			opts := map[string]string{optTransferSize: "0"}
+			for i := 1; i < c.options; i++ {
+				opts[fmt.Sprintf("x-%03d", i)] = "v"
+			}
+			var req datagram
+			req.writeReadReq("file", ModeOctet, opts)
+			cConn.send(req, sAddr)
+			dg, _ := cConn.read(3 * time.Second)
+
+			if dg.opcode() != c.expectedOpcode {
+				t.Fatalf("expected %s response, got %s", c.expectedOpcode, dg)
+			}
+			if c.expectedMsg != "" && dg.errMsg() != c.expectedMsg {
+				t.Errorf("expected error message %q, got %q", c.expectedMsg, dg.errMsg())
+			}
+		})
+	}
+}
+
+func TestServer_unknownSize(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64 // -1 doesn't call WriteSize
+		opts []ServerOpt
+
+		expectedOpts options
+	}{
+		{
+			name: "size known",
+			size: 8,
+
+			expectedOpts: options{optBlocksize: "512", optTransferSize: "8"},
+		},
+		{
+			name: "size unknown",
+			size: -1,
+
+			expectedOpts: options{optBlocksize: "512"},
+		},
+		{
+			name: "size known, suppressed",
+			size: 8,
+			opts: []ServerOpt{ServerSuppressTSize(true)},
+
+			expectedOpts: options{optBlocksize: "512"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				if c.size >= 0 {
+					w.WriteSize(c.size)
+				}
+				w.Write([]byte("the data"))
+			}), nil, c.opts...)
+			defer s.Close()
+
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+
+			var req datagram
+			req.writeReadReq("file", ModeOctet, map[string]string{optBlocksize: "512", optTransferSize: "0"})
+			cConn.send(req, sAddr)
+			dg, _ := cConn.read(3 * time.Second)
+
+			if dg.opcode() != opCodeOACK {
+				t.Fatalf("expected OACK response, got %s", dg)
+			}
+			if opts := dg.options(); !reflect.DeepEqual(opts, c.expectedOpts) {
+				t.Errorf("expected OACK options %v, but they were %v", c.expectedOpts, opts)
+			}
+		})
+	}
+}
+
+func TestServer_FragmentationHook(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []ServerOpt
+		blksize int
+
+		expected []FragmentationWarning
+	}{
+		{
+			name:    "default mtu",
+			blksize: 1468,
+		},
+		{
+			name:    "low mtu",
+			opts:    []ServerOpt{ServerMTU(1280)},
+			blksize: 4096,
+
+			expected: []FragmentationWarning{{Blocksize: 4096, DatagramSize: 4128, MTU: 1280}},
+		},
+		{
+			name:    "disabled",
+			opts:    []ServerOpt{ServerMTU(0)},
+			blksize: 9000,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []FragmentationWarning
+			opts := append([]ServerOpt{ServerFragmentationHook(func(w FragmentationWarning) {
+				w.ID, w.Addr = 0, nil // Vary by run
+				got = append(got, w)
+			})}, c.opts...)
+			done := make(chan struct{})
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				defer close(done)
+				w.Write([]byte("the data"))
+			}), nil, opts...)
+			defer s.Close()
+
+			client, err := NewClient(ClientBlocksize(c.blksize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(resp); err != nil {
+				t.Fatal(err)
+			}
+			<-done
+
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("expected warnings %+v, but they were %+v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestServer_Ready(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		t.Run(fmt.Sprintf("single port mode: %t", singlePort), func(t *testing.T) {
+			var opts []ServerOpt
+			if singlePort {
+				opts = append(opts, ServerSinglePort(true))
+			}
+			s, err := NewServer("127.0.0.1:0", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handled := false
+			s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+				handled = true
+			}))
+
+			if s.Ready() {
+				t.Error("expected server not to be ready before serving")
+			}
+			if err := s.Ping(time.Second); err != ErrAddressNotAvailable {
+				t.Errorf("expected Ping error %v before serving, got %v", ErrAddressNotAvailable, err)
+			}
+
+			serveTestServer(s)
+
+			if !s.Ready() {
+				t.Error("expected server to be ready")
+			}
+			if err := s.Ping(3 * time.Second); err != nil {
+				t.Errorf("expected Ping to succeed, got %v", err)
+			}
+			if handled {
+				t.Error("expected Ping not to invoke the handler")
+			}
+
+			s.Close()
+
+			if s.Ready() {
+				t.Error("expected server not to be ready after Close")
+			}
+			if err := s.Ping(time.Second); err == nil {
+				t.Error("expected Ping to fail after Close")
+			}
+		})
+	}
+}
+
+func TestServer_Close_twice(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing before serving is safe
+	if err := s.Close(); err != nil {
+		t.Errorf("expected no error closing unstarted server, got %v", err)
+	}
+
+	s, err = NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {}))
+	serveTestServer(s)
+
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Errorf("close %d: expected no error, got %v", i+1, err)
+		}
+	}
+}
+
+func TestServer_dualStack(t *testing.T) {
+	s, err := NewServer(":0", ServerNet("udp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}))
+	sAddr := serveTestServer(s)
+	defer s.Close()
+
+	client, err := NewClient(ClientNetwork("udp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://127.0.0.1:%d/file", sAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "the data" {
+		t.Errorf("expected response %q, but it was %q", "the data", data)
+	}
+}
+
+func TestServer_singlePortDuplicateRequest(t *testing.T) {
+	var requests int32
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("the data"))
+	}), nil, ServerSinglePort(true))
+	defer s.Close()
+
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+
+	var dg *datagram
+	readDG := func() {
+		var addr net.Addr
+		dg, addr = cConn.read(3 * time.Second)
+		if addr.String() != sAddr.String() {
+			t.Fatalf("expected response from %s, got %s", sAddr, addr)
+		}
+	}
+	send := func(tx datagram) {
+		cConn.send(tx, sAddr)
+	}
+
+	var req datagram
+	req.writeReadReq("file", ModeOctet, map[string]string{optBlocksize: "512"})
+
+	// Client didn't see the OACK and sends the request again
+	for i := 0; i < 2; i++ {
+		send(req)
+		readDG()
+		if dg.opcode() != opCodeOACK {
+			t.Fatalf("request %d: expected %s, got %s", i+1, opCodeOACK, dg)
+		}
+	}
+
+	var ack datagram
+	ack.writeAck(0)
+	send(ack)
+	readDG()
+	if dg.opcode() != opCodeDATA || string(dg.data()) != "the data" {
+		t.Fatalf("expected DATA with %q, got %s", "the data", dg)
+	}
+	ack.writeAck(1)
+	send(ack)
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected handler to be called once, but it was called %d times", n)
+	}
+}
+
+func TestServer_singlePortConcurrent(t *testing.T) {
+	files := map[string][]byte{
+		"1MB-random": getTestData(t, "1MB-random")[:64*1024],
+		"text":       getTestData(t, "text"),
+	}
+
+	// Hold each handler until both transfers have started
+	var started sync.WaitGroup
+	started.Add(len(files))
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		started.Done()
+		started.Wait()
+		w.Write(files[w.Name()])
+	}), nil, ServerSinglePort(true))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for name, data := range files {
+		wg.Add(1)
+		go func(name string, data []byte) {
+			defer wg.Done()
+
+			client, err := NewClient(ClientWindowsize(4), ClientBlocksize(1024))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/%s", sAddr, name))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			got, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: response didn't match, expected %d bytes, got %d", name, len(data), len(got))
+			}
+		}(name, data)
+	}
+	wg.Wait()
+
+	// Transfers are unregistered on completion
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		s.transfersMu.Lock()
+		n := len(s.transfers)
+		s.transfersMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no transfers after completion, but there were %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_FilenameRewrite(t *testing.T) {
+	names := make(chan string, 1)
+	fs := FileServer("testdata")
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		names <- w.Name()
+		fs.ServeTFTP(w)
+	}), nil, ServerFilenameRewrite(func(name string) string {
+		return strings.TrimPrefix(name, "v2/")
+	}))
+	defer s.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://%s/v2/text", sAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := <-names; name != "text" {
+		t.Errorf("expected handler to see name %q, but it was %q", "text", name)
+	}
+	if !bytes.Equal(data, getTestData(t, "text")) {
+		t.Error("expected response to be the content of testdata/text")
+	}
+}
+
+func TestServer_Append(t *testing.T) {
+	cases := []struct {
+		name   string
+		append bool
+
+		expected string
+	}{
+		{
+			name:     "disabled",
+			expected: "second\n",
+		},
+		{
+			name:     "enabled",
+			append:   true,
+			expected: "first\nsecond\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			done := make(chan struct{})
+			fs := FileServer(dir)
+			s, sAddr := startTestServer(t, nil, WriteHandlerFunc(func(w WriteRequest) {
+				defer func() { done <- struct{}{} }()
+				fs.ReceiveTFTP(w)
+			}), ServerAppend(c.append))
+			defer s.Close()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, upload := range []string{"first\n", "second\n"} {
+				url := fmt.Sprintf("tftp://%s/log", sAddr)
+				if err := client.Put(url, strings.NewReader(upload), int64(len(upload))); err != nil {
+					t.Fatal(err)
+				}
+				<-done
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.expected {
+				t.Errorf("expected file to contain %q, but it was %q", c.expected, data)
+			}
+		})
+	}
+}
+
+func TestServer_HandleFunc(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(data string) ReadHandlerFunc {
+		return func(w ReadRequest) {
+			w.Write([]byte(data))
+		}
+	}
+	telemetry := make(chan string, 1)
+	s.HandleFunc(MatchName("firmware/*"), serve("firmware"), nil)
+	s.HandleFunc(MatchName("telemetry/*"), nil, func(w WriteRequest) {
+		data, _ := ioutil.ReadAll(w)
+		telemetry <- w.Name() + ": " + string(data)
+	})
+	s.HandleRead(MatchOption(optBlocksize, "1024"), serve("large blocks"))
+	s.ReadHandler(serve("fallback"))
+	sAddr := serveTestServer(s)
+	defer s.Close()
+
+	readCases := []struct {
+		name string
+		opts []ClientOpt
+
+		expected string
+	}{
+		{name: "firmware/image.bin", expected: "firmware"},
+		{name: "firmware/image.bin", opts: []ClientOpt{ClientBlocksize(1024)}, expected: "firmware"},
+		{name: "config", opts: []ClientOpt{ClientBlocksize(1024)}, expected: "large blocks"},
+		{name: "config", expected: "fallback"},
+	}
+	for _, c := range readCases {
+		client, err := NewClient(c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/%s", sAddr, c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.expected {
+			t.Errorf("expected %q to be served by %q handler, but got %q", c.name, c.expected, data)
+		}
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(fmt.Sprintf("tftp://%s/telemetry/1", sAddr), strings.NewReader("up"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-telemetry; got != "telemetry/1: up" {
+		t.Errorf("expected telemetry handler to receive %q, but it was %q", "telemetry/1: up", got)
+	}
+
+	// No write handler matches and there's no fallback
+	err = client.Put(fmt.Sprintf("tftp://%s/firmware/image.bin", sAddr), strings.NewReader("up"), 2)
+	if !IsRemoteError(err) {
+		t.Errorf("expected remote error for unmatched write request, got %v", err)
+	}
+}
+
+func TestServer_noHandlerMessage(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []ServerOpt
+		request opcode
+
+		expectedMsg string
+	}{
+		{
+			name:        "read, default",
+			request:     opCodeRRQ,
+			expectedMsg: "Server does not support read requests.",
+		},
+		{
+			name:        "read, custom",
+			opts:        []ServerOpt{ServerNoReadHandlerMessage("Access denied")},
+			request:     opCodeRRQ,
+			expectedMsg: "Access denied",
+		},
+		{
+			name:        "write, default",
+			request:     opCodeWRQ,
+			expectedMsg: "Server does not support write requests.",
+		},
+		{
+			name:        "write, custom",
+			opts:        []ServerOpt{ServerNoWriteHandlerMessage("Access denied")},
+			request:     opCodeWRQ,
+			expectedMsg: "Access denied",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := NewServer("127.0.0.1:0", c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Register only the handler not being requested
+			if c.request == opCodeRRQ {
+				s.WriteHandler(WriteHandlerFunc(func(r WriteRequest) {}))
+			} else {
+				s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {}))
+			}
+			sAddr := serveTestServer(s)
+			defer s.Close()
+
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+
+			var req datagram
+			req.writeReq(c.request, "file", ModeOctet, nil)
+			cConn.send(req, sAddr)
+			dg, _ := cConn.read(3 * time.Second)
+
+			if dg.opcode() != opCodeERROR {
+				t.Fatalf("expected %s, got %s", opCodeERROR, dg)
+			}
+			if msg := dg.errMsg(); msg != c.expectedMsg {
+				t.Errorf("expected error message %q, but it was %q", c.expectedMsg, msg)
+			}
+		})
+	}
+}
+
+func TestServer_transferID(t *testing.T) {
+	infoChan := make(chan TransferInfo, 3)
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write([]byte("the data"))
+	}), nil, ServerTransferHook(func(i TransferInfo) {
+		infoChan <- i
+	}))
+	defer s.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp)
+
+		select {
+		case info := <-infoChan:
+			if info.ID == 0 || ids[info.ID] {
+				t.Errorf("transfer %d: expected unique non-zero ID, got %d", i, info.ID)
+			}
+			ids[info.ID] = true
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for transfer hook")
+		}
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		close(started)
+		<-release
+		w.Write([]byte("the data"))
+	}), nil)
+
+	// Start a transfer which is in progress during shutdown
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+		if err == nil {
+			_, err = ioutil.ReadAll(resp)
+		}
+		getErr <- err
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	for {
+		s.shutdownMu.Lock()
+		shuttingDown := s.shuttingDown
+		s.shutdownMu.Unlock()
+		if shuttingDown {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	// New requests are rejected
+	cConn := newFakePeer(t, nil)
+	defer cConn.Close()
+	var req datagram
+	req.writeReadReq("file", ModeOctet, nil)
+	cConn.send(req, sAddr)
+	dg, _ := cConn.read(3 * time.Second)
+	if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeNotDefined || dg.errMsg() != "server shutting down" {
+		t.Errorf("expected shutting down error, got %s", dg)
+	}
+
+	// Transfer in progress completes before Shutdown returns
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before transfer completed: %v", err)
+	default:
+	}
+	close(release)
+	if err := <-getErr; err != nil {
+		t.Errorf("expected in progress transfer to succeed, got %v", err)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("expected Shutdown to succeed, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for Shutdown")
+	}
+	if s.Ready() {
+		t.Error("expected server not to be ready after Shutdown")
+	}
+}
+
+func TestServer_GlobalRateLimit(t *testing.T) {
+	const rate = 40000
+	data := bytes.Repeat([]byte("x"), 20000)
+
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write(data)
+	}), nil, ServerGlobalRateLimit(rate))
+	defer s.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two concurrent transfers share the limit
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			received, err := ioutil.ReadAll(resp)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("expected %d bytes, received %d", len(data), len(received))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Less the initial burst allowance
+	total := 2 * len(data) * 516 / 512
+	if min := time.Duration(float64(total-rate/10) / rate * float64(time.Second)); elapsed < min {
+		t.Errorf("expected transfers to take at least %s, but they took %s", min, elapsed)
+	}
+}
+
+func TestServer_unexpectedTID(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 700)
+	// More than the retransmit limit, they mustn't count as retries
+	const interlopers = defaultRetransmit + 2
+
+	cases := []struct {
+		name  string
+		write bool
+	}{
+		{name: "read"},
+		{name: "write", write: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			written := make(chan []byte, 1)
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(data)
+			}), WriteHandlerFunc(func(w WriteRequest) {
+				received, _ := ioutil.ReadAll(w)
+				written <- received
+			}), ServerTransferHook(func(info TransferInfo) { infos <- info }))
+			defer s.Close()
+
+			cConn, other := newFakePeer(t, nil), newFakePeer(t, nil)
+			defer cConn.Close()
+			defer other.Close()
+
+			recv := func(op opcode, block uint16) (*datagram, net.Addr) {
+				dg, addr := cConn.read(3 * time.Second)
+				if dg.opcode() != op || dg.block() != block {
+					t.Fatalf("expected %s block %d, got %s", op, block, dg)
+				}
+				return dg, addr
+			}
+			// A third party attempting to disrupt the transfer
+			interfere := func(tAddr net.Addr, block uint16) {
+				for i := 0; i < interlopers; i++ {
+					var bad datagram
+					if c.write {
+						bad.writeData(block, []byte("bad data"))
+					} else {
+						bad.writeAck(block)
+					}
+					other.send(bad, tAddr)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			var dg datagram
+			var received []byte
+			if c.write {
+				dg.writeWriteReq("file", ModeOctet, nil)
+				cConn.send(dg, sAddr)
+				_, tAddr := recv(opCodeACK, 0)
+				for block := uint16(1); ; block++ {
+					n := 512
+					if n > len(data)-len(received) {
+						n = len(data) - len(received)
+					}
+					if block == 1 {
+						interfere(tAddr, block)
+					}
+					var out datagram
+					out.writeData(block, data[len(received):len(received)+n])
+					cConn.send(out, tAddr)
+					received = append(received, data[len(received):len(received)+n]...)
+					recv(opCodeACK, block)
+					if n < 512 {
+						break
+					}
+				}
+				if got := <-written; !bytes.Equal(got, data) {
+					t.Errorf("expected %d bytes of data written, got %d", len(data), len(got))
+				}
+			} else {
+				dg.writeReadReq("file", ModeOctet, nil)
+				cConn.send(dg, sAddr)
+				for block := uint16(1); ; block++ {
+					dg, tAddr := recv(opCodeDATA, block)
+					received = append(received, dg.data()...)
+					if block == 1 {
+						interfere(tAddr, block)
+					}
+					var ack datagram
+					ack.writeAck(block)
+					cConn.send(ack, tAddr)
+					if len(dg.data()) < 512 {
+						break
+					}
+				}
+			}
+
+			if !bytes.Equal(received, data) {
+				t.Errorf("expected %d bytes of data, received %d", len(data), len(received))
+			}
+			select {
+			case info := <-infos:
+				if info.Err != nil {
+					t.Errorf("expected transfer to succeed, got %v", info.Err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout waiting for transfer to end")
+			}
+
+			// Third party was sent an error for each datagram
+			for i := 0; i < interlopers; i++ {
+				dg, _, err := other.tryRead(time.Second)
+				if err != nil {
+					t.Fatalf("expected %d errors, got %d: %v", interlopers, i, err)
+				}
+				if dg.opcode() != opCodeERROR || dg.errorCode() != ErrCodeUnknownTransferID {
+					t.Errorf("expected Unknown TID error, got %s", dg)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_unexpectedTID_silentPeer(t *testing.T) {
+	cases := []struct {
+		name  string
+		write bool
+	}{
+		{name: "read"},
+		{name: "write", write: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(make([]byte, 700))
+			}), WriteHandlerFunc(func(w WriteRequest) {
+				ioutil.ReadAll(w)
+			}),
+				ServerReadTimeout(100*time.Millisecond),
+				ServerRetransmit(2),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+			)
+			defer s.Close()
+
+			cConn, other := newFakePeer(t, nil), newFakePeer(t, nil)
+			defer cConn.Close()
+			defer other.Close()
+
+			// Request, then go silent after the first response
+			var dg datagram
+			if c.write {
+				dg.writeWriteReq("file", ModeOctet, nil)
+			} else {
+				dg.writeReadReq("file", ModeOctet, nil)
+			}
+			cConn.send(dg, sAddr)
+			_, tAddr := cConn.read(time.Second)
+
+			// A third party sending more often than the timeout
+			// mustn't keep the transfer waiting
+			start := time.Now()
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				var bad datagram
+				if c.write {
+					bad.writeData(1, []byte("bad data"))
+				} else {
+					bad.writeAck(1)
+				}
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(20 * time.Millisecond):
+						other.WriteTo(bad.bytes(), tAddr)
+					}
+				}
+			}()
+
+			select {
+			case info := <-infos:
+				if ErrorCause(info.Err) != ErrMaxRetries {
+					t.Errorf("expected %v, got %v", ErrMaxRetries, info.Err)
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("expected transfer to time out after about 300ms, took %s", elapsed)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("transfer didn't time out")
+			}
+		})
+	}
+}
+
+func TestServer_lostOACK(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 700)
+
+	cases := []struct {
+		name  string
+		write bool
+		opts  []ServerOpt
+
+		// Expected response after the OACK isn't acknowledged
+		expectedOpcode opcode
+		expectedBlock  uint16
+	}{
+		{
+			name: "read, resend",
+
+			expectedOpcode: opCodeOACK,
+		},
+		{
+			name: "read, fallback",
+			opts: []ServerOpt{ServerOACKFallback(true)},
+
+			expectedOpcode: opCodeDATA,
+			expectedBlock:  1,
+		},
+		{
+			name:  "write, resend",
+			write: true,
+
+			expectedOpcode: opCodeOACK,
+		},
+		{
+			name:  "write, fallback",
+			write: true,
+			opts:  []ServerOpt{ServerOACKFallback(true)},
+
+			expectedOpcode: opCodeACK,
+			expectedBlock:  0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			received := make(chan []byte, 1)
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.WriteSize(int64(len(data)))
+				w.Write(data)
+			}), WriteHandlerFunc(func(r WriteRequest) {
+				b, _ := ioutil.ReadAll(r)
+				received <- b
+			}), c.opts...)
+			defer s.Close()
+
+			cConn := newFakePeer(t, nil)
+			defer cConn.Close()
+
+			read := func() (*datagram, net.Addr) { return cConn.read(3 * time.Second) }
+			send := cConn.send
+
+			var dg datagram
+			opts := map[string]string{optBlocksize: "1024", optTransferSize: "0"}
+			if c.write {
+				opts[optTransferSize] = strconv.Itoa(len(data))
+				dg.writeWriteReq("file", ModeOctet, opts)
+			} else {
+				dg.writeReadReq("file", ModeOctet, opts)
+			}
+			send(dg, sAddr)
+
+			// The OACK isn't acknowledged
+			rx, tAddr := read()
+			if rx.opcode() != opCodeOACK {
+				t.Fatalf("expected OACK, got %s", rx)
+			}
+			rx, _ = read()
+			if rx.opcode() != c.expectedOpcode || (c.expectedOpcode != opCodeOACK && rx.block() != c.expectedBlock) {
+				t.Fatalf("expected %s %d, got %s", c.expectedOpcode, c.expectedBlock, rx)
+			}
+
+			blksize := 1024
+			if c.expectedOpcode == opCodeOACK {
+				// Acknowledged on the second attempt, by
+				// ACK 0 or the first DATA for writes
+				if !c.write {
+					dg.writeAck(0)
+					send(dg, tAddr)
+					rx, _ = read()
+				}
+			} else {
+				blksize = 512 // Fallen back to the default
+			}
+
+			if c.write {
+				// Send the data with the blocksize in effect
+				for i, block := 0, uint16(1); ; i, block = i+blksize, block+1 {
+					end := i + blksize
+					if end > len(data) {
+						end = len(data)
+					}
+					dg.writeData(block, data[i:end])
+					send(dg, tAddr)
+					if ack, _ := read(); ack.opcode() != opCodeACK || ack.block() != block {
+						t.Fatalf("expected ACK %d, got %s", block, ack)
+					}
+					if end-i < blksize {
+						break
+					}
+				}
+				if b := <-received; !bytes.Equal(b, data) {
+					t.Errorf("expected server to receive %d bytes, got %d", len(data), len(b))
+				}
+				return
+			}
+
+			// Receive the data with the blocksize in effect
+			var got []byte
+			for {
+				if rx.opcode() != opCodeDATA {
+					t.Fatalf("expected DATA, got %s", rx)
+				}
+				got = append(got, rx.data()...)
+				dg.writeAck(rx.block())
+				send(dg, tAddr)
+				if len(rx.data()) < blksize {
+					break
+				}
+				rx, _ = read()
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("expected to receive %d bytes, got %d", len(data), len(got))
+			}
+		})
+	}
+}
+
+func TestServer_ActiveTransfers(t *testing.T) {
+	written := make(chan struct{})
+	release := make(chan struct{})
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		w.Write(make([]byte, 1024))
+		close(written)
+		<-release
+		w.Write([]byte("end"))
+	}), nil)
+	defer s.Close()
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	<-written
+
+	// Mid-transfer, both blocks sent and acknowledged
+	states := s.ActiveTransfers()
+	if len(states) != 1 {
+		t.Fatalf("expected 1 active transfer, got %d", len(states))
+	}
+	state := states[0]
+	state.Addr, state.Started = nil, time.Time{}
+	expected := TransferState{ID: 1, Name: "file", Block: 2, LastAck: 2, Bytes: 1024}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected state %+v, but it was %+v", expected, state)
+	}
+
+	close(release)
+	if _, err := ioutil.ReadAll(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed once complete
+	for start := time.Now(); len(s.ActiveTransfers()) > 0; runtime.Gosched() {
+		if time.Since(start) > time.Second {
+			t.Fatal("expected transfer to be removed once complete")
+		}
+	}
+}
+
+func TestServer_AbortTransfer(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		t.Run(fmt.Sprintf("singlePort=%t", singlePort), func(t *testing.T) {
+			written := make(chan struct{})
+			handlerErr := make(chan error, 1)
+			s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(make([]byte, 1024))
+				close(written)
+				<-Context(w).Done()
+				_, err := w.Write([]byte("end"))
+				handlerErr <- err
+			}), nil, ServerSinglePort(singlePort))
+			defer s.Close()
+
+			if err := s.AbortTransfer(1); err != ErrTransferNotFound {
+				t.Errorf("expected ErrTransferNotFound before the transfer started, got %v", err)
+			}
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(resp, make([]byte, 1024)); err != nil {
+				t.Fatal(err)
+			}
+			<-written
+
+			states := s.ActiveTransfers()
+			if len(states) != 1 {
+				t.Fatalf("expected 1 active transfer, got %d", len(states))
+			}
+			if err := s.AbortTransfer(states[0].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			// The client is told promptly, well before it would time out
+			start := time.Now()
+			_, err = ioutil.ReadAll(resp)
+			if !IsRemoteError(err) {
+				t.Errorf("expected remote error, got %v", err)
+			}
+			if time.Since(start) > 500*time.Millisecond {
+				t.Errorf("expected client to be notified promptly, took %s", time.Since(start))
+			}
+			if err := <-handlerErr; ErrorCause(err) != ErrTransferAborted {
+				t.Errorf("expected handler to get ErrTransferAborted, got %v", err)
+			}
+
+			for start := time.Now(); len(s.ActiveTransfers()) > 0; runtime.Gosched() {
+				if time.Since(start) > time.Second {
+					t.Fatal("expected transfer to be removed once aborted")
+				}
+			}
+			if err := s.AbortTransfer(states[0].ID); err != ErrTransferNotFound {
+				t.Errorf("expected ErrTransferNotFound after the transfer ended, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_ServeContext(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		close(started)
+		<-release
+		w.Write([]byte("the data"))
+	}))
+	defer s.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ServeContext(ctx, conn)
+	}()
+	for !s.Connected() {
+		runtime.Gosched()
+	}
+	sAddr, _ := s.Addr()
+
+	// Start a transfer which is in progress during cancellation
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+		if err == nil {
+			_, err = ioutil.ReadAll(resp)
+		}
+		getErr <- err
+	}()
+	<-started
+
+	cancel()
+	select {
+	case err := <-serveErr:
+		if err != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected ServeContext to return promptly after cancellation")
+	}
+
+	// Transfer in progress completes
+	close(release)
+	if err := <-getErr; err != nil {
+		t.Errorf("expected transfer in progress to complete, got %v", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected Shutdown to return nil, got %v", err)
+	}
+}
+
+func TestServer_Shutdown_deadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s, sAddr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		close(started)
+		<-release
+	}), nil)
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Get(fmt.Sprintf("tftp://%s/file", sAddr))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestServer_SlowTransferThreshold(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+
+	cases := []struct {
+		name          string
+		maxDuration   time.Duration
+		minThroughput int
+		elapsed       time.Duration // Advanced by the handler
+
+		expectedSlow bool
+	}{
+		{
+			name:        "within duration",
+			maxDuration: time.Second,
+		},
+		{
+			name:        "exceeds duration",
+			maxDuration: time.Second,
+			elapsed:     2 * time.Second,
+
+			expectedSlow: true,
+		},
+		{
+			name:          "above throughput",
+			minThroughput: 100,
+			elapsed:       2 * time.Second,
+		},
+		{
+			name:          "below throughput",
+			minThroughput: 1000,
+			elapsed:       2 * time.Second,
+
+			expectedSlow: true,
+		},
+		{
+			name:          "below throughput, under a second",
+			minThroughput: 1e6,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			clk := newFakeClock()
+			infos := make(chan TransferInfo, 1)
+			slow := make(chan TransferInfo, 1)
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				clk.Advance(c.elapsed)
+				w.Write(data)
+			}), nil,
+				ServerSlowTransferThreshold(c.maxDuration, c.minThroughput),
+				ServerSlowTransferHook(func(info TransferInfo) { slow <- info }),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+				serverClock(clk),
+			)
+			defer s.Close()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+			if err == nil {
+				ioutil.ReadAll(resp)
+			}
+
+			select {
+			case <-infos:
+			case <-time.After(3 * time.Second):
+				t.Fatal("timeout waiting for transfer hook")
+			}
+			select {
+			case info := <-slow:
+				if !c.expectedSlow {
+					t.Errorf("expected transfer not to be slow, it took %s", info.Duration)
+				}
+				if info.Bytes != int64(len(data)) || info.Duration != c.elapsed {
+					t.Errorf("expected %d bytes in %s, got %d bytes in %s", len(data), c.elapsed, info.Bytes, info.Duration)
+				}
+			default:
+				if c.expectedSlow {
+					t.Error("expected slow transfer hook to be called")
+				}
+			}
+		})
+	}
+}
+
+func TestServer_CloseAbortsTransfers(t *testing.T) {
+	data := getTestData(t, "text")[:2000]
+
+	cases := []struct {
+		name       string
+		singlePort bool
+		waitForAck bool // Close while Write waits for an ACK, rather than before Write
+	}{
+		{name: "waiting for ACK", waitForAck: true},
+		{name: "waiting for ACK, single port", singlePort: true, waitForAck: true},
+		{name: "before write"},
+		{name: "before write, single port", singlePort: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			started, closed := make(chan struct{}), make(chan struct{})
+			writeErrs := make(chan error, 1)
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				close(started)
+				if !c.waitForAck {
+					<-closed
+				}
+				_, err := w.Write(data)
+				writeErrs <- err
+			}), nil,
+				ServerSinglePort(c.singlePort),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+			)
+			defer s.Close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			var dg datagram
+			dg.buf = make([]byte, 512)
+			dg.writeReadReq("file", ModeOctet, nil)
+			if _, err := pc.WriteTo(dg.bytes(), addr); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			if c.waitForAck {
+				// Block 1 has been sent, the handler is waiting for ACK 1
+				dg.buf = make([]byte, 516)
+				if _, _, err := pc.ReadFrom(dg.buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s.Close()
+			close(closed)
+
+			select {
+			case err := <-writeErrs:
+				if cause := ErrorCause(err); cause != ErrServerClosing {
+					t.Errorf("expected Write error %v, got %v", ErrServerClosing, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Write wasn't aborted")
+			}
+			info := <-infos
+			if cause := ErrorCause(info.Err); cause != ErrServerClosing {
+				t.Errorf("expected TransferInfo.Err %v, got %v", ErrServerClosing, info.Err)
+			}
+		})
+	}
+}
+
+func TestServer_RequestOptions(t *testing.T) {
+	data := getTestData(t, "text")
+
+	expectedRequested := map[string]string{optWindowSize: "8", optBlocksize: "1024"}
+	expectedNegotiated := map[string]string{optWindowSize: "4", optBlocksize: "1024"}
+
+	cases := []struct {
+		name  string
+		write bool
+
+		expectedBefore map[string]string // Negotiated when the handler is called
+	}{
+		{name: "read", expectedBefore: map[string]string{}},
+		{name: "write", write: true, expectedBefore: expectedNegotiated},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var requested, negotiated, before map[string]string
+			done := make(chan struct{})
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				defer close(done)
+				requested, before = RequestedOptions(w), AcknowledgedOptions(w)
+				w.Write(data)
+				negotiated = AcknowledgedOptions(w)
+			}), WriteHandlerFunc(func(w WriteRequest) {
+				defer close(done)
+				requested, before = RequestedOptions(w), AcknowledgedOptions(w)
+				ioutil.ReadAll(w)
+				negotiated = AcknowledgedOptions(w)
+			}), ServerMaxWindowsize(4))
+			defer s.Close()
+
+			client, err := NewClient(ClientWindowsize(8), ClientBlocksize(1024), ClientTransferSize(false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := fmt.Sprintf("tftp://%s/file", addr)
+			if c.write {
+				err = client.Put(url, bytes.NewReader(data), int64(len(data)))
+			} else {
+				var resp *Response
+				if resp, err = client.Get(url); err == nil {
+					_, err = ioutil.ReadAll(resp)
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-done
+
+			if !reflect.DeepEqual(requested, expectedRequested) {
+				t.Errorf("expected requested options %v, got %v", expectedRequested, requested)
+			}
+			if !reflect.DeepEqual(before, c.expectedBefore) {
+				t.Errorf("expected negotiated options %v when handler called, got %v", c.expectedBefore, before)
+			}
+			if !reflect.DeepEqual(negotiated, expectedNegotiated) {
+				t.Errorf("expected negotiated options %v, got %v", expectedNegotiated, negotiated)
+			}
+		})
+	}
+}
+
+func TestServer_MaxBlocksize(t *testing.T) {
+	data := getTestData(t, "text")
+
+	var requested, negotiated map[string]string
+	done := make(chan struct{})
+	s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		defer close(done)
+		w.Write(data)
+		requested, negotiated = RequestedOptions(w), AcknowledgedOptions(w)
+	}), nil, ServerMaxBlocksize(1468))
+	defer s.Close()
+
+	client, err := NewClient(ClientBlocksize(65464), ClientTransferSize(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !bytes.Equal(received, data) {
+		t.Errorf("expected %d bytes, received %d bytes that don't match", len(data), len(received))
+	}
+	if blksize := requested[optBlocksize]; blksize != "65464" {
+		t.Errorf("expected requested blocksize 65464, got %q", blksize)
+	}
+	if blksize := negotiated[optBlocksize]; blksize != "1468" {
+		t.Errorf("expected negotiated blocksize 1468, got %q", blksize)
+	}
+}
+
+func TestServer_WriteIdleTimeout(t *testing.T) {
+	infos := make(chan TransferInfo, 1)
+	readErrs := make(chan error, 1)
+	s, addr := startTestServer(t, nil, WriteHandlerFunc(func(w WriteRequest) {
+		_, err := ioutil.ReadAll(w)
+		readErrs <- err
+	}),
+		ServerWriteIdleTimeout(100*time.Millisecond),
+		ServerTransferHook(func(info TransferInfo) { infos <- info }),
+	)
+	defer s.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Send WRQ, receive ACK 0, then send nothing
+	var dg datagram
+	dg.buf = make([]byte, 512)
+	dg.writeWriteReq("file", ModeOctet, nil)
+	if _, err := pc.WriteTo(dg.bytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := pc.ReadFrom(dg.buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Default timeout and retransmit would wait 10s
+	select {
+	case info := <-infos:
+		if cause := ErrorCause(info.Err); cause != ErrWriteIdleTimeout {
+			t.Errorf("expected TransferInfo.Err %v, got %v", ErrWriteIdleTimeout, info.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("transfer wasn't abandoned")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected transfer to be abandoned after 100ms, took %s", elapsed)
+	}
+	if err := <-readErrs; ErrorCause(err) != ErrWriteIdleTimeout {
+		t.Errorf("expected Read error %v, got %v", ErrWriteIdleTimeout, err)
+	}
+
+	// Client is told the transfer was abandoned
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(dg.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dg.offset = n
+	if dg.opcode() != opCodeERROR {
+		t.Errorf("expected ERROR, got %s", dg)
+	}
+}
+
+func TestServer_TransferDeadline(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, 4*512)
+	const stallAfter = 2 * 512 // Two full blocks are sent before the stall
+
+	cases := []struct {
+		name  string
+		write bool
+	}{
+		{name: "read"},
+		{name: "write", write: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			handlerErrs := make(chan error, 1)
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write(data[:stallAfter])
+				time.Sleep(400 * time.Millisecond)
+				_, err := w.Write(data[stallAfter:])
+				handlerErrs <- err
+			}), WriteHandlerFunc(func(w WriteRequest) {
+				_, err := ioutil.ReadAll(w)
+				handlerErrs <- err
+			}),
+				ServerTransferDeadline(200*time.Millisecond),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+			)
+			defer s.Close()
+
+			client, err := NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := fmt.Sprintf("tftp://%s/file", addr)
+			var received int64
+			if c.write {
+				stalled := io.MultiReader(bytes.NewReader(data[:stallAfter]), readerFunc(func(p []byte) (int, error) {
+					time.Sleep(400 * time.Millisecond)
+					return copy(p, data[stallAfter:]), io.EOF
+				}))
+				err = client.Put(url, stalled, int64(len(data)))
+			} else {
+				var resp *Response
+				if resp, err = client.Get(url); err == nil {
+					received, err = io.Copy(ioutil.Discard, resp)
+				}
+			}
+			if !IsRemoteError(err) {
+				t.Errorf("expected client to be sent an ERROR, got %v", err)
+			}
+			if !c.write && received != stallAfter {
+				t.Errorf("expected client to receive %d bytes, got %d", stallAfter, received)
+			}
+
+			if err := <-handlerErrs; ErrorCause(err) != ErrTransferDeadline {
+				t.Errorf("expected handler error %v, got %v", ErrTransferDeadline, err)
+			}
+			select {
+			case info := <-infos:
+				if ErrorCause(info.Err) != ErrTransferDeadline {
+					t.Errorf("expected TransferInfo.Err %v, got %v", ErrTransferDeadline, info.Err)
+				}
+				if info.Bytes != stallAfter {
+					t.Errorf("expected TransferInfo.Bytes %d, got %d", stallAfter, info.Bytes)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout waiting for transfer hook")
+			}
+		})
+	}
+}
+
+func TestServer_CaptureTimeline(t *testing.T) {
+	infos := make(chan TransferInfo, 1)
+	s, addr := startTestServer(t, nil, WriteHandlerFunc(func(w WriteRequest) {
+		ioutil.ReadAll(w)
+	}),
+		ServerCaptureTimeline(true),
+		ServerRetransmit(2),
+		ServerReadTimeout(50*time.Millisecond),
+		ServerTransferHook(func(info TransferInfo) { infos <- info }),
+	)
+	defer s.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Send WRQ then nothing, the server resends ACK 0 until it gives up
+	var dg datagram
+	dg.buf = make([]byte, 512)
+	dg.writeWriteReq("file", ModeOctet, nil)
+	if _, err := pc.WriteTo(dg.bytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	var info TransferInfo
+	select {
+	case info = <-infos:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for transfer hook")
+	}
+	if ErrorCause(info.Err) != ErrMaxRetries {
+		t.Fatalf("expected %v, got %v", ErrMaxRetries, info.Err)
+	}
+
+	var got []string
+	for _, e := range info.Timeline {
+		got = append(got, strings.TrimSpace(e.Event+" "+e.Datagram))
+	}
+	expected := []string{
+		"send ACK 0",
+		"timeout", "resend ACK 0",
+		"timeout", "resend ACK 0",
+		"timeout", "send ERROR NOT_DEFINED",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected timeline\n%s\ngot\n%s", strings.Join(expected, ", "), strings.Join(got, ", "))
+	}
+	for i := 1; i < len(info.Timeline); i++ {
+		if info.Timeline[i].At < info.Timeline[i-1].At {
+			t.Errorf("expected events in order, %+v follows %+v", info.Timeline[i], info.Timeline[i-1])
+		}
+	}
+}
+
+func TestServer_ClientTID(t *testing.T) {
+	cases := []struct {
+		name       string
+		singlePort bool
+	}{
+		{name: "default"},
+		{name: "single port", singlePort: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			infos := make(chan TransferInfo, 1)
+			addrs := make(chan *net.UDPAddr, 1)
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				addrs <- w.Addr()
+				w.Write([]byte("data"))
+			}), nil,
+				ServerSinglePort(c.singlePort),
+				ServerTransferHook(func(info TransferInfo) { infos <- info }),
+			)
+			defer s.Close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			expected := pc.LocalAddr().(*net.UDPAddr)
+
+			client, err := NewClient(ClientPacketConn(pc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ioutil.ReadAll(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := <-addrs; got.String() != expected.String() {
+				t.Errorf("expected handler Addr %s, got %s", expected, got)
+			}
+			if info := <-infos; info.Addr.String() != expected.String() {
+				t.Errorf("expected TransferInfo.Addr %s, got %s", expected, info.Addr)
+			}
+		})
+	}
+}
+
+func TestServer_StrictMode(t *testing.T) {
+	cases := []struct {
+		name   string
+		mode   TransferMode
+		strict bool
+		noMode bool
+
+		expectedOpcode opcode
+	}{
+		{name: "empty mode", mode: "", strict: true, expectedOpcode: opCodeERROR},
+		{name: "no mode", noMode: true, strict: true, expectedOpcode: opCodeERROR},
+		{name: "bogus mode", mode: "fast", strict: true, expectedOpcode: opCodeERROR},
+		{name: "uppercase mode", mode: "OCTET", strict: true, expectedOpcode: opCodeDATA},
+		{name: "empty mode, lenient", mode: "", expectedOpcode: opCodeDATA},
+		{name: "bogus mode, lenient", mode: "fast", expectedOpcode: opCodeDATA},
+		{name: "no mode, lenient", noMode: true, expectedOpcode: opCodeDATA},
+		{name: "mail, lenient", mode: modeMail, expectedOpcode: opCodeERROR},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				w.Write([]byte("data"))
+			}), nil, ServerStrictMode(c.strict))
+			defer s.Close()
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			var dg datagram
+			dg.buf = make([]byte, 512)
+			dg.writeReadReq("file", c.mode, nil)
+			if c.noMode {
+				dg.offset = 2 + len("file") + 1 // Drop the mode field
+			}
+			if _, err := pc.WriteTo(dg.bytes(), addr); err != nil {
+				t.Fatal(err)
+			}
+			pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := pc.ReadFrom(dg.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dg.offset = n
+
+			if op := dg.opcode(); op != c.expectedOpcode {
+				t.Fatalf("expected %s, got %s", c.expectedOpcode, dg.String())
+			}
+			if c.expectedOpcode == opCodeERROR && dg.errorCode() != ErrCodeIllegalOperation {
+				t.Errorf("expected error code %s, got %s", ErrCodeIllegalOperation, dg.errorCode())
+			}
+		})
+	}
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	data := getTestData(t, "text")
+	const delay = time.Second
+
+	cases := []struct {
+		name      string
+		heartbeat time.Duration
+		writeSize bool
+
+		expectTimeout bool
+	}{
+		{name: "heartbeat", heartbeat: 50 * time.Millisecond},
+		{name: "heartbeat, size", heartbeat: 50 * time.Millisecond, writeSize: true},
+		{name: "disabled", expectTimeout: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+				if c.writeSize {
+					w.WriteSize(int64(len(data)))
+				}
+				time.Sleep(delay) // Preparing the data
+				w.Write(data)
+			}), nil, ServerHeartbeat(c.heartbeat))
+			defer s.Close()
+
+			// Gives up after about 400ms without a response
+			client, err := NewClient(
+				ClientReadTimeout(200*time.Millisecond),
+				ClientRetransmit(2),
+				ClientBlocksize(1024),
+				ClientTransferSize(true),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+			var received []byte
+			if err == nil {
+				received, err = ioutil.ReadAll(resp)
+			}
+			if c.expectTimeout {
+				if err == nil {
+					t.Error("expected client to time out")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("expected %d bytes, received %d bytes that don't match", len(data), len(received))
+			}
+			if size, err := resp.Size(); c.writeSize && (err != nil || size != int64(len(data))) {
+				t.Errorf("expected size %d, got %d (%v)", len(data), size, err)
+			}
+		})
+	}
+}
+
+func TestServer_ErrorStats(t *testing.T) {
+	s, addr := startTestServer(t, ReadHandlerFunc(func(w ReadRequest) {
+		switch w.Name() {
+		case "missing":
+			w.WriteError(ErrCodeFileNotFound, "not found")
+		case "secret":
+			w.WriteError(ErrCodeAccessViolation, "denied")
+		default:
+			w.Write(make([]byte, 1024))
+		}
+	}), nil)
+	defer s.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	requests := []struct {
+		name  string
+		write bool
+		reply ErrorCode // ERROR sent in response to DATA, 0 for none
+
+		expectedCode ErrorCode
+	}{
+		{name: "missing", expectedCode: ErrCodeFileNotFound},
+		{name: "missing", expectedCode: ErrCodeFileNotFound},
+		{name: "secret", expectedCode: ErrCodeAccessViolation},
+		{name: "upload", write: true, expectedCode: ErrCodeIllegalOperation},
+		{name: "file", reply: ErrCodeDiskFull},
+	}
+	for _, r := range requests {
+		var dg datagram
+		dg.buf = make([]byte, 1024)
+		if r.write {
+			dg.writeWriteReq(r.name, ModeOctet, nil)
+		} else {
+			dg.writeReadReq(r.name, ModeOctet, nil)
+		}
+		if _, err := pc.WriteTo(dg.bytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, raddr, err := pc.ReadFrom(dg.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dg.offset = n
+
+		if r.reply != 0 {
+			if op := dg.opcode(); op != opCodeDATA {
+				t.Fatalf("%s: expected DATA, got %s", r.name, dg.String())
+			}
+			dg.writeError(r.reply, "disk full")
+			if _, err := pc.WriteTo(dg.bytes(), raddr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if op := dg.opcode(); op != opCodeERROR || dg.errorCode() != r.expectedCode {
+			t.Fatalf("%s: expected ERROR %s, got %s", r.name, r.expectedCode, dg.String())
+		}
+	}
+
+	// A stray ACK is counted, a Ping isn't
+	var ack datagram
+	ack.writeAck(0)
+	if _, err := pc.WriteTo(ack.bytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[ErrorCode][2]int{ // Sent, Received
+		ErrCodeFileNotFound:      {2, 0},
+		ErrCodeAccessViolation:   {1, 0},
+		ErrCodeIllegalOperation:  {1, 0},
+		ErrCodeDiskFull:          {0, 1},
+		ErrCodeUnknownTransferID: {1, 0},
+	}
+	// Counts are updated by the transfers after the ERRORs are sent
+	var stats map[ErrorCode]ErrorStats
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = s.ErrorStats()
+		if len(stats) == len(expected) && stats[ErrCodeDiskFull].Received == 1 {
+			break
+		}
+	}
+	if len(stats) != len(expected) {
+		t.Errorf("expected %d error codes, got %v", len(expected), stats)
+	}
+	for code, counts := range expected {
+		got := stats[code]
+		if got.Sent != counts[0] || got.Received != counts[1] {
+			t.Errorf("%s: expected %d sent and %d received, got %d and %d", code, counts[0], counts[1], got.Sent, got.Received)
+		}
+		if got.LastTime.IsZero() {
+			t.Errorf("%s: expected LastTime to be set", code)
+		}
+	}
+	if msg := stats[ErrCodeFileNotFound].LastMessage; msg != "not found" {
+		t.Errorf("expected last FileNotFound message %q, got %q", "not found", msg)
+	}
+	if msg := stats[ErrCodeDiskFull].LastMessage; msg != "disk full" {
+		t.Errorf("expected last DiskFull message %q, got %q", "disk full", msg)
+	}
+}
+
+// reorderPacketConn delays full DATA datagrams for blocks where
+// block%every == 0 until after the following datagram is written, the
+// first time each is sent.
+type reorderPacketConn struct {
+	net.PacketConn
+	every uint16
+
+	full     int // Length of the first DATA, taken as full
+	held     []byte
+	heldAddr net.Addr
+	sent     map[uint16]bool
+}
+
+func (c *reorderPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var dg datagram
+	dg.setBytes(p)
+	if dg.opcode() != opCodeDATA {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if c.full == 0 {
+		c.full = len(p)
+	}
+	if block := dg.block(); block%c.every == 0 && len(p) == c.full && !c.sent[block] {
+		c.sent[block] = true
+		c.held, c.heldAddr = append([]byte(nil), p...), addr
+		return len(p), nil
+	}
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if c.held != nil {
+		c.PacketConn.WriteTo(c.held, c.heldAddr)
+		c.held = nil
+	}
+	return n, err
+}
+
+func TestServer_ReorderedUpload(t *testing.T) {
+	data := getTestData(t, "1MB-random")[:100*512+100]
+
+	// The server resends its ACK when the sender doesn't fill the window
+	received := make(chan []byte, 1)
+	s, addr := startTestServer(t, nil, WriteHandlerFunc(func(w WriteRequest) {
+		got, err := ioutil.ReadAll(w)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- got
+	}), ServerReadTimeout(20*time.Millisecond))
+	defer s.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	rpc := &reorderPacketConn{PacketConn: pc, every: 7, sent: make(map[uint16]bool)}
+
+	client, err := NewClient(
+		ClientPacketConn(rpc),
+		ClientWindowsize(8),
+		ClientReadTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(fmt.Sprintf("tftp://%s/file", addr), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, data) {
+			t.Errorf("expected %d bytes, received %d bytes that don't match", len(data), len(got))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for upload")
+	}
+	if len(rpc.sent) == 0 {
+		t.Error("expected blocks to be reordered")
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package tftp // import "pack.ag/tftp"
+
+// soReusePort is SO_REUSEPORT, which syscall doesn't define on every
+// Linux architecture. It is 15 everywhere except MIPS.
+const soReusePort = 0xf
@@ -0,0 +1,17 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package tftp // import "pack.ag/tftp"
+
+// setReuse fails, the socket options aren't supported on this platform.
+func setReuse(fd uintptr, addr, port bool) error {
+	return ErrReuseNotSupported
+}
+
+// isConnRefused reports false, ICMP errors aren't detected on this platform.
+func isConnRefused(err error) bool {
+	return false
+}
@@ -0,0 +1,11 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && (mips || mipsle || mips64 || mips64le))
+
+package tftp // import "pack.ag/tftp"
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,33 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReuse sets SO_REUSEADDR and SO_REUSEPORT on the socket fd.
+func setReuse(fd uintptr, addr, port bool) error {
+	if addr {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return wrapError(err, "setting SO_REUSEADDR")
+		}
+	}
+	if port {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return wrapError(err, "setting SO_REUSEPORT")
+		}
+	}
+	return nil
+}
+
+// isConnRefused reports whether err is ECONNREFUSED, the result of an ICMP
+// port unreachable.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer_ReusePort(t *testing.T) {
+	text := getTestData(t, "text")
+	serve := func(t *testing.T, addr string, opts ...ServerOpt) *Server {
+		s, err := NewServer(addr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+			w.Write(text)
+		}))
+		errc := make(chan error, 1)
+		go func() { errc <- s.ListenAndServe() }()
+		for !s.Connected() {
+			select {
+			case err := <-errc:
+				t.Fatal(err)
+			default:
+				runtime.Gosched()
+			}
+		}
+		return s
+	}
+
+	first := serve(t, "127.0.0.1:0", ServerReuseAddr(true), ServerReusePort(true), ServerSinglePort(true))
+	defer first.Close()
+	addr, err := first.Addr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := serve(t, addr.String(), ServerReuseAddr(true), ServerReusePort(true), ServerSinglePort(true))
+	defer second.Close()
+	if got, _ := second.Addr(); got.Port != addr.Port {
+		t.Fatalf("expected second server on port %d, got %d", addr.Port, got.Port)
+	}
+
+	// Servers share the port regardless of which receives the request
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, text) {
+		t.Errorf("expected %d bytes, received %d bytes that don't match", len(text), len(received))
+	}
+
+	// Without SO_REUSEPORT the address is in use
+	s, err := NewServer(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(ReadRequest) {}))
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected error listening without SO_REUSEPORT")
+		}
+	case <-time.After(time.Second):
+		s.Close()
+		t.Error("expected listening without SO_REUSEPORT to fail")
+	}
+}
+
+func TestServer_ServeFile(t *testing.T) {
+	text := getTestData(t, "text")
+
+	// The socket a parent process, such as systemd, would pass
+	parent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := parent.LocalAddr()
+	inherited, err := parent.File() // A duplicate of the descriptor
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	parent.Close()
+
+	s, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ReadHandler(ReadHandlerFunc(func(w ReadRequest) {
+		w.Write(text)
+	}))
+	errc := make(chan error, 1)
+	go func() { errc <- s.ServeFile(inherited) }()
+	for !s.Connected() {
+		runtime.Gosched()
+	}
+	defer s.Close()
+	if sAddr, _ := s.Addr(); sAddr.String() != addr.String() {
+		t.Errorf("expected server on inherited socket's address %s, got %s", addr, sAddr)
+	}
+
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(fmt.Sprintf("tftp://%s/file", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, text) {
+		t.Errorf("expected %d bytes, received %d bytes that don't match", len(text), len(received))
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("server stopped: %v", err)
+	default:
+	}
+}
+
+func TestServer_ServeFile_notUDP(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "unixgram")
+	defer f.Close()
+	defer syscall.Close(fds[1])
+
+	s, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ServeFile(f); ErrorCause(err) != ErrInvalidNetwork {
+		t.Errorf("expected %v, got %v", ErrInvalidNetwork, err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// TransferStats contains statistics collected over the course of a transfer.
+//
+// Round trip times are measured from the last datagram sent to the next
+// datagram received. Samples following a retransmission are discarded as
+// the response cannot be attributed to a specific send.
+type TransferStats struct {
+	Retransmits int           // Number of datagrams retransmitted
+	RTTSamples  int           // Number of round trip times measured
+	MinRTT      time.Duration // Shortest round trip time
+	MaxRTT      time.Duration // Longest round trip time
+	AvgRTT      time.Duration // Mean round trip time
+
+	// LossCapUnavailable is set when ClientLossWindowCap was configured
+	// but the peer didn't negotiate the flush option it depends on.
+	LossCapUnavailable bool
+
+	rttTotal time.Duration
+}
+
+func (s *TransferStats) observeRTT(d time.Duration) {
+	if s.RTTSamples == 0 || d < s.MinRTT {
+		s.MinRTT = d
+	}
+	if d > s.MaxRTT {
+		s.MaxRTT = d
+	}
+	s.RTTSamples++
+	s.rttTotal += d
+	s.AvgRTT = s.rttTotal / time.Duration(s.RTTSamples)
+}
+
+// ErrorStats counts the ERROR datagrams with a single error code sent and
+// received by a Server, see Server.ErrorStats.
+type ErrorStats struct {
+	Sent        int       // ERRORs sent to clients
+	Received    int       // ERRORs received from clients
+	LastTime    time.Time // When the most recent ERROR was sent or received
+	LastMessage string    // Message of the most recent ERROR
+}
+
+// errorCounter accumulates ErrorStats by code, it's shared by a server's transfers.
+type errorCounter struct {
+	clock clock
+
+	mu    sync.Mutex
+	codes map[ErrorCode]ErrorStats
+}
+
+func newErrorCounter(clk clock) *errorCounter {
+	return &errorCounter{clock: clk, codes: make(map[ErrorCode]ErrorStats)}
+}
+
+// observe records an ERROR sent, or received when sent is false.
+func (e *errorCounter) observe(code ErrorCode, msg string, sent bool) {
+	e.mu.Lock()
+	s := e.codes[code]
+	if sent {
+		s.Sent++
+	} else {
+		s.Received++
+	}
+	s.LastTime = e.clock.Now()
+	s.LastMessage = msg
+	e.codes[code] = s
+	e.mu.Unlock()
+}
+
+// snapshot returns a copy of the counts.
+func (e *errorCounter) snapshot() map[ErrorCode]ErrorStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	codes := make(map[ErrorCode]ErrorStats, len(e.codes))
+	for code, s := range e.codes {
+		codes[code] = s
+	}
+	return codes
+}
+
+// TransferInfo describes a completed server transfer.
+type TransferInfo struct {
+	ID       uint64        // Unique ID of the transfer, included in its log lines
+	Name     string        // File name requested by the client, after any rewrite
+	Addr     *net.UDPAddr  // Address and source port (TID) of the client
+	Write    bool          // True for write requests, false for read requests
+	Bytes    int64         // Number of data bytes transferred, up to the error if Err is set
+	Duration time.Duration // Time from receiving the request to completion
+	Err      error         // Error terminating the transfer, if any
+	Stats    TransferStats
+	Timeline []TimelineEvent // Last events of a failed transfer, see ServerCaptureTimeline
+}
+
+// TimelineEvent is an entry in the timeline of a transfer's datagrams,
+// captured with ServerCaptureTimeline.
+type TimelineEvent struct {
+	At       time.Duration // Time since the request was received
+	Event    string        // "send", "resend", "recv", or "timeout"
+	Datagram string        // Datagram sent or received, such as "DATA 3" or "ACK 2", empty for timeouts
+}
+
+// timelineSize is the number of events kept in a timeline, the oldest
+// are discarded once it's full.
+const timelineSize = 128
+
+// timeline is a ring buffer of a transfer's last events. Datagrams can be
+// sent by the heartbeat and pause goroutines, so it's safe for concurrent use.
+type timeline struct {
+	start time.Time
+
+	mu     sync.Mutex
+	events []TimelineEvent
+	next   int // Index of the oldest event once events is full
+}
+
+func newTimeline(start time.Time) *timeline {
+	return &timeline{start: start, events: make([]TimelineEvent, 0, timelineSize)}
+}
+
+// add records event at now.
+func (t *timeline) add(now time.Time, event, dg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := TimelineEvent{At: now.Sub(t.start), Event: event, Datagram: dg}
+	if len(t.events) < timelineSize {
+		t.events = append(t.events, e)
+		return
+	}
+	t.events[t.next] = e
+	t.next = (t.next + 1) % timelineSize
+}
+
+// resent marks the last datagram sent as a retransmission.
+func (t *timeline) resent() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.events); i > 0; i-- {
+		e := &t.events[(t.next+i-1)%len(t.events)]
+		if e.Event == "send" {
+			e.Event = "resend"
+			return
+		}
+		if e.Event == "resend" {
+			return
+		}
+	}
+}
+
+// snapshot returns the events, oldest first.
+func (t *timeline) snapshot() []TimelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(append([]TimelineEvent(nil), t.events[t.next:]...), t.events[:t.next]...)
+}
+
+// FragmentationWarning describes a server transfer which negotiated
+// a blocksize resulting in DATA datagrams larger than the configured MTU.
+// The datagrams will be fragmented, which is prone to failure on lossy
+// links or through firewalls that drop fragments.
+type FragmentationWarning struct {
+	ID           uint64       // Unique ID of the transfer, included in its log lines
+	Addr         *net.UDPAddr // Address of the client
+	Blocksize    int          // Negotiated blocksize
+	DatagramSize int          // Size of DATA datagrams including IP, UDP, and TFTP headers
+	MTU          int          // Configured MTU
+}
+
+// TransferState is a snapshot of an active server transfer, returned by
+// Server.ActiveTransfers for diagnosing stalled transfers. It's updated as
+// the transfer progresses, while the handler is reading or writing.
+type TransferState struct {
+	ID      uint64       // Unique ID of the transfer, included in its log lines
+	Name    string       // File name requested by the client, after any rewrite
+	Addr    *net.UDPAddr // Address of the client
+	Write   bool         // True for write requests, false for read requests
+	Started time.Time    // Time the request was received
+
+	Block       uint16 // Last block sent or received
+	Window      int    // Blocks sent or received in the current window
+	Unacked     int    // Blocks sent which haven't been acknowledged, when sending
+	LastAck     uint16 // Block of the last ACK received, when sending
+	Retransmits int    // Number of datagrams retransmitted
+	Bytes       int64  // Number of data bytes transferred
+}
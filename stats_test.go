@@ -0,0 +1,56 @@
+// Copyright (C) 2017 Kale Blankenship. All rights reserved.
+// This software may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details
+
+package tftp // import "pack.ag/tftp"
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTransferStats_observeRTT(t *testing.T) {
+	var s TransferStats
+	for _, d := range []time.Duration{3, 1, 5, 3} {
+		s.observeRTT(d * time.Millisecond)
+	}
+
+	if s.RTTSamples != 4 {
+		t.Errorf("expected 4 samples, but it was %d", s.RTTSamples)
+	}
+	if s.MinRTT != time.Millisecond {
+		t.Errorf("expected min RTT to be 1ms, but it was %s", s.MinRTT)
+	}
+	if s.MaxRTT != 5*time.Millisecond {
+		t.Errorf("expected max RTT to be 5ms, but it was %s", s.MaxRTT)
+	}
+	if s.AvgRTT != 3*time.Millisecond {
+		t.Errorf("expected avg RTT to be 3ms, but it was %s", s.AvgRTT)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	start := time.Now()
+	tl := newTimeline(start)
+	for i := 0; i < timelineSize+2; i++ {
+		tl.add(start.Add(time.Duration(i)), "send", fmt.Sprintf("DATA %d", i))
+	}
+	tl.resent()
+
+	events := tl.snapshot()
+	if len(events) != timelineSize {
+		t.Fatalf("expected %d events, got %d", timelineSize, len(events))
+	}
+	// The two oldest were discarded
+	if first := events[0]; first.At != 2 || first.Datagram != "DATA 2" {
+		t.Errorf("expected oldest event DATA 2 at 2ns, got %+v", first)
+	}
+	last := events[len(events)-1]
+	if last.Event != "resend" || last.Datagram != fmt.Sprintf("DATA %d", timelineSize+1) {
+		t.Errorf("expected the last event to be marked resent, got %+v", last)
+	}
+	if prev := events[len(events)-2]; prev.Event != "send" {
+		t.Errorf("expected only the last event to be marked resent, got %+v", prev)
+	}
+}